@@ -0,0 +1,42 @@
+package annotate
+
+import (
+	"fmt"
+	"strings"
+
+	"local/quickfix"
+	"local/rules"
+)
+
+// Formats names the supported --annotate values.
+var Formats = []string{"github"}
+
+// GitHub returns the workflow command ("::error file=...,line=...::msg")
+// that makes a GitHub Actions run annotate the match line's location. The
+// runner reads these from the step's stdout and stderr alike.
+func GitHub(rs []rules.Rule, plain, dir string) (string, bool) {
+	e, ok := quickfix.Parse(rs, plain, dir)
+	if !ok {
+		return "", false
+	}
+	cmd := "error"
+	switch sev, _ := rules.LineSeverity(rs, plain); sev {
+	case rules.Warning:
+		cmd = "warning"
+	case rules.Info:
+		cmd = "notice"
+	}
+	props := fmt.Sprintf("file=%s,line=%d", escapeProperty(e.File), e.Line)
+	if e.Col > 0 {
+		props += fmt.Sprintf(",col=%d", e.Col)
+	}
+	return fmt.Sprintf("::%s %s::%s", cmd, props, escapeData(e.Msg)), true
+}
+
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
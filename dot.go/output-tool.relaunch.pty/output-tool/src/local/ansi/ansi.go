@@ -0,0 +1,214 @@
+package ansi
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Tool output piped through --pipe/--exec often carries ANSI colors. The
+// capture keeps the raw line; rules, search and the editor work on Strip(line)
+// and the viewer draws Styled(line).
+
+const esc = '\x1b'
+
+// Has reports whether s contains an escape sequence worth parsing.
+func Has(s string) bool { return strings.IndexByte(s, esc) >= 0 }
+
+// Strip returns s without escape sequences (CSI, OSC and other ESC ones).
+func Strip(s string) string {
+	if !Has(s) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	scan(s, func(_ int, text string) { b.WriteString(text) }, nil)
+	return b.String()
+}
+
+// Offsets maps Strip(s) back to s: the offset in s of each byte of the
+// stripped text, then of its end.
+func Offsets(s string) []int {
+	offs := make([]int, 0, len(s)+1)
+	scan(s, func(at int, text string) {
+		for i := 0; i < len(text); i++ {
+			offs = append(offs, at+i)
+		}
+	}, nil)
+	return append(offs, len(s))
+}
+
+// Styled returns the text of s without escapes and the style of each of its
+// runes: SGR sequences applied on top of base (SGR 0 / 39 / 49 return to it).
+func Styled(s string, base tcell.Style) (string, []tcell.Style) {
+	var b strings.Builder
+	b.Grow(len(s))
+	styles := make([]tcell.Style, 0, len(s))
+	st := base
+	scan(s, func(_ int, text string) {
+		b.WriteString(text)
+		for range text {
+			styles = append(styles, st)
+		}
+	}, func(params string) {
+		st = applySGR(st, base, params)
+	})
+	return b.String(), styles
+}
+
+// scan calls text for runs of plain text, with their offset in s, and sgr
+// with the parameters of each SGR ("ESC [ ... m") sequence; other sequences
+// are dropped.
+func scan(s string, text func(at int, text string), sgr func(string)) {
+	n := len(s)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, esc)
+		if i < 0 {
+			text(n-len(s), s)
+			return
+		}
+		if i > 0 {
+			text(n-len(s), s[:i])
+		}
+		s = s[i:]
+		if len(s) < 2 {
+			return
+		}
+		switch s[1] {
+		case '[': // CSI: parameters and intermediates, then a final byte 0x40-0x7e
+			j := 2
+			for j < len(s) && (s[j] < 0x40 || s[j] > 0x7e) {
+				j++
+			}
+			if j == len(s) {
+				return
+			}
+			if s[j] == 'm' && sgr != nil {
+				sgr(s[2:j])
+			}
+			s = s[j+1:]
+		case ']': // OSC: up to BEL or ESC \
+			j := 2
+			for j < len(s) && s[j] != '\a' && !(s[j] == esc && j+1 < len(s) && s[j+1] == '\\') {
+				j++
+			}
+			switch {
+			case j == len(s):
+				s = ""
+			case s[j] == '\a':
+				s = s[j+1:]
+			default:
+				s = s[j+2:]
+			}
+		default: // ESC, intermediates 0x20-0x2f (as in "ESC ( B"), final byte
+			j := 1
+			for j < len(s) && s[j] >= 0x20 && s[j] <= 0x2f {
+				j++
+			}
+			if j == len(s) {
+				return
+			}
+			s = s[j+1:]
+		}
+	}
+}
+
+func applySGR(st, base tcell.Style, params string) tcell.Style {
+	if params == "" {
+		return base
+	}
+	baseFg, baseBg, _ := base.Decompose()
+	ps := strings.FieldsFunc(params, func(r rune) bool { return r == ';' || r == ':' })
+	for i := 0; i < len(ps); i++ {
+		n, err := strconv.Atoi(ps[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case n == 0:
+			st = base
+		case n == 1:
+			st = st.Bold(true)
+		case n == 2:
+			st = st.Dim(true)
+		case n == 3:
+			st = st.Italic(true)
+		case n == 4:
+			st = st.Underline(true)
+		case n == 5 || n == 6:
+			st = st.Blink(true)
+		case n == 7:
+			st = st.Reverse(true)
+		case n == 9:
+			st = st.StrikeThrough(true)
+		case n == 22:
+			st = st.Bold(false).Dim(false)
+		case n == 23:
+			st = st.Italic(false)
+		case n == 24:
+			st = st.Underline(false)
+		case n == 25:
+			st = st.Blink(false)
+		case n == 27:
+			st = st.Reverse(false)
+		case n == 29:
+			st = st.StrikeThrough(false)
+		case n >= 30 && n <= 37:
+			st = st.Foreground(tcell.PaletteColor(n - 30))
+		case n >= 90 && n <= 97:
+			st = st.Foreground(tcell.PaletteColor(n - 90 + 8))
+		case n == 39:
+			st = st.Foreground(baseFg)
+		case n >= 40 && n <= 47:
+			st = st.Background(tcell.PaletteColor(n - 40))
+		case n >= 100 && n <= 107:
+			st = st.Background(tcell.PaletteColor(n - 100 + 8))
+		case n == 49:
+			st = st.Background(baseBg)
+		case n == 38 || n == 48:
+			c, used := extendedColor(ps[i+1:])
+			i += used
+			if c == tcell.ColorDefault {
+				break
+			}
+			if n == 38 {
+				st = st.Foreground(c)
+			} else {
+				st = st.Background(c)
+			}
+		}
+	}
+	return st
+}
+
+// extendedColor parses the rest of a 38/48 sequence: "5;N" or "2;R;G;B".
+// It returns how many parameters it consumed.
+func extendedColor(ps []string) (tcell.Color, int) {
+	num := func(i int) (int32, bool) {
+		if i >= len(ps) {
+			return 0, false
+		}
+		n, err := strconv.Atoi(ps[i])
+		return int32(n), err == nil && n >= 0 && n <= 255
+	}
+	if len(ps) == 0 {
+		return tcell.ColorDefault, 0
+	}
+	switch ps[0] {
+	case "5":
+		if n, ok := num(1); ok {
+			return tcell.PaletteColor(int(n)), 2
+		}
+		return tcell.ColorDefault, len(ps)
+	case "2":
+		r, ok1 := num(1)
+		g, ok2 := num(2)
+		b, ok3 := num(3)
+		if ok1 && ok2 && ok3 {
+			return tcell.NewRGBColor(r, g, b), 4
+		}
+		return tcell.ColorDefault, len(ps)
+	}
+	return tcell.ColorDefault, 0
+}
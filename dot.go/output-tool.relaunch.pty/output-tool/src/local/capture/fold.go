@@ -0,0 +1,42 @@
+package capture
+
+import "encoding/json"
+
+// Folder encodes records; with fold set (--fold-dupes) it collapses each run
+// of identical consecutive lines (same text and stream) into the run's first
+// record, with Count the length of the run. That record is held until the
+// run ends or Flush.
+type Folder struct {
+	enc  *json.Encoder
+	fold bool
+	held Rec
+	has  bool
+}
+
+func NewFolder(enc *json.Encoder, fold bool) *Folder {
+	return &Folder{enc: enc, fold: fold}
+}
+
+func (f *Folder) Encode(r *Rec) error {
+	if !f.fold {
+		return f.enc.Encode(r)
+	}
+	n := max(f.held.Count, 1)
+	if f.has && r.N == f.held.N+n && r.Text == f.held.Text && r.Stream == f.held.Stream {
+		f.held.Count = n + 1
+		return nil
+	}
+	err := f.Flush()
+	f.held, f.has = *r, true
+	return err
+}
+
+// Flush writes the held record, if any; a following viewer sees it then (a
+// run continuing after a flush starts a new record).
+func (f *Folder) Flush() error {
+	if !f.has {
+		return nil
+	}
+	f.has = false
+	return f.enc.Encode(&f.held)
+}
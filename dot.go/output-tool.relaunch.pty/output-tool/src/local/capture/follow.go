@@ -0,0 +1,90 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// Follower reads a capture that may still be growing: each Next returns the
+// complete records appended since the previous call and keeps a trailing
+// partial line until its newline arrives. A .jsonl.gz capture is read a
+// whole gzip member at a time (see Writer.Flush).
+type Follower struct {
+	br   *bufio.Reader
+	part []byte
+	gz   *os.File // compressed capture
+	raw  []byte   // compressed: bytes of the member not complete yet
+}
+
+func NewFollower(f *os.File) *Follower {
+	if Compressed(f.Name()) {
+		return &Follower{gz: f}
+	}
+	return &Follower{br: bufio.NewReaderSize(f, 64*1024)}
+}
+
+func (t *Follower) Next() ([]Rec, error) {
+	if t.gz != nil {
+		plain, err := t.inflate()
+		if err != nil {
+			return nil, err
+		}
+		t.br = bufio.NewReader(bytes.NewReader(plain))
+	}
+	var out []Rec
+	for {
+		chunk, err := t.br.ReadBytes('\n')
+		if len(chunk) > 0 {
+			t.part = append(t.part, chunk...)
+		}
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		var rec Rec
+		if err := json.Unmarshal(t.part, &rec); err != nil {
+			t.part = t.part[:0]
+			return out, err
+		}
+		t.part = t.part[:0]
+		out = append(out, rec)
+	}
+}
+
+// inflate returns the text of the gzip members completed since the previous
+// call.
+func (t *Follower) inflate() ([]byte, error) {
+	more, err := io.ReadAll(t.gz)
+	if err != nil {
+		return nil, err
+	}
+	t.raw = append(t.raw, more...)
+	var plain bytes.Buffer
+	for len(t.raw) > 0 {
+		src := bytes.NewReader(t.raw) // an io.ByteReader: gzip reads no further than the member
+		zr, err := gzip.NewReader(src)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		var member bytes.Buffer
+		if _, err := io.Copy(&member, zr); errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		plain.Write(member.Bytes())
+		t.raw = append(t.raw[:0], t.raw[len(t.raw)-src.Len():]...)
+	}
+	return plain.Bytes(), nil
+}
@@ -0,0 +1,122 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Index reads the capture at path (not compressed) without keeping the text
+// of non-match lines: fn gets each record and its offset in the file, match
+// lines whole and others with N and Stream only, to be read back with
+// ReadAt when shown.
+func Index(path string, fn func(r Rec, off int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 1<<20)
+	var off int64
+	var long []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			long = append(long[:0], line...)
+			for errors.Is(err, bufio.ErrBufferFull) {
+				line, err = br.ReadSlice('\n')
+				long = append(long, line...)
+			}
+			line = long
+		}
+		if len(line) > 0 {
+			r, ierr := indexRec(line)
+			if ierr != nil {
+				return ierr
+			}
+			fn(r, off)
+			off += int64(len(line))
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The encoder escapes quotes inside text, so these only occur as keys.
+var (
+	keyMatch  = []byte(`"m":true`)
+	keyStdout = []byte(`"s":"out"`)
+	keyStderr = []byte(`"s":"err"`)
+	keyCount  = []byte(`"c":`)
+)
+
+// indexRec decodes a match line whole and only N, Stream and Count of others.
+func indexRec(line []byte) (Rec, error) {
+	var r Rec
+	if bytes.Contains(line, keyMatch) {
+		err := json.Unmarshal(line, &r)
+		return r, err
+	}
+	rest, ok := bytes.CutPrefix(line, []byte(`{"n":`))
+	if !ok {
+		return r, json.Unmarshal(line, &r) // not as the writer encodes it
+	}
+	end := bytes.IndexByte(rest, ',')
+	if end < 0 {
+		return r, json.Unmarshal(line, &r)
+	}
+	n, err := strconv.Atoi(string(rest[:end]))
+	if err != nil {
+		return r, err
+	}
+	r.N = n
+	if i := bytes.Index(line, keyCount); i >= 0 {
+		digits := line[i+len(keyCount):]
+		end := bytes.IndexAny(digits, ",}")
+		if end < 0 {
+			return r, json.Unmarshal(line, &r)
+		}
+		if r.Count, err = strconv.Atoi(string(digits[:end])); err != nil {
+			return r, err
+		}
+	}
+	switch {
+	case bytes.Contains(line, keyStderr):
+		r.Stream = "err"
+	case bytes.Contains(line, keyStdout):
+		r.Stream = "out"
+	}
+	return r, nil
+}
+
+// ReadAt decodes the record at off of a capture file.
+func ReadAt(f io.ReaderAt, off int64) (Rec, error) {
+	buf := make([]byte, 4096)
+	var line []byte
+	for {
+		n, err := f.ReadAt(buf, off)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			line = append(line, buf[:i]...)
+			break
+		}
+		line = append(line, buf[:n]...)
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				break
+			}
+			return Rec{}, err
+		}
+		off += int64(n)
+	}
+	var r Rec
+	err := json.Unmarshal(line, &r)
+	return r, err
+}
@@ -6,17 +6,23 @@ type Source struct {
 }
 
 type Meta struct {
-	Version        int      `json:"version"`
-	Source         Source   `json:"source"`
-	CapturePath    string   `json:"capture_path"`
-	Filtered       bool     `json:"filtered"`
-	LineFormat     string   `json:"line_format"`
-	LinesTotal     int      `json:"lines_total"`
-	MatchLines     int      `json:"match_lines"`
-	MatchesTotal   int      `json:"matches_total"`
-	Rules          []string `json:"rules"`
-	CreatedUnixSec int64    `json:"created_unix"`
-	Temp           bool     `json:"temp"`
-	OwnerPID       int      `json:"owner_pid"`
-	ExitCode       int      `json:"exit_code,omitempty"` // only set for exec
+	Version        int            `json:"version"`
+	Source         Source         `json:"source"`
+	CapturePath    string         `json:"capture_path"`
+	Filtered       bool           `json:"filtered"`
+	LineFormat     string         `json:"line_format"`
+	LinesTotal     int            `json:"lines_total"`
+	MatchLines     int            `json:"match_lines"`
+	MatchesTotal   int            `json:"matches_total"`
+	Severities     map[string]int `json:"severities,omitempty"` // match lines per rule severity
+	Rules          []string       `json:"rules"`
+	CreatedUnixSec int64          `json:"created_unix"`
+	Temp           bool           `json:"temp"`
+	OwnerPID       int            `json:"owner_pid"`
+	ExitCode       int            `json:"exit_code,omitempty"`   // only set for exec
+	Argv           []string       `json:"argv,omitempty"`        // exec: the command as run
+	Cwd            string         `json:"cwd,omitempty"`         // exec: where it ran
+	DurationMs     int64          `json:"duration_ms,omitempty"` // exec: wall time, set when it exits
+	Live           bool           `json:"live,omitempty"`        // producer still writing; rewritten with live=false when done
+	BaseDir        string         `json:"base_dir,omitempty"`    // relative paths in matches are from here (producer's cwd or --base-dir)
 }
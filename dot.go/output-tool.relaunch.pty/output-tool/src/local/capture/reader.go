@@ -2,18 +2,61 @@ package capture
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 )
 
-func ReadAll(path string) ([]Rec, error) {
+// gzExt marks a gzip-compressed capture (.jsonl.gz).
+const gzExt = ".gz"
+
+// Compressed reports whether the capture at path is gzip-compressed, by its
+// extension.
+func Compressed(path string) bool { return strings.HasSuffix(path, gzExt) }
+
+// Format is the meta's line_format for the capture at path.
+func Format(path string) string {
+	if Compressed(path) {
+		return "jsonl.gz"
+	}
+	return "jsonl"
+}
+
+// gzFile closes the decompressor and the file under it.
+type gzFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzFile) Close() error {
+	_ = g.Reader.Close()
+	return g.f.Close()
+}
+
+// Open opens the capture at path for reading, decompressing as it is read
+// when it is a .jsonl.gz.
+func Open(path string) (io.ReadCloser, error) {
 	f, err := os.Open(path)
+	if err != nil || !Compressed(path) {
+		return f, err
+	}
+	zr, err := gzip.NewReader(bufio.NewReaderSize(f, 64*1024))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzFile{zr, f}, nil
+}
+
+func ReadAll(path string) ([]Rec, error) {
+	r, err := Open(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	return ReadAllFromReader(f)
+	defer r.Close()
+	return ReadAllFromReader(r)
 }
 
 func ReadAllFromReader(r io.Reader) ([]Rec, error) {
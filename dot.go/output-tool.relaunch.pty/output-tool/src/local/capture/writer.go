@@ -2,7 +2,9 @@ package capture
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"io"
 	"os"
 )
 
@@ -10,23 +12,38 @@ type Rec struct {
 	N      int    `json:"n"`
 	Text   string `json:"text"`
 	M      bool   `json:"m"`
-	Stream string `json:"s,omitempty"` // "out" or "err" for --exec; empty otherwise
+	Stream string `json:"s,omitempty"`   // "out" or "err" for --exec; empty otherwise
+	Dir    string `json:"dir,omitempty"` // match lines: make's current directory, if any
+	T      int64  `json:"t,omitempty"`   // --exec: when the line was read, unix milliseconds
+	Count  int    `json:"c,omitempty"`   // --fold-dupes: identical consecutive lines, from N, this stands for (0: one)
 }
 
 type Writer struct {
 	f   *os.File
+	gz  *gzip.Writer // compressing (.jsonl.gz); nil otherwise
 	bw  *bufio.Writer
 	enc *json.Encoder
 }
 
-func NewTempWriter(prefix string) (*Writer, error) {
-	f, err := os.CreateTemp(os.TempDir(), prefix+"*.jsonl")
+// NewTempWriter creates a capture in the temp directory, a .jsonl.gz when
+// compress is set.
+func NewTempWriter(prefix string, compress bool) (*Writer, error) {
+	ext := ".jsonl"
+	if compress {
+		ext += gzExt
+	}
+	f, err := os.CreateTemp(os.TempDir(), prefix+"*"+ext)
 	if err != nil {
 		return nil, err
 	}
-	bw := bufio.NewWriterSize(f, 64*1024)
-	enc := json.NewEncoder(bw)
-	w := &Writer{f: f, bw: bw, enc: enc}
+	w := &Writer{f: f}
+	var dst io.Writer = f
+	if compress {
+		w.gz = gzip.NewWriter(f)
+		dst = w.gz
+	}
+	w.bw = bufio.NewWriterSize(dst, 64*1024)
+	w.enc = json.NewEncoder(w.bw)
 	return w, nil
 }
 
@@ -37,6 +54,23 @@ func (w *Writer) Encode(rec *Rec) error {
 	return w.enc.Encode(rec)
 }
 
+// Flush makes the records written so far readable by a Follower. A
+// compressed capture ends its gzip member there and starts the next, so
+// flush after bursts rather than after every record.
+func (w *Writer) Flush() error {
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if w.gz == nil {
+		return nil
+	}
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	w.gz.Reset(w.f)
+	return nil
+}
+
 func (w *Writer) Close() error {
 	if w == nil {
 		return nil
@@ -44,6 +78,9 @@ func (w *Writer) Close() error {
 	if w.bw != nil {
 		_ = w.bw.Flush()
 	}
+	if w.gz != nil {
+		_ = w.gz.Close()
+	}
 	if w.f != nil {
 		return w.f.Close()
 	}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"local/capture"
+	"local/util"
 )
 
 type Config struct {
@@ -88,6 +89,9 @@ func SweepOrphans(ttlMinutes int) {
 		if !m.Temp {
 			continue
 		}
+		if m.Live && util.PIDAlive(m.OwnerPID) {
+			continue // a long-running producer, still writing
+		}
 		_ = os.Remove(metaPath)
 		if m.CapturePath != "" && strings.HasPrefix(m.CapturePath, dir+string(os.PathSeparator)) {
 			_ = os.Remove(m.CapturePath)
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"local/editor"
+	"local/hyperlink"
+	"local/rules"
+	"local/tmux"
+	"local/viewer"
+)
+
+// Problem is one finding of Check: the key it is about ("" for the file)
+// and its line, 0 when not known.
+type Problem struct {
+	Line int
+	Key  string
+	Msg  string
+}
+
+func (p Problem) String() string {
+	if p.Key == "" {
+		return p.Msg
+	}
+	return p.Key + ": " + p.Msg
+}
+
+// Check strictly validates the config file at path: TOML syntax and types,
+// keys no field takes, rules (regexes, groups, severities), theme colors,
+// the selected rule sets and theme, and the editor templates. The error is
+// for a file that can't be read.
+func Check(path string) ([]Problem, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	md, err := toml.Decode(string(src), &cfg)
+	if err != nil {
+		return []Problem{decodeProblem(err)}, nil
+	}
+	c := checker{lines: findKeyLines(string(src))}
+
+	// [editor] decodes itself (editor.Config.UnmarshalTOML), so toml can't
+	// tell which of its keys were used
+	editorKeys := tomlKeys(reflect.TypeOf(editor.Config{}))
+	for _, k := range md.Undecoded() {
+		if len(k) == 2 && k[0] == "editor" && editorKeys[k[1]] {
+			continue
+		}
+		c.add(k.String(), "unknown key")
+	}
+
+	c.rules("rules", cfg.Rules)
+	for _, name := range sortedKeys(cfg.RuleSets) {
+		c.rules("rulesets."+name+".rules", cfg.RuleSets[name].Rules)
+	}
+	if len(cfg.Behavior.Rules) > 0 {
+		if _, err := cfg.SelectRules(cfg.Behavior.Rules); err != nil {
+			c.add("behavior.rules", err.Error())
+		}
+	}
+	switch cfg.Behavior.MatchStderr {
+	case "", "none", "line":
+	default:
+		c.add("behavior.match_stderr", fmt.Sprintf("%q: want none or line", cfg.Behavior.MatchStderr))
+	}
+
+	if cfg.Behavior.Hyperlink != "" {
+		if err := hyperlink.Check(cfg.Behavior.Hyperlink); err != nil {
+			c.add("behavior.hyperlink", err.Error())
+		}
+	}
+
+	if m := cfg.Launcher.TmuxMode; m != "" && !slices.Contains(tmux.Modes, m) {
+		c.add("launcher.tmux_mode", fmt.Sprintf("%q: want %s", m, strings.Join(tmux.Modes, ", ")))
+	}
+	for _, s := range []struct{ key, v string }{
+		{"launcher.tmux_width", cfg.Launcher.TmuxWidth},
+		{"launcher.tmux_height", cfg.Launcher.TmuxHeight},
+	} {
+		if s.v != "" {
+			if err := tmux.CheckSize(s.v); err != nil {
+				c.add(s.key, err.Error())
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.Themes) {
+		for _, b := range cfg.Themes[name].BadColors() {
+			c.add("themes."+name+"."+b.Key, fmt.Sprintf("unknown color %q (want a name, colorN or #rrggbb)", b.Name))
+		}
+	}
+	if _, err := viewer.LookupTheme(cfg.Viewer.Theme, cfg.Themes); err != nil {
+		c.add("viewer.theme", err.Error())
+	}
+	for _, n := range []struct {
+		key string
+		v   int
+	}{
+		{"viewer.gutter_width", cfg.Viewer.GutterWidth},
+		{"viewer.err_lines", cfg.Viewer.ErrLinesMax},
+		{"viewer.tab_width", cfg.Viewer.TabWidth},
+		{"cleanup.ttl_minutes", cfg.Cleanup.TTLMinutes},
+	} {
+		if n.v < 0 {
+			c.add(n.key, fmt.Sprintf("%d: want 0 or more", n.v))
+		}
+	}
+
+	if md.IsDefined("editor") {
+		c.editor(cfg)
+	}
+	sort.SliceStable(c.probs, func(i, j int) bool { return c.probs[i].Line < c.probs[j].Line })
+	return c.probs, nil
+}
+
+// errLine splits what toml puts in front of an error message.
+var errLine = regexp.MustCompile(`^toml: line (\d+)(?: \(last key "(.*?)"\))?: (.*)$`)
+
+// decodeProblem turns a syntax or type error of toml.Decode into a Problem.
+func decodeProblem(err error) Problem {
+	m := errLine.FindStringSubmatch(err.Error())
+	if m == nil {
+		return Problem{Msg: err.Error()}
+	}
+	n, _ := strconv.Atoi(m[1])
+	return Problem{Line: n, Key: m[2], Msg: strings.TrimPrefix(m[3], m[2]+": ")}
+}
+
+type checker struct {
+	lines keyLines
+	probs []Problem
+}
+
+func (c *checker) add(key, msg string) {
+	c.probs = append(c.probs, Problem{Line: c.lines.line(key), Key: key, Msg: msg})
+}
+
+// rules checks the [[path]] list rs.
+func (c *checker) rules(path string, rs []rules.Rule) {
+	for i, r := range rs {
+		at := fmt.Sprintf("%s[%d]", path, i)
+		if r.ID == "" {
+			c.add(at+".id", "missing")
+		}
+		if r.Severity != "" {
+			if _, ok := rules.ParseSeverity(r.Severity); !ok {
+				c.add(at+".severity", fmt.Sprintf("%q: want error, warning or info", r.Severity))
+			}
+		}
+		if r.RegexStr == "" {
+			c.add(at+".regex", "missing")
+			continue
+		}
+		re, err := regexp.Compile(r.RegexStr)
+		if err != nil {
+			c.add(at+".regex", err.Error())
+			continue
+		}
+		r.Regex = re
+		if err := r.ResolveGroups(); err != nil {
+			c.add(at, err.Error())
+			continue
+		}
+		for _, g := range []struct {
+			key string
+			idx int
+		}{
+			{"file_group", r.FileGroup},
+			{"line_group", r.LineGroup},
+			{"column_group", r.ColumnGroup},
+		} {
+			if g.idx < 0 || g.idx > re.NumSubexp() {
+				c.add(at+"."+g.key, fmt.Sprintf("%d: the regex has %d groups", g.idx, re.NumSubexp()))
+			}
+		}
+	}
+}
+
+// editorVar is a ${__NAME__} variable of an editor template.
+var editorVar = regexp.MustCompile(`\$\{(__\w*)\}`)
+
+// editor checks the templates of [editor] (or its preset): each is an argv,
+// not a shell line, and says where the value it is chosen for goes.
+func (c *checker) editor(cfg Config) {
+	ed := cfg.Editor
+	if len(ed.File) == 0 {
+		c.add("editor.file", "missing: it opens lines without a file:line, and is the fallback")
+	}
+	for _, t := range []struct {
+		key  string
+		argv []string
+		need string
+	}{
+		{"file", ed.File, "__FILE__"},
+		{"file_line", ed.FileLine, "__LINE__"},
+		{"file_line_col", ed.FileLineCol, "__COLUMN__"},
+	} {
+		if t.argv == nil {
+			continue
+		}
+		key := "editor." + t.key
+		if len(t.argv) == 0 || strings.TrimSpace(t.argv[0]) == "" {
+			c.add(key, "no program")
+			continue
+		}
+		if strings.ContainsAny(t.argv[0], " \t") {
+			c.add(key, fmt.Sprintf("program %q has a space: the argv is not split by a shell, give each argument its own string", t.argv[0]))
+		}
+		used := false
+		for _, a := range t.argv {
+			for _, m := range editorVar.FindAllStringSubmatch(a, -1) {
+				switch m[1] {
+				case "__FILE__", "__LINE__", "__COLUMN__":
+					used = used || m[1] == t.need
+				default:
+					c.add(key, fmt.Sprintf("unknown variable ${%s} (have ${__FILE__}, ${__LINE__}, ${__COLUMN__})", m[1]))
+				}
+			}
+		}
+		if !used {
+			c.add(key, fmt.Sprintf("does not use ${%s}", t.need))
+		}
+	}
+}
+
+// keyLines maps the keys of a TOML document to the line they are set on:
+// "viewer.title", "rules[1].regex" (in the second [[rules]]), and the same
+// without indices ("rules.regex", first one) for the keys of toml.MetaData.
+type keyLines map[string]int
+
+// tableKey matches the key of a "key = value" line.
+var tableKey = regexp.MustCompile(`^([A-Za-z0-9_\-."' ]+?)\s*=`)
+
+// findKeyLines scans src line by line; it is no parser, just enough for
+// the documents toml.Decode accepted.
+func findKeyLines(src string) keyLines {
+	kl := keyLines{}
+	set := func(key string, n int) {
+		for _, k := range []string{key, stripIndex.ReplaceAllString(key, "")} {
+			if _, ok := kl[k]; !ok {
+				kl[k] = n
+			}
+		}
+	}
+	arrays := map[string]int{} // [[name]] seen so far
+	table := ""
+	multi := "" // the closing quotes of a multi-line string being skipped
+	for i, l := range strings.Split(src, "\n") {
+		n := i + 1
+		l = strings.TrimSpace(l)
+		if multi != "" {
+			if strings.Contains(l, multi) {
+				multi = ""
+			}
+			continue
+		}
+		switch {
+		case l == "" || l[0] == '#':
+		case strings.HasPrefix(l, "[["):
+			if end := strings.Index(l, "]]"); end > 0 {
+				name := normKey(l[2:end])
+				table = fmt.Sprintf("%s[%d]", name, arrays[name])
+				arrays[name]++
+				set(table, n)
+			}
+		case l[0] == '[':
+			if end := strings.IndexByte(l, ']'); end > 0 {
+				table = normKey(l[1:end])
+				set(table, n)
+			}
+		default:
+			m := tableKey.FindStringSubmatch(l)
+			if m == nil {
+				continue // in a multi-line array
+			}
+			key := normKey(m[1])
+			if table != "" {
+				key = table + "." + key
+			}
+			set(key, n)
+			rest := l[len(m[0]):]
+			for _, q := range []string{`"""`, `'''`} {
+				if strings.Count(rest, q) == 1 {
+					multi = q
+				}
+			}
+		}
+	}
+	return kl
+}
+
+var stripIndex = regexp.MustCompile(`\[\d+\]`)
+
+// normKey drops the spaces and quotes around the parts of a dotted key.
+func normKey(k string) string {
+	parts := strings.Split(k, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// line is the line of key or, failing that, of the nearest table or inline
+// table it is in; 0 if none is known.
+func (kl keyLines) line(key string) int {
+	for key != "" {
+		if n, ok := kl[key]; ok {
+			return n
+		}
+		i := strings.LastIndexByte(key, '.')
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0
+}
+
+// tomlKeys are the keys of the fields of struct type t.
+func tomlKeys(t reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		if k, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ","); k != "" && k != "-" {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -19,18 +20,33 @@ import (
 // ---------- Types ----------
 
 type Behavior struct {
-	OnlyViewMatches bool   `toml:"only_view_matches"`
-	OnlyOnMatches   bool   `toml:"only_on_matches"`
-	MatchStderr     string `toml:"match_stderr"` // none|line
+	OnlyViewMatches bool     `toml:"only_view_matches"`
+	OnlyOnMatches   bool     `toml:"only_on_matches"`
+	FollowOnMatch   bool     `toml:"follow_on_match"`     // pipe: launch the following viewer at the first match line
+	Compress        bool     `toml:"compress"`            // gzip captures (.jsonl.gz)
+	FoldDupes       bool     `toml:"fold_dupes"`          // collapse runs of identical lines (×N)
+	MatchStderr     string   `toml:"match_stderr"`        // none|line
+	Hyperlink       string   `toml:"hyperlink,omitempty"` // pipe: OSC 8 link URI template or preset for file:line:col
+	Rules           []string `toml:"rules,omitempty"`     // active rule sets (default: ["default"])
 }
 
+// RuleSet is a named group of rules, [rulesets.NAME] with [[rulesets.NAME.rules]].
+type RuleSet struct {
+	Rules []rules.Rule `toml:"rules"`
+}
+
+// DefaultRuleSet names the top-level [[rules]] list.
+const DefaultRuleSet = "default"
+
 type Config struct {
-	Rules    []rules.Rule    `toml:"rules"`
-	Viewer   viewer.Options  `toml:"viewer"`
-	Editor   editor.Config   `toml:"editor"`
-	Launcher launcher.Config `toml:"launcher"`
-	Behavior Behavior        `toml:"behavior"`
-	Cleanup  cleanup.Config  `toml:"cleanup"`
+	Rules    []rules.Rule            `toml:"rules"`
+	RuleSets map[string]RuleSet      `toml:"rulesets,omitempty"`
+	Themes   map[string]viewer.Theme `toml:"themes,omitempty"`
+	Viewer   viewer.Options          `toml:"viewer"`
+	Editor   editor.Config           `toml:"editor"`
+	Launcher launcher.Config         `toml:"launcher"`
+	Behavior Behavior                `toml:"behavior"`
+	Cleanup  cleanup.Config          `toml:"cleanup"`
 }
 
 // ---------- Defaults ----------
@@ -53,6 +69,8 @@ func Default(bexe string) *Config {
 			ShowBottomBar: true,
 			Mouse:         true,
 			NoAlt:         false,
+			ErrLinesMax:   5,
+			TabWidth:      viewer.DefaultTabWidth,
 		},
 		Editor: editor.Config{
 			File:        []string{"cudatext", "${__FILE__}"},
@@ -62,8 +80,8 @@ func Default(bexe string) *Config {
 		},
 		Launcher: launcher.Config{
 			TermPrefix: "xfce4-terminal --hide-menubar --hide-scrollbar --hide-toolbar --title='OutputTool' --command",
-			TmuxPrefix: "tmux new-window --",
 			PreferTmux: true,
+			TmuxMode:   "window",
 		},
 		Behavior: Behavior{
 			OnlyViewMatches: false,
@@ -245,6 +263,48 @@ func (c *Config) ToCompiledRules() []CompiledRule {
 	return out
 }
 
+// SelectRules returns the rules of the named sets, in order; "default" is
+// the top-level [[rules]] list. No names means [behavior].rules, else default.
+func (c *Config) SelectRules(names []string) ([]rules.Rule, error) {
+	if len(names) == 0 {
+		names = c.Behavior.Rules
+	}
+	if len(names) == 0 {
+		names = []string{DefaultRuleSet}
+	}
+	var out []rules.Rule
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if name == DefaultRuleSet {
+			out = append(out, c.Rules...)
+			continue
+		}
+		set, ok := c.RuleSets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule set %q (have: %s)", name, strings.Join(c.RuleSetNames(), ", "))
+		}
+		out = append(out, set.Rules...)
+	}
+	return out, nil
+}
+
+// RuleSetNames lists "default" and the [rulesets.NAME] names, sorted.
+func (c *Config) RuleSetNames() []string {
+	names := make([]string, 0, len(c.RuleSets)+1)
+	names = append(names, DefaultRuleSet)
+	for name := range c.RuleSets {
+		if name != DefaultRuleSet {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
 // CleanPath pretty-prints the path for logs (no changes; here just trim).
 func CleanPath(p string) string {
 	return strings.TrimSpace(p)
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"local/rules"
+	"local/viewer"
+)
+
+// schemaDocs says what each key does, by dotted path; NAME stands for the
+// name of a [rulesets.NAME] or [themes.NAME] table.
+var schemaDocs = map[string]string{
+	"rules":                   "Rules of the default rule set; a line matching any is a match line.",
+	"rules.id":                "Name of the rule, in counts, exports and quickfix files.",
+	"rules.regex":             "Go regexp (RE2) matched against each line, escapes stripped.",
+	"rules.file_group":        "Capture group with the file path (1-based, 0 = none).",
+	"rules.line_group":        "Capture group with the line number.",
+	"rules.column_group":      "Capture group with the column number.",
+	"rules.file_name_group":   "Named group (?P<NAME>...) for the file path; wins over file_group.",
+	"rules.line_name_group":   "Named group for the line number; wins over line_group.",
+	"rules.column_name_group": "Named group for the column number; wins over column_group.",
+	"rules.severity":          "error (default), warning or info; --fail-on and the viewer colors use it.",
+
+	"rulesets":            "More rule sets, picked with --rules=NAME[,NAME...] or [behavior].rules.",
+	"rulesets.NAME.rules": "Rules of the set, with the keys of [[rules]].",
+
+	"themes":                    "Viewer color themes, picked with --theme or [viewer].theme; a theme named like a built-in (dark, light, solarized) replaces it, pairs left out come from dark. Colors are tcell names, colorN or #rrggbb.",
+	"themes.NAME.normal":        "Plain lines.",
+	"themes.NAME.stderr":        "Plain lines from the command's stderr (--exec).",
+	"themes.NAME.match":         "Rule matches (error severity).",
+	"themes.NAME.warning":       "Rule matches of warning severity.",
+	"themes.NAME.info":          "Rule matches of info severity.",
+	"themes.NAME.search":        "Search hits.",
+	"themes.NAME.cursor":        "The cursor line.",
+	"themes.NAME.cursor_match":  "Matches on the cursor line.",
+	"themes.NAME.gutter":        "Line numbers, and the log pane reversed.",
+	"themes.NAME.gutter_cursor": "The cursor line's number.",
+	"themes.NAME.mark":          "Bookmark sign in the gutter.",
+	"themes.NAME.top_bar":       "Top status bar.",
+	"themes.NAME.bottom_bar":    "Bottom status bar.",
+
+	"viewer":              "The tcell viewer.",
+	"viewer.title":        "Window title (--viewer-title).",
+	"viewer.gutter_width": "Width of the line number gutter (--gutter-width).",
+	"viewer.top_bar":      "Show the top status bar (--top-bar).",
+	"viewer.bottom_bar":   "Show the bottom status bar (--bottom-bar).",
+	"viewer.mouse":        "Mouse tracking; disables the terminal's text selection (--mouse).",
+	"viewer.no_alt":       "Do not use the terminal's alternate screen (--no-alt).",
+	"viewer.err_lines":    "Most lines of the bottom log pane (--err-lines).",
+	"viewer.tab_width":    "Columns between tab stops; 8 lines up the caret lines gcc and clang print under source lines (--tab-width).",
+	"viewer.follow":       "Tail the capture while it is written (--follow).",
+	"viewer.wrap":         "Soft-wrap long lines; w toggles (--wrap).",
+	"viewer.theme":        "Color theme: dark, light, solarized or a [themes.NAME] (--theme).",
+
+	"editor":               "Editor opened on a line (Enter/e): each template is a full argv, no shell, with ${__FILE__}, ${__LINE__}, ${__COLUMN__}, ${PWD} and environment variables expanded. `editor = \"NAME\"` at the top picks a preset instead.",
+	"editor.file":          "Opens a file; also used with the line as a JSON file when it has no file:line.",
+	"editor.file_line":     "Opens a file at a line.",
+	"editor.file_line_col": "Opens a file at a line and column.",
+	"editor.pretty_json":   "Indent the JSON file written for lines without a file:line.",
+	"editor.terminal":      "The editor runs in the viewer's terminal (vim, nvim); the viewer steps aside until it exits.",
+	"editor.preset":        "Start from a preset (vim, nvim, emacsclient, vscode, subl, cudatext); templates given here override its own.",
+
+	"launcher":             "How pipe mode opens the viewer.",
+	"launcher.prefix":      "Graphical terminal command; the viewer command is appended (--launcher).",
+	"launcher.tmux_prefix": "tmux command used inside tmux when tmux_mode is not set; the viewer command is appended.",
+	"launcher.prefer_tmux": "Use tmux when running inside it.",
+	"launcher.tmux_mode":   "Where the viewer opens in tmux: popup (tmux >= 3.2, else window), split-below, split-right or window.",
+	"launcher.tmux_width":  "Width of a popup or split-right pane: N cells or N%.",
+	"launcher.tmux_height": "Height of a popup or split-below pane: N cells or N%.",
+	"launcher.tmux_reuse":  "Open the viewer in the pane titled like it (viewer.title), when there is one, instead of a new one; not for popups.",
+
+	"behavior":                   "Pipe and exec modes.",
+	"behavior.only_view_matches": "Capture and view match lines only (--only-view-matches).",
+	"behavior.only_on_matches":   "Pipe: launch no viewer when nothing matched (--only-on-matches).",
+	"behavior.follow_on_match":   "Pipe: launch the viewer at the first match line, tailing the capture (--follow-on-match).",
+	"behavior.compress":          "Write gzip captures, .jsonl.gz (--compress).",
+	"behavior.fold_dupes":        "Collapse runs of identical lines into one shown with ×N (--fold-dupes).",
+	"behavior.match_stderr":      "Echo match lines to stderr while streaming: none or line (--match-stderr).",
+	"behavior.hyperlink":         "Pipe: link file:line:col in the streamed output (OSC 8) with this URI template or preset (file, vscode); ${__FILE__}, ${__RELFILE__}, ${__LINE__}, ${__COLUMN__}, ${__HOST__} are expanded (--hyperlink).",
+	"behavior.rules":             "Rule sets applied: default is [[rules]], others [rulesets.NAME] (--rules).",
+
+	"cleanup":              "Temporary captures.",
+	"cleanup.keep_capture": "Keep the capture and meta files after viewing (--keep-capture).",
+	"cleanup.ttl_minutes":  "Remove orphaned captures older than this when a viewer starts (--cleanup-ttl-minutes).",
+}
+
+// schemaExamples are shown, commented out, for optional keys the defaults
+// leave out, and for the [NAME] tables of maps the defaults have none of.
+var schemaExamples = map[string]any{
+	"rules.file_name_group":   "file",
+	"rules.line_name_group":   "line",
+	"rules.column_name_group": "col",
+	"rules.severity":          "warning",
+	"rulesets":                RuleSet{Rules: []rules.Rule{{ID: "go:vet", RegexStr: `^(?P<file>[^\s:]+\.go):(?P<line>\d+):(?P<col>\d+): `, FileNameGroup: "file", LineNameGroup: "line", ColumnNameGroup: "col", Severity: "warning"}}},
+	"themes":                  viewer.Themes[viewer.DefaultTheme],
+	"viewer.theme":            viewer.DefaultTheme,
+	"editor.preset":           "vim",
+	"launcher.tmux_prefix":    "tmux new-window --",
+	"launcher.tmux_width":     "80%",
+	"launcher.tmux_height":    "50%",
+	"behavior.hyperlink":      "https://github.com/OWNER/REPO/blob/main/${__RELFILE__}#L${__LINE__}",
+	"behavior.rules":          []string{DefaultRuleSet},
+}
+
+// pairType is written as an inline table, fg and bg on one line.
+var pairType = reflect.TypeOf(viewer.Pair{})
+
+// Schema writes the default config for bexe as TOML with every supported
+// key, each under a comment saying what it does. Optional keys the
+// defaults leave out, and example [rulesets.NAME] and [themes.NAME]
+// tables, are commented out.
+func Schema(w io.Writer, bexe string) error {
+	s := schemaWriter{w: bufio.NewWriter(w)}
+	fmt.Fprintf(s.w, "# %s config: every supported key, with its default.\n", bexe)
+	fmt.Fprintf(s.w, "# --check-config validates a config file against it.\n")
+	s.table("", reflect.ValueOf(*Default(bexe)), false)
+	if s.err != nil {
+		return s.err
+	}
+	return s.w.Flush()
+}
+
+type schemaWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes text, commented out when off.
+func (s *schemaWriter) line(off bool, text string) {
+	if off {
+		text = "# " + text
+	}
+	s.w.WriteString(text + "\n")
+}
+
+func (s *schemaWriter) doc(path string) {
+	if d, ok := schemaDocs[stripIndex.ReplaceAllString(path, "")]; ok {
+		s.w.WriteString("# " + d + "\n")
+	}
+}
+
+// table writes the keys of the struct v at path, then its subtables.
+func (s *schemaWriter) table(path string, v reflect.Value, off bool) {
+	join := func(p, k string) string {
+		if p == "" {
+			return k
+		}
+		return p + "." + k
+	}
+	type field struct {
+		key string
+		v   reflect.Value
+	}
+	var tables []field
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		tag, opts, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		switch {
+		case fv.Kind() == reflect.Struct && fv.Type() != pairType,
+			fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct,
+			fv.Kind() == reflect.Map:
+			tables = append(tables, field{tag, fv})
+			continue
+		}
+		p := join(path, tag)
+		s.doc(p)
+		ex, hasEx := schemaExamples[p]
+		switch {
+		case opts == "omitempty" && fv.IsZero() && hasEx:
+			s.line(true, tag+" = "+s.value(reflect.ValueOf(ex)))
+		case opts == "omitempty" && fv.IsZero():
+			s.line(true, tag+" = "+s.value(fv))
+		default:
+			s.line(off, tag+" = "+s.value(fv))
+		}
+	}
+	for _, t := range tables {
+		p := join(path, t.key)
+		switch t.v.Kind() {
+		case reflect.Struct:
+			s.w.WriteString("\n")
+			s.doc(p)
+			s.line(off, "["+p+"]")
+			s.table(p, t.v, off)
+		case reflect.Slice:
+			for i := 0; i < t.v.Len(); i++ {
+				s.w.WriteString("\n")
+				if i == 0 {
+					s.doc(p)
+				}
+				s.line(off, "[["+p+"]]")
+				s.table(p, t.v.Index(i), off)
+			}
+		case reflect.Map:
+			ex, ok := schemaExamples[p]
+			if !ok {
+				continue
+			}
+			s.w.WriteString("\n")
+			s.doc(p)
+			s.line(true, "["+p+".NAME]")
+			s.table(p+".NAME", reflect.ValueOf(ex), true)
+		}
+	}
+}
+
+// value formats v as a TOML value.
+func (s *schemaWriter) value(v reflect.Value) string {
+	if v.Type() == pairType {
+		p := v.Interface().(viewer.Pair)
+		return fmt.Sprintf("{ fg = %s, bg = %s }", s.value(reflect.ValueOf(p.Fg)), s.value(reflect.ValueOf(p.Bg)))
+	}
+	if str, ok := v.Interface().(string); ok && strings.Contains(str, `\`) && !strings.ContainsAny(str, "'\n") {
+		return "'" + str + "'" // a literal string: regexes read as written
+	}
+	var b strings.Builder
+	if err := toml.NewEncoder(&b).Encode(map[string]any{"v": v.Interface()}); err != nil && s.err == nil {
+		s.err = err
+	}
+	out := strings.TrimSuffix(strings.TrimPrefix(b.String(), "v = "), "\n")
+	if out == "" && v.Kind() == reflect.Slice {
+		return "[]" // the encoder leaves out nil slices
+	}
+	return out
+}
@@ -25,17 +25,34 @@ type Config struct {
 	FileLine    []string `toml:"file_line"`     // e.g. ["cudatext", "${__FILE__}@${__LINE__}"]
 	FileLineCol []string `toml:"file_line_col"` // e.g. ["cudatext", "${__FILE__}@${__LINE__}@${__COLUMN__}"]
 	PrettyJSON  bool     `toml:"pretty_json"`
+	// Terminal editors (vim, nvim) run in the viewer's terminal: the viewer
+	// steps aside until they exit.
+	Terminal bool   `toml:"terminal,omitempty"`
+	Preset   string `toml:"preset,omitempty"` // see Presets
 }
 
 // LaunchForLine builds argv from the configured templates, sets editor vars,
-// starts the editor (non-blocking), and returns the argv used.
+// starts the editor (non-blocking, unless cfg.Terminal), and returns the argv used.
 //
 // Behavior:
 //   - If the line yields (file,line,col):
 //   - prefer FileLineColDef, else FileLineDef, else FileDef
+//   - the file is found with ResolveFile (at.File, when set, is used as is);
+//     nothing is launched when it can't be
 //   - Else (no file/line found): write a temp JSON and use FileDef with __FILE__=that path
-func LaunchForLine(line string, rs []rules.Rule, cfg Config) ([]string, error) {
+func LaunchForLine(line string, at Where, rs []rules.Rule, cfg Config) ([]string, error) {
 	file, ln, col, ok := rules.ExtractPathLineCol(rs, line)
+	if ok {
+		if at.File != "" {
+			file = at.File
+		} else {
+			p, err := ResolveFile(file, at)
+			if err != nil {
+				return nil, err
+			}
+			file = p
+		}
+	}
 
 	// If no (file,line) extracted, write a small JSON payload and use that path as __FILE__.
 	if !ok {
@@ -76,6 +93,10 @@ func LaunchForLine(line string, rs []rules.Rule, cfg Config) ([]string, error) {
 
 	cmd := exec.Command(argv[0], argv[1:]...)
 	cmd.Env = withVars(os.Environ(), vars) // inject our vars
+	if cfg.Terminal {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return argv, cmd.Run()
+	}
 	return argv, cmd.Start()
 }
 
@@ -0,0 +1,108 @@
+package editor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"local/makedir"
+)
+
+// Where tells LaunchForLine how to find the file a line names.
+type Where struct {
+	Dir  string // make's directory for the line ("" if none)
+	Base string // relative paths are taken from here ("" is our cwd)
+	File string // the user's pick among ambiguous candidates; used as is
+}
+
+// AmbiguousError is returned when a missing file's basename occurs more than
+// once under the base directory; the caller lets the user pick one.
+type AmbiguousError struct {
+	Name  string
+	Files []string
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("editor: %s: %d candidates", e.Name, len(e.Files))
+}
+
+// searchMax bounds the directory entries visited looking for a basename.
+const searchMax = 50000
+
+var errSearchMax = errors.New("search limit")
+
+// skipDirs are not searched for basenames.
+var skipDirs = map[string]bool{".git": true, ".hg": true, ".svn": true, "node_modules": true}
+
+// ResolveFile returns the existing file that file (as printed by a tool)
+// refers to. In order:
+//   - file relative to make's directory, then to the base directory
+//   - with leading components stripped, relative to the base directory, for
+//     paths from a build tree or container mounted elsewhere (/__w/proj/src/x.c)
+//   - the files under the base directory with the same basename: one is the
+//     answer, more are an *AmbiguousError
+func ResolveFile(file string, at Where) (string, error) {
+	base := at.Base
+	if base == "" {
+		base, _ = os.Getwd()
+	}
+	if p := makedir.Resolve(at.Dir, file); p != file {
+		return p, nil
+	}
+	p := file
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	if isFile(p) {
+		return p, nil
+	}
+
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(file)), "/")
+	for i := 1; i < len(parts)-1; i++ {
+		if parts[i] == ".." {
+			continue
+		}
+		if p := filepath.Join(base, filepath.Join(parts[i:]...)); isFile(p) {
+			return p, nil
+		}
+	}
+
+	name := filepath.Base(file)
+	var found []string
+	seen := 0
+	_ = filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if seen++; seen > searchMax {
+			return errSearchMax
+		}
+		if d.IsDir() {
+			if p != base && skipDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == name {
+			found = append(found, p)
+		}
+		return nil
+	})
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("editor: %s: no such file (nor one named %s under %s)", file, name, base)
+	case 1:
+		return found[0], nil
+	}
+	sort.Strings(found)
+	return "", &AmbiguousError{Name: file, Files: found}
+}
+
+func isFile(p string) bool {
+	st, err := os.Stat(p)
+	return err == nil && !st.IsDir()
+}
@@ -0,0 +1,132 @@
+package editor
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Presets are ready-made templates, chosen with `editor = "NAME"` at the top
+// of the config or `preset = "NAME"` in [editor] (where templates given next
+// to it override the preset's).
+var Presets = map[string]Config{
+	"vim": {
+		File:        []string{"vim", "${__FILE__}"},
+		FileLine:    []string{"vim", "+${__LINE__}", "${__FILE__}"},
+		FileLineCol: []string{"vim", "+call cursor(${__LINE__},${__COLUMN__})", "${__FILE__}"},
+		Terminal:    true,
+	},
+	"nvim": {
+		File:        []string{"nvim", "${__FILE__}"},
+		FileLine:    []string{"nvim", "+${__LINE__}", "${__FILE__}"},
+		FileLineCol: []string{"nvim", "+call cursor(${__LINE__},${__COLUMN__})", "${__FILE__}"},
+		Terminal:    true,
+	},
+	"emacsclient": {
+		File:        []string{"emacsclient", "-n", "${__FILE__}"},
+		FileLine:    []string{"emacsclient", "-n", "+${__LINE__}", "${__FILE__}"},
+		FileLineCol: []string{"emacsclient", "-n", "+${__LINE__}:${__COLUMN__}", "${__FILE__}"},
+	},
+	"vscode": {
+		File:        []string{"code", "${__FILE__}"},
+		FileLine:    []string{"code", "--goto", "${__FILE__}:${__LINE__}"},
+		FileLineCol: []string{"code", "--goto", "${__FILE__}:${__LINE__}:${__COLUMN__}"},
+	},
+	"subl": {
+		File:        []string{"subl", "${__FILE__}"},
+		FileLine:    []string{"subl", "${__FILE__}:${__LINE__}"},
+		FileLineCol: []string{"subl", "${__FILE__}:${__LINE__}:${__COLUMN__}"},
+	},
+	"cudatext": {
+		File:        []string{"cudatext", "${__FILE__}"},
+		FileLine:    []string{"cudatext", "${__FILE__}@${__LINE__}"},
+		FileLineCol: []string{"cudatext", "${__FILE__}@${__LINE__}@${__COLUMN__}"},
+	},
+}
+
+// PresetNames lists the presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for n := range Presets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnmarshalTOML accepts a preset name (`editor = "vscode"`) or the [editor]
+// table, whose preset, if any, is applied before its templates.
+func (c *Config) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		return c.usePreset(v)
+	case map[string]any:
+		if p, ok := v["preset"]; ok {
+			name, ok := p.(string)
+			if !ok {
+				return fmt.Errorf("editor: preset: want a string, have %T", p)
+			}
+			if err := c.usePreset(name); err != nil {
+				return err
+			}
+		}
+		for key, dst := range map[string]*[]string{
+			"file":          &c.File,
+			"file_line":     &c.FileLine,
+			"file_line_col": &c.FileLineCol,
+		} {
+			raw, ok := v[key]
+			if !ok {
+				continue
+			}
+			argv, err := stringList(raw)
+			if err != nil {
+				return fmt.Errorf("editor: %s: %w", key, err)
+			}
+			*dst = argv
+		}
+		for key, dst := range map[string]*bool{
+			"pretty_json": &c.PrettyJSON,
+			"terminal":    &c.Terminal,
+		} {
+			raw, ok := v[key]
+			if !ok {
+				continue
+			}
+			b, ok := raw.(bool)
+			if !ok {
+				return fmt.Errorf("editor: %s: want true or false, have %T", key, raw)
+			}
+			*dst = b
+		}
+		return nil
+	}
+	return fmt.Errorf("editor: want a preset name or a table, have %T", v)
+}
+
+func (c *Config) usePreset(name string) error {
+	p, ok := Presets[name]
+	if !ok {
+		return fmt.Errorf("editor: unknown preset %q (have %v)", name, PresetNames())
+	}
+	pretty := c.PrettyJSON
+	*c = p
+	c.Preset = name
+	c.PrettyJSON = pretty
+	return nil
+}
+
+func stringList(v any) ([]string, error) {
+	items, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("want an array of strings, have %T", v)
+	}
+	out := make([]string, 0, len(items))
+	for _, it := range items {
+		s, ok := it.(string)
+		if !ok {
+			return nil, fmt.Errorf("want an array of strings, have a %T in it", it)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
@@ -11,17 +11,42 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 
+	"local/ansi"
 	"local/capture"
+	"local/makedir"
 	"local/rules"
 )
 
 type Options struct {
 	OnlyViewMatches bool   // write only matches into capture
 	MatchStderr     string // "none" | "line"  (mirror matches to process' stderr)
+
+	// Follow mode: a viewer tails the capture while the command runs, so
+	// nothing is streamed to the terminal and the capture is flushed
+	// whenever the reader catches up with the command.
+	Quiet   bool
+	Started func(capturePath string) // called once the command is running
+
+	BaseDir string // recorded in the meta
+
+	Compress  bool // write a .jsonl.gz capture
+	FoldDupes bool // collapse runs of identical lines into one record (Rec.Count)
+
+	// PTY runs the command on a pseudo-terminal, so it colors its output and
+	// draws progress as for a terminal. Its stdout and stderr are then one
+	// stream ("out"), copied to our stdout as it arrives; a line overwritten
+	// with \r is captured as last drawn. Input is not forwarded.
+	PTY bool
+
+	// OnMatch is called for each match line (its number, text with escapes
+	// stripped, and make's directory for it); calls are serialized.
+	OnMatch func(n int, plain, dir string)
+	// Annotate returns a line streamed right after a match line, on the same
+	// fd ("" for none), e.g. a CI workflow command.
+	Annotate func(plain, dir string) string
 }
 
 type Result struct {
@@ -38,7 +63,8 @@ type Result struct {
 //
 // It streams both to os.Stdout in real time (so the invoking tool sees output),
 // mirrors matching lines to os.Stderr if opts.MatchStderr == "line",
-// and writes a JSONL capture (with Rec.Stream set to "out" or "err").
+// and writes a JSONL capture (with Rec.Stream set to "out" or "err"), the
+// lines of both streams numbered in the order they were read.
 //
 // It returns when the process exits and the capture is fully written.
 func Run(cmdArgs []string, rs []rules.Rule, opts Options) (*Result, error) {
@@ -48,26 +74,64 @@ func Run(cmdArgs []string, rs []rules.Rule, opts Options) (*Result, error) {
 	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("execcap: stdout pipe: %w", err)
+	// Readers
+	type streamInfo struct {
+		name string
+		r    io.Reader
+		raw  bool // already copied to the terminal as read (pty)
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, fmt.Errorf("execcap: stderr pipe: %w", err)
+	var streams []streamInfo
+	var slave *os.File // pty: the child's end, closed once it has started
+	if opts.PTY {
+		master, s, err := openPTY()
+		if err != nil {
+			return nil, fmt.Errorf("execcap: %w", err)
+		}
+		defer master.Close()
+		slave = s
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		// the pty's session; the leader keeps pgid == pid as with Setpgid
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		var r io.Reader = master
+		if !opts.Quiet {
+			r = io.TeeReader(master, os.Stdout)
+		}
+		streams = []streamInfo{{"out", r, true}}
+	} else {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("execcap: stdout pipe: %w", err)
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return nil, fmt.Errorf("execcap: stderr pipe: %w", err)
+		}
+		streams = []streamInfo{
+			{"out", stdout, false},
+			{"err", stderr, false},
+		}
 	}
 
 	// Create capture writer
-	wr, err := capture.NewTempWriter("ot-exec-")
+	wr, err := capture.NewTempWriter("ot-exec-", opts.Compress)
 	if err != nil {
 		return nil, fmt.Errorf("execcap: temp writer: %w", err)
 	}
-	enc := json.NewEncoder(wr.Writer())
+	enc := capture.NewFolder(json.NewEncoder(wr.Writer()), opts.FoldDupes)
 
-	if err := cmd.Start(); err != nil {
+	cwd, _ := os.Getwd()
+	start := time.Now()
+	err = cmd.Start()
+	if slave != nil {
+		_ = slave.Close() // reads of the master end with EIO once the child's are closed
+	}
+	if err != nil {
 		_ = wr.Close()
 		return nil, fmt.Errorf("execcap: start: %w", err)
 	}
+	if opts.Started != nil {
+		opts.Started(wr.Path())
+	}
 
 	// --- Signal forwarding: forward INT/TERM/HUP/QUIT to child *process group*
 	sigc := make(chan os.Signal, 4)
@@ -90,94 +154,134 @@ func Run(cmdArgs []string, rs []rules.Rule, opts Options) (*Result, error) {
 	}(cmd.Process)
 
 	var (
-		linesTotal   int64
-		matchLines   int64
-		matchesTotal int64
-		anyMatch     int32
+		linesTotal   int
+		matchLines   int
+		matchesTotal int
+		anyMatch     bool
+		sevLines     [rules.Error + 1]int64 // match lines per severity
 	)
 
-	// Readers
-	type streamInfo struct {
-		name string
-		r    io.Reader
+	// The readers only split lines; one loop numbers, echoes and captures
+	// them in arrival order, so n and the capture follow one timeline.
+	type streamLine struct {
+		st   int // index in streams
+		text string
+		t    time.Time
 	}
-	streams := []streamInfo{
-		{"out", stdout},
-		{"err", stderr},
-	}
-
+	lines := make(chan streamLine, 1024)
 	var wg sync.WaitGroup
-	writeLine := func(n int64, sname, line string, matched bool) {
-		rec := capture.Rec{
-			N: int(n), Text: line, M: matched, Stream: sname,
-		}
-		if !opts.OnlyViewMatches || matched {
-			_ = enc.Encode(&rec)
-		}
-	}
-
-	for _, st := range streams {
-		st := st
+	for i, st := range streams {
+		i, st := i, st
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			in := bufio.NewReaderSize(st.r, 64*1024)
-
-			// IMPORTANT: write to the same-origin stream
-			var out *bufio.Writer
-			switch st.name {
-			case "out":
-				out = bufio.NewWriterSize(os.Stdout, 64*1024)
-			case "err":
-				out = bufio.NewWriterSize(os.Stderr, 64*1024)
-			default:
-				out = bufio.NewWriterSize(os.Stdout, 64*1024)
-			}
-			defer out.Flush()
-
-			// Separate writer used only for optional mirroring of stdout matches
-			errw := bufio.NewWriterSize(os.Stderr, 64*1024)
-			defer errw.Flush()
-
 			for {
 				line, rerr := in.ReadString('\n')
-				if errors.Is(rerr, io.EOF) && len(line) == 0 {
+				if rerr != nil && len(line) == 0 { // EOF, or EIO from a pty
 					break
 				}
 				line = strings.TrimRight(line, "\r\n")
-				n := atomic.AddInt64(&linesTotal, 1)
-
-				// Stream to the SAME fd as the child’s origin
-				out.WriteString(line)
-				out.WriteByte('\n')
-
-				matched, count := rules.AnyMatch(rs, line)
-				if matched {
-					atomic.StoreInt32(&anyMatch, 1)
-					atomic.AddInt64(&matchLines, 1)
-					atomic.AddInt64(&matchesTotal, int64(count))
-
-					// Mirror to stderr ONLY when the origin was stdout (avoid double printing)
-					if opts.MatchStderr == "line" && st.name == "out" {
-						fmt.Fprintf(errw, "%d: %s\n", n, line)
+				if st.raw {
+					// progress redrawn with \r: keep what was left on screen
+					if j := strings.LastIndexByte(line, '\r'); j >= 0 {
+						line = line[j+1:]
 					}
 				}
-
-				writeLine(n, st.name, line, matched)
-
+				lines <- streamLine{i, line, time.Now()}
 				if rerr != nil {
-					if errors.Is(rerr, io.EOF) {
-						break
-					}
 					break
 				}
 			}
 		}()
 	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	// IMPORTANT: write to the same-origin stream
+	outs := make([]*bufio.Writer, len(streams))
+	for i, st := range streams {
+		var w io.Writer = os.Stdout
+		switch {
+		case opts.Quiet:
+			w = io.Discard
+		case st.name == "err":
+			w = os.Stderr
+		}
+		outs[i] = bufio.NewWriterSize(w, 64*1024)
+	}
+	// Separate writer used only for optional mirroring of stdout matches
+	errw := bufio.NewWriterSize(os.Stderr, 64*1024)
+
+	var dirs makedir.Tracker
+	for ln := range lines {
+		st, out, line := streams[ln.st], outs[ln.st], ln.text
+		linesTotal++
+		n := linesTotal
+
+		// Stream to the SAME fd as the child’s origin
+		if !st.raw {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+
+		plain := ansi.Strip(line)
+		dir := dirs.Line(plain)
+		matched, count := rules.AnyMatch(rs, plain)
+		if matched {
+			sev, _ := rules.LineSeverity(rs, plain)
+			sevLines[sev]++
+			anyMatch = true
+			matchLines++
+			matchesTotal += count
+			if opts.OnMatch != nil {
+				opts.OnMatch(n, plain, dir)
+			}
+			if opts.Annotate != nil {
+				if a := opts.Annotate(plain, dir); a != "" {
+					out.WriteString(a)
+					out.WriteByte('\n')
+				}
+			}
+
+			// Mirror to stderr ONLY when the origin was stdout (avoid double printing)
+			if opts.MatchStderr == "line" && st.name == "out" && !opts.Quiet {
+				fmt.Fprintf(errw, "%d: %s\n", n, line)
+			}
+		}
+
+		if !opts.OnlyViewMatches || matched {
+			rec := capture.Rec{N: n, Text: line, M: matched, Stream: st.name, T: ln.t.UnixMilli()}
+			if matched {
+				rec.Dir = dir
+			}
+			_ = enc.Encode(&rec)
+		}
+
+		if len(lines) == 0 {
+			// caught up: let the terminal (and a raw pty copy) see it now,
+			// and a following viewer
+			if opts.Quiet {
+				_ = enc.Flush()
+				_ = wr.Flush()
+			}
+			for _, w := range outs {
+				_ = w.Flush()
+			}
+			_ = errw.Flush()
+		}
+	}
+	for _, w := range outs {
+		_ = w.Flush()
+	}
+	_ = errw.Flush()
 
-	wg.Wait()
+	_ = enc.Flush()
 	_ = wr.Close()
 	waitErr := cmd.Wait()
+	elapsed := time.Since(start)
 	exitCode := 0
 	if waitErr != nil {
 		if ee, ok := waitErr.(*exec.ExitError); ok {
@@ -190,23 +294,28 @@ func Run(cmdArgs []string, rs []rules.Rule, opts Options) (*Result, error) {
 
 	res := &Result{
 		CapturePath:  wr.Path(),
-		AnyMatch:     atomic.LoadInt32(&anyMatch) == 1,
-		LinesTotal:   int(linesTotal),
-		MatchLines:   int(matchLines),
-		MatchesTotal: int(matchesTotal),
+		AnyMatch:     anyMatch,
+		LinesTotal:   linesTotal,
+		MatchLines:   matchLines,
+		MatchesTotal: matchesTotal,
 		ExitCode:     exitCode,
 		Meta: capture.Meta{
 			Version:        1,
 			CapturePath:    wr.Path(),
 			Filtered:       opts.OnlyViewMatches,
-			LineFormat:     "jsonl",
-			LinesTotal:     int(linesTotal),
-			MatchLines:     int(matchLines),
-			MatchesTotal:   int(matchesTotal),
+			LineFormat:     capture.Format(wr.Path()),
+			LinesTotal:     linesTotal,
+			MatchLines:     matchLines,
+			MatchesTotal:   matchesTotal,
+			Severities:     severityCounts(sevLines[:]),
 			CreatedUnixSec: time.Now().Unix(),
 			Temp:           false, // viewer inline won't auto-delete
 			OwnerPID:       os.Getpid(),
 			ExitCode:       exitCode,
+			Argv:           cmdArgs,
+			Cwd:            cwd,
+			DurationMs:     max(elapsed.Milliseconds(), 1),
+			BaseDir:        opts.BaseDir,
 			Source: capture.Source{
 				Mode: "exec",
 				Arg:  strings.Join(cmdArgs, " "),
@@ -215,3 +324,13 @@ func Run(cmdArgs []string, rs []rules.Rule, opts Options) (*Result, error) {
 	}
 	return res, nil
 }
+
+func severityCounts(lines []int64) map[string]int {
+	m := map[string]int{}
+	for sev, n := range lines {
+		if n > 0 {
+			m[rules.Severity(sev).String()] = int(n)
+		}
+	}
+	return m
+}
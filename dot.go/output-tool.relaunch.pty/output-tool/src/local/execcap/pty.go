@@ -0,0 +1,48 @@
+package execcap
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); e != 0 {
+		return e
+	}
+	return nil
+}
+
+type winsize struct {
+	Row, Col, X, Y uint16
+}
+
+// openPTY allocates a pty pair sized like our terminal (80x24 without one),
+// so the child lays out progress bars and tables for it.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pty: %w", err)
+	}
+	var unlock int32
+	var n uint32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("pty: %w", err)
+	}
+	ws := winsize{Row: 24, Col: 80}
+	var term winsize
+	if ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&term)) == nil && term.Col > 0 {
+		ws = term
+	}
+	_ = ioctl(master.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+	return master, slave, nil
+}
@@ -0,0 +1,75 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+
+	"local/makedir"
+	"local/rules"
+)
+
+// Formats names the supported --export values.
+var Formats = []string{"csv", "tsv"}
+
+var header = []string{"n", "rule", "file", "line", "col", "text"}
+
+// Writer writes one row per rule matching a line: the capture line number,
+// the rule id, the file/line/col the rule extracts (empty without) and the
+// line's text with escapes stripped.
+type Writer struct {
+	f *os.File
+	w *csv.Writer
+}
+
+// Create truncates path and writes the header row.
+func Create(path, format string) (*Writer, error) {
+	var comma rune
+	switch format {
+	case "csv":
+		comma = ','
+	case "tsv":
+		comma = '\t'
+	default:
+		return nil, fmt.Errorf("export: unknown format %q", format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("export: %w", err)
+	}
+	w := &Writer{f: f, w: csv.NewWriter(f)}
+	w.w.Comma = comma
+	_ = w.w.Write(header)
+	return w, nil
+}
+
+// Match writes the rows of a match line; dir is make's directory for it.
+func (w *Writer) Match(rs []rules.Rule, n int, plain, dir string) {
+	for _, r := range rs {
+		if !r.Regex.MatchString(plain) {
+			continue
+		}
+		row := []string{strconv.Itoa(n), r.ID, "", "", "", plain}
+		if file, ln, col, ok := r.PathLineCol(plain); ok {
+			row[2] = makedir.Resolve(dir, file)
+			if ln > 0 {
+				row[3] = strconv.Itoa(ln)
+			}
+			if col > 0 {
+				row[4] = strconv.Itoa(col)
+			}
+		}
+		_ = w.w.Write(row)
+	}
+}
+
+// Close flushes the rows and closes the file.
+func (w *Writer) Close() error {
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		_ = w.f.Close()
+		return fmt.Errorf("export: %w", err)
+	}
+	return w.f.Close()
+}
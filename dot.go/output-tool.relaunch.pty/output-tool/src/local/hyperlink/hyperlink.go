@@ -0,0 +1,133 @@
+package hyperlink
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"local/ansi"
+	"local/makedir"
+	"local/rules"
+)
+
+// Presets are ready-made URI templates for --hyperlink.
+var Presets = map[string]string{
+	"file":   "file://${__HOST__}${__FILE__}",
+	"vscode": "vscode://file${__FILE__}:${__LINE__}:${__COLUMN__}",
+}
+
+// PresetNames lists the presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for n := range Presets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Linker wraps the file:line:col spans of lines in OSC 8 hyperlinks, so a
+// terminal that supports them opens the location on a click. The template
+// is expanded like the editor's: ${__FILE__} (absolute path),
+// ${__RELFILE__} (relative to the base directory, for code browsers),
+// ${__LINE__}, ${__COLUMN__} (1 when not given), ${__HOST__}, and
+// environment variables.
+type Linker struct {
+	tmpl string
+	base string
+	host string
+}
+
+// New returns a Linker for a preset name or a URI template; relative paths
+// are from base.
+func New(tmpl, base string) (*Linker, error) {
+	if p, ok := Presets[tmpl]; ok {
+		tmpl = p
+	}
+	if err := Check(tmpl); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &Linker{tmpl: tmpl, base: base, host: host}, nil
+}
+
+// Check reports whether tmpl (a preset name or a template) can make links.
+func Check(tmpl string) error {
+	if p, ok := Presets[tmpl]; ok {
+		tmpl = p
+	}
+	if !strings.Contains(tmpl, "://") {
+		return fmt.Errorf("%q: want a preset (%s) or a URI template (SCHEME://...)", tmpl, strings.Join(PresetNames(), ", "))
+	}
+	if !strings.Contains(tmpl, "${__FILE__}") && !strings.Contains(tmpl, "${__RELFILE__}") {
+		return errors.New("the URI template uses neither ${__FILE__} nor ${__RELFILE__}")
+	}
+	return nil
+}
+
+// Line returns line, which may carry escape sequences, with its locations
+// linked; dir is make's directory for it. A line without any is returned
+// as is.
+func (l *Linker) Line(rs []rules.Rule, line, dir string) string {
+	plain := ansi.Strip(line)
+	locs := rules.Locs(rs, plain)
+	if len(locs) == 0 {
+		return line
+	}
+	offs := ansi.Offsets(line)
+	var b strings.Builder
+	b.Grow(len(line) + len(locs)*64)
+	at := 0
+	for _, loc := range locs {
+		if loc.Span[1] <= loc.Span[0] {
+			continue
+		}
+		// escapes around the span stay outside the link
+		start, end := offs[loc.Span[0]], offs[loc.Span[1]-1]+1
+		b.WriteString(line[at:start])
+		b.WriteString("\x1b]8;;" + l.uri(loc, dir) + "\x1b\\")
+		b.WriteString(line[start:end])
+		b.WriteString("\x1b]8;;\x1b\\")
+		at = end
+	}
+	b.WriteString(line[at:])
+	return b.String()
+}
+
+func (l *Linker) uri(loc rules.Loc, dir string) string {
+	file := loc.File
+	if !filepath.IsAbs(file) {
+		if p := makedir.Resolve(dir, file); p != file {
+			file = p
+		} else {
+			file = filepath.Join(l.base, file)
+		}
+	}
+	rel, err := filepath.Rel(l.base, file)
+	if err != nil {
+		rel = file
+	}
+	vars := map[string]string{
+		"__FILE__":    pathEscape(file),
+		"__RELFILE__": pathEscape(filepath.ToSlash(rel)),
+		"__LINE__":    strconv.Itoa(max(loc.Line, 1)),
+		"__COLUMN__":  strconv.Itoa(max(loc.Col, 1)),
+		"__HOST__":    l.host,
+	}
+	return os.Expand(l.tmpl, func(k string) string {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+		return os.Getenv(k)
+	})
+}
+
+// pathEscape escapes p for a URI, keeping its slashes.
+func pathEscape(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
@@ -10,20 +10,34 @@ import (
 )
 
 type Config struct {
-	TermPrefix string `toml:"prefix"`      // graphical terminal (existing)
-	TmuxPrefix string `toml:"tmux_prefix"` // tmux popup command prefix
-	PreferTmux bool   `toml:"prefer_tmux"` // prefer tmux when available (auto-detect)
+	TermPrefix string `toml:"prefix"`                // graphical terminal (existing)
+	TmuxPrefix string `toml:"tmux_prefix,omitempty"` // tmux command prefix, when tmux_mode is not set
+	PreferTmux bool   `toml:"prefer_tmux"`           // prefer tmux when available (auto-detect)
+	// Where the viewer opens in tmux (tmux.Modes) and its size, N or N%;
+	// with TmuxReuse, a pane titled like the viewer is reused.
+	TmuxMode   string `toml:"tmux_mode,omitempty"`
+	TmuxWidth  string `toml:"tmux_width,omitempty"`
+	TmuxHeight string `toml:"tmux_height,omitempty"`
+	TmuxReuse  bool   `toml:"tmux_reuse,omitempty"`
 
-	ViewerTitle   string
-	OnlyView      bool
-	Mouse         bool
-	KeepCapture   bool
-	CleanupTTLMin int
-	DryRun        bool
+	// Runtime, from the flags; not config keys.
+	ViewerTitle   string `toml:"-"`
+	OnlyView      bool   `toml:"-"`
+	Mouse         bool   `toml:"-"`
+	KeepCapture   bool   `toml:"-"`
+	CleanupTTLMin int    `toml:"-"`
+	DryRun        bool   `toml:"-"`
 
-	ForceTmux   bool // CLI override: force tmux
-	NoTmux      bool // CLI override: disable tmux
-	ErrLinesMax int
+	ForceTmux   bool   `toml:"-"` // CLI override: force tmux
+	NoTmux      bool   `toml:"-"` // CLI override: disable tmux
+	ErrLinesMax int    `toml:"-"`
+	TabWidth    int    `toml:"-"`
+	Follow      bool   `toml:"-"` // viewer tails a capture that is still being written
+	Wrap        bool   `toml:"-"`
+	Rules       string `toml:"-"` // --rules, so the viewer highlights with the same sets
+	ConfigPath  string `toml:"-"` // config file in use; the new terminal may have another cwd
+	Quickfix    string `toml:"-"` // --quickfix, where x in the viewer writes
+	Theme       string `toml:"-"`
 }
 
 func SpawnTerminalViewer(cfg Config, selfExe, capturePath, metaPath string) error {
@@ -50,9 +64,30 @@ func SpawnTerminalViewer(cfg Config, selfExe, capturePath, metaPath string) erro
 	if cfg.CleanupTTLMin > 0 {
 		inner.WriteString(fmt.Sprintf("--cleanup-ttl-minutes=%d ", cfg.CleanupTTLMin))
 	}
+	if cfg.Follow {
+		inner.WriteString("--follow ")
+	}
+	if cfg.Wrap {
+		inner.WriteString("--wrap ")
+	}
+	if cfg.ConfigPath != "" {
+		inner.WriteString("--config=" + util.ShellQuote(cfg.ConfigPath) + " ")
+	}
+	if cfg.Rules != "" {
+		inner.WriteString("--rules=" + util.ShellQuote(cfg.Rules) + " ")
+	}
+	if cfg.Theme != "" {
+		inner.WriteString("--theme=" + util.ShellQuote(cfg.Theme) + " ")
+	}
+	if cfg.Quickfix != "" {
+		inner.WriteString("--quickfix=" + util.ShellQuote(cfg.Quickfix) + " ")
+	}
 	if cfg.ErrLinesMax > 0 {
 		inner.WriteString(fmt.Sprintf("--err-lines=%d ", cfg.ErrLinesMax))
 	}
+	if cfg.TabWidth > 0 {
+		inner.WriteString(fmt.Sprintf("--tab-width=%d ", cfg.TabWidth))
+	}
 
 	innerCmd := inner.String()
 
@@ -61,11 +96,35 @@ func SpawnTerminalViewer(cfg Config, selfExe, capturePath, metaPath string) erro
 	if !cfg.NoTmux {
 		if cfg.ForceTmux {
 			useTmux = true
-		} else if tmux.InTmux() && (cfg.PreferTmux || cfg.TmuxPrefix != "") && tmux.SupportsPopups() {
+		} else if tmux.InTmux() && (cfg.PreferTmux || cfg.TmuxPrefix != "" || cfg.TmuxMode != "") {
 			useTmux = true
 		}
 	}
 
+	if useTmux && cfg.TmuxMode != "" {
+		l := tmux.Launch{
+			Mode:   cfg.TmuxMode,
+			Width:  cfg.TmuxWidth,
+			Height: cfg.TmuxHeight,
+			Title:  cfg.ViewerTitle,
+			Reuse:  cfg.TmuxReuse,
+		}
+		if l.Mode == "popup" && !tmux.SupportsPopups() {
+			l.Mode = "window" // tmux < 3.2
+		}
+		if cfg.DryRun {
+			argv, err := l.Argv(innerCmd)
+			if pane, ok := tmux.FindPane(l.Title); ok && l.Reuse && l.Mode != "popup" {
+				argv, err = tmux.Respawn(pane, innerCmd), nil
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("DRY LAUNCH (tmux): %s\n", strings.Join(argv, " "))
+			return nil
+		}
+		return l.Start(innerCmd)
+	}
 	if useTmux && cfg.TmuxPrefix != "" {
 		// tmux popup: pass the whole inner command as a single argument
 		// Example default: "tmux display-popup -E -w 100% -h 100% --"
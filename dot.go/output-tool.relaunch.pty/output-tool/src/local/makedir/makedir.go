@@ -0,0 +1,62 @@
+package makedir
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// Recursive makes announce where relative paths in the following output are
+// rooted: "make[1]: Entering directory '/src/lib'" ... "Leaving directory".
+var dirRe = regexp.MustCompile("\\bmake(?:\\[\\d+\\])?: (Entering|Leaving) directory [`'\"‘](.+?)['\"’]\\s*$")
+
+// Tracker keeps the directory stack; safe for the two streams of --exec.
+type Tracker struct {
+	mu    sync.Mutex
+	stack []string
+}
+
+// Line updates the stack from line and returns the directory in effect for
+// it ("" outside any make directory).
+func (t *Tracker) Line(line string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m := dirRe.FindStringSubmatch(line); m != nil {
+		if m[1] == "Entering" {
+			t.stack = append(t.stack, m[2])
+			return m[2]
+		}
+		// Leaving: pop back to below the matching entry (or just the top)
+		for i := len(t.stack) - 1; i >= 0; i-- {
+			if t.stack[i] == m[2] {
+				t.stack = t.stack[:i]
+				return t.top()
+			}
+		}
+		if len(t.stack) > 0 {
+			t.stack = t.stack[:len(t.stack)-1]
+		}
+	}
+	return t.top()
+}
+
+func (t *Tracker) top() string {
+	if len(t.stack) == 0 {
+		return ""
+	}
+	return t.stack[len(t.stack)-1]
+}
+
+// Resolve returns file joined to dir when file is relative and exists there;
+// otherwise file unchanged.
+func Resolve(dir, file string) string {
+	if dir == "" || filepath.IsAbs(file) {
+		return file
+	}
+	p := filepath.Join(dir, file)
+	if _, err := os.Stat(p); err != nil {
+		return file
+	}
+	return p
+}
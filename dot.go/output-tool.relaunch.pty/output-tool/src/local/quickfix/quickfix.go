@@ -0,0 +1,71 @@
+package quickfix
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"local/makedir"
+	"local/rules"
+)
+
+// Matches exported as "file:line:col: message" lines, the format vim reads
+// with `vim -q PATH` (and most editors' error lists understand).
+
+// DefaultPath is vim's default errorfile, read by a bare `vim -q`.
+const DefaultPath = "errors.err"
+
+// Entry is a match line's location and message.
+type Entry struct {
+	File string
+	Line int // 1 when the rule has no line group
+	Col  int // 0 when unknown
+	Msg  string
+}
+
+// Parse takes the location from a match line (escapes stripped); dir is
+// make's directory for the line, for relative paths. ok is false when no rule
+// yields a file.
+func Parse(rs []rules.Rule, text, dir string) (Entry, bool) {
+	file, ln, col, ok := rules.ExtractPathLineCol(rs, text)
+	if !ok {
+		return Entry{}, false
+	}
+	msg := strings.TrimSpace(text)
+	// "x.c:3:5: error: ..." → "error: ..."; other layouts keep the whole line
+	loc := fmt.Sprintf("%s:%d:", file, ln)
+	if col > 0 {
+		loc = fmt.Sprintf("%s:%d:%d:", file, ln, col)
+	}
+	if rest, found := strings.CutPrefix(msg, loc); found && strings.TrimSpace(rest) != "" {
+		msg = strings.TrimSpace(rest)
+	}
+	return Entry{File: makedir.Resolve(dir, file), Line: max(ln, 1), Col: col, Msg: msg}, true
+}
+
+// String is the quickfix line.
+func (e Entry) String() string {
+	if e.Col > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Line is the quickfix line of a match line, if a rule yields a file.
+func Line(rs []rules.Rule, text, dir string) (string, bool) {
+	e, ok := Parse(rs, text, dir)
+	if !ok {
+		return "", false
+	}
+	return e.String(), true
+}
+
+// WriteFile writes entries, one per line, replacing path.
+func WriteFile(path string, entries []string) error {
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
@@ -1,6 +1,10 @@
 package rules
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
 
 type Rule struct {
 	ID          string `toml:"id"`
@@ -8,7 +12,83 @@ type Rule struct {
 	FileGroup   int    `toml:"file_group"`   // 1-based capture group index for file path (0 = none)
 	LineGroup   int    `toml:"line_group"`   // 1-based capture group index for line number
 	ColumnGroup int    `toml:"column_group"` // 1-based capture group index for column number
-	Regex       *regexp.Regexp
+	// Named alternatives to the indices, e.g. file_name_group = "file" for
+	// (?P<file>...); they survive edits to the regex. A name wins over an index.
+	FileNameGroup   string `toml:"file_name_group,omitempty"`
+	LineNameGroup   string `toml:"line_name_group,omitempty"`
+	ColumnNameGroup string `toml:"column_name_group,omitempty"`
+	Severity        string `toml:"severity,omitempty"` // error (default) | warning | info
+	Regex           *regexp.Regexp
+}
+
+// ResolveGroups sets the group indices from the group names, failing when
+// the compiled Regex has no group of that name.
+func (r *Rule) ResolveGroups() error {
+	for _, g := range []struct {
+		name string
+		idx  *int
+	}{
+		{r.FileNameGroup, &r.FileGroup},
+		{r.LineNameGroup, &r.LineGroup},
+		{r.ColumnNameGroup, &r.ColumnGroup},
+	} {
+		if g.name == "" {
+			continue
+		}
+		i := r.Regex.SubexpIndex(g.name)
+		if i < 0 {
+			return fmt.Errorf("rule %q: regex has no group named %q", r.ID, g.name)
+		}
+		*g.idx = i
+	}
+	return nil
+}
+
+// Severity orders rule severities: a line takes the highest of the rules
+// matching it.
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Error
+)
+
+var severityNames = [...]string{Info: "info", Warning: "warning", Error: "error"}
+
+func (s Severity) String() string { return severityNames[s] }
+
+// ParseSeverity accepts error|warning|info ("" is error).
+func ParseSeverity(name string) (Severity, bool) {
+	if name == "" {
+		return Error, true
+	}
+	for i, n := range severityNames {
+		if n == name {
+			return Severity(i), true
+		}
+	}
+	return Error, false
+}
+
+// Level is the rule's severity; an unknown name counts as error.
+func (r Rule) Level() Severity {
+	s, _ := ParseSeverity(r.Severity)
+	return s
+}
+
+// LineSeverity is the highest severity of the rules matching line.
+func LineSeverity(rs []Rule, line string) (Severity, bool) {
+	best, any := Info, false
+	for _, r := range rs {
+		if r.Regex.MatchString(line) {
+			if lv := r.Level(); !any || lv > best {
+				best = lv
+			}
+			any = true
+		}
+	}
+	return best, any
 }
 
 func Default() []Rule {
@@ -73,32 +153,84 @@ func coalesce(spans [][2]int) [][2]int {
 // ExtractPathLineCol returns first occurrence
 func ExtractPathLineCol(rs []Rule, line string) (file string, lineNo, col int, ok bool) {
 	for _, r := range rs {
-		idxs := r.Regex.FindStringSubmatchIndex(line)
-		if idxs == nil {
+		if file, lineNo, col, ok = r.PathLineCol(line); ok {
+			return file, lineNo, col, true
+		}
+	}
+	return "", 0, 0, false
+}
+
+// PathLineCol returns the rule's first match's file, line and column; ok is
+// false when it doesn't match or has no file group.
+func (r Rule) PathLineCol(line string) (file string, lineNo, col int, ok bool) {
+	idxs := r.Regex.FindStringSubmatchIndex(line)
+	if idxs == nil {
+		return "", 0, 0, false
+	}
+	l, ok := r.loc(line, idxs)
+	return l.File, l.Line, l.Col, ok
+}
+
+// Loc is a file:line:col found in a line; Span is its bytes in the line,
+// from the file to the end of the line or column number.
+type Loc struct {
+	File      string
+	Line, Col int
+	Span      [2]int
+}
+
+// Locs returns the file:line:col of every match of the rules with a file
+// group, ordered by position; a location overlapping an earlier one (of
+// another rule) is left out.
+func Locs(rs []Rule, line string) []Loc {
+	var locs []Loc
+	for _, r := range rs {
+		if r.FileGroup <= 0 {
 			continue
 		}
-		get := func(g int) (string, bool) {
-			if g <= 0 {
-				return "", false
+		for _, idxs := range r.Regex.FindAllStringSubmatchIndex(line, -1) {
+			if l, ok := r.loc(line, idxs); ok {
+				locs = append(locs, l)
 			}
-			i := 2 * g
-			if i+1 >= len(idxs) || idxs[i] < 0 || idxs[i+1] < 0 {
-				return "", false
-			}
-			return line[idxs[i]:idxs[i+1]], true
 		}
-		if file, ok = get(r.FileGroup); !ok {
-			continue
+	}
+	sort.SliceStable(locs, func(i, j int) bool { return locs[i].Span[0] < locs[j].Span[0] })
+	out := locs[:0]
+	for _, l := range locs {
+		if len(out) == 0 || l.Span[0] >= out[len(out)-1].Span[1] {
+			out = append(out, l)
 		}
-		if s, ok2 := get(r.LineGroup); ok2 {
-			lineNo, _ = atoiSafe(s)
+	}
+	return out
+}
+
+// loc reads the groups of the match idxs of r in line.
+func (r Rule) loc(line string, idxs []int) (Loc, bool) {
+	get := func(g int) (string, bool) {
+		if g <= 0 {
+			return "", false
 		}
-		if s, ok2 := get(r.ColumnGroup); ok2 {
-			col, _ = atoiSafe(s)
+		i := 2 * g
+		if i+1 >= len(idxs) || idxs[i] < 0 || idxs[i+1] < 0 {
+			return "", false
 		}
-		return file, lineNo, col, true
+		return line[idxs[i]:idxs[i+1]], true
 	}
-	return "", 0, 0, false
+	var l Loc
+	var ok bool
+	if l.File, ok = get(r.FileGroup); !ok {
+		return Loc{}, false
+	}
+	l.Span = [2]int{idxs[2*r.FileGroup], idxs[2*r.FileGroup+1]}
+	if s, ok := get(r.LineGroup); ok {
+		l.Line, _ = atoiSafe(s)
+		l.Span[1] = max(l.Span[1], idxs[2*r.LineGroup+1])
+	}
+	if s, ok := get(r.ColumnGroup); ok {
+		l.Col, _ = atoiSafe(s)
+		l.Span[1] = max(l.Span[1], idxs[2*r.ColumnGroup+1])
+	}
+	return l, true
 }
 
 func atoiSafe(s string) (int, error) {
@@ -0,0 +1,106 @@
+package tmux
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Modes names where Launch opens a command: a popup over the current pane
+// (tmux >= 3.2), a pane split off below or to the right of it, or a new
+// window.
+var Modes = []string{"popup", "split-below", "split-right", "window"}
+
+// Launch says where and how big a command opens in tmux.
+type Launch struct {
+	Mode   string // one of Modes
+	Width  string // N cells or N% (popup, split-right); "" is tmux's default
+	Height string // N cells or N% (popup, split-below)
+	// Title is set as the pane's title; with Reuse, a pane already titled
+	// so runs the command instead of a new one (not for popups).
+	Title string
+	Reuse bool
+}
+
+// CheckSize reports whether s is a size tmux takes: N or N%.
+func CheckSize(s string) error {
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || n <= 0 || (strings.HasSuffix(s, "%") && n > 100) {
+		return fmt.Errorf("%q: want N (cells) or N%% (1-100)", s)
+	}
+	return nil
+}
+
+// Argv returns the tmux command opening cmd (a shell command line) in a new
+// popup, pane or window; with -P it prints the new pane's id.
+func (l Launch) Argv(cmd string) ([]string, error) {
+	size := func(flag, v string) []string {
+		if v == "" {
+			return nil
+		}
+		return []string{flag, v}
+	}
+	var argv []string
+	switch l.Mode {
+	case "popup":
+		argv = append([]string{"tmux", "display-popup", "-E"}, size("-w", l.Width)...)
+		argv = append(argv, size("-h", l.Height)...)
+	case "split-below":
+		argv = append([]string{"tmux", "split-window", "-v", "-P", "-F", "#{pane_id}"}, size("-l", l.Height)...)
+	case "split-right":
+		argv = append([]string{"tmux", "split-window", "-h", "-P", "-F", "#{pane_id}"}, size("-l", l.Width)...)
+	case "window":
+		argv = []string{"tmux", "new-window", "-P", "-F", "#{pane_id}"}
+	default:
+		return nil, fmt.Errorf("tmux: unknown mode %q (have %s)", l.Mode, strings.Join(Modes, ", "))
+	}
+	return append(argv, cmd), nil
+}
+
+// Respawn returns the tmux command running cmd in pane instead of what runs
+// there, and switching to it.
+func Respawn(pane, cmd string) []string {
+	return []string{"tmux", "respawn-pane", "-k", "-t", pane, cmd,
+		";", "select-window", "-t", pane,
+		";", "select-pane", "-t", pane}
+}
+
+// FindPane returns the id of a pane (of any session) titled title.
+func FindPane(title string) (string, bool) {
+	out, err := exec.Command("tmux", "list-panes", "-a", "-F", "#{pane_id}\t#{pane_title}").Output()
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if id, t, ok := strings.Cut(line, "\t"); ok && t == title {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// Start opens cmd as l says and titles its pane.
+func (l Launch) Start(cmd string) error {
+	if l.Reuse && l.Mode != "popup" && l.Title != "" {
+		if pane, ok := FindPane(l.Title); ok {
+			return exec.Command("tmux", Respawn(pane, cmd)[1:]...).Run()
+		}
+	}
+	argv, err := l.Argv(cmd)
+	if err != nil {
+		return err
+	}
+	c := exec.Command(argv[0], argv[1:]...)
+	if l.Mode == "popup" {
+		return c.Start() // -E: display-popup returns when cmd exits
+	}
+	out, err := c.Output()
+	if err != nil {
+		return fmt.Errorf("tmux %s: %w", argv[1], err)
+	}
+	if pane := strings.TrimSpace(string(out)); pane != "" && l.Title != "" {
+		return exec.Command("tmux", "select-pane", "-t", pane, "-T", l.Title).Run()
+	}
+	return nil
+}
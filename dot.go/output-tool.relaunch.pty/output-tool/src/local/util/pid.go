@@ -0,0 +1,12 @@
+package util
+
+import "syscall"
+
+// PIDAlive reports whether pid exists (EPERM means it does, just not ours).
+func PIDAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
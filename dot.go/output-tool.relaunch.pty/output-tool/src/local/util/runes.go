@@ -2,13 +2,16 @@ package util
 
 import "unicode/utf8"
 
-// ByteToRuneIndexMap returns mapping from byte offset -> rune index.
+// ByteToRuneIndexMap returns mapping from byte offset -> rune index: every
+// byte of a rune maps to the rune's index, len(s) to the rune count.
 func ByteToRuneIndexMap(s string) []int {
 	mapIdx := make([]int, 0, len(s)+1)
 	rpos := 0
 	for i := 0; i < len(s); {
-		mapIdx = append(mapIdx, rpos)
 		_, size := utf8.DecodeRuneInString(s[i:])
+		for j := 0; j < size; j++ {
+			mapIdx = append(mapIdx, rpos)
+		}
 		i += size
 		rpos++
 	}
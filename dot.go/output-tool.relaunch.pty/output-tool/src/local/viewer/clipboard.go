@@ -0,0 +1,45 @@
+package viewer
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// copyText puts s on the clipboard. OSC 52 goes to the terminal (it works
+// over ssh, but some terminals ignore it), so wl-copy or xclip also get it
+// when there is a display to copy to. It returns the ways used.
+func copyText(s string) ([]string, error) {
+	var used []string
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err == nil {
+		_, err = tty.WriteString("\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(s)) + "\a")
+		_ = tty.Close()
+	}
+	if err == nil {
+		used = append(used, "osc52")
+	}
+	var argv []string
+	switch {
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		argv = []string{"wl-copy"}
+	case os.Getenv("DISPLAY") != "":
+		argv = []string{"xclip", "-selection", "clipboard"}
+	}
+	if len(argv) > 0 {
+		if _, lerr := exec.LookPath(argv[0]); lerr == nil {
+			cmd := exec.Command(argv[0], argv[1:]...)
+			cmd.Stdin = strings.NewReader(s)
+			if rerr := cmd.Run(); rerr == nil {
+				used = append(used, argv[0])
+			} else if err == nil {
+				err = rerr
+			}
+		}
+	}
+	if len(used) > 0 {
+		return used, nil
+	}
+	return nil, err
+}
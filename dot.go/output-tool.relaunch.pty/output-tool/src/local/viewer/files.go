@@ -0,0 +1,166 @@
+package viewer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gdamore/tcell/v2"
+	"local/makedir"
+	"local/rules"
+)
+
+// fileSum is a row of the g pane: a file named by match lines.
+type fileSum struct {
+	File  string
+	Lines int            // match lines naming it
+	Sev   rules.Severity // highest severity of those lines
+	First int            // N of the first of them
+}
+
+// summarize groups the match lines of all by the file their rules extract
+// (relative paths resolved against make's directory for the line).
+func summarize(all []rec, rs []rules.Rule) []fileSum {
+	idx := map[string]int{}
+	var out []fileSum
+	for _, x := range all {
+		if !x.M {
+			continue
+		}
+		file, _, _, ok := rules.ExtractPathLineCol(rs, x.Text)
+		if !ok {
+			continue
+		}
+		file = makedir.Resolve(x.Dir, file)
+		sev, _ := rules.LineSeverity(rs, x.Text)
+		i, seen := idx[file]
+		if !seen {
+			i = len(out)
+			idx[file] = i
+			out = append(out, fileSum{File: file, Sev: sev, First: x.N})
+		}
+		out[i].Lines++
+		out[i].Sev = max(out[i].Sev, sev)
+	}
+	return out
+}
+
+// filesPane lists the files of the match lines with their counts, by count
+// or by severity (s toggles); Enter jumps to the file's first match.
+type filesPane struct {
+	open  bool
+	list  []fileSum
+	cur   int
+	top   int
+	bySev bool
+}
+
+// refresh rebuilds the list, keeping the selected file selected.
+func (p *filesPane) refresh(all []rec, rs []rules.Rule) {
+	file := p.selected()
+	p.list = summarize(all, rs)
+	p.sort()
+	p.selectFile(file)
+}
+
+func (p *filesPane) selected() string {
+	if p.cur < len(p.list) {
+		return p.list[p.cur].File
+	}
+	return ""
+}
+
+func (p *filesPane) selectFile(file string) {
+	p.cur = 0
+	for i, f := range p.list {
+		if f.File == file {
+			p.cur = i
+		}
+	}
+}
+
+func (p *filesPane) sort() {
+	sort.SliceStable(p.list, func(i, j int) bool {
+		a, b := p.list[i], p.list[j]
+		if p.bySev && a.Sev != b.Sev {
+			return a.Sev > b.Sev
+		}
+		if a.Lines != b.Lines {
+			return a.Lines > b.Lines
+		}
+		if !p.bySev && a.Sev != b.Sev {
+			return a.Sev > b.Sev
+		}
+		return a.File < b.File
+	})
+}
+
+func (p *filesPane) sortName() string {
+	if p.bySev {
+		return "severity"
+	}
+	return "count"
+}
+
+// key handles a key while the pane is open. It returns the line to jump to
+// (the pane then closes) and whether there is one.
+func (p *filesPane) key(e *tcell.EventKey, rowsVis int) (int, bool) {
+	switch e.Key() {
+	case tcell.KeyEsc:
+		p.open = false
+	case tcell.KeyEnter:
+		if p.cur < len(p.list) {
+			p.open = false
+			return p.list[p.cur].First, true
+		}
+	case tcell.KeyUp:
+		p.cur--
+	case tcell.KeyDown:
+		p.cur++
+	case tcell.KeyPgUp:
+		p.cur -= rowsVis
+	case tcell.KeyPgDn:
+		p.cur += rowsVis
+	case tcell.KeyHome:
+		p.cur = 0
+	case tcell.KeyEnd:
+		p.cur = len(p.list) - 1
+	case tcell.KeyRune:
+		switch e.Rune() {
+		case 'g', 'q':
+			p.open = false
+		case 's':
+			file := p.selected()
+			p.bySev = !p.bySev
+			p.sort()
+			p.selectFile(file)
+		}
+	}
+	p.cur = max(min(p.cur, len(p.list)-1), 0)
+	return 0, false
+}
+
+// draw fills rows [bodyTop, bodyTop+rowsVis) with the list.
+func (p *filesPane) draw(screen tcell.Screen, bodyTop, rowsVis, w int, normal, cursor tcell.Style, sevStyle []tcell.Style) {
+	if p.cur < p.top {
+		p.top = p.cur
+	}
+	if p.cur >= p.top+rowsVis {
+		p.top = p.cur - rowsVis + 1
+	}
+	if len(p.list) == 0 {
+		drawLine(screen, 0, bodyTop, w, " no match line names a file", normal)
+		return
+	}
+	for row := 0; row < rowsVis && p.top+row < len(p.list); row++ {
+		i := p.top + row
+		f := p.list[i]
+		st := normal
+		if i == p.cur {
+			st = cursor
+		}
+		y := bodyTop + row
+		drawLine(screen, 0, y, w, fmt.Sprintf(" %6d  %-8s %s", f.Lines, "", f.File), st)
+		// the severity in its match color
+		drawText(screen, 9, y, f.Sev.String(), sevStyle[f.Sev])
+	}
+}
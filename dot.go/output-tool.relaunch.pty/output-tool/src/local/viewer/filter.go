@@ -0,0 +1,64 @@
+package viewer
+
+// filter is what the view shows of the capture: match lines only (f) and
+// one stream of an --exec capture (s).
+type filter struct {
+	matchesOnly bool
+	stream      string // "" both, "out" or "err"
+}
+
+// none reports whether the filter shows every record.
+func (f filter) none() bool { return !f.matchesOnly && f.stream == "" }
+
+// of returns the records of recs the filter shows, in order.
+func (f filter) of(recs []rec) []rec {
+	if f.none() {
+		return recs
+	}
+	out := make([]rec, 0, len(recs)/4)
+	for _, x := range recs {
+		if f.matchesOnly && !x.M {
+			continue
+		}
+		if f.stream != "" && x.Stream != f.stream {
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// nextStream cycles the stream filter: both, out, err.
+func nextStream(s string) string {
+	switch s {
+	case "":
+		return "out"
+	case "out":
+		return "err"
+	}
+	return ""
+}
+
+// hasStreams reports whether recs carry stream tags (--exec captures).
+func hasStreams(recs []rec) bool {
+	for _, x := range recs {
+		if x.Stream != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestLine is the index in recs (ordered by N) of line n, else of the
+// closest line before it, else 0; it keeps the cursor put across a filter
+// toggle.
+func nearestLine(recs []rec, n int) int {
+	best := 0
+	for i, x := range recs {
+		if x.N > n {
+			break
+		}
+		best = i
+	}
+	return best
+}
@@ -0,0 +1,120 @@
+package viewer
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"local/capture"
+	"local/util"
+)
+
+// followEvent carries records appended to the capture since the last poll.
+// meta is set once the producer has finished (its meta no longer live).
+type followEvent struct {
+	tcell.EventTime
+	fol  *capture.Follower // the capture it is from (stale after a Rerun)
+	recs []rec
+	meta *capture.Meta
+	err  error
+}
+
+// Rerun is a capture of the same command to show instead of the current
+// one, which it supersedes (exec --watch). Note, if any, is logged; without
+// a CapturePath there is only the note.
+type Rerun struct {
+	CapturePath string
+	MetaPath    string
+	Note        string
+}
+
+// rerunEvent delivers a Rerun to the viewer loop.
+type rerunEvent struct {
+	tcell.EventTime
+	Rerun
+}
+
+// forwardReruns posts the reruns received until quit is closed.
+func forwardReruns(screen tcell.Screen, reruns <-chan Rerun, quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case r := <-reruns:
+			ev := &rerunEvent{Rerun: r}
+			ev.SetEventNow()
+			for screen.PostEvent(ev) != nil {
+				select {
+				case <-quit:
+					return
+				case <-time.After(followPoll):
+				}
+			}
+		}
+	}
+}
+
+const followPoll = 200 * time.Millisecond
+
+// follow tails fol until quit is closed or the producer is done. The producer
+// is done when metaPath is rewritten with live=false, or when its owner PID
+// is gone; without a metaPath it follows until the viewer quits.
+func follow(screen tcell.Screen, fol *capture.Follower, metaPath string, ownerPID int, quit <-chan struct{}) {
+	t := time.NewTicker(followPoll)
+	defer t.Stop()
+	var pending []rec
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+		}
+		ev := &followEvent{fol: fol}
+		rows, err := fol.Next()
+		for _, x := range rows {
+			pending = append(pending, newRec(x))
+		}
+		ev.err = err
+		if metaPath != "" {
+			if m, ok := readMeta(metaPath); ok && !m.Live {
+				// the final flush happened before the meta was rewritten
+				rows, _ := fol.Next()
+				for _, x := range rows {
+					pending = append(pending, newRec(x))
+				}
+				ev.meta = m
+			} else if ownerPID > 0 && !util.PIDAlive(ownerPID) {
+				ev.meta = &capture.Meta{}
+				if ok {
+					*ev.meta = *m
+				}
+				ev.meta.Live = false
+			}
+		}
+		if len(pending) == 0 && ev.meta == nil && ev.err == nil {
+			continue
+		}
+		ev.recs = pending
+		ev.SetEventNow()
+		if screen.PostEvent(ev) != nil {
+			continue // queue full; keep pending for the next tick
+		}
+		pending = nil
+		if ev.meta != nil {
+			return
+		}
+	}
+}
+
+func readMeta(path string) (*capture.Meta, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var m capture.Meta
+	if json.Unmarshal(b, &m) != nil {
+		return nil, false
+	}
+	return &m, true
+}
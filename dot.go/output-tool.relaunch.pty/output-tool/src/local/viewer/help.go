@@ -0,0 +1,118 @@
+package viewer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"local/capture"
+)
+
+// helpKeys are the keys listed by the ? overlay.
+var helpKeys = [][2]string{
+	{"↑/↓ PgUp/PgDn Home/End", "move"},
+	{"←/→ (Shift: half screen)", "scroll sideways (without wrap)"},
+	{"Enter, double-click", "open the line's file:line:col in the editor"},
+	{"/", "search (regexp); Enter keeps it, Esc drops it"},
+	{"n / N", "next / previous search hit"},
+	{"f", "filter: match lines only, or all lines"},
+	{"s", "stream: both, stdout, stderr (--exec captures)"},
+	{"w", "soft-wrap long lines"},
+	{"F", "follow: keep the cursor on the last line"},
+	{"g", "files of the matches; Enter jumps to the first"},
+	{"m", "mark / unmark the line"},
+	{"' / \"", "next / previous mark"},
+	{"y / Y", "copy the line / its match"},
+	{"x", "write the match lines as a quickfix file"},
+	{"M", "mouse on/off (off: the terminal selects text)"},
+	{"?", "this help"},
+	{"q, Esc", "quit"},
+}
+
+// helpLines are the rows of the ? overlay: the keys, then flags (the state
+// of the toggles).
+func helpLines(flags []string) []string {
+	kw := 0
+	for _, k := range helpKeys {
+		kw = max(kw, textWidth(k[0]))
+	}
+	lines := make([]string, 0, len(helpKeys)+4)
+	for _, k := range helpKeys {
+		lines = append(lines, fmt.Sprintf("%s%s  %s", k[0], strings.Repeat(" ", kw-textWidth(k[0])), k[1]))
+	}
+	return append(lines, "", strings.Join(flags, "  "), "", "any key closes")
+}
+
+// helpFlags is the state of the toggles, for the ? overlay; live: the
+// capture is followed.
+func helpFlags(opts Options, meta *capture.Meta, flt filter, wrap, live, following, autoScroll bool) []string {
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+	filterState := onOff(flt.matchesOnly)
+	if meta != nil && meta.Filtered {
+		filterState = "on (capture)"
+	}
+	stream := flt.stream
+	if stream == "" {
+		stream = "both"
+	}
+	follow := "n/a"
+	switch {
+	case live && !following:
+		follow = "done"
+	case live:
+		follow = onOff(autoScroll)
+	}
+	return []string{
+		"mouse:" + onOff(opts.Mouse),
+		"filter:" + filterState,
+		"stream:" + stream,
+		"wrap:" + onOff(wrap),
+		"follow:" + follow,
+	}
+}
+
+// drawHelp draws the ? overlay in a box centered over rows [bodyTop,
+// bodyBottom), cut to fit.
+func drawHelp(screen tcell.Screen, bodyTop, bodyBottom, w int, flags []string, frame, body tcell.Style) {
+	lines := helpLines(flags)
+	bw := 0
+	for _, l := range lines {
+		bw = max(bw, textWidth(l))
+	}
+	bw = min(bw+4, w)                           // border and a space each side
+	bh := min(len(lines)+2, bodyBottom-bodyTop) // borders
+	x0, y0 := (w-bw)/2, bodyTop+(bodyBottom-bodyTop-bh)/2
+	if bw < 4 || bh < 3 {
+		return
+	}
+	for y := y0; y < y0+bh; y++ {
+		for x := x0; x < x0+bw; x++ {
+			r, st := ' ', body
+			switch {
+			case y == y0 && x == x0:
+				r, st = '┌', frame
+			case y == y0 && x == x0+bw-1:
+				r, st = '┐', frame
+			case y == y0+bh-1 && x == x0:
+				r, st = '└', frame
+			case y == y0+bh-1 && x == x0+bw-1:
+				r, st = '┘', frame
+			case y == y0 || y == y0+bh-1:
+				r, st = '─', frame
+			case x == x0 || x == x0+bw-1:
+				r, st = '│', frame
+			}
+			screen.SetContent(x, y, r, nil, st)
+		}
+	}
+	drawText(screen, x0+2, y0, " keys ", frame)
+	for i, l := range lines[:bh-2] {
+		drawText(screen, x0+2, y0+1+i, truncateTo(l, bw-4), body)
+	}
+}
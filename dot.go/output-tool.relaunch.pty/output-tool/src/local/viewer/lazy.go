@@ -0,0 +1,108 @@
+package viewer
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"local/capture"
+)
+
+// lazyMin is the capture size from which the viewer keeps only match lines
+// whole and reads the text of the others when they are shown or searched.
+const lazyMin = 64 << 20
+
+// lazyCache bounds the texts a lineStore keeps loaded.
+const lazyCache = 4096
+
+// lazyWindow is how much of the capture a lineStore reads at once, so a
+// search going through the lines reads it in large pieces.
+const lazyWindow = 1 << 20
+
+// lineStore reads the text of lazy records back from the capture.
+type lineStore struct {
+	f      *os.File
+	cache  map[int64]rec
+	win    []byte // the capture from winOff
+	winOff int64
+}
+
+// openLazy indexes the capture at path for on-demand loading; n is the
+// number of records expected, if known.
+func openLazy(path string, n int) (*lineStore, []rec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	all := make([]rec, 0, n)
+	err = capture.Index(path, func(x capture.Rec, off int64) {
+		if x.M {
+			all = append(all, newRec(x))
+			return
+		}
+		all = append(all, rec{N: x.N, Stream: x.Stream, Count: x.Count, lazy: true, off: off})
+	})
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &lineStore{f: f, cache: map[int64]rec{}}, all, nil
+}
+
+func (s *lineStore) Close() error { return s.f.Close() }
+
+// load returns r with its text; records that are not lazy (and any with a
+// nil store) are returned as is. A record that can't be read shows the error.
+func (s *lineStore) load(r rec) rec {
+	if s == nil || !r.lazy {
+		return r
+	}
+	if c, ok := s.cache[r.off]; ok {
+		return c
+	}
+	x, err := s.read(r.off)
+	if err != nil {
+		x = capture.Rec{N: r.N, Text: "<capture: " + err.Error() + ">"}
+	}
+	if len(s.cache) >= lazyCache {
+		clear(s.cache)
+	}
+	c := newRec(x)
+	c.Stream = r.Stream
+	s.cache[r.off] = c
+	return c
+}
+
+// read decodes the record at off, through the window around it.
+func (s *lineStore) read(off int64) (capture.Rec, error) {
+	var x capture.Rec
+	if line, ok := s.window(off); ok {
+		err := json.Unmarshal(line, &x)
+		return x, err
+	}
+	// refill, half before off for searching backwards
+	if s.win == nil {
+		s.win = make([]byte, lazyWindow)
+	}
+	s.winOff = max(off-lazyWindow/2, 0)
+	n, _ := s.f.ReadAt(s.win[:cap(s.win)], s.winOff)
+	s.win = s.win[:n]
+	if line, ok := s.window(off); ok {
+		err := json.Unmarshal(line, &x)
+		return x, err
+	}
+	return capture.ReadAt(s.f, off) // longer than the window
+}
+
+// window returns the line at off if the window holds all of it.
+func (s *lineStore) window(off int64) ([]byte, bool) {
+	if off < s.winOff || off >= s.winOff+int64(len(s.win)) {
+		return nil, false
+	}
+	rest := s.win[off-s.winOff:]
+	i := bytes.IndexByte(rest, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	return rest[:i], true
+}
@@ -0,0 +1,19 @@
+package viewer
+
+// Bookmarks are kept by line number, so they survive f and follow updates.
+
+// nextMark returns the index of the first bookmarked record after cur in
+// direction dir (1 or -1), wrapping around once.
+func nextMark(recs []rec, marks map[int]bool, cur, dir int) (int, bool) {
+	n := len(recs)
+	if n == 0 || len(marks) == 0 {
+		return 0, false
+	}
+	for k := 1; k <= n; k++ {
+		i := ((cur+dir*k)%n + n) % n
+		if marks[recs[i].N] {
+			return i, true
+		}
+	}
+	return 0, false
+}
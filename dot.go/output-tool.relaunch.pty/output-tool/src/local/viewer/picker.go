@@ -0,0 +1,63 @@
+package viewer
+
+import (
+	"github.com/gdamore/tcell/v2"
+)
+
+// picker lists the files a match's path could mean when editing found more
+// than one; Enter edits the line's location in the chosen file.
+type picker struct {
+	open  bool
+	r     rec // the line being edited
+	name  string
+	files []string
+	cur   int
+	top   int
+}
+
+// key handles a key while the picker is open. It returns the chosen file
+// (the picker then closes) and whether there is one.
+func (p *picker) key(e *tcell.EventKey, rowsVis int) (string, bool) {
+	switch e.Key() {
+	case tcell.KeyEsc:
+		p.open = false
+	case tcell.KeyEnter:
+		p.open = false
+		return p.files[p.cur], true
+	case tcell.KeyUp:
+		p.cur--
+	case tcell.KeyDown:
+		p.cur++
+	case tcell.KeyPgUp:
+		p.cur -= rowsVis
+	case tcell.KeyPgDn:
+		p.cur += rowsVis
+	case tcell.KeyHome:
+		p.cur = 0
+	case tcell.KeyEnd:
+		p.cur = len(p.files) - 1
+	case tcell.KeyRune:
+		if e.Rune() == 'q' {
+			p.open = false
+		}
+	}
+	p.cur = max(min(p.cur, len(p.files)-1), 0)
+	return "", false
+}
+
+// draw fills rows [bodyTop, bodyTop+rowsVis) with the candidates.
+func (p *picker) draw(screen tcell.Screen, bodyTop, rowsVis, w int, normal, cursor tcell.Style) {
+	if p.cur < p.top {
+		p.top = p.cur
+	}
+	if p.cur >= p.top+rowsVis {
+		p.top = p.cur - rowsVis + 1
+	}
+	for row := 0; row < rowsVis && p.top+row < len(p.files); row++ {
+		st := normal
+		if p.top+row == p.cur {
+			st = cursor
+		}
+		drawLine(screen, 0, bodyTop+row, w, " "+p.files[p.top+row], st)
+	}
+}
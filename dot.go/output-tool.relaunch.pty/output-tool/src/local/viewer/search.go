@@ -0,0 +1,170 @@
+package viewer
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"local/util"
+)
+
+// searchHistory is how many accepted patterns the / prompt remembers.
+const searchHistory = 50
+
+// search is the / prompt: the pattern is a regexp (taken literally when it
+// doesn't compile), case-insensitive unless it has an upper-case letter.
+// Hits are highlighted while typing; n/N jump between lines with hits.
+type search struct {
+	prompt  bool   // the prompt is open
+	input   []rune // pattern being typed
+	re      *regexp.Regexp
+	origin  int      // cursor when the prompt opened; Esc returns there
+	history []string // oldest first
+	hist    int      // history entry shown by Up/Down; len(history) = input
+	saved   []rune   // input typed before browsing history
+}
+
+func compileSearch(p string) *regexp.Regexp {
+	if p == "" {
+		return nil
+	}
+	prefix := "(?i)"
+	if strings.IndexFunc(p, unicode.IsUpper) >= 0 {
+		prefix = ""
+	}
+	re, err := regexp.Compile(prefix + p)
+	if err != nil {
+		re = regexp.MustCompile(prefix + regexp.QuoteMeta(p))
+	}
+	return re
+}
+
+func (s *search) open(cur int) {
+	s.prompt = true
+	s.input = s.input[:0]
+	s.saved = nil
+	s.origin = cur
+	s.hist = len(s.history)
+}
+
+// key handles a key while the prompt is open and returns the new cursor.
+func (s *search) key(e *tcell.EventKey, recs []rec, ls *lineStore, cur int) int {
+	switch e.Key() {
+	case tcell.KeyEsc, tcell.KeyCtrlC:
+		s.prompt = false
+		s.re = nil
+		return s.origin
+	case tcell.KeyEnter:
+		s.prompt = false
+		if len(s.input) == 0 {
+			return cur
+		}
+		s.remember(string(s.input))
+		return cur
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(s.input) == 0 {
+			s.prompt = false
+			s.re = nil
+			return s.origin
+		}
+		s.input = s.input[:len(s.input)-1]
+	case tcell.KeyCtrlU:
+		s.input = s.input[:0]
+	case tcell.KeyUp:
+		if s.hist == 0 {
+			return cur
+		}
+		if s.hist == len(s.history) {
+			s.saved = append(s.saved[:0], s.input...)
+		}
+		s.hist--
+		s.input = []rune(s.history[s.hist])
+	case tcell.KeyDown:
+		if s.hist >= len(s.history) {
+			return cur
+		}
+		s.hist++
+		if s.hist == len(s.history) {
+			s.input = append(s.input[:0], s.saved...)
+		} else {
+			s.input = []rune(s.history[s.hist])
+		}
+	case tcell.KeyRune:
+		s.input = append(s.input, e.Rune())
+	default:
+		return cur
+	}
+	// incremental: the first hit at or after where the prompt was opened
+	s.re = compileSearch(string(s.input))
+	if s.re == nil {
+		return s.origin
+	}
+	if i, ok := findHit(recs, ls, s.re, s.origin, 1); ok {
+		return i
+	}
+	return s.origin
+}
+
+// remember appends p to the history ring, moving a repeat to the end.
+func (s *search) remember(p string) {
+	for i, h := range s.history {
+		if h == p {
+			s.history = append(s.history[:i], s.history[i+1:]...)
+			break
+		}
+	}
+	s.history = append(s.history, p)
+	if len(s.history) > searchHistory {
+		s.history = s.history[len(s.history)-searchHistory:]
+	}
+}
+
+// findHit returns the first record from start (inclusive) in direction dir
+// (1 or -1) whose text matches re, wrapping around once.
+func findHit(recs []rec, ls *lineStore, re *regexp.Regexp, start, dir int) (int, bool) {
+	n := len(recs)
+	if n == 0 || re == nil {
+		return 0, false
+	}
+	for k := 0; k < n; k++ {
+		i := ((start+dir*k)%n + n) % n
+		if re.MatchString(ls.load(recs[i]).Text) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// runeSpans converts byte spans [start,end) of text to rune spans.
+func runeSpans(text string, spans [][2]int) [][2]int {
+	if len(spans) == 0 {
+		return nil
+	}
+	mapIdx := util.ByteToRuneIndexMap(text)
+	out := make([][2]int, 0, len(spans))
+	for _, se := range spans {
+		startRune := util.ByteIndexToRuneIndex(mapIdx, se[0])
+		endRune := util.ByteIndexToRuneIndex(mapIdx, se[1])
+		if endRune < startRune {
+			endRune = startRune
+		}
+		out = append(out, [2]int{startRune, endRune})
+	}
+	return out
+}
+
+// searchSpans are the rune spans of re's hits in text (nil without re).
+func searchSpans(re *regexp.Regexp, text string) [][2]int {
+	if re == nil {
+		return nil
+	}
+	locs := re.FindAllStringIndex(text, -1)
+	spans := make([][2]int, 0, len(locs))
+	for _, l := range locs {
+		if l[1] > l[0] {
+			spans = append(spans, [2]int{l[0], l[1]})
+		}
+	}
+	return runeSpans(text, spans)
+}
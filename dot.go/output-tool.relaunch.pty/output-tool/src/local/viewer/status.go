@@ -3,6 +3,12 @@ package viewer
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
 	"local/capture"
 )
 
@@ -25,3 +31,65 @@ func buildTopStatus(meta *capture.Meta, counters Counters, shortcuts string) str
 	}
 	return base
 }
+
+// cmdMax bounds the command line shown in the top bar, in screen cells.
+const cmdMax = 48
+
+// execInfo describes an exec capture's command for the top bar: its command
+// line and directory, and once it has exited, its exit code and run time.
+func execInfo(meta *capture.Meta) string {
+	cmd := meta.Source.Arg
+	if len(meta.Argv) > 0 {
+		cmd = commandLine(meta.Argv)
+	}
+	if textWidth(cmd) > cmdMax {
+		cmd = truncateTo(cmd, cmdMax-1) + "…"
+	}
+	s := "cmd:" + cmd + "  "
+	if meta.Cwd != "" {
+		s += "cwd:" + homeRel(meta.Cwd) + "  "
+	}
+	if meta.Live {
+		return s
+	}
+	s += fmt.Sprintf("exit:%d  ", meta.ExitCode)
+	if meta.DurationMs > 0 {
+		d := time.Duration(meta.DurationMs) * time.Millisecond
+		if d >= time.Second {
+			d = d.Round(100 * time.Millisecond)
+		}
+		s += "time:" + d.String() + "  "
+	}
+	return s
+}
+
+// commandLine joins argv as a shell would need it, single-quoting arguments
+// that are empty or hold anything but plain word characters.
+func commandLine(argv []string) string {
+	parts := make([]string, len(argv))
+	for i, a := range argv {
+		if a != "" && strings.IndexFunc(a, func(r rune) bool {
+			return !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./:=+,@%", r))
+		}) < 0 {
+			parts[i] = a
+			continue
+		}
+		parts[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(parts, " ")
+}
+
+// homeRel abbreviates a path under the home directory with ~.
+func homeRel(p string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" || home == "/" {
+		return p
+	}
+	if p == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(p, home+string(filepath.Separator)); ok {
+		return "~/" + rest
+	}
+	return p
+}
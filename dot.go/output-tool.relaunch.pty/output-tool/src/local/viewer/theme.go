@@ -0,0 +1,175 @@
+package viewer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Pair is a foreground/background color: a name tcell knows ("black",
+// "darkorange", "color208") or "#rrggbb". Empty keeps the terminal default.
+type Pair struct {
+	Fg string `toml:"fg"`
+	Bg string `toml:"bg"`
+}
+
+// Theme holds every color pair the viewer draws with, [themes.NAME] in the
+// config; pairs a theme leaves out come from the dark theme.
+type Theme struct {
+	Normal       Pair `toml:"normal"`        // plain lines
+	Stderr       Pair `toml:"stderr"`        // plain lines from the command's stderr (--exec)
+	Match        Pair `toml:"match"`         // rule matches (error severity)
+	Warning      Pair `toml:"warning"`       // rule matches of warning severity
+	Info         Pair `toml:"info"`          // rule matches of info severity
+	Search       Pair `toml:"search"`        // / hits
+	Cursor       Pair `toml:"cursor"`        // the cursor line
+	CursorMatch  Pair `toml:"cursor_match"`  // matches on the cursor line
+	Gutter       Pair `toml:"gutter"`        // line numbers, and the log pane reversed
+	GutterCursor Pair `toml:"gutter_cursor"` // the cursor line's number
+	Mark         Pair `toml:"mark"`          // bookmark sign in the gutter
+	TopBar       Pair `toml:"top_bar"`
+	BottomBar    Pair `toml:"bottom_bar"`
+}
+
+// DefaultTheme is used when none is selected.
+const DefaultTheme = "dark"
+
+// Themes are the built-in themes; config [themes.NAME] tables add to them or
+// replace them.
+var Themes = map[string]Theme{
+	"dark": {
+		Normal:       Pair{"white", "black"},
+		Stderr:       Pair{"lightsalmon", "black"},
+		Match:        Pair{"black", "green"},
+		Warning:      Pair{"black", "orange"},
+		Info:         Pair{"black", "teal"},
+		Search:       Pair{"black", "fuchsia"},
+		Cursor:       Pair{"black", "yellow"},
+		CursorMatch:  Pair{"black", "blue"},
+		Gutter:       Pair{"gray", "black"},
+		GutterCursor: Pair{"white", "blue"},
+		Mark:         Pair{"fuchsia", "black"},
+		TopBar:       Pair{"black", "green"},
+		BottomBar:    Pair{"black", "yellow"},
+	},
+	"light": {
+		Normal:       Pair{"black", "white"},
+		Stderr:       Pair{"firebrick", "white"},
+		Match:        Pair{"black", "lightgreen"},
+		Warning:      Pair{"black", "navajowhite"},
+		Info:         Pair{"black", "lightblue"},
+		Search:       Pair{"black", "violet"},
+		Cursor:       Pair{"black", "lightyellow"},
+		CursorMatch:  Pair{"white", "royalblue"},
+		Gutter:       Pair{"dimgray", "white"},
+		GutterCursor: Pair{"white", "royalblue"},
+		Mark:         Pair{"darkmagenta", "white"},
+		TopBar:       Pair{"black", "lightgreen"},
+		BottomBar:    Pair{"black", "lightyellow"},
+	},
+	"solarized": {
+		Normal:       Pair{"#839496", "#002b36"},
+		Stderr:       Pair{"#dc322f", "#002b36"},
+		Match:        Pair{"#002b36", "#859900"},
+		Warning:      Pair{"#002b36", "#cb4b16"},
+		Info:         Pair{"#002b36", "#2aa198"},
+		Search:       Pair{"#002b36", "#d33682"},
+		Cursor:       Pair{"#93a1a1", "#073642"},
+		CursorMatch:  Pair{"#fdf6e3", "#268bd2"},
+		Gutter:       Pair{"#586e75", "#002b36"},
+		GutterCursor: Pair{"#fdf6e3", "#268bd2"},
+		Mark:         Pair{"#d33682", "#002b36"},
+		TopBar:       Pair{"#002b36", "#859900"},
+		BottomBar:    Pair{"#002b36", "#b58900"},
+	},
+}
+
+// ThemeNames lists the built-in themes plus those in extra, sorted.
+func ThemeNames(extra map[string]Theme) []string {
+	var names []string
+	for n := range Themes {
+		if _, dup := extra[n]; !dup {
+			names = append(names, n)
+		}
+	}
+	for n := range extra {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupTheme returns the theme called name ("" is the default) from extra
+// or the built-ins, with pairs it leaves out taken from the dark theme.
+func LookupTheme(name string, extra map[string]Theme) (Theme, error) {
+	if name == "" {
+		name = DefaultTheme
+	}
+	t, ok := extra[name]
+	if !ok {
+		if t, ok = Themes[name]; !ok {
+			return Theme{}, fmt.Errorf("unknown theme %q (have %v)", name, ThemeNames(extra))
+		}
+	}
+	base := Themes[DefaultTheme]
+	for _, p := range []struct{ dst, src *Pair }{
+		{&t.Normal, &base.Normal}, {&t.Stderr, &base.Stderr}, {&t.Match, &base.Match}, {&t.Warning, &base.Warning},
+		{&t.Info, &base.Info}, {&t.Search, &base.Search}, {&t.Cursor, &base.Cursor},
+		{&t.CursorMatch, &base.CursorMatch}, {&t.Gutter, &base.Gutter},
+		{&t.GutterCursor, &base.GutterCursor}, {&t.Mark, &base.Mark},
+		{&t.TopBar, &base.TopBar}, {&t.BottomBar, &base.BottomBar},
+	} {
+		if *p.dst == (Pair{}) {
+			*p.dst = *p.src
+		}
+	}
+	return t, nil
+}
+
+// BadColor is a color of a theme that is not a name tcell knows, "colorN"
+// or "#rrggbb"; Key is the pair's, e.g. "normal.fg".
+type BadColor struct {
+	Key  string
+	Name string
+}
+
+// BadColors lists the colors of t that would draw as the terminal default.
+func (t Theme) BadColors() []BadColor {
+	var bad []BadColor
+	v := reflect.ValueOf(t)
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("toml")
+		p := v.Field(i).Interface().(Pair)
+		for _, c := range []struct{ key, name string }{{"fg", p.Fg}, {"bg", p.Bg}} {
+			if _, ok := color(c.name); !ok {
+				bad = append(bad, BadColor{key + "." + c.key, c.name})
+			}
+		}
+	}
+	return bad
+}
+
+// color resolves a Pair color; "" and "default" are the terminal's, and ok
+// is false for a name tcell does not know.
+func color(name string) (c tcell.Color, ok bool) {
+	if name == "" || name == "default" {
+		return tcell.ColorDefault, true
+	}
+	if rest, ok := strings.CutPrefix(name, "color"); ok {
+		if n, err := strconv.Atoi(rest); err == nil {
+			return tcell.PaletteColor(n), n >= 0 && n < 256
+		}
+	}
+	c = tcell.GetColor(name)
+	return c, c != tcell.ColorDefault
+}
+
+func (p Pair) style() tcell.Style {
+	fg, _ := color(p.Fg)
+	bg, _ := color(p.Bg)
+	return tcell.StyleDefault.Foreground(fg).Background(bg)
+}
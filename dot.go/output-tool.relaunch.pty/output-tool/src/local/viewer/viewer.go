@@ -1,6 +1,7 @@
 package viewer
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -9,51 +10,132 @@ import (
 	"time"
 
 	"github.com/gdamore/tcell/v2"
+	"local/ansi"
 	"local/capture"
+	"local/editor"
+	"local/quickfix"
 	"local/rules"
-	"local/util"
 )
 
 type Options struct {
-	Title         string `toml:"title"`
-	GutterWidth   int    `toml:"gutter_width"`
-	ShowTopBar    bool   `toml:"top_bar"`
-	ShowBottomBar bool   `toml:"bottom_bar"`
-	Mouse         bool   `toml:"mouse"`
-	NoAlt         bool   `toml:"no_alt"`
-	ErrLinesMax   int    `toml:"no_alt"`
+	Title         string           `toml:"title"`
+	GutterWidth   int              `toml:"gutter_width"`
+	ShowTopBar    bool             `toml:"top_bar"`
+	ShowBottomBar bool             `toml:"bottom_bar"`
+	Mouse         bool             `toml:"mouse"`
+	NoAlt         bool             `toml:"no_alt"`
+	ErrLinesMax   int              `toml:"err_lines"`
+	TabWidth      int              `toml:"tab_width"`       // columns between tab stops (0: DefaultTabWidth)
+	Follow        bool             `toml:"follow"`          // tail the capture while the producer is still writing
+	OnlyMatches   bool             `toml:"-"`               // start on match lines only; f shows all (unless filtered upstream)
+	Wrap          bool             `toml:"wrap"`            // soft-wrap long lines (w toggles)
+	MetaPath      string           `toml:"-"`               // with Follow: polled for live=false (producer done)
+	Quickfix      string           `toml:"-"`               // x writes the match lines here (default errors.err)
+	Theme         string           `toml:"theme,omitempty"` // built-in (dark, light, solarized) or [themes.NAME]
+	Themes        map[string]Theme `toml:"-"`               // the config's [themes.NAME] tables
+	Reruns        <-chan Rerun     `toml:"-"`               // with Follow: captures replacing the one shown (exec --watch)
 }
 
+// hscrollStep is how far Left/Right scroll; with Shift, half a screen.
+const hscrollStep = 4
+
 type Hooks struct {
 	// OnActivate is called when the user "edits" (Enter/e/E/etc.). It returns the argv used and an error, if any.
-	OnActivate func(lineText string) (argv []string, err error)
+	// dir is the make directory the line was printed in ("" if none); file
+	// is "" or the user's pick after an *editor.AmbiguousError.
+	OnActivate func(lineText, dir, file string) (argv []string, err error)
+	// Foreground: OnActivate runs a program in this terminal, so the screen
+	// is suspended around it.
+	Foreground bool
 }
 
+// rec is a capture record as shown: Text has escape sequences stripped (for
+// rules, search and the editor); Raw keeps them, when there were any, for
+// drawing the line in its colors. In a huge capture, non-match lines are
+// lazy: their text is read back from offset off when needed (lineStore.load).
 type rec struct {
-	N    int
-	Text string
-	M    bool
+	N      int
+	Text   string
+	Raw    string
+	M      bool
+	Dir    string
+	Stream string // --exec: "out" or "err"
+	Count  int    // --fold-dupes: identical lines this stands for (0: one)
+	lazy   bool
+	off    int64
 }
 
+func newRec(x capture.Rec) rec {
+	r := rec{N: x.N, Text: x.Text, M: x.M, Dir: x.Dir, Stream: x.Stream, Count: x.Count}
+	if ansi.Has(x.Text) {
+		r.Text, r.Raw = ansi.Strip(x.Text), x.Text
+	}
+	return r
+}
+
+// RunFromFile views the capture at capturePath (a .jsonl.gz is decompressed
+// as it is read, one of lazyMin bytes or more is indexed and read on demand).
 func RunFromFile(capturePath string, meta *capture.Meta, rs []rules.Rule, opts Options, hooks Hooks) error {
-	f, err := os.Open(capturePath)
+	if st, err := os.Stat(capturePath); err == nil && !opts.Follow &&
+		!capture.Compressed(capturePath) && st.Size() >= lazyMin {
+		n := 0
+		if meta != nil {
+			n = meta.LinesTotal
+			if meta.Filtered {
+				n = meta.MatchLines
+			}
+		}
+		ls, all, err := openLazy(capturePath, n)
+		if err != nil {
+			return err
+		}
+		defer ls.Close()
+		return run(all, nil, ls, meta, rs, opts, hooks)
+	}
+	if opts.Follow {
+		f, err := os.Open(capturePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fol := capture.NewFollower(f)
+		rows, err := fol.Next()
+		if err != nil {
+			return err
+		}
+		return run(recsOf(rows), fol, nil, meta, rs, opts, hooks)
+	}
+	r, err := capture.Open(capturePath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return runFromReader(f, meta, rs, opts, hooks)
+	defer r.Close()
+	return runFromReader(r, meta, rs, opts, hooks)
 }
 
 func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Options, hooks Hooks) error {
-
 	rows, err := capture.ReadAllFromReader(r)
 	if err != nil {
 		return err
 	}
-	recs := make([]rec, 0, len(rows))
+	return run(recsOf(rows), nil, nil, meta, rs, opts, hooks)
+}
+
+func recsOf(rows []capture.Rec) []rec {
+	all := make([]rec, 0, len(rows))
 	for _, x := range rows {
-		recs = append(recs, rec{N: x.N, Text: x.Text, M: x.M})
+		all = append(all, newRec(x))
 	}
+	return all
+}
+
+// run is the viewer loop over all, the capture as loaded. With fol != nil,
+// records appended to the capture arrive as followEvents until the producer
+// is done; with ls != nil, lazy records are loaded from it.
+func run(all []rec, fol *capture.Follower, ls *lineStore, meta *capture.Meta, rs []rules.Rule, opts Options, hooks Hooks) error {
+	// recs is what is shown (all, or matches with f)
+	flt := filter{matchesOnly: opts.OnlyMatches}
+	recs := flt.of(all)
 
 	screen, err := tcell.NewScreen()
 	if err != nil {
@@ -70,14 +152,32 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 		screen.DisableMouse()
 	}
 
-	normalStyle := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
-	matchStyle := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorGreen)
-	cursorStyle := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorYellow)
-	cursorMatchStyle := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorBlue)
-	gutterStyle := tcell.StyleDefault.Foreground(tcell.ColorGray).Background(tcell.ColorBlack)
-	gutterCursor := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlue)
-	topStyle := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorGreen)
-	botStyle := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorYellow)
+	th, err := LookupTheme(opts.Theme, opts.Themes)
+	if err != nil {
+		return err
+	}
+	normalStyle := th.Normal.style()
+	matchStyle := th.Match.style()
+	cursorStyle := th.Cursor.style()
+	cursorMatchStyle := th.CursorMatch.style()
+	gutterStyle := th.Gutter.style()
+	gutterCursor := th.GutterCursor.style()
+	topStyle := th.TopBar.style()
+	botStyle := th.BottomBar.style()
+	searchStyle := th.Search.style()
+	markStyle := th.Mark.style().Bold(true)
+	stderrStyle := th.Stderr.style()
+	// match spans and the gutter number of match lines, by the line's severity
+	sevStyle := [...]tcell.Style{
+		rules.Info:    th.Info.style(),
+		rules.Warning: th.Warning.style(),
+		rules.Error:   matchStyle,
+	}
+	sevGutter := [...]tcell.Style{
+		rules.Info:    gutterStyle.Foreground(tcell.GetColor(th.Info.Bg)),
+		rules.Warning: gutterStyle.Foreground(tcell.GetColor(th.Warning.Bg)),
+		rules.Error:   gutterStyle.Foreground(tcell.GetColor(th.Match.Bg)),
+	}
 
 	gw := opts.GutterWidth
 	if gw < 3 {
@@ -86,6 +186,39 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 
 	cur := 0
 	top := 0
+	var sr search
+	var fp filesPane        // g: matches grouped by file
+	marks := map[int]bool{} // bookmarked line numbers (m toggles)
+
+	// follow mode: autoScroll keeps the cursor on the last line, like less +F
+	following := fol != nil
+	autoScroll := following
+	if following {
+		if meta == nil {
+			meta = &capture.Meta{Live: true}
+		}
+		if meta.Live {
+			countLive(meta, all, rs)
+		}
+		cur = len(recs) - 1
+	}
+	// the follow goroutine of the capture shown stops when stopFollow is closed
+	stopFollow := make(chan struct{})
+	defer func() { close(stopFollow) }()
+	if following {
+		go follow(screen, fol, opts.MetaPath, meta.OwnerPID, stopFollow)
+	}
+	if opts.Reruns != nil {
+		quit := make(chan struct{})
+		defer close(quit)
+		go forwardReruns(screen, opts.Reruns, quit)
+	}
+	var rerunFile *os.File // the capture of the last Rerun
+	defer func() {
+		if rerunFile != nil {
+			rerunFile.Close()
+		}
+	}()
 
 	// bottom log pane (grows up to opts.ErrLinesMax)
 	var logLines []string
@@ -102,6 +235,53 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 		screen.Sync()
 	}
 
+	// refilter applies flt, keeping the cursor on its line (or the one before)
+	refilter := func() {
+		n := 0
+		if cur >= 0 && cur < len(recs) {
+			n = recs[cur].N
+		}
+		recs = flt.of(all)
+		cur = nearestLine(recs, n)
+		if autoScroll {
+			cur = len(recs) - 1
+		}
+	}
+
+	// activate runs the edit hook for r (with file, the pick among ambiguous
+	// paths, if any) and logs what it ran; ambiguity opens the picker
+	var pk picker
+	activate := func(r rec, file string) {
+		r = ls.load(r)
+		if hooks.Foreground {
+			_ = screen.Suspend()
+		}
+		argv, err := hooks.OnActivate(r.Text, r.Dir, file)
+		if hooks.Foreground {
+			_ = screen.Resume()
+		}
+		if len(argv) > 0 {
+			appendLog("edit: exec: " + strings.Join(argv, " "))
+		}
+		var amb *editor.AmbiguousError
+		switch {
+		case errors.As(err, &amb):
+			pk = picker{open: true, r: r, name: amb.Name, files: amb.Files}
+		case err != nil:
+			appendLog("edit: error: " + err.Error())
+		}
+	}
+
+	help := false // the ? overlay is shown
+	wrap := opts.Wrap
+	tab := opts.TabWidth
+	if tab <= 0 {
+		tab = DefaultTabWidth
+	}
+	hoff := 0        // first column shown when not wrapping (Left/Right)
+	maxLen := 0      // longest line drawn last frame, bounds hoff
+	var rowRec []int // record index drawn on each body row, for the mouse
+
 	var lastClickLine = -1
 	var lastClickTime = int64(0)
 	doubleClickMaxMs := int64(300)
@@ -154,19 +334,29 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 		if top > int(math.Max(0, float64(len(recs)-rowsVis))) {
 			top = int(math.Max(0, float64(len(recs)-rowsVis)))
 		}
+		textW := w - gw
+		if wrap && cur > top {
+			top = wrapTop(recs, ls, top, cur, rowsVis, textW, tab)
+		}
 
 		screen.Clear()
 
 		if opts.ShowTopBar {
-			// Build a richer status including capture mode and (for exec) exit code
+			// Build a richer status including capture mode and (for exec) the command and its exit code
 			mode := ""
 			exit := ""
 			if meta != nil {
 				if meta.Source.Mode != "" {
 					mode = fmt.Sprintf("input:%s  ", meta.Source.Mode)
 				}
+				if flt.matchesOnly || meta.Filtered {
+					mode += "view:matches  "
+				}
+				if flt.stream != "" {
+					mode += "stream:" + flt.stream + "  "
+				}
 				if meta.Source.Mode == "exec" {
-					exit = fmt.Sprintf("exit:%d  ", meta.ExitCode)
+					exit = execInfo(meta)
 				}
 			}
 			ml := 0
@@ -174,69 +364,149 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 			if meta != nil {
 				ml, mt = meta.MatchLines, meta.MatchesTotal
 			}
-			s := fmt.Sprintf(" %s | %s%slines:%d  pos:%d/%d  match-lines:%d  matches:%d  (mouse:%v) ",
-				opts.Title, mode, exit, len(recs), cur+1, len(recs), ml, mt, opts.Mouse)
+			if fol != nil {
+				switch {
+				case !following:
+					mode += "follow:done  "
+				case autoScroll:
+					mode += "follow:on  "
+				default:
+					mode += "follow:off  "
+				}
+			}
+			sevs := ""
+			if meta != nil {
+				for sev := rules.Error; sev >= rules.Info; sev-- {
+					if n := meta.Severities[sev.String()]; n > 0 {
+						sevs += fmt.Sprintf("  %s:%d", sev, n)
+					}
+				}
+			}
+			if len(marks) > 0 {
+				sevs += fmt.Sprintf("  marks:%d", len(marks))
+			}
+			s := fmt.Sprintf(" %s | %s%slines:%d  pos:%d/%d  match-lines:%d  matches:%d%s  (mouse:%v) ",
+				opts.Title, mode, exit, len(recs), cur+1, len(recs), ml, mt, sevs, opts.Mouse)
 
 			drawLine(screen, 0, 0, w, s, topStyle)
 		}
 
-		for row := 0; row < rowsVis; row++ {
-			idx := top + row
-			if idx >= len(recs) {
-				break
-			}
-			y := bodyTop + row
-			rc := recs[idx]
-
-			ln := fmt.Sprintf("%*d", gw-2, rc.N)
+		rowRec = rowRec[:0]
+		maxLen = 0
+		switch {
+		case pk.open:
+			pk.draw(screen, bodyTop, rowsVis, w, normalStyle, cursorStyle)
+		case fp.open:
+			fp.draw(screen, bodyTop, rowsVis, w, normalStyle, cursorStyle, sevGutter[:])
+		}
+		for idx, row := top, 0; !pk.open && !fp.open && idx < len(recs) && row < rowsVis; idx++ {
+			rc := ls.load(recs[idx])
+			ruleSpans := runeSpans(rc.Text, rules.AllSpans(rs, rc.Text))
+			sev, _ := rules.LineSeverity(rs, rc.Text)
 			gs := gutterStyle
+			if len(ruleSpans) > 0 {
+				gs = sevGutter[sev]
+			}
 			if idx == cur {
 				gs = gutterCursor
 			}
-			drawText(screen, 0, y, ln, gs)
-			drawText(screen, gw-2, y, ": ", gs)
 
-			spans := rules.AllSpans(rs, rc.Text)
-			mapIdx := util.ByteToRuneIndexMap(rc.Text)
+			hitSpans := searchSpans(sr.re, rc.Text)
 
-			runeSpans := make([][2]int, 0, len(spans))
-			for _, se := range spans {
-				startRune := util.ByteIndexToRuneIndex(mapIdx, se[0])
-				endRune := util.ByteToRuneIndexMap(rc.Text) // not used; left for clarity
-				_ = endRune
-				endRuneIdx := util.ByteIndexToRuneIndex(mapIdx, se[1])
-				if endRuneIdx < startRune {
-					endRuneIdx = startRune
-				}
-				runeSpans = append(runeSpans, [2]int{startRune, endRuneIdx})
+			var colors []tcell.Style // per rune, from the line's SGR sequences
+			if rc.Raw != "" {
+				_, colors = ansi.Styled(rc.Raw, normalStyle)
 			}
 
-			rx := gw
-			runeIdx := 0
-			for _, r := range rc.Text {
-				if rx >= w {
-					break
+			// one screen row per line, or per textW columns of it when
+			// wrapping; spans and colors are by rune of rc.Text, so runes
+			// from an expanded tab look them up through src
+			runes, src := expandTabs(rc.Text, tab)
+			maxLen = max(maxLen, runesWidth(runes))
+			starts := []int{0}
+			if wrap {
+				starts = rowStarts(runes, textW)
+			}
+			segs := len(starts)
+			for seg := 0; seg < segs && row < rowsVis; seg, row = seg+1, row+1 {
+				y := bodyTop + row
+				rowRec = append(rowRec, idx)
+				if seg == 0 {
+					drawText(screen, 0, y, fmt.Sprintf("%*d", gw-2, rc.N), gs)
+					drawText(screen, gw-2, y, ": ", gs)
+					if marks[rc.N] {
+						drawText(screen, gw-2, y, "◆", markStyle)
+					}
+				} else {
+					drawText(screen, 0, y, fmt.Sprintf("%*s", gw-2, "↪"), gs) // continuation
+					drawText(screen, gw-2, y, "  ", gs)
+				}
+				runeIdx, rx, stop := starts[seg], gw, len(runes)
+				if seg+1 < segs {
+					stop = starts[seg+1]
 				}
-				st := normalStyle
-				if idx == cur {
-					st = cursorStyle
+				if !wrap {
+					var pad int
+					runeIdx, pad = skipCols(runes, hoff)
+					rx += pad
 				}
-				if insideAnySpan(runeIdx, runeSpans) {
+				// a wide rune takes two cells; marks combine with the rune
+				// in the cell before them
+				bx, comb := -1, []rune(nil)
+				for ; runeIdx < stop; runeIdx++ {
+					r, ri := runes[runeIdx], runeIdx
+					if src != nil {
+						ri = src[runeIdx]
+					}
+					st := normalStyle
+					if rc.Stream == "err" {
+						st = stderrStyle
+					}
+					if ri < len(colors) {
+						st = colors[ri]
+					}
 					if idx == cur {
-						st = cursorMatchStyle
-					} else {
-						st = matchStyle
+						st = cursorStyle
+					}
+					if insideAnySpan(ri, hitSpans) {
+						st = searchStyle
+					} else if insideAnySpan(ri, ruleSpans) {
+						if idx == cur {
+							st = cursorMatchStyle
+						} else {
+							st = sevStyle[sev]
+						}
 					}
+					cw := cellWidth(r)
+					if cw == 0 {
+						if bx >= 0 {
+							comb = append(comb, r)
+							mainc, _, bst, _ := screen.GetContent(bx, y)
+							screen.SetContent(bx, y, mainc, comb, bst)
+						}
+						continue
+					}
+					if rx+cw > w {
+						break
+					}
+					screen.SetContent(rx, y, r, nil, st)
+					bx, comb = rx, nil
+					rx += cw
+				}
+				end := rx
+				for ; rx < w; rx++ {
+					screen.SetContent(rx, y, ' ', nil, normalStyle)
+				}
+				if seg == segs-1 && rc.Count > 1 {
+					drawText(screen, end, y, fmt.Sprintf(" ×%d", rc.Count), gutterStyle)
 				}
-				screen.SetContent(rx, y, r, nil, st)
-				rx++
-				runeIdx++
-			}
-			for ; rx < w; rx++ {
-				screen.SetContent(rx, y, ' ', nil, normalStyle)
 			}
 		}
 
+		if help {
+			drawHelp(screen, bodyTop, bodyBottom+logVis, w, helpFlags(opts, meta, flt, wrap, fol != nil, following, autoScroll), topStyle, normalStyle)
+		}
+
 		// draw bottom log pane (if any), just above the bottom bar
 		if opts.ErrLinesMax > 0 && len(logLines) > 0 {
 			logVis := len(logLines)
@@ -259,8 +529,41 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 		}
 
 		if opts.ShowBottomBar {
-			status := " ↑/↓ PgUp/PgDn Home/End  Enter=edit  M=toggle-mouse  q/Esc=quit "
+			status := " ↑/↓ PgUp/PgDn Home/End  Enter=edit  /=search  f=filter  s=stream  w=wrap"
+			if !wrap {
+				status += "  ←/→=scroll"
+			}
+			if sr.re != nil {
+				status += "  n/N=next/prev"
+			}
+			if fol != nil {
+				status += "  F=follow"
+			}
+			status += "  g=files  m=mark  y/Y=copy-line/match"
+			if len(marks) > 0 {
+				status += "  '/\"=next/prev-mark"
+			}
+			status += "  M=toggle-mouse  ?=help  q/Esc=quit "
+			if sr.re != nil {
+				status += " /" + string(sr.input) + " "
+			}
+			if !wrap && hoff > 0 {
+				status = fmt.Sprintf(" col:%d+ |", hoff+1) + status // where the view starts
+			}
+			if sr.prompt {
+				status = "/" + string(sr.input)
+			}
+			if pk.open {
+				status = fmt.Sprintf(" %s: %d files | ↑/↓ Enter=edit  Esc=cancel ", pk.name, len(pk.files))
+			} else if fp.open {
+				status = fmt.Sprintf(" files:%d | ↑/↓ PgUp/PgDn Home/End  Enter=first match  s=sort (%s)  g/Esc=back ", len(fp.list), fp.sortName())
+			}
 			drawLine(screen, 0, h-1, w, status, botStyle)
+			if sr.prompt {
+				screen.ShowCursor(1+textWidth(string(sr.input)), h-1)
+			} else {
+				screen.HideCursor()
+			}
 		}
 
 		screen.Show()
@@ -269,6 +572,70 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 		switch e := ev.(type) {
 		case *tcell.EventResize:
 			screen.Sync()
+		case *rerunEvent:
+			if e.Note != "" {
+				appendLog(e.Note)
+			}
+			if e.CapturePath == "" {
+				break
+			}
+			f, err := os.Open(e.CapturePath)
+			if err != nil {
+				appendLog("watch: " + err.Error())
+				break
+			}
+			nf := capture.NewFollower(f)
+			rows, err := nf.Next()
+			if err != nil {
+				appendLog("watch: " + err.Error())
+			}
+			if rerunFile != nil {
+				rerunFile.Close()
+			}
+			rerunFile, fol = f, nf
+			if m, ok := readMeta(e.MetaPath); ok {
+				*meta = *m
+			}
+			all = recsOf(rows)
+			if meta.Live {
+				countLive(meta, all, rs)
+			}
+			recs = flt.of(all)
+			clear(marks)
+			following, autoScroll = true, true
+			cur = len(recs) - 1
+			close(stopFollow)
+			stopFollow = make(chan struct{})
+			go follow(screen, fol, e.MetaPath, meta.OwnerPID, stopFollow)
+			if fp.open {
+				fp.refresh(all, rs)
+			}
+		case *followEvent:
+			if e.fol != fol {
+				break // from a capture a rerun replaced
+			}
+			if meta.Live {
+				countLive(meta, e.recs, rs)
+			}
+			all = append(all, e.recs...)
+			if flt.none() {
+				recs = all
+			} else {
+				recs = append(recs, flt.of(e.recs)...)
+			}
+			if e.err != nil {
+				appendLog("follow: " + e.err.Error())
+			}
+			if e.meta != nil {
+				*meta = *e.meta
+				following = false
+			}
+			if fp.open {
+				fp.refresh(all, rs)
+			}
+			if autoScroll {
+				cur = len(recs) - 1
+			}
 		case *tcell.EventMouse:
 			if !opts.Mouse {
 				break
@@ -282,43 +649,165 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 			if y < bodyTop {
 				break
 			}
-			idx := top + (y - bodyTop)
-			if idx < 0 || idx >= len(recs) {
+			if y-bodyTop >= len(rowRec) || help {
 				break
 			}
+			idx := rowRec[y-bodyTop]
 			if btn&tcell.Button1 != 0 {
 				cur = idx
+				autoScroll = autoScroll && cur == len(recs)-1
 				// double click?
 				now := time.Now().UnixNano() / 1e6
 				if lastClickLine == cur && now-lastClickTime <= doubleClickMaxMs {
 					if hooks.OnActivate != nil {
-						hooks.OnActivate(recs[cur].Text)
+						activate(recs[cur], "")
 					}
 				}
 				lastClickLine = cur
 				lastClickTime = now
 			}
 		case *tcell.EventKey:
+			if help {
+				help = false
+				break
+			}
+			if sr.prompt {
+				cur = sr.key(e, recs, ls, cur)
+				break
+			}
+			if pk.open {
+				if file, ok := pk.key(e, rowsVis); ok {
+					activate(pk.r, file)
+				}
+				break
+			}
+			if fp.open {
+				if n, ok := fp.key(e, rowsVis); ok {
+					cur = nearestLine(recs, n)
+					autoScroll = false
+				}
+				break
+			}
 			switch e.Key() {
 			case tcell.KeyEsc:
 				return nil
 			case tcell.KeyEnter:
 				if cur >= 0 && cur < len(recs) {
 					if hooks.OnActivate != nil {
-						argv, err := hooks.OnActivate(recs[cur].Text)
-						if len(argv) > 0 {
-							appendLog("edit: exec: " + strings.Join(argv, " "))
-						}
-						if err != nil {
-							appendLog("edit: error: " + err.Error())
-						}
+						activate(recs[cur], "")
 					}
 				}
 			case tcell.KeyRune:
 				switch e.Rune() {
 				case 'q', 'Q':
 					return nil
-				case 'M', 'm':
+				case '?':
+					help = true
+				case 'f':
+					if meta != nil && meta.Filtered {
+						appendLog("filter: capture holds match lines only (--only-view-matches upstream)")
+						break
+					}
+					flt.matchesOnly = !flt.matchesOnly
+					refilter()
+				case 's':
+					if !hasStreams(all) {
+						appendLog("filter: no stdout/stderr tags (only --exec captures have them)")
+						break
+					}
+					flt.stream = nextStream(flt.stream)
+					refilter()
+				case 'w':
+					wrap = !wrap
+				case 'g':
+					fp.open = true
+					fp.refresh(all, rs)
+				case 'x':
+					path := opts.Quickfix
+					if path == "" {
+						path = quickfix.DefaultPath
+					}
+					var qf []string
+					for _, r := range all {
+						if e, ok := quickfix.Line(rs, r.Text, r.Dir); r.M && ok {
+							qf = append(qf, e)
+						}
+					}
+					if err := quickfix.WriteFile(path, qf); err != nil {
+						appendLog("quickfix: " + err.Error())
+					} else {
+						appendLog(fmt.Sprintf("quickfix: wrote %d entries to %s (vim -q %s)", len(qf), path, path))
+					}
+				case '/':
+					sr.open(cur)
+					autoScroll = false
+				case 'n', 'N':
+					if sr.re == nil {
+						break
+					}
+					from, dir := cur+1, 1
+					if e.Rune() == 'N' {
+						from, dir = cur-1, -1
+					}
+					if i, ok := findHit(recs, ls, sr.re, from, dir); ok {
+						cur = i
+						autoScroll = false
+					} else {
+						appendLog("search: no match for /" + string(sr.input))
+					}
+				case 'F':
+					if fol != nil {
+						autoScroll = !autoScroll
+						if autoScroll {
+							cur = len(recs) - 1
+						}
+					}
+				case 'm':
+					if cur >= 0 && cur < len(recs) {
+						if n := recs[cur].N; marks[n] {
+							delete(marks, n)
+						} else {
+							marks[n] = true
+						}
+					}
+				case '\'', '"':
+					dir := 1
+					if e.Rune() == '"' {
+						dir = -1
+					}
+					if i, ok := nextMark(recs, marks, cur, dir); ok {
+						cur = i
+						autoScroll = false
+					} else if len(marks) == 0 {
+						appendLog("marks: none (m marks the current line)")
+					} else {
+						appendLog("marks: none in this view (f shows all lines)")
+					}
+				case 'y', 'Y':
+					if cur < 0 || cur >= len(recs) {
+						break
+					}
+					text, what := ls.load(recs[cur]).Text, "line"
+					if e.Rune() == 'Y' {
+						// the rule match, else the search hit
+						spans := rules.AllSpans(rs, text)
+						if len(spans) == 0 && sr.re != nil {
+							if loc := sr.re.FindStringIndex(text); loc != nil {
+								spans = [][2]int{{loc[0], loc[1]}}
+							}
+						}
+						if len(spans) == 0 {
+							appendLog("copy: no match on this line")
+							break
+						}
+						text, what = text[spans[0][0]:spans[0][1]], "match"
+					}
+					if used, err := copyText(text); err != nil {
+						appendLog("copy: " + err.Error())
+					} else {
+						appendLog(fmt.Sprintf("copy: %s (%d chars) via %s", what, len([]rune(text)), strings.Join(used, "+")))
+					}
+				case 'M':
 					opts.Mouse = !opts.Mouse
 					if opts.Mouse {
 						screen.EnableMouse()
@@ -326,14 +815,29 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 						screen.DisableMouse()
 					}
 				}
+			case tcell.KeyLeft, tcell.KeyRight:
+				if wrap {
+					break
+				}
+				step := hscrollStep
+				if e.Modifiers()&tcell.ModShift != 0 {
+					step = max(hscrollStep, (w-gw)/2)
+				}
+				if e.Key() == tcell.KeyLeft {
+					step = -step
+				}
+				hoff = min(max(hoff+step, 0), max(maxLen-(w-gw), 0))
 			case tcell.KeyUp:
 				cur--
+				autoScroll = false
 			case tcell.KeyDown:
 				cur++
 			case tcell.KeyHome:
 				cur = 0
+				autoScroll = false
 			case tcell.KeyEnd:
 				cur = len(recs) - 1
+				autoScroll = fol != nil
 			case tcell.KeyPgUp:
 				_, h := screen.Size()
 				bodyTop := 0
@@ -346,6 +850,7 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 				}
 				rowsVis := bodyBottom - bodyTop
 				cur -= rowsVis
+				autoScroll = false
 			case tcell.KeyPgDn:
 				_, h := screen.Size()
 				bodyTop := 0
@@ -369,6 +874,23 @@ func runFromReader(r io.Reader, meta *capture.Meta, rs []rules.Rule, opts Option
 	}
 }
 
+// countLive keeps the top-bar counters current while the producer's meta
+// is still live; the final meta replaces them.
+func countLive(meta *capture.Meta, recs []rec, rs []rules.Rule) {
+	for _, x := range recs {
+		if x.M {
+			_, n := rules.AnyMatch(rs, x.Text)
+			meta.MatchLines++
+			meta.MatchesTotal += n
+			if meta.Severities == nil {
+				meta.Severities = map[string]int{}
+			}
+			sev, _ := rules.LineSeverity(rs, x.Text)
+			meta.Severities[sev.String()]++
+		}
+	}
+}
+
 func insideAnySpan(pos int, spans [][2]int) bool {
 	for _, s := range spans {
 		if pos >= s[0] && pos < s[1] {
@@ -383,13 +905,24 @@ func drawText(s tcell.Screen, x, y int, text string, st tcell.Style) {
 	if y < 0 || x >= w {
 		return
 	}
-	rx := x
+	rx, bx := x, -1
+	var comb []rune
 	for _, r := range text {
-		if rx >= w {
+		cw := cellWidth(r)
+		if cw == 0 {
+			if bx >= 0 {
+				comb = append(comb, r)
+				mainc, _, _, _ := s.GetContent(bx, y)
+				s.SetContent(bx, y, mainc, comb, st)
+			}
+			continue
+		}
+		if rx+cw > w {
 			break
 		}
 		s.SetContent(rx, y, r, nil, st)
-		rx++
+		bx, comb = rx, nil
+		rx += cw
 	}
 }
 
@@ -400,16 +933,17 @@ func drawLine(s tcell.Screen, x, y, w int, text string, st tcell.Style) {
 	drawText(s, x, y, truncateTo(text, w), st)
 }
 
+// truncateTo cuts s to at most max screen cells.
 func truncateTo(s string, max int) string {
 	if max <= 0 {
 		return ""
 	}
-	out := make([]rune, 0, max)
-	for _, r := range s {
-		if len(out) >= max {
-			break
+	col := 0
+	for i, r := range s {
+		if col+cellWidth(r) > max {
+			return s[:i]
 		}
-		out = append(out, r)
+		col += cellWidth(r)
 	}
-	return string(out)
+	return s
 }
@@ -0,0 +1,82 @@
+package viewer
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// cellWidth is how many screen cells r takes: 2 for wide runes (CJK, most
+// emoji), 0 for marks and format characters (drawn combined with the rune
+// before them), else 1.
+func cellWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	return max(runewidth.RuneWidth(r), 1) // control characters as one cell
+}
+
+// textWidth is how many screen cells s takes.
+func textWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += cellWidth(r)
+	}
+	return n
+}
+
+// DefaultTabWidth is the tab stop spacing when Options.TabWidth is unset,
+// as gcc assumes when it draws the caret line under a source line.
+const DefaultTabWidth = 8
+
+// expandTabs returns the runes of s as drawn, each tab expanded to spaces up
+// to the next multiple of tab columns, and for each of them the index of the
+// rune of s it comes from (for its style and the spans); src is nil when s
+// has no tab.
+func expandTabs(s string, tab int) (runes []rune, src []int) {
+	runes = []rune(s)
+	if !strings.ContainsRune(s, '\t') {
+		return runes, nil
+	}
+	out := make([]rune, 0, len(runes)+tab)
+	src = make([]int, 0, cap(out))
+	col := 0
+	for i, r := range runes {
+		if r != '\t' {
+			out = append(out, r)
+			src = append(src, i)
+			col += cellWidth(r)
+			continue
+		}
+		for n := tab - col%tab; n > 0; n-- {
+			out = append(out, ' ')
+			src = append(src, i)
+			col++
+		}
+	}
+	return out, src
+}
+
+// runesWidth is how many screen cells runes take.
+func runesWidth(runes []rune) int {
+	n := 0
+	for _, r := range runes {
+		n += cellWidth(r)
+	}
+	return n
+}
+
+// skipCols returns the index of the first rune of runes at or after column
+// col, and the cells between col and it (1 when a wide rune straddles col).
+func skipCols(runes []rune, col int) (idx, pad int) {
+	c := 0
+	for idx < len(runes) && c < col {
+		c += cellWidth(runes[idx])
+		idx++
+	}
+	for idx < len(runes) && cellWidth(runes[idx]) == 0 {
+		idx++ // marks of a rune scrolled out
+	}
+	return idx, c - col
+}
@@ -0,0 +1,48 @@
+package viewer
+
+// wrapRows is how many screen rows text takes when soft-wrapped at width,
+// tabs expanded to tab stops every tab columns.
+func wrapRows(text string, width, tab int) int {
+	runes, _ := expandTabs(text, tab)
+	if width <= 0 || runesWidth(runes) <= width {
+		return 1
+	}
+	return len(rowStarts(runes, width))
+}
+
+// rowStarts are the indices of the runes starting each screen row of runes
+// soft-wrapped at width columns; a wide rune that doesn't fit at the end of
+// a row starts the next one.
+func rowStarts(runes []rune, width int) []int {
+	starts := []int{0}
+	if width <= 0 {
+		return starts
+	}
+	col := 0
+	for i, r := range runes {
+		cw := cellWidth(r)
+		if col+cw > width && col > 0 {
+			starts = append(starts, i)
+			col = 0
+		}
+		col += cw
+	}
+	return starts
+}
+
+// wrapTop moves top down until the wrapped rows of recs[top..cur] fit in
+// rowsVis, so the cursor line stays on screen (its first row, if it alone
+// is taller than the screen).
+func wrapTop(recs []rec, ls *lineStore, top, cur, rowsVis, width, tab int) int {
+	rows := 0
+	for i := cur; i >= top; i-- {
+		rows += wrapRows(ls.load(recs[i]).Text, width, tab)
+		if rows > rowsVis {
+			if i == cur {
+				return cur
+			}
+			return i + 1
+		}
+	}
+	return top
+}
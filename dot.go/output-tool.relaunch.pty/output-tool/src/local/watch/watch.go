@@ -0,0 +1,176 @@
+// Package watch reports changes to files and directory trees with inotify,
+// for re-running a command on save.
+package watch
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Debounce is how long changes must have stopped before Wait returns, so a
+// save touching several files (or one written in pieces) is one change.
+const Debounce = 300 * time.Millisecond
+
+const events = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE
+
+// skipDirs are not watched inside a watched tree.
+var skipDirs = map[string]bool{".git": true, ".hg": true, ".svn": true, "node_modules": true}
+
+type Watcher struct {
+	fd      int
+	dirs    map[int32]string           // watch descriptor -> directory
+	only    map[string]map[string]bool // directory -> the names watched in it; nil: all (a tree)
+	changes chan string
+	err     error
+}
+
+// New watches paths: a directory with everything under it, a file through
+// its directory (editors save by replacing the file).
+func New(paths []string) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("watch: inotify: %w", err)
+	}
+	w := &Watcher{fd: fd, dirs: map[int32]string{}, only: map[string]map[string]bool{}, changes: make(chan string, 64)}
+	for _, p := range paths {
+		p, err := filepath.Abs(p)
+		if err == nil {
+			err = w.add(p)
+		}
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("watch: %w", err)
+		}
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *Watcher) add(p string) error {
+	st, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		dir, name := filepath.Split(p)
+		dir = filepath.Clean(dir)
+		if names, ok := w.only[dir]; ok && names == nil {
+			return nil // in a watched tree already
+		}
+		if w.only[dir] == nil {
+			w.only[dir] = map[string]bool{}
+		}
+		w.only[dir][name] = true
+		return w.watchDir(dir)
+	}
+	return filepath.WalkDir(p, func(d string, e fs.DirEntry, err error) error {
+		if err != nil || !e.IsDir() {
+			return nil
+		}
+		if d != p && skipDirs[e.Name()] {
+			return filepath.SkipDir
+		}
+		w.only[d] = nil
+		return w.watchDir(d)
+	})
+}
+
+func (w *Watcher) watchDir(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, events)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+// read turns inotify events into changed paths until the watcher is closed.
+func (w *Watcher) read() {
+	defer close(w.changes)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			w.err = err
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			raw := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			name := strings.TrimRight(string(raw), "\x00")
+			dir, ok := w.dirs[ev.Wd]
+			if !ok || name == "" || scratch(name) {
+				continue
+			}
+			names := w.only[dir]
+			if names != nil && !names[name] {
+				continue
+			}
+			p := filepath.Join(dir, name)
+			if names == nil && ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !skipDirs[name] {
+				_ = w.add(p) // a new directory in a watched tree
+			}
+			select {
+			case w.changes <- p:
+			default: // Wait has plenty pending already
+			}
+		}
+	}
+}
+
+// scratch reports editor swap and backup files, which change without a save.
+func scratch(name string) bool {
+	return name == "4913" || strings.HasSuffix(name, "~") ||
+		strings.HasSuffix(name, ".swp") || strings.HasSuffix(name, ".swx") ||
+		strings.HasPrefix(name, ".#")
+}
+
+// Wait blocks until a watched file changes and then until changes have
+// stopped for Debounce, and returns the first path changed.
+func (w *Watcher) Wait() (string, error) {
+	p, ok := <-w.changes
+	if !ok {
+		return "", fmt.Errorf("watch: %v", w.err)
+	}
+	t := time.NewTimer(Debounce)
+	defer t.Stop()
+	for {
+		select {
+		case _, ok := <-w.changes:
+			if !ok {
+				return p, nil
+			}
+			t.Reset(Debounce)
+		case <-t.C:
+			return p, nil
+		}
+	}
+}
+
+func (w *Watcher) Close() error { return syscall.Close(w.fd) }
+
+// Drain forgets the changes seen so far, such as those a command made to
+// the watched files while it ran.
+func (w *Watcher) Drain() {
+	for {
+		select {
+		case _, ok := <-w.changes:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
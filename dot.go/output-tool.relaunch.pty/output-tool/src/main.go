@@ -9,20 +9,31 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
 
+	"local/annotate"
+	"local/ansi"
 	"local/capture"
 	"local/cleanup"
 	"local/config"
 	"local/editor"
 	"local/execcap"
+	"local/export"
+	"local/hyperlink"
 	"local/launcher"
+	"local/makedir"
+	"local/quickfix"
 	"local/rules"
 	"local/viewer"
+	"local/watch"
 )
 
 var (
@@ -38,9 +49,24 @@ var (
 	flagExec = flag.Bool("exec", true, "If extra args are present, run them as a command (set --exec=false to forbid)")
 
 	// Pipe behavior
-	flagOnlyView    = flag.Bool("only-view-matches", defaultConfig.Behavior.OnlyViewMatches, "Viewer shows only matching lines (capture filtered in pipe)")
+	flagOnlyView    = flag.Bool("only-view-matches", defaultConfig.Behavior.OnlyViewMatches, "Viewer shows only matching lines (capture filtered in pipe/exec; f in the viewer toggles otherwise)")
 	flagOnlyOnMatch = flag.Bool("only-on-matches", defaultConfig.Behavior.OnlyOnMatches, "Do not launch viewer when no matches were seen")
+	flagCount       = flag.Bool("count", false, "Only count matches (per rule and in total) and print the counts; no capture, no viewer. Input is stdin unless --file or a command is given")
+	flagCountFormat = flag.String("count-format", "text", "Output of --count: text (RULE<TAB>N lines, then total) or json")
+	flagWatch       = flag.String("watch", "", "Exec: re-run the command when files under PATH[,PATH...] change, viewing each run as it happens (changes during a run are ignored)")
+	flagFoldDupes   = flag.Bool("fold-dupes", defaultConfig.Behavior.FoldDupes, "Collapse runs of identical consecutive lines into one record shown with a ×N count")
+	flagCompress    = flag.Bool("compress", defaultConfig.Behavior.Compress, "Write gzip-compressed captures (.jsonl.gz); the viewer reads either")
+	flagFollowMatch = flag.Bool("follow-on-match", defaultConfig.Behavior.FollowOnMatch, "Pipe: launch the viewer at the first match line and have it tail the capture (like --follow, which launches up front)")
 	flagMatchStderr = flag.String("match-stderr", "line", "During --pipe, echo matches to stderr: none|line")
+	flagFailOn      = flag.String("fail-on", "", "Exit 1 when a match of this severity or higher was seen: error|warning|info (default: never)")
+	flagQuickfix    = flag.String("quickfix", "", "Also write matches to PATH as file:line:col: message (vim -q PATH); x in the viewer writes it too")
+	flagHyperlink   = flag.String("hyperlink", defaultConfig.Behavior.Hyperlink, "Pipe: wrap file:line:col in the streamed output in OSC 8 hyperlinks: file, vscode, or a URI template with ${__FILE__}/${__RELFILE__}, ${__LINE__}, ${__COLUMN__}")
+	flagAnnotate    = flag.String("annotate", "", "During --pipe/--exec, also print a CI annotation after each match: github (default: none)")
+	flagPTY         = flag.Bool("pty", false, "Exec: run the command on a pseudo-terminal (colors, progress bars, line buffering); stdout and stderr are merged")
+	flagBaseDir     = flag.String("base-dir", "", "Relative paths in matches are from DIR (default: the cwd where output-tool ran; recorded in the meta for the viewer)")
+	flagExport      = flag.String("export", "", "Also write one row per rule match to --export-dest: csv|tsv (n, rule, file, line, col, text)")
+	flagExportDest  = flag.String("export-dest", "", "Path for --export")
+	flagRules       = flag.String("rules", "", "Rule sets to apply, NAME[,NAME...]: 'default' is [[rules]], others [rulesets.NAME] (default: [behavior].rules, else default)")
 
 	// Viewer internal
 	flagView        = flag.Bool("view", false, "Internal: run viewer on a capture JSONL file")
@@ -52,9 +78,13 @@ var (
 	flagGutterWidth = flag.Int("gutter-width", defaultConfig.Viewer.GutterWidth, "Fixed gutter width for line numbers")
 	flagTopBar      = flag.Bool("top-bar", defaultConfig.Viewer.ShowTopBar, "Show top status bar")
 	flagBottomBar   = flag.Bool("bottom-bar", defaultConfig.Viewer.ShowBottomBar, "Show bottom status bar")
-	flagErrLines    = flag.Int("err-lines", 5, "Max lines for bottom error/log pane")
+	flagErrLines    = flag.Int("err-lines", defaultConfig.Viewer.ErrLinesMax, "Max lines for bottom error/log pane")
+	flagTabWidth    = flag.Int("tab-width", defaultConfig.Viewer.TabWidth, "Viewer: columns between tab stops (tabs are expanded so gcc/clang caret lines line up)")
 	flagNoAlt       = flag.Bool("no-alt", defaultConfig.Viewer.NoAlt, "Do not use terminal alt screen (debug)")
 	flagMouse       = flag.Bool("mouse", defaultConfig.Viewer.Mouse, "Enable mouse tracking (disables terminal text selection)")
+	flagWrap        = flag.Bool("wrap", defaultConfig.Viewer.Wrap, "Viewer soft-wraps long lines (w toggles)")
+	flagTheme       = flag.String("theme", defaultConfig.Viewer.Theme, "Viewer color theme: dark|light|solarized or a [themes.NAME] of the config (default dark)")
+	flagFollow      = flag.Bool("follow", defaultConfig.Viewer.Follow, "Viewer tails the capture while it is written (pipe: launch viewer up front; exec: view inline while the command runs)")
 
 	// Launcher (pipe -> new terminal)
 	flagLauncher  = flag.String("launcher", "xfce4-terminal --hide-menubar --hide-scrollbar --hide-toolbar --title='OutputTool' --command", "Terminal launcher prefix")
@@ -72,24 +102,48 @@ var (
 	flagUsage             = flag.Bool("usage", false, "Show usage")
 	flagPrintEffectiveCfg = flag.Bool("print-effective-config", false, "Print merged config (defaults -> file -> CLI) as TOML and exit")
 	flagWhichConfig       = flag.Bool("which-config", false, "Print the resolved config path and origin, then exit")
+	flagCheckConfig       = flag.Bool("check-config", false, "Strictly validate the config file (unknown keys, regexes, colors, editor argv), print FILE:LINE: problems and exit 1 if any")
+	flagConfigSchema      = flag.Bool("print-config-schema", false, "Print the default config with every supported key, annotated, as TOML and exit")
 	flagDebugLaunch       = flag.Bool("debug-launch", false, "Print tmux/launch decision inputs (implies --dry-launch)")
 )
 
+// loadedConfig is the absolute path of the config file in use, if any; the
+// viewer launched in a new terminal (another cwd) is pointed at it.
+var loadedConfig string
+
+// baseDirSet: --base-dir was given (else it holds the cwd).
+var baseDirSet bool
+
+// themes are the loaded config's [themes.NAME] tables.
+var themes map[string]viewer.Theme
+
 func usage() {
 	fmt.Fprintf(os.Stdout, `Usage:
-  output-tool --pipe [--only-view-matches] [--only-on-matches] [--match-stderr=none|line] [--launcher="..."] [--mouse]
+  output-tool --pipe [--hyperlink=file|vscode|URI-TEMPLATE] [--rules=NAME,...] [--only-view-matches] [--only-on-matches] [--follow|--follow-on-match] [--match-stderr=none|line] [--launcher="..."] [--mouse]
   output-tool --file=PATH [--only-view-matches] [--mouse]
+  output-tool [--follow] [--only-view-matches] [--mouse] -- CMD [ARGS...]
+  output-tool --watch=PATH[,PATH...] -- CMD [ARGS...]
+  output-tool --count [--count-format=json] [--file=PATH | -- CMD [ARGS...]]   (stdin otherwise)
   output-tool --view --capture=/tmp/ot-XXXX.jsonl --meta=/tmp/ot-XXXX.meta.json   (internal)
 
 Config:
   --config=/default     Use ${XDG_CONFIG_HOME:-~/.config}/user-dev-tooling/output-tool/<bexename>-config.toml
   --output-new-config   Write a new config TOML and exit (respects --config and --force)
   --force               Overwrite config if it exists (when writing)
+  --check-config        Validate the config file strictly; problems are printed as FILE:LINE: KEY: MESSAGE
+  --print-config-schema Print the default config with every supported key, annotated
 
 Notes:
   - Pipe mode acts like 'cat': streams stdin to stdout in real time, scans matches, writes JSONL capture and meta.
   - After streaming: if (--only-on-matches && none), exits quietly. Otherwise spawns terminal with viewer and exits.
   - File mode reads file, builds capture in-memory, and runs tcell viewer inline.
+  - --follow: the viewer tails the capture while it is still written (F toggles auto-scroll).
+    Pipe mode launches the viewer before reading stdin, so --only-on-matches does not apply;
+    exec mode runs the viewer inline during the command instead of echoing its output.
+  - --hyperlink (pipe): file:line:col in the streamed output become OSC 8 links (clickable in terminals that
+    support them); the capture keeps the lines as read.
+  - --follow-on-match (pipe): as --follow, but the viewer is launched when the first match line arrives;
+    without one, the end of input is handled as without --follow.
 `)
 }
 
@@ -107,6 +161,17 @@ func main() {
 		fmt.Printf("config: path=%s origin=%s\n", config.CleanPath(cfgPath), cfgOrigin)
 		return
 	}
+	if *flagCheckConfig {
+		checkConfig(cfgPath)
+		return
+	}
+	if *flagConfigSchema {
+		if err := config.Schema(os.Stdout, baseExe(os.Args[0])); err != nil {
+			fmt.Fprintf(os.Stderr, "print-config-schema: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// --- Write new config and exit?
 	if *flagNewConfig {
@@ -133,10 +198,13 @@ func main() {
 	cfg, err := config.Load(cfgPath)
 	if err == nil {
 		fmt.Printf("config: loaded %s (origin=%s)\n", config.CleanPath(cfgPath), cfgOrigin)
+		loadedConfig, _ = filepath.Abs(cfgPath)
 	} else {
 		// If path is /default and not found, that's fine; we proceed with compiled defaults.
 		// Only print a note if user explicitly pointed at a path that doesn't exist.
-		if *flagConfigPath != "" && !isDefault {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "config: %s: %v (using compiled defaults)\n", config.CleanPath(cfgPath), err)
+		} else if *flagConfigPath != "" && !isDefault {
 			fmt.Printf("config: not found %s (using compiled defaults)\n", config.CleanPath(cfgPath))
 		}
 		cfg = defaultConfig // fallback for rules
@@ -144,6 +212,7 @@ func main() {
 
 	// Apply config values to flags not set on CLI (works for both: loaded or default)
 	applyConfigToFlagsIfNotSet(cfg)
+	themes = cfg.Themes
 
 	if *flagPrintEffectiveCfg {
 		// Comment header with path/origin + names of CLI-overridden flags
@@ -165,9 +234,62 @@ func main() {
 		return
 	}
 
+	// compile rules from cfg (the selected rule sets)
+	rs := compileRules(cfg)
+	if *flagFailOn != "" {
+		if _, ok := rules.ParseSeverity(*flagFailOn); !ok {
+			fmt.Fprintf(os.Stderr, "error: --fail-on=%s: want error, warning or info\n", *flagFailOn)
+			os.Exit(2)
+		}
+	}
+
+	if *flagAnnotate != "" && !slices.Contains(annotate.Formats, *flagAnnotate) {
+		fmt.Fprintf(os.Stderr, "error: --annotate=%s: want %s\n", *flagAnnotate, strings.Join(annotate.Formats, " or "))
+		os.Exit(2)
+	}
+	if *flagExport != "" && !slices.Contains(export.Formats, *flagExport) {
+		fmt.Fprintf(os.Stderr, "error: --export=%s: want %s\n", *flagExport, strings.Join(export.Formats, " or "))
+		os.Exit(2)
+	}
+	if (*flagExport == "") != (*flagExportDest == "") {
+		fmt.Fprintln(os.Stderr, "error: --export and --export-dest go together")
+		os.Exit(2)
+	}
+	if *flagHyperlink != "" {
+		if err := hyperlink.Check(*flagHyperlink); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --hyperlink: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *flagTabWidth < 1 {
+		fmt.Fprintf(os.Stderr, "error: --tab-width=%d: want 1 or more\n", *flagTabWidth)
+		os.Exit(2)
+	}
+	if *flagCountFormat != "text" && *flagCountFormat != "json" {
+		fmt.Fprintf(os.Stderr, "error: --count-format=%s: want text or json\n", *flagCountFormat)
+		os.Exit(2)
+	}
+	if _, err := viewer.LookupTheme(*flagTheme, cfg.Themes); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --theme: %v\n", err)
+		os.Exit(2)
+	}
+	baseDirSet = *flagBaseDir != ""
+	if !baseDirSet {
+		*flagBaseDir, _ = os.Getwd()
+	}
+	if p, err := filepath.Abs(*flagBaseDir); err == nil {
+		*flagBaseDir = p
+	}
+	if *flagQuickfix != "" {
+		// absolute: the viewer may run in a terminal with another cwd
+		if p, err := filepath.Abs(*flagQuickfix); err == nil {
+			*flagQuickfix = p
+		}
+	}
+
 	// --- Viewer internal mode
 	if *flagView {
-		runViewerWithCleanup(*flagCapturePath, *flagMetaPath, cfg)
+		runViewerWithCleanup(*flagCapturePath, *flagMetaPath, rs, cfg)
 		return
 	}
 
@@ -185,6 +307,9 @@ func main() {
 	if execImplied {
 		modes++
 	}
+	if *flagCount && modes == 0 {
+		*flagPipe, modes = true, 1 // count stdin
+	}
 	if modes != 1 {
 		if len(args) > 0 && !*flagExec {
 			fmt.Fprintln(os.Stderr, "error: extra arguments present but --exec=false was set")
@@ -193,8 +318,10 @@ func main() {
 		os.Exit(2)
 	}
 
-	// compile rules from cfg
-	rs := compileRules(cfg)
+	if *flagCount {
+		runCount(rs, args)
+		return
+	}
 	if *flagPipe {
 		runPipe(rs, cfg)
 		return
@@ -230,6 +357,11 @@ func configFromCurrentFlags(args0 string) *config.Config {
 	cfg.Viewer.ShowBottomBar = *flagBottomBar
 	cfg.Viewer.Mouse = *flagMouse
 	cfg.Viewer.NoAlt = *flagNoAlt
+	cfg.Viewer.ErrLinesMax = *flagErrLines
+	cfg.Viewer.TabWidth = *flagTabWidth
+	cfg.Viewer.Follow = *flagFollow
+	cfg.Viewer.Wrap = *flagWrap
+	cfg.Viewer.Theme = *flagTheme
 
 	// Launcher
 	cfg.Launcher.TermPrefix = *flagLauncher
@@ -237,7 +369,14 @@ func configFromCurrentFlags(args0 string) *config.Config {
 	// Behavior
 	cfg.Behavior.OnlyViewMatches = *flagOnlyView
 	cfg.Behavior.OnlyOnMatches = *flagOnlyOnMatch
+	cfg.Behavior.FollowOnMatch = *flagFollowMatch
+	cfg.Behavior.Compress = *flagCompress
+	cfg.Behavior.FoldDupes = *flagFoldDupes
 	cfg.Behavior.MatchStderr = *flagMatchStderr
+	cfg.Behavior.Hyperlink = *flagHyperlink
+	if names := ruleSetNames(); len(names) > 0 {
+		cfg.Behavior.Rules = names
+	}
 	// Cleanup
 	cfg.Cleanup.KeepCapture = *flagKeepCapture
 	cfg.Cleanup.TTLMinutes = *flagTTLMinutes
@@ -267,6 +406,21 @@ func applyConfigToFlagsIfNotSet(cfg *config.Config) {
 	if !set["no-alt"] {
 		*flagNoAlt = cfg.Viewer.NoAlt
 	}
+	if !set["err-lines"] && cfg.Viewer.ErrLinesMax > 0 {
+		*flagErrLines = cfg.Viewer.ErrLinesMax
+	}
+	if !set["tab-width"] && cfg.Viewer.TabWidth > 0 {
+		*flagTabWidth = cfg.Viewer.TabWidth
+	}
+	if !set["follow"] {
+		*flagFollow = cfg.Viewer.Follow
+	}
+	if !set["wrap"] {
+		*flagWrap = cfg.Viewer.Wrap
+	}
+	if !set["theme"] {
+		*flagTheme = cfg.Viewer.Theme
+	}
 	// Launcher
 	if !set["launcher"] && cfg.Launcher.TermPrefix != "" {
 		*flagLauncher = cfg.Launcher.TermPrefix
@@ -278,6 +432,18 @@ func applyConfigToFlagsIfNotSet(cfg *config.Config) {
 	if !set["only-on-matches"] {
 		*flagOnlyOnMatch = cfg.Behavior.OnlyOnMatches
 	}
+	if !set["follow-on-match"] {
+		*flagFollowMatch = cfg.Behavior.FollowOnMatch
+	}
+	if !set["compress"] {
+		*flagCompress = cfg.Behavior.Compress
+	}
+	if !set["fold-dupes"] {
+		*flagFoldDupes = cfg.Behavior.FoldDupes
+	}
+	if !set["hyperlink"] {
+		*flagHyperlink = cfg.Behavior.Hyperlink
+	}
 	if !set["match-stderr"] && cfg.Behavior.MatchStderr != "" {
 		*flagMatchStderr = cfg.Behavior.MatchStderr
 	}
@@ -290,25 +456,68 @@ func applyConfigToFlagsIfNotSet(cfg *config.Config) {
 	}
 }
 
-// compileRules builds []rules.Rule from cfg.Rules
+// checkConfig reports the problems config.Check finds in path, one
+// FILE:LINE: line each, and exits 1 if there are any.
+func checkConfig(path string) {
+	probs, err := config.Check(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	name := config.CleanPath(path)
+	for _, p := range probs {
+		if p.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", name, p.Line, p)
+		} else {
+			fmt.Printf("%s: %s\n", name, p)
+		}
+	}
+	if len(probs) > 0 {
+		fmt.Fprintf(os.Stderr, "config: %s: %d problem(s)\n", name, len(probs))
+		os.Exit(1)
+	}
+	fmt.Printf("config: ok %s\n", name)
+}
+
+// ruleSetNames splits --rules.
+func ruleSetNames() []string {
+	var names []string
+	for _, n := range strings.Split(*flagRules, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// compileRules builds []rules.Rule from the rule sets selected by --rules
+// (or [behavior].rules); an empty [[rules]] list means the compiled defaults.
 func compileRules(cfg *config.Config) []rules.Rule {
-	if cfg == nil || len(cfg.Rules) == 0 {
+	if cfg == nil {
 		return rules.Default()
 	}
-	out := make([]rules.Rule, 0, len(cfg.Rules))
-	for _, r := range cfg.Rules {
+	c := *cfg
+	if len(c.Rules) == 0 {
+		c.Rules = defaultConfig.Rules
+	}
+	selected, err := c.SelectRules(ruleSetNames())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rules: %v\n", err)
+		os.Exit(2)
+	}
+	out := make([]rules.Rule, 0, len(selected))
+	for _, r := range selected {
 		re, err := regexp.Compile(r.RegexStr)
 		if err != nil {
 			// invalid regex → skip
 			continue
 		}
-		out = append(out, rules.Rule{
-			ID:          r.ID,
-			Regex:       re,
-			FileGroup:   r.FileGroup,
-			LineGroup:   r.LineGroup,
-			ColumnGroup: r.ColumnGroup,
-		})
+		r.Regex = re
+		if err := r.ResolveGroups(); err != nil {
+			fmt.Fprintf(os.Stderr, "rules: %v\n", err)
+			os.Exit(2)
+		}
+		out = append(out, r)
 	}
 	if len(out) == 0 {
 		return rules.Default()
@@ -322,19 +531,53 @@ func editorConfig(cfg *config.Config) editor.Config {
 		FileLine:    cfg.Editor.FileLine,
 		FileLineCol: cfg.Editor.FileLineCol,
 		PrettyJSON:  cfg.Editor.PrettyJSON,
+		Terminal:    cfg.Editor.Terminal,
+		Preset:      cfg.Editor.Preset,
+	}
+}
+
+// editHooks opens the line's file:line:col in the configured editor; dir is
+// the make directory the line was printed in, for relative paths, and file
+// the user's pick when the path was ambiguous. Other relative paths are from
+// --base-dir when given to the viewer, else base (the meta's).
+func editHooks(rs []rules.Rule, cfg *config.Config, base string) viewer.Hooks {
+	if baseDirSet {
+		base = *flagBaseDir
+	}
+	return viewer.Hooks{
+		OnActivate: func(lineText, dir, file string) ([]string, error) {
+			return editor.LaunchForLine(lineText, editor.Where{Dir: dir, Base: base, File: file}, rs, editorConfig(cfg))
+		},
+		Foreground: cfg.Editor.Terminal,
 	}
 }
 
 // ---------- Pipe / File / Viewer implementations ----------
 func runExec(rs []rules.Rule, cfg *config.Config, cmdArgs []string) {
+	if *flagWatch != "" {
+		runExecWatch(rs, cfg, cmdArgs)
+		return
+	}
+	if *flagFollow {
+		runExecFollow(rs, cfg, cmdArgs)
+		return
+	}
 	// run command & capture
+	mf := openMatchFiles(rs)
 	res, err := execcap.Run(cmdArgs, rs, execcap.Options{
 		OnlyViewMatches: *flagOnlyView,
 		MatchStderr:     *flagMatchStderr,
+		BaseDir:         *flagBaseDir,
+		PTY:             *flagPTY,
+		Compress:        *flagCompress,
+		FoldDupes:       *flagFoldDupes,
+		OnMatch:         mf.add,
+		Annotate:        func(plain, dir string) string { return annotation(rs, plain, dir) },
 	})
 	if err != nil {
 		fatalf("exec: %v", err)
 	}
+	mf.close()
 
 	// respect only-on-matches
 	if *flagOnlyOnMatch && !res.AnyMatch {
@@ -349,21 +592,211 @@ func runExec(rs []rules.Rule, cfg *config.Config, cmdArgs []string) {
 
 	run := func() error {
 		// meta is already in res.Meta (Temp=false)
-		return viewer.RunFromFile(res.CapturePath, &res.Meta, rs, viewerOptions(), viewer.Hooks{
-			OnActivate: func(lineText string) ([]string, error) {
-				return editor.LaunchForLine(lineText, rs, editorConfig(cfg))
-			},
-		})
+		return viewer.RunFromFile(res.CapturePath, &res.Meta, rs, viewerOptions(), editHooks(rs, cfg, res.Meta.BaseDir))
 	}
 	ccfg := cleanup.Config{KeepCapture: *flagKeepCapture, TTLMinutes: *flagTTLMinutes}
 	if err := cleanup.WrapWithSignals(run, &res.Meta, ccfg, res.CapturePath, res.CapturePath+".meta.json"); err != nil {
 		fatalf("viewer: %v", err)
 	}
+	exitOnFailOn(&res.Meta)
+}
+
+// runExecFollow runs the viewer inline while the command writes the capture;
+// the meta stays live until the command exits.
+func runExecFollow(rs []rules.Rule, cfg *config.Config, cmdArgs []string) {
+	er, err := startExecRun(rs, cmdArgs)
+	if err != nil {
+		fatalf("exec: %v", err)
+	}
+	meta := er.meta // the viewer updates meta as it follows
+	run := func() error {
+		opts := viewerOptions()
+		opts.MetaPath = er.metaPath
+		return viewer.RunFromFile(er.capturePath, &meta, rs, opts, editHooks(rs, cfg, meta.BaseDir))
+	}
+	ccfg := cleanup.Config{KeepCapture: *flagKeepCapture, TTLMinutes: *flagTTLMinutes}
+	if err := cleanup.WrapWithSignals(run, &meta, ccfg, er.capturePath, er.metaPath); err != nil {
+		fatalf("viewer: %v", err)
+	}
+	er.wait()
+	_ = os.Remove(er.metaPath) // only needed while following
+	exitOnFailOn(&er.final)
+}
+
+// execRun is a run of the command writing a capture for a viewer that
+// follows it.
+type execRun struct {
+	capturePath string
+	metaPath    string
+	meta        capture.Meta  // as written when the command started (live)
+	final       capture.Meta  // set when done is closed
+	done        chan struct{} // closed once the command has exited and the meta is final
+}
+
+// startExecRun starts the command, writing its capture, a live meta and the
+// match files; when it exits, the meta is rewritten with live=false.
+func startExecRun(rs []rules.Rule, cmdArgs []string) (*execRun, error) {
+	type outcome struct {
+		res *execcap.Result
+		err error
+	}
+	started := make(chan string, 1)
+	finished := make(chan outcome, 1)
+	mf := openMatchFiles(rs)
+	go func() {
+		res, err := execcap.Run(cmdArgs, rs, execcap.Options{
+			OnlyViewMatches: *flagOnlyView,
+			MatchStderr:     *flagMatchStderr,
+			BaseDir:         *flagBaseDir,
+			PTY:             *flagPTY,
+			Compress:        *flagCompress,
+			FoldDupes:       *flagFoldDupes,
+			Quiet:           true,
+			Started:         func(p string) { started <- p },
+			OnMatch:         mf.add,
+		})
+		finished <- outcome{res, err}
+	}()
+
+	var capturePath string
+	select {
+	case capturePath = <-started:
+	case o := <-finished:
+		mf.close()
+		return nil, o.err
+	}
+	er := &execRun{capturePath: capturePath, metaPath: capturePath + ".meta.json", done: make(chan struct{})}
+	wd, _ := os.Getwd()
+	er.meta = capture.Meta{
+		Version:        1,
+		CapturePath:    capturePath,
+		Filtered:       *flagOnlyView,
+		LineFormat:     capture.Format(capturePath),
+		CreatedUnixSec: time.Now().Unix(),
+		OwnerPID:       os.Getpid(),
+		Live:           true,
+		BaseDir:        *flagBaseDir,
+		Argv:           cmdArgs,
+		Cwd:            wd,
+		Source:         capture.Source{Mode: "exec", Arg: strings.Join(cmdArgs, " ")},
+	}
+	if err := capture.WriteMeta(er.metaPath, &er.meta); err != nil {
+		fatalf("write meta: %v", err)
+	}
+	go func() {
+		defer close(er.done)
+		o := <-finished
+		mf.close()
+		er.final = er.meta
+		er.final.Live = false
+		if o.err == nil {
+			er.final = o.res.Meta
+		}
+		_ = capture.WriteMeta(er.metaPath, &er.final)
+	}()
+	return er, nil
+}
+
+// wait waits for the command, saying so when it is still running.
+func (er *execRun) wait() {
+	select {
+	case <-er.done:
+	default:
+		fmt.Fprintln(os.Stderr, "exec: command still running; waiting for it (Ctrl-C interrupts it)")
+		<-er.done
+	}
+}
+
+// runExecWatch is runExecFollow re-running the command when a --watch path
+// changes. A change while the command runs is ignored (the command's own
+// outputs would re-run it); each run's capture replaces the previous one.
+func runExecWatch(rs []rules.Rule, cfg *config.Config, cmdArgs []string) {
+	w, err := watch.New(strings.Split(*flagWatch, ","))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer w.Close()
+	er, err := startExecRun(rs, cmdArgs)
+	if err != nil {
+		fatalf("exec: %v", err)
+	}
+	meta := er.meta // the viewer updates meta as it follows
+
+	// the latest run; once stopped (the viewer has quit), no run is started
+	var mu sync.Mutex
+	cur, stopped := er, false
+	reruns := make(chan viewer.Rerun)
+	stop := make(chan struct{})
+	send := func(r viewer.Rerun) bool {
+		select {
+		case reruns <- r:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	go func() {
+		for runs := 2; ; runs++ {
+			<-cur.done
+			w.Drain()
+			p, err := w.Wait()
+			if err != nil {
+				send(viewer.Rerun{Note: err.Error()})
+				return
+			}
+			note := fmt.Sprintf("watch: %s changed; run %d", p, runs)
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				return
+			}
+			prev := cur
+			next, err := startExecRun(rs, cmdArgs)
+			if err == nil {
+				cur = next
+			}
+			mu.Unlock()
+			if err != nil {
+				if !send(viewer.Rerun{Note: note + ": " + err.Error()}) {
+					return
+				}
+				continue // wait for the next change
+			}
+			ok := send(viewer.Rerun{CapturePath: next.capturePath, MetaPath: next.metaPath, Note: note})
+			if !*flagKeepCapture {
+				_ = os.Remove(prev.capturePath) // superseded
+			}
+			_ = os.Remove(prev.metaPath)
+			if !ok {
+				return
+			}
+		}
+	}()
+
+	run := func() error {
+		opts := viewerOptions()
+		opts.Follow = true
+		opts.MetaPath = er.metaPath
+		opts.Reruns = reruns
+		return viewer.RunFromFile(er.capturePath, &meta, rs, opts, editHooks(rs, cfg, meta.BaseDir))
+	}
+	ccfg := cleanup.Config{KeepCapture: *flagKeepCapture, TTLMinutes: *flagTTLMinutes}
+	if err := cleanup.WrapWithSignals(run, &meta, ccfg, er.capturePath, er.metaPath); err != nil {
+		fatalf("viewer: %v", err)
+	}
+	mu.Lock()
+	stopped = true
+	last := cur
+	mu.Unlock()
+	close(stop)
+	last.wait()
+	_ = os.Remove(last.metaPath) // only needed while following
+	exitOnFailOn(&last.final)
 }
 
 func runPipe(rs []rules.Rule, cfg *config.Config) {
 	// Create temp writer
-	wr, err := capture.NewTempWriter("ot-")
+	wr, err := capture.NewTempWriter("ot-", *flagCompress)
 	if err != nil {
 		fatalf("capture: %v", err)
 	}
@@ -380,8 +813,42 @@ func runPipe(rs []rules.Rule, cfg *config.Config) {
 	linesTotal := 0
 	matchLines := 0
 	matchesTotal := 0
+	sevLines := map[string]int{}
+	var dirs makedir.Tracker
+	mf := openMatchFiles(rs)
+	var links *hyperlink.Linker
+	if *flagHyperlink != "" {
+		links, _ = hyperlink.New(*flagHyperlink, *flagBaseDir) // checked in main
+	}
+
+	enc := capture.NewFolder(json.NewEncoder(wr.Writer()), *flagFoldDupes)
+	metaPath := wr.Path() + ".meta.json"
 
-	enc := json.NewEncoder(wr.Writer())
+	// --follow: the viewer starts now and tails the capture; --follow-on-match:
+	// at the first match line. The meta stays live until EOF.
+	follow := *flagFollow || *flagFollowMatch
+	launched := false
+	if follow {
+		live := capture.Meta{
+			Version:        1,
+			CapturePath:    wr.Path(),
+			Filtered:       *flagOnlyView,
+			LineFormat:     capture.Format(wr.Path()),
+			CreatedUnixSec: time.Now().Unix(),
+			Temp:           true,
+			OwnerPID:       os.Getpid(),
+			Live:           true,
+			BaseDir:        *flagBaseDir,
+		}
+		live.Source.Mode = "pipe"
+		if err := capture.WriteMeta(metaPath, &live); err != nil {
+			fatalf("write meta: %v", err)
+		}
+		if *flagFollow {
+			spawnViewer(cfg, wr.Path(), metaPath, true)
+			launched = true
+		}
+	}
 
 	for {
 		line, err := in.ReadString('\n')
@@ -396,20 +863,36 @@ func runPipe(rs []rules.Rule, cfg *config.Config) {
 		lineNo++
 		linesTotal++
 
+		plain := ansi.Strip(line)
+		dir := dirs.Line(plain)
+
 		// stream to stdout
-		out.WriteString(line)
+		if links != nil {
+			out.WriteString(links.Line(rs, line, dir))
+		} else {
+			out.WriteString(line)
+		}
 		out.WriteByte('\n')
-
-		matched, count := rules.AnyMatch(rs, line)
+		matched, count := rules.AnyMatch(rs, plain)
 		if matched {
 			any = true
 			matchLines++
 			matchesTotal += count
+			sev, _ := rules.LineSeverity(rs, plain)
+			sevLines[sev.String()]++
+			mf.add(lineNo, plain, dir)
+			if a := annotation(rs, plain, dir); a != "" {
+				out.WriteString(a)
+				out.WriteByte('\n')
+			}
 			if *flagMatchStderr == "line" {
 				fmt.Fprintf(errw, "%d: %s\n", lineNo, line)
 			}
 		}
 		rec := capture.Rec{N: lineNo, Text: line, M: matched}
+		if matched {
+			rec.Dir = dir
+		}
 		if *flagOnlyView {
 			if matched {
 				_ = enc.Encode(&rec)
@@ -417,20 +900,33 @@ func runPipe(rs []rules.Rule, cfg *config.Config) {
 		} else {
 			_ = enc.Encode(&rec)
 		}
+		if follow && in.Buffered() == 0 {
+			_ = enc.Flush()
+			_ = wr.Flush() // caught up with the input
+		}
+		if follow && matched && !launched {
+			spawnViewer(cfg, wr.Path(), metaPath, true)
+			launched = true
+		}
 	}
+	_ = enc.Flush()
+	_ = wr.Flush() // before the viewer reads it
+	mf.close()
 
 	// meta
 	meta := capture.Meta{
 		Version:        1,
 		CapturePath:    wr.Path(),
 		Filtered:       *flagOnlyView,
-		LineFormat:     "jsonl",
+		LineFormat:     capture.Format(wr.Path()),
 		LinesTotal:     linesTotal,
 		MatchLines:     matchLines,
 		MatchesTotal:   matchesTotal,
+		Severities:     sevLines,
 		CreatedUnixSec: time.Now().Unix(),
 		Temp:           true,
 		OwnerPID:       os.Getpid(),
+		BaseDir:        *flagBaseDir,
 	}
 	meta.Source.Mode = "pipe"
 	meta.Source.Arg = ""
@@ -438,7 +934,18 @@ func runPipe(rs []rules.Rule, cfg *config.Config) {
 		meta.Rules = append(meta.Rules, r.ID)
 	}
 
-	metaPath := wr.Path() + ".meta.json"
+	if launched {
+		if _, err := os.Stat(wr.Path()); err != nil {
+			return // the viewer was closed and cleaned up already
+		}
+		if err := capture.WriteMeta(metaPath, &meta); err != nil {
+			fatalf("write meta: %v", err)
+		}
+		out.Flush()
+		errw.Flush()
+		exitOnFailOn(&meta)
+		return
+	}
 	if err := capture.WriteMeta(metaPath, &meta); err != nil {
 		fatalf("write meta: %v", err)
 	}
@@ -450,12 +957,182 @@ func runPipe(rs []rules.Rule, cfg *config.Config) {
 		return
 	}
 
-	// spawn viewer in terminal
+	spawnViewer(cfg, wr.Path(), metaPath, false)
+	out.Flush()
+	errw.Flush()
+	exitOnFailOn(&meta)
+}
+
+// matchCounts are what --count prints.
+type matchCounts struct {
+	Lines      int            `json:"lines"`
+	MatchLines int            `json:"match_lines"`
+	Matches    int            `json:"matches"`
+	Rules      map[string]int `json:"rules"`      // matches per rule id
+	Severities map[string]int `json:"severities"` // match lines per severity
+}
+
+// runCount counts the matches in stdin, --file or the output of a command
+// (stdout and stderr, whose exit code is then ours when it fails).
+func runCount(rs []rules.Rule, cmdArgs []string) {
+	var in io.Reader = os.Stdin
+	var cmd *exec.Cmd
+	switch {
+	case *flagFile != "":
+		f, err := os.Open(*flagFile)
+		if err != nil {
+			fatalf("read: %v", err)
+		}
+		defer f.Close()
+		in = f
+	case !*flagPipe:
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			fatalf("exec: %v", err)
+		}
+		cmd = exec.Command(cmdArgs[0], cmdArgs[1:]...)
+		cmd.Stdout, cmd.Stderr = pw, pw
+		if err := cmd.Start(); err != nil {
+			fatalf("exec: %v", err)
+		}
+		pw.Close()
+		defer pr.Close()
+		in = pr
+	}
+
+	c := matchCounts{Rules: map[string]int{}, Severities: map[string]int{}}
+	for _, r := range rs {
+		c.Rules[r.ID] = 0
+	}
+	br := bufio.NewReaderSize(in, 64*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			plain := ansi.Strip(strings.TrimRight(line, "\r\n"))
+			c.Lines++
+			n := 0
+			for _, r := range rs {
+				k := len(r.Regex.FindAllStringIndex(plain, -1))
+				c.Rules[r.ID] += k
+				n += k
+			}
+			if n > 0 {
+				c.MatchLines++
+				c.Matches += n
+				sev, _ := rules.LineSeverity(rs, plain)
+				c.Severities[sev.String()]++
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if *flagCountFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(&c)
+	} else {
+		for _, r := range rs {
+			fmt.Printf("%s\t%d\n", r.ID, c.Rules[r.ID])
+		}
+		fmt.Printf("total\t%d\n", c.Matches)
+	}
+
+	if cmd != nil {
+		if err := cmd.Wait(); err != nil {
+			var ee *exec.ExitError
+			if errors.As(err, &ee) && ee.ExitCode() > 0 {
+				os.Exit(ee.ExitCode())
+			}
+			os.Exit(1)
+		}
+	}
+	exitOnFailOn(&capture.Meta{Severities: c.Severities})
+}
+
+// exitOnFailOn exits 1 when --fail-on is set and meta counts a match line of
+// that severity or higher.
+func exitOnFailOn(meta *capture.Meta) {
+	if *flagFailOn == "" {
+		return
+	}
+	min, _ := rules.ParseSeverity(*flagFailOn)
+	for name, n := range meta.Severities {
+		if sev, ok := rules.ParseSeverity(name); ok && sev >= min && n > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// annotation is the --annotate line for a match line ("" without one).
+func annotation(rs []rules.Rule, plain, dir string) string {
+	if *flagAnnotate != "github" {
+		return ""
+	}
+	a, _ := annotate.GitHub(rs, plain, dir)
+	return a
+}
+
+// matchFiles are the per-match outputs besides the capture: --quickfix
+// (written at the end) and --export (written as matches arrive).
+type matchFiles struct {
+	rs  []rules.Rule
+	qf  []string
+	exp *export.Writer
+}
+
+func openMatchFiles(rs []rules.Rule) *matchFiles {
+	mf := &matchFiles{rs: rs}
+	if *flagExport != "" {
+		w, err := export.Create(*flagExportDest, *flagExport)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		mf.exp = w
+	}
+	return mf
+}
+
+// add records match line n (escapes stripped); dir is make's directory.
+func (mf *matchFiles) add(n int, plain, dir string) {
+	if *flagQuickfix != "" {
+		if e, ok := quickfix.Line(mf.rs, plain, dir); ok {
+			mf.qf = append(mf.qf, e)
+		}
+	}
+	if mf.exp != nil {
+		mf.exp.Match(mf.rs, n, plain, dir)
+	}
+}
+
+// close writes the --quickfix file (even when empty, so a stale list from an
+// earlier run doesn't linger) and finishes the export.
+func (mf *matchFiles) close() {
+	if *flagQuickfix != "" {
+		if err := quickfix.WriteFile(*flagQuickfix, mf.qf); err != nil {
+			fmt.Fprintf(os.Stderr, "quickfix: %v\n", err)
+		}
+	}
+	if mf.exp != nil {
+		if err := mf.exp.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// spawnViewer launches `--view` on the capture in a new terminal (or tmux),
+// tailing it when follow is set.
+func spawnViewer(cfg *config.Config, capturePath, metaPath string, follow bool) {
 	self, _ := os.Executable()
 	lcfg := launcher.Config{
 		TermPrefix:    cfg.Launcher.TermPrefix,
 		TmuxPrefix:    cfg.Launcher.TmuxPrefix,
 		PreferTmux:    cfg.Launcher.PreferTmux,
+		TmuxMode:      cfg.Launcher.TmuxMode,
+		TmuxWidth:     cfg.Launcher.TmuxWidth,
+		TmuxHeight:    cfg.Launcher.TmuxHeight,
+		TmuxReuse:     cfg.Launcher.TmuxReuse,
 		ViewerTitle:   *flagViewerTitle,
 		OnlyView:      *flagOnlyView,
 		Mouse:         *flagMouse,
@@ -465,8 +1142,15 @@ func runPipe(rs []rules.Rule, cfg *config.Config) {
 		ForceTmux:     *flagTmuxForce,
 		NoTmux:        *flagTmuxOff,
 		ErrLinesMax:   *flagErrLines,
+		TabWidth:      *flagTabWidth,
+		Follow:        follow,
+		Wrap:          *flagWrap,
+		Rules:         *flagRules,
+		ConfigPath:    loadedConfig,
+		Quickfix:      *flagQuickfix,
+		Theme:         *flagTheme,
 	}
-	if err := launcher.SpawnTerminalViewer(lcfg, self, wr.Path(), metaPath); err != nil {
+	if err := launcher.SpawnTerminalViewer(lcfg, self, capturePath, metaPath); err != nil {
 		fatalf("launch viewer: %v", err)
 	}
 }
@@ -478,41 +1162,55 @@ func runFile(rs []rules.Rule, cfg *config.Config, path string) {
 	}
 
 	// write capture to temp for simplicity (Temp=false so no auto-delete)
-	wr, err := capture.NewTempWriter("ot-")
+	wr, err := capture.NewTempWriter("ot-", *flagCompress)
 	if err != nil {
 		fatalf("capture: %v", err)
 	}
-	enc := json.NewEncoder(wr.Writer())
+	enc := capture.NewFolder(json.NewEncoder(wr.Writer()), *flagFoldDupes)
 
 	sc := bufio.NewScanner(bytes.NewReader(data))
 	sc.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
-	lineNo := 0
+	lineNo, matchLines, matchesTotal := 0, 0, 0
+	sevLines := map[string]int{}
+	var dirs makedir.Tracker
+	mf := openMatchFiles(rs)
 	for sc.Scan() {
 		lineNo++
 		line := sc.Text()
-		matched, _ := rules.AnyMatch(rs, line)
+		plain := ansi.Strip(line)
+		dir := dirs.Line(plain)
+		matched, count := rules.AnyMatch(rs, plain)
+		if matched {
+			matchLines++
+			matchesTotal += count
+			sev, _ := rules.LineSeverity(rs, plain)
+			sevLines[sev.String()]++
+			mf.add(lineNo, plain, dir)
+		}
+		// keep every line: the viewer filters (f toggles) for --only-view-matches
 		rec := capture.Rec{N: lineNo, Text: line, M: matched}
-		if *flagOnlyView {
-			if matched {
-				_ = enc.Encode(&rec)
-			}
-		} else {
-			_ = enc.Encode(&rec)
+		if matched {
+			rec.Dir = dir
 		}
+		_ = enc.Encode(&rec)
 	}
+	_ = enc.Flush()
 	_ = wr.Close()
+	mf.close()
 
 	meta := capture.Meta{
 		Version:        1,
 		CapturePath:    wr.Path(),
-		Filtered:       *flagOnlyView,
-		LineFormat:     "jsonl",
+		Filtered:       false,
+		LineFormat:     capture.Format(wr.Path()),
 		LinesTotal:     lineNo,
-		MatchLines:     0,
-		MatchesTotal:   0,
+		MatchLines:     matchLines,
+		MatchesTotal:   matchesTotal,
+		Severities:     sevLines,
 		CreatedUnixSec: time.Now().Unix(),
 		Temp:           false,
 		OwnerPID:       os.Getpid(),
+		BaseDir:        *flagBaseDir,
 	}
 	meta.Source.Mode = "file"
 	meta.Source.Arg = path
@@ -521,16 +1219,15 @@ func runFile(rs []rules.Rule, cfg *config.Config, path string) {
 
 	// run viewer inline, with cleanup wrapper (won't delete since Temp=false)
 	run := func() error {
-		return viewer.RunFromFile(wr.Path(), &meta, rs, viewerOptions(), viewer.Hooks{
-			OnActivate: func(lineText string) ([]string, error) {
-				return editor.LaunchForLine(lineText, rs, editorConfig(cfg))
-			},
-		})
+		opts := viewerOptions()
+		opts.Follow = false // the capture is complete
+		return viewer.RunFromFile(wr.Path(), &meta, rs, opts, editHooks(rs, cfg, meta.BaseDir))
 	}
 	ccfg := cleanup.Config{KeepCapture: *flagKeepCapture, TTLMinutes: *flagTTLMinutes}
 	if err := cleanup.WrapWithSignals(run, &meta, ccfg, wr.Path(), metaPath); err != nil {
 		fatalf("viewer: %v", err)
 	}
+	exitOnFailOn(&meta)
 }
 
 func viewerOptions() viewer.Options {
@@ -542,10 +1239,17 @@ func viewerOptions() viewer.Options {
 		Mouse:         *flagMouse,
 		NoAlt:         *flagNoAlt,
 		ErrLinesMax:   *flagErrLines,
+		TabWidth:      *flagTabWidth,
+		Follow:        *flagFollow,
+		OnlyMatches:   *flagOnlyView,
+		Wrap:          *flagWrap,
+		Quickfix:      *flagQuickfix,
+		Theme:         *flagTheme,
+		Themes:        themes,
 	}
 }
 
-func runViewerWithCleanup(capturePath, metaPath string, cfg *config.Config) {
+func runViewerWithCleanup(capturePath, metaPath string, rs []rules.Rule, cfg *config.Config) {
 	// load meta if present
 	var meta capture.Meta
 	if metaPath != "" {
@@ -556,14 +1260,10 @@ func runViewerWithCleanup(capturePath, metaPath string, cfg *config.Config) {
 	// sweep orphans
 	cleanup.SweepOrphans(*flagTTLMinutes)
 
-	// rules from compiled defaults (config already applied above to flags; rules for viewer can be default)
-	rs := rules.Default()
 	run := func() error {
-		return viewer.RunFromFile(capturePath, &meta, rs, viewerOptions(), viewer.Hooks{
-			OnActivate: func(lineText string) ([]string, error) {
-				return editor.LaunchForLine(lineText, rs, editorConfig(cfg))
-			},
-		})
+		opts := viewerOptions()
+		opts.MetaPath = metaPath
+		return viewer.RunFromFile(capturePath, &meta, rs, opts, editHooks(rs, cfg, meta.BaseDir))
 	}
 	ccfg := cleanup.Config{KeepCapture: *flagKeepCapture, TTLMinutes: *flagTTLMinutes}
 	_ = cleanup.WrapWithSignals(run, &meta, ccfg, capturePath, metaPath)
@@ -52,19 +52,50 @@ var (
 	flagEnvs     envList
 	flagID       string
 	flagVerbose  bool
+	flagPID      int
 )
 
-func init() {
-	// NOTE: Go's flag package accepts "-flag" by default; many shells also pass "--flag" fine.
-	flag.StringVar(&flagRoot, "root", "", "socket root path (REQUIRED)")
-	flag.StringVar(&flagMode, "mode", "", "mode: server or client (REQUIRED)")
-	flag.StringVar(&flagName, "name", "", "server socket name (listens on <root>/<name>.sock) or client target name (connects to it) (REQUIRED)")
-	flag.StringVar(&flagStartDir, "startdir", "", "server: chdir on startup; client: per-request working directory")
-	flag.StringVar(&flagStdinStr, "stdin", "", "client: literal stdin data (mutually exclusive with -stdinfile)")
-	flag.StringVar(&flagStdinFile, "stdinfile", "", "client: path to file used as stdin (mutually exclusive with -stdin)")
-	flag.Var(&flagEnvs, "env", "repeatable env (KEY=VAL or KEY). Server: base env; Client: per-request overlay. (repeat)")
-	flag.StringVar(&flagID, "id", "", "machine ID override (else /etc/machine-id; else random)")
-	flag.BoolVar(&flagVerbose, "verbose", false, "client: print timing/summary (still exits with server return code)")
+// Subcommands, each with its own flag set:
+//   prs server -root R -name N [-startdir DIR] [-env ...]
+//   prs exec   -root R -name N [-startdir DIR] [-stdin STR|-stdinfile PATH] [-env ...] [-id ID] [-verbose] -- COMMAND [ARGS...]
+//   prs cancel -root R -name N -pid PID [-id ID]
+//   prs ping   -root R -name N [-id ID] [-verbose]
+// The old "-mode server|client" form is still accepted.
+// NOTE: Go's flag package accepts "-flag" by default; many shells also pass "--flag" fine.
+
+func addTargetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagRoot, "root", "", "socket root path (REQUIRED)")
+	fs.StringVar(&flagName, "name", "", "server socket name, <root>/<name>.sock (REQUIRED)")
+}
+
+func addServerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagStartDir, "startdir", "", "chdir on startup")
+	fs.Var(&flagEnvs, "env", "repeatable base env for children (KEY=VAL or KEY) (repeat)")
+}
+
+func addExecFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagStartDir, "startdir", "", "per-request working directory")
+	fs.StringVar(&flagStdinStr, "stdin", "", "literal stdin data (mutually exclusive with -stdinfile)")
+	fs.StringVar(&flagStdinFile, "stdinfile", "", "path to file used as stdin (mutually exclusive with -stdin)")
+	fs.Var(&flagEnvs, "env", "repeatable env overlay for the command (KEY=VAL or KEY) (repeat)")
+}
+
+func addIDFlag(fs *flag.FlagSet) {
+	fs.StringVar(&flagID, "id", "", "machine ID override (else /etc/machine-id; else random)")
+}
+
+func addVerboseFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&flagVerbose, "verbose", false, "print timing/summary (still exits with server return code)")
+}
+
+func newSubcommand(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", filepath.Base(os.Args[0]), name, usage)
+		fs.PrintDefaults()
+	}
+	addTargetFlags(fs)
+	return fs
 }
 
 /* ===========================
@@ -812,8 +843,8 @@ func exitCodeFromWaitErr(err error) int {
    =========================== */
 
 func runServer() {
-	if flagRoot == "" || flagMode != "server" || flagName == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -mode server -name <name> [-startdir DIR] [--env ...]\n", filepath.Base(os.Args[0]))
+	if flagRoot == "" || flagName == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s server -root <path> -name <name> [-startdir DIR] [--env ...]\n", filepath.Base(os.Args[0]))
 		os.Exit(2)
 	}
 	absRoot, err := filepath.Abs(flagRoot)
@@ -910,9 +941,10 @@ func runServer() {
    Client runner
    =========================== */
 
-func runClient() {
-	if flagRoot == "" || flagMode != "client" || flagName == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -mode client -name <name> [-startdir DIR] [-stdin STR|-stdinfile PATH] [--env ...] [-id ID] [-verbose] -- [COMMAND [ARGS...]]\n", filepath.Base(os.Args[0]))
+// runClient runs cmdline on the server; an empty cmdline is a ping.
+func runClient(cmdline []string) {
+	if flagRoot == "" || flagName == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s exec -root <path> -name <name> [-startdir DIR] [-stdin STR|-stdinfile PATH] [--env ...] [-id ID] [-verbose] -- COMMAND [ARGS...]\n", filepath.Base(os.Args[0]))
 		os.Exit(2)
 	}
 	if flagStdinStr != "" && flagStdinFile != "" {
@@ -1023,7 +1055,6 @@ func runClient() {
 	}()
 
 	// Command & args (positional after flags)
-	cmdline := flag.Args()
 	var command string
 	var cmdArgs []string
 	if len(cmdline) > 0 {
@@ -1105,6 +1136,41 @@ func runClient() {
 	os.Exit(resp.ReturnCode)
 }
 
+/* ===========================
+   Cancel runner
+   =========================== */
+
+// runCancel asks the server to stop the session of another client process,
+// identified by its machine ID and PID.
+func runCancel() {
+	if flagRoot == "" || flagName == "" || flagPID <= 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s cancel -root <path> -name <name> -pid PID [-id ID]\n", filepath.Base(os.Args[0]))
+		os.Exit(2)
+	}
+	absRoot, err := filepath.Abs(flagRoot)
+	if err != nil {
+		errorf("invalid root: %v", err)
+		os.Exit(2)
+	}
+	machineID := loadMachineID(flagID)
+	conn, err := net.Dial("unix", filepath.Join(absRoot, flagName+".sock"))
+	if err != nil {
+		errorf("dial server: %v", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	var reply CancelReply
+	if err := jsonrpc.NewClient(conn).Call("ServerService.Cancel", CancelArgs{MachineID: machineID, PID: flagPID}, &reply); err != nil {
+		errorf("rpc error: %v", err)
+		os.Exit(1)
+	}
+	if !reply.OK {
+		errorf("no session for machine %s pid %d", machineID, flagPID)
+		os.Exit(1)
+	}
+	infof("cancel sent to machine %s pid %d", machineID, flagPID)
+}
+
 /* ===========================
    Socket server helper (client side)
    =========================== */
@@ -1136,19 +1202,88 @@ func serveOnSocket(sockPath, serviceName string, svc any, ready chan<- struct{})
    main
    =========================== */
 
-func main() {
-	flag.Parse()
+func usage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", prog)
+	fmt.Fprintln(os.Stderr, "  server   serve <root>/<name>.sock")
+	fmt.Fprintln(os.Stderr, "  exec     run a command on the server: exec [flags] -- COMMAND [ARGS...]")
+	fmt.Fprintln(os.Stderr, "  cancel   cancel the session of a client process (-pid)")
+	fmt.Fprintln(os.Stderr, "  ping     check that the server answers")
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command\n", prog)
+}
 
-	// Randomize math/rand once (used minimally)
-	mrand.Seed(time.Now().UnixNano())
+// runLegacy keeps the original single flag set with -mode server|client.
+func runLegacy(args []string) {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	addTargetFlags(fs)
+	fs.StringVar(&flagMode, "mode", "", "mode: server or client (REQUIRED)")
+	fs.StringVar(&flagStartDir, "startdir", "", "server: chdir on startup; client: per-request working directory")
+	fs.StringVar(&flagStdinStr, "stdin", "", "client: literal stdin data (mutually exclusive with -stdinfile)")
+	fs.StringVar(&flagStdinFile, "stdinfile", "", "client: path to file used as stdin (mutually exclusive with -stdin)")
+	fs.Var(&flagEnvs, "env", "repeatable env (KEY=VAL or KEY). Server: base env; Client: per-request overlay. (repeat)")
+	addIDFlag(fs)
+	addVerboseFlag(fs)
+	_ = fs.Parse(args)
 
 	switch flagMode {
 	case "server":
 		runServer()
 	case "client":
-		runClient()
+		runClient(fs.Args())
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func main() {
+	// Randomize math/rand once (used minimally)
+	mrand.Seed(time.Now().UnixNano())
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	sub, args := os.Args[1], os.Args[2:]
+	if strings.HasPrefix(sub, "-") && sub != "-h" && sub != "-help" && sub != "--help" {
+		runLegacy(os.Args[1:])
+		return
+	}
+
+	switch sub {
+	case "server":
+		fs := newSubcommand(sub, "-root <path> -name <name> [-startdir DIR] [-env ...]")
+		addServerFlags(fs)
+		_ = fs.Parse(args)
+		runServer()
+	case "exec":
+		fs := newSubcommand(sub, "-root <path> -name <name> [flags] -- COMMAND [ARGS...]")
+		addExecFlags(fs)
+		addIDFlag(fs)
+		addVerboseFlag(fs)
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		runClient(fs.Args())
+	case "cancel":
+		fs := newSubcommand(sub, "-root <path> -name <name> -pid PID [-id ID]")
+		fs.IntVar(&flagPID, "pid", 0, "client process ID whose session to cancel (REQUIRED)")
+		addIDFlag(fs)
+		_ = fs.Parse(args)
+		runCancel()
+	case "ping":
+		fs := newSubcommand(sub, "-root <path> -name <name> [-id ID] [-verbose]")
+		addIDFlag(fs)
+		addVerboseFlag(fs)
+		_ = fs.Parse(args)
+		runClient(nil)
+	case "help", "-h", "-help", "--help":
+		usage()
 	default:
-		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -mode server|client -name <name> [other flags]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", sub)
+		usage()
 		os.Exit(2)
 	}
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -27,12 +30,56 @@ var (
 	flagStdinStr  string
 	flagStdinFile string
 	flagEnvs      envList
+	flagLabels    labelMap
+	flagProto     int
+	flagQueue     string
 	flagID        string
 	flagSummary   bool
 	flagConfig    string
 	flagServer    bool
+	flagStats     bool
+
+	flagBatch       string
+	flagBatchPolicy string
+	flagParallel    int
+	flagProgress    time.Duration
+	flagGrace       time.Duration
+	flagGraceSet    bool // -grace given, so 0 counts
+	flagSignalRC    int
+	flagInterleave  bool
+	flagReconnect   time.Duration
+	flagCompress    string
+	flagPing        bool
+	flagPut         envList
+	flagGet         envList
+	flagCount       int
+	flagInterval    time.Duration
+	flagMaxWall     time.Duration
+	flagDirMode     string
+	flagDirGroup    string
+	flagLogLevel    string
+	flagLogFormat   string
+	flagLogFile     string
 )
 
+// maxWallExitCode is returned when -max-wall expires (same as timeout(1)).
+const maxWallExitCode = 124
+
+type labelMap map[string]string
+
+func (m *labelMap) String() string { return csjrpc.FormatLabels(*m) }
+func (m *labelMap) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("label %q: want KEY=VALUE", s)
+	}
+	if *m == nil {
+		*m = make(labelMap)
+	}
+	(*m)[k] = v
+	return csjrpc.ValidateLabels(*m)
+}
+
 type envList []string
 
 func (e *envList) String() string { return strings.Join(*e, ",") }
@@ -44,30 +91,86 @@ func (e *envList) Set(s string) error {
 	return nil
 }
 
+// statusLine is a single overwritable progress line on stderr. On a terminal
+// it is redrawn in place and erased before regular output; otherwise each
+// update is logged as its own line.
+type statusLine struct {
+	mu    sync.Mutex
+	out   *os.File
+	tty   bool
+	shown bool
+}
+
+func newStatusLine(out *os.File) *statusLine {
+	l := &statusLine{out: out}
+	if fi, err := out.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		l.tty = true
+	}
+	return l
+}
+
+func (l *statusLine) show(text string) {
+	if l == nil {
+		return
+	}
+	if !l.tty {
+		csjrpc.Infof("progress: %s", text)
+		return
+	}
+	l.mu.Lock()
+	fmt.Fprintf(l.out, "\r\x1b[K%s", text)
+	l.shown = true
+	l.mu.Unlock()
+}
+
+func (l *statusLine) clear() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.shown {
+		fmt.Fprint(l.out, "\r\x1b[K")
+		l.shown = false
+	}
+	l.mu.Unlock()
+}
+
 type reorderSink struct {
 	mu     sync.Mutex
 	next   int
-	buffer map[int]string
+	buffer map[int]csjrpc.Line
 	out    *os.File
+	errOut *os.File    // interleaved mode: destination of OriginStderr lines
+	status *statusLine // erased before each line; may be nil
 }
 
-func newReorderSink(out *os.File) *reorderSink {
+func newReorderSink(out *os.File, status *statusLine) *reorderSink {
 	return &reorderSink{
-		buffer: make(map[int]string),
+		buffer: make(map[int]csjrpc.Line),
 		out:    out,
+		status: status,
 	}
 }
 
 func (s *reorderSink) write(line csjrpc.Line) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.buffer[line.Index] = line.Text
+	s.buffer[line.Index] = line
 	for {
-		txt, ok := s.buffer[s.next]
+		l, ok := s.buffer[s.next]
 		if !ok {
 			break
 		}
-		fmt.Fprintln(s.out, txt)
+		s.status.clear()
+		out := s.out
+		if l.Origin == csjrpc.OriginStderr && s.errOut != nil {
+			out = s.errOut
+		}
+		if l.Continued {
+			fmt.Fprint(out, l.Text)
+		} else {
+			fmt.Fprintln(out, l.Text)
+		}
 		delete(s.buffer, s.next)
 		s.next++
 	}
@@ -79,6 +182,89 @@ type StderrService struct{ sink *reorderSink }
 func (s *StdoutService) WriteLine(in csjrpc.Line, _ *struct{}) error { s.sink.write(in); return nil }
 func (s *StderrService) WriteLine(in csjrpc.Line, _ *struct{}) error { s.sink.write(in); return nil }
 
+func (s *StdoutService) WriteBatch(in csjrpc.LineBatch, _ *struct{}) error {
+	return s.sink.writeBatch(in)
+}
+func (s *StderrService) WriteBatch(in csjrpc.LineBatch, _ *struct{}) error {
+	return s.sink.writeBatch(in)
+}
+
+func (s *reorderSink) writeBatch(b csjrpc.LineBatch) error {
+	lines, err := csjrpc.DecodeLines(b)
+	if err != nil {
+		csjrpc.Errorf("decode output batch: %v", err)
+		return err
+	}
+	for _, l := range lines {
+		s.write(l)
+	}
+	return nil
+}
+
+// discardService accepts output lines and drops them (ping mode).
+type discardService struct{}
+
+func (discardService) WriteLine(csjrpc.Line, *struct{}) error       { return nil }
+func (discardService) WriteBatch(csjrpc.LineBatch, *struct{}) error { return nil }
+
+type ProgressService struct{ status *statusLine }
+
+func (p *ProgressService) Update(in csjrpc.ProgressArgs, _ *struct{}) error {
+	p.status.show(fmt.Sprintf("[pid %d] %s out=%d lines/%s err=%d lines/%s cpu=%s rss=%s",
+		in.PID,
+		(time.Duration(in.ElapsedMillis) * time.Millisecond).Round(time.Second),
+		in.StdoutLines, humanBytes(in.StdoutBytes),
+		in.StderrLines, humanBytes(in.StderrBytes),
+		time.Duration(in.CPUMillis)*time.Millisecond,
+		humanBytes(in.RSSBytes)))
+	return nil
+}
+
+// QueueService reports the -queue position; the server repeats unchanged
+// positions as a liveness check, only changes are shown.
+type QueueService struct {
+	mu     sync.Mutex
+	last   int
+	status *statusLine
+}
+
+func (q *QueueService) Update(in csjrpc.QueueArgs, _ *struct{}) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if in.Position == q.last {
+		return nil
+	}
+	waited := q.last > 0
+	q.last = in.Position
+	if in.Position == 0 {
+		q.status.clear()
+		if waited {
+			csjrpc.Infof("queue %q: running", in.Key)
+		}
+		return nil
+	}
+	msg := fmt.Sprintf("queue %q: position %d of %d", in.Key, in.Position, in.Length)
+	if q.status != nil {
+		q.status.show(msg)
+	} else {
+		csjrpc.Infof("%s", msg)
+	}
+	return nil
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 type StdinService struct {
 	mu sync.Mutex
 	r  io.Reader
@@ -112,8 +298,11 @@ func (s *StdinService) ReadChunk(args csjrpc.StdinReadArgs, reply *csjrpc.StdinR
 	return nil
 }
 
-func serveOnSocket(sockPath, serviceName string, svc any, ready chan<- struct{}) (net.Listener, error) {
-	if _, err := os.Lstat(sockPath); err == nil {
+// serveOnSocket serves the registered callback services on sockPath.
+func serveOnSocket(sockPath string, ready chan<- struct{}) (net.Listener, error) {
+	if csjrpc.IsAbstract(sockPath) {
+		// nothing on disk; Listen itself fails with EADDRINUSE on a clash
+	} else if _, err := os.Lstat(sockPath); err == nil {
 		return nil, fmt.Errorf("refusing to overwrite existing socket: %s", sockPath)
 	} else if !os.IsNotExist(err) {
 		return nil, fmt.Errorf("stat socket %s: %v", sockPath, err)
@@ -122,10 +311,6 @@ func serveOnSocket(sockPath, serviceName string, svc any, ready chan<- struct{})
 	if err != nil {
 		return nil, err
 	}
-	if err := rpc.RegisterName(serviceName, svc); err != nil {
-		l.Close()
-		return nil, err
-	}
 	go func() {
 		close(ready)
 		for {
@@ -139,6 +324,359 @@ func serveOnSocket(sockPath, serviceName string, svc any, ready chan<- struct{})
 	return l, nil
 }
 
+// parseBatchFile reads one command per line: either a JSON array of strings
+// (["cmd","arg 1"]) or whitespace separated words. Blank lines and lines
+// starting with '#' are skipped. Path "-" reads the client's stdin.
+func parseBatchFile(path string) ([]csjrpc.BatchCommand, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var out []csjrpc.BatchCommand
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var words []string
+		if strings.HasPrefix(line, "[") {
+			if err := json.Unmarshal([]byte(line), &words); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+		} else {
+			words = strings.Fields(line)
+		}
+		if len(words) == 0 || words[0] == "" {
+			return nil, fmt.Errorf("%s:%d: empty command", path, lineNo)
+		}
+		out = append(out, csjrpc.BatchCommand{Command: words[0], Args: words[1:]})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no commands", path)
+	}
+	return out, nil
+}
+
+// callWithMaxWall performs the RPC; if maxWall (> 0) elapses first it calls
+// cancel and waits up to settle for the server to answer. timedOut reports
+// whether the limit was hit; the reply is only valid when err == nil.
+func callWithMaxWall(client *rpc.Client, method string, args, reply any, maxWall, settle time.Duration, cancel func()) (timedOut bool, err error) {
+	if maxWall <= 0 {
+		return false, client.Call(method, args, reply)
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return false, call.Error
+	case <-time.After(maxWall):
+	}
+	csjrpc.Warnf("max wall time %s exceeded; cancelling", maxWall)
+	cancel()
+	select {
+	case <-call.Done:
+		return true, call.Error
+	case <-time.After(settle):
+		return true, fmt.Errorf("server did not return within %s after cancel", settle)
+	}
+}
+
+// printStats queries ServerService.Stats and prints one "key: value" line per
+// counter; the return value is the exit code (1 when the server is unreachable).
+func printStats(mainSock string) int {
+	conn, err := net.Dial("unix", mainSock)
+	if err != nil {
+		csjrpc.Errorf("dial server: %v", err)
+		return 1
+	}
+	defer conn.Close()
+	var st csjrpc.StatsReply
+	if err := jsonrpc.NewClient(conn).Call("ServerService.Stats", csjrpc.StatsArgs{}, &st); err != nil {
+		csjrpc.Errorf("rpc error: %v", err)
+		return 1
+	}
+	fmt.Printf("started:         %s\n", st.StartedRFC3339)
+	fmt.Printf("uptime:          %s\n", (time.Duration(st.UptimeMillis) * time.Millisecond).String())
+	fmt.Printf("sessions_total:  %d\n", st.TotalSessions)
+	fmt.Printf("sessions_active: %d\n", st.ActiveSessions)
+	fmt.Printf("queued:          %d\n", st.Queued)
+	fmt.Printf("commands:        %d\n", st.Commands)
+	fmt.Printf("commands_failed: %d\n", st.FailedCommands)
+	fmt.Printf("exec_time:       %s\n", (time.Duration(st.ExecMillis) * time.Millisecond).String())
+	if st.LastError != "" {
+		fmt.Printf("last_error:      %s key=%s %s\n", st.LastErrorRFC3339, st.LastErrorKey, st.LastError)
+	}
+	keys := make([]string, 0, len(st.Queues))
+	for k := range st.Queues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("queue:           %q %d\n", k, st.Queues[k])
+	}
+	for _, a := range st.Active {
+		fmt.Printf("active:          id=%d key=%s started=%s labels=%s cmd=%q\n", a.ID, a.Key, a.StartedRFC3339, csjrpc.FormatLabels(a.Labels), a.Command)
+	}
+	return 0
+}
+
+// putFile uploads spec (LOCAL[:REMOTE], REMOTE defaults to LOCAL's base
+// name) in FileChunkSize pieces.
+func putFile(client *rpc.Client, machineID string, pid int, nonce, spec string) error {
+	local, remote, ok := strings.Cut(spec, ":")
+	if !ok || remote == "" {
+		remote = filepath.Base(local)
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, csjrpc.FileChunkSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		var rep csjrpc.PutFileReply
+		if err := client.Call("ServerService.PutFile", csjrpc.PutFileArgs{
+			MachineID: machineID,
+			PID:       pid,
+			Nonce:     nonce,
+			StartDir:  flagStartDir,
+			Path:      remote,
+			Offset:    off,
+			Data:      buf[:n],
+			Final:     final,
+			Mode:      uint32(fi.Mode().Perm()),
+		}, &rep); err != nil {
+			return err
+		}
+		if rep.Error != "" {
+			return errors.New(rep.Error)
+		}
+		off = rep.Size
+		if final {
+			return nil
+		}
+	}
+}
+
+// getFile downloads spec (REMOTE[:LOCAL], LOCAL defaults to REMOTE's base
+// name), writing to a temp file that replaces LOCAL once complete.
+func getFile(client *rpc.Client, machineID string, pid int, nonce, spec string) error {
+	remote, local, ok := strings.Cut(spec, ":")
+	if !ok || local == "" {
+		local = filepath.Base(remote)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var off int64
+	for {
+		var rep csjrpc.GetFileReply
+		if err := client.Call("ServerService.GetFile", csjrpc.GetFileArgs{
+			MachineID: machineID,
+			PID:       pid,
+			Nonce:     nonce,
+			StartDir:  flagStartDir,
+			Path:      remote,
+			Offset:    off,
+			Max:       csjrpc.FileChunkSize,
+		}, &rep); err != nil {
+			return err
+		}
+		if rep.Error != "" {
+			return errors.New(rep.Error)
+		}
+		if _, err := tmp.Write(rep.Data); err != nil {
+			return err
+		}
+		off += int64(len(rep.Data))
+		if rep.EOF {
+			break
+		}
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), local)
+}
+
+// getFiles runs all -get transfers; the result is 1 if any failed.
+func getFiles(client *rpc.Client, machineID string, pid int, nonce string) int {
+	rc := 0
+	for _, spec := range flagGet {
+		if err := getFile(client, machineID, pid, nonce, spec); err != nil {
+			csjrpc.Errorf("get %s: %v", spec, err)
+			rc = 1
+		}
+	}
+	return rc
+}
+
+// negotiateProtocol offers max (0: ProtoMax) via Hello; servers that predate
+// Hello answer with an rpc.ServerError and get ProtoSockets.
+func negotiateProtocol(client *rpc.Client, max int) (int, error) {
+	if max <= 0 {
+		max = csjrpc.ProtoMax
+	}
+	if max == csjrpc.ProtoSockets {
+		return max, nil
+	}
+	var rep csjrpc.HelloReply
+	err := client.Call("ServerService.Hello", csjrpc.HelloArgs{Protocol: max}, &rep)
+	var se rpc.ServerError
+	if errors.As(err, &se) {
+		return csjrpc.ProtoSockets, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if rep.Protocol > max {
+		return max, nil
+	}
+	return csjrpc.NegotiateProtocol(rep.Protocol), nil
+}
+
+// runPing sends -count empty Process requests -interval apart and prints
+// per-request and summary round-trip times in the style of ping(8). It
+// returns the exit code: 0 if any request succeeded.
+func runPing(client *rpc.Client, mainSock, machineID string, pid int, nonce string, proto int) int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var sent, recv int
+	var min, max, total time.Duration
+	fmt.Printf("PING %s\n", mainSock)
+loop:
+	for seq := 1; flagCount <= 0 || seq <= flagCount; seq++ {
+		if seq > 1 {
+			select {
+			case <-stop:
+				break loop
+			case <-time.After(flagInterval):
+			}
+		}
+		if client == nil {
+			conn, err := net.Dial("unix", mainSock)
+			if err != nil {
+				sent++
+				fmt.Printf("seq=%d error: %v\n", seq, err)
+				continue
+			}
+			client = jsonrpc.NewClient(conn)
+		}
+		sent++
+		var resp csjrpc.ProcessReply
+		start := time.Now()
+		err := client.Call("ServerService.Process", csjrpc.ProcessArgs{MachineID: machineID, PID: pid, Nonce: nonce, Protocol: proto}, &resp)
+		rtt := time.Since(start)
+		switch {
+		case err != nil:
+			fmt.Printf("seq=%d error: %v\n", seq, err)
+			if connBroken(err) {
+				client.Close()
+				client = nil
+			}
+			continue
+		case resp.ReturnCode != 0:
+			fmt.Printf("seq=%d rc=%d %s\n", seq, resp.ReturnCode, resp.Error)
+			continue
+		}
+		recv++
+		total += rtt
+		if recv == 1 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		fmt.Printf("seq=%d time=%.3f ms\n", seq, float64(rtt.Microseconds())/1000)
+	}
+	if client != nil {
+		client.Close()
+	}
+
+	loss := 0.0
+	if sent > 0 {
+		loss = float64(sent-recv) * 100 / float64(sent)
+	}
+	fmt.Printf("--- %s ping statistics ---\n", mainSock)
+	fmt.Printf("%d requests sent, %d answered, %.1f%% loss\n", sent, recv, loss)
+	if recv > 0 {
+		ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+		fmt.Printf("rtt min/avg/max = %.3f/%.3f/%.3f ms\n", ms(min), ms(total/time.Duration(recv)), ms(max))
+		return 0
+	}
+	return 1
+}
+
+// connBroken tells transport failures apart from errors returned by the
+// server's method.
+func connBroken(err error) bool {
+	var se rpc.ServerError
+	return !errors.As(err, &se)
+}
+
+// recoverResult redials the server and polls ServerService.Result until the
+// call with our (machineID, pid, nonce) has finished or window has passed.
+// The returned client is the new connection, left open.
+func recoverResult(mainSock, machineID string, pid int, nonce string, window time.Duration) (*rpc.Client, csjrpc.ProcessReply, error) {
+	deadline := time.Now().Add(window)
+	lastErr := errors.New("timed out")
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("unix", mainSock)
+		if err == nil {
+			var rr csjrpc.ResultReply
+			client := jsonrpc.NewClient(conn)
+			err = client.Call("ServerService.Result", csjrpc.ResultArgs{
+				MachineID:  machineID,
+				PID:        pid,
+				Nonce:      nonce,
+				WaitMillis: time.Until(deadline).Milliseconds(),
+			}, &rr)
+			if err == nil && rr.Found && !rr.Running {
+				csjrpc.Infof("reconnected; result collected")
+				return client, rr.Reply, nil // still open, for -get
+			}
+			client.Close()
+			if err == nil {
+				if !rr.Found {
+					return nil, csjrpc.ProcessReply{}, errors.New("server has no result for this call")
+				}
+				continue
+			}
+		}
+		lastErr = err
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil, csjrpc.ProcessReply{}, fmt.Errorf("no result within %s: %v", window, lastErr)
+}
+
 func main() {
 	flag.StringVar(&flagRoot, "root", "", "socket root path (REQUIRED if not provided in config.common.root)")
 	flag.StringVar(&flagName, "name", "", "server socket name to connect to (REQUIRED if not provided in config.common.name)")
@@ -146,16 +684,74 @@ func main() {
 	flag.StringVar(&flagStdinStr, "stdin", "", "literal stdin data (mutually exclusive with -stdinfile)")
 	flag.StringVar(&flagStdinFile, "stdinfile", "", "path to file used as stdin (mutually exclusive with -stdin)")
 	flag.Var(&flagEnvs, "env", "repeatable env (KEY=VAL or KEY) overlay for child process (repeat)")
-	flag.StringVar(&flagID, "id", "", "machine ID override (else /etc/machine-id; else random; can come from config.client.id)")
+	flag.IntVar(&flagProto, "callback-proto", 0, "highest callback protocol to offer: 1 = one socket per stream, 2 = one multiplexed socket (default: newest the server speaks)")
+	flag.StringVar(&flagQueue, "queue", "", "run strictly one at a time (FIFO) with other requests using the same queue KEY, e.g. a shared device")
+	flag.Var(&flagLabels, "label", "tag the session KEY=VALUE, e.g. a CI job id, for server logs, ls, stats and audit (repeat)")
+	flag.StringVar(&flagID, "id", "", "machine ID override (else $CSJRPC_ID, else config.client.id, else /etc/machine-id, else random)")
 	flag.BoolVar(&flagSummary, "summary", false, "emit execution summary via logger (can be enabled by config.client.summary)")
 	flag.StringVar(&flagConfig, "config", "", "path to JSON config (optional; default ./config.json or $CSJRPC_CONFIG). If provided and missing, it's an error.")
 	flag.BoolVar(&flagServer, "server", false, "admin mode: run a server command instead of executing a process")
+	flag.BoolVar(&flagStats, "stats", false, "print server uptime and session/exec counters and exit (health check)")
+	flag.StringVar(&flagBatch, "batch", "", "batch mode: run the commands listed in FILE (one per line, JSON array or words; '-' for stdin) in one call")
+	flag.StringVar(&flagBatchPolicy, "batch-policy", "", "batch: sequential (default), stop-on-error or parallel")
+	flag.IntVar(&flagParallel, "parallel", 0, "batch parallel: max concurrent commands (0: all)")
+	flag.StringVar(&flagDirMode, "dir-mode", "", "chmod the callback socket dirs after creation, octal e.g. 0770; sockets get the same bits minus x (overrides config.client.dir_mode)")
+	flag.StringVar(&flagDirGroup, "dir-group", "", "chgrp the callback socket dirs and sockets, name or gid (overrides config.client.dir_group)")
+	flag.DurationVar(&flagMaxWall, "max-wall", 0, "cancel the command and exit 124 if the server hasn't returned within this time")
+	flag.DurationVar(&flagGrace, "grace", 0, "on cancel, give the command this long between SIGTERM and SIGKILL, 0 for SIGKILL at once (default: server setting)")
+	flag.Var(&flagPut, "put", "upload LOCAL[:REMOTE] into the working directory before the command (repeat)")
+	flag.Var(&flagGet, "get", "download REMOTE[:LOCAL] from the working directory after the command (repeat)")
+	flag.BoolVar(&flagPing, "ping", false, "ping mode: send empty requests and report round-trip statistics")
+	flag.IntVar(&flagCount, "count", 5, "ping: number of requests (0: until interrupted)")
+	flag.DurationVar(&flagInterval, "interval", time.Second, "ping: delay between requests")
+	flag.StringVar(&flagCompress, "compress", "", "ask the server to send output in compressed batches: gzip or none")
+	flag.DurationVar(&flagReconnect, "reconnect", 0, "if the server connection drops mid-run, keep reconnecting for up to this long to collect the result")
+	flag.BoolVar(&flagInterleave, "interleave", false, "keep the command's true stdout/stderr interleaving (one server-ordered stream) instead of ordering each stream independently")
+	flag.IntVar(&flagSignalRC, "signal-rc", 0, "exit with this code (1-255) when the command is killed by a signal, instead of 128+signal (default: server setting)")
+	flag.DurationVar(&flagProgress, "progress", 0, "show a live progress line (output, CPU, RSS) updated at this interval, e.g. 2s")
+	flag.StringVar(&flagLogLevel, "log-level", "", "minimum log level: debug, info, warn or error (overrides config.common.log.level)")
+	flag.StringVar(&flagLogFormat, "log-format", "", "log line format: text or json (overrides config.common.log.format)")
+	flag.StringVar(&flagLogFile, "log-file", "", "append log lines to FILE instead of stderr (overrides config.common.log.file)")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { flagGraceSet = flagGraceSet || f.Name == "grace" })
 
 	if flagStdinStr != "" && flagStdinFile != "" {
 		csjrpc.Errorf("-stdin and -stdinfile are mutually exclusive")
 		os.Exit(2)
 	}
+	if flagPing && (flagBatch != "" || flagServer || len(flag.Args()) > 0) {
+		csjrpc.Errorf("-ping excludes -batch, -server and positional commands")
+		os.Exit(2)
+	}
+	if flagGrace < 0 {
+		csjrpc.Errorf("-grace must not be negative: %s", flagGrace)
+		os.Exit(2)
+	}
+	if flagSignalRC < 0 || flagSignalRC > 255 {
+		csjrpc.Errorf("-signal-rc must be 1-255: %d", flagSignalRC)
+		os.Exit(2)
+	}
+	if _, err := csjrpc.NegotiateCompression(flagCompress); err != nil {
+		csjrpc.Errorf("-compress: %v", err)
+		os.Exit(2)
+	}
+	var batchCmds []csjrpc.BatchCommand
+	if flagBatch != "" {
+		if flagStdinStr != "" || flagStdinFile != "" || flagServer || len(flag.Args()) > 0 {
+			csjrpc.Errorf("-batch excludes -stdin/-stdinfile, -server and positional commands")
+			os.Exit(2)
+		}
+		if _, err := csjrpc.NormalizeBatchPolicy(flagBatchPolicy); err != nil {
+			csjrpc.Errorf("%v", err)
+			os.Exit(2)
+		}
+		var err error
+		batchCmds, err = parseBatchFile(flagBatch)
+		if err != nil {
+			csjrpc.Errorf("batch: %v", err)
+			os.Exit(2)
+		}
+	}
 
 	cfgPath := csjrpc.DefaultConfigPath
 	if envPath := os.Getenv(csjrpc.ClientConfigEnv); envPath != "" {
@@ -176,6 +772,10 @@ func main() {
 		csjrpc.Errorf("config file not found: %s", cfgPath)
 		os.Exit(2)
 	}
+	if err := csjrpc.SetupLogging(cfg.Common.Log.WithFlags(flagLogLevel, flagLogFormat, flagLogFile)); err != nil {
+		csjrpc.Errorf("%v", err)
+		os.Exit(2)
+	}
 
 	root := cfg.Common.Root
 	name := cfg.Common.Name
@@ -186,29 +786,32 @@ func main() {
 		name = flagName
 	}
 	if root == "" || name == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -name <name> [-startdir DIR] [-stdin STR|-stdinfile PATH] [--env ...] [-id ID] [-summary] [-config PATH]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -name <name> [-startdir DIR] [-stdin STR|-stdinfile PATH] [--env ...] [-label K=V] [-queue KEY] [-id ID] [-callback-proto N] [-summary] [-config PATH] [-put LOCAL[:REMOTE]] [-get REMOTE[:LOCAL]] [-stats] [-ping [-count N] [-interval D]] [-batch FILE [-batch-policy P] [-parallel N]] [-interleave] [-compress ALG] [-reconnect D] [-progress D] [-grace D] [-signal-rc N] [-max-wall D] [-dir-mode MODE] [-dir-group GROUP] [-log-level L] [-log-format F] [-log-file FILE]\n", filepath.Base(os.Args[0]))
 		os.Exit(2)
 	}
 
-	machineID := flagID
+	// Machine ID: -id, else $CSJRPC_ID, else config, else /etc/machine-id
+	machineID, idFrom := flagID, "--id"
 	if machineID == "" {
-		if cfg.Client.ID != "" {
-			machineID = cfg.Client.ID
-		} else {
-			machineID = csjrpc.LoadMachineID("")
-		}
-	} else {
-		if _, err := csjrpc.SanitizeMachineID(machineID); err != nil {
-			csjrpc.Errorf("invalid --id: %v", err)
-			os.Exit(2)
+		if v := os.Getenv(csjrpc.MachineIDEnv); v != "" {
+			machineID, idFrom = v, "$"+csjrpc.MachineIDEnv
+		} else if cfg.Client.ID != "" {
+			machineID, idFrom = cfg.Client.ID, "config.client.id"
 		}
 	}
+	if machineID == "" {
+		machineID = csjrpc.LoadMachineID("")
+	} else if _, err := csjrpc.SanitizeMachineID(machineID); err != nil {
+		csjrpc.Errorf("invalid %s: %v", idFrom, err)
+		os.Exit(2)
+	}
 
-	absRoot, err := filepath.Abs(root)
+	absRoot, err := csjrpc.ResolveRoot(root)
 	if err != nil {
 		csjrpc.Errorf("invalid root: %v", err)
 		os.Exit(2)
 	}
+	abstract := csjrpc.IsAbstract(absRoot)
 
 	clientOverlay := csjrpc.EnvMapToList(cfg.Client.Env)
 	for _, e := range flagEnvs {
@@ -224,40 +827,108 @@ func main() {
 		clientOverlay = append(clientOverlay, e+"="+val)
 	}
 
-	pid := os.Getpid()
-	dir := csjrpc.DeriveClientSocketDir(absRoot, machineID, pid)
-	if err := os.MkdirAll(dir, 0o700); err != nil {
-		csjrpc.Errorf("mkdir %s: %v", dir, err)
+	dirModeStr, dirGroup := cfg.Client.DirMode, cfg.Client.DirGroup
+	if flagDirMode != "" {
+		dirModeStr = flagDirMode
+	}
+	if flagDirGroup != "" {
+		dirGroup = flagDirGroup
+	}
+	dirMode, err := csjrpc.ParseMode(dirModeStr)
+	if err != nil {
+		csjrpc.Errorf("dir mode: %v", err)
 		os.Exit(2)
 	}
-	stdoutSock, stderrSock, stdinSock := csjrpc.DeriveClientSockets(absRoot, machineID, pid)
-	for _, s := range []string{stdoutSock, stderrSock, stdinSock} {
-		if _, err := os.Lstat(s); err == nil {
-			csjrpc.Errorf("refusing to overwrite existing socket: %s", s)
-			os.Exit(2)
-		} else if !os.IsNotExist(err) {
-			csjrpc.Errorf("stat socket %s: %v", s, err)
-			os.Exit(2)
-		}
+	dirGID, err := csjrpc.LookupGID(dirGroup)
+	if err != nil {
+		csjrpc.Errorf("dir group %q: %v", dirGroup, err)
+		os.Exit(2)
+	}
+	if abstract && (dirMode != 0 || dirGID >= 0) {
+		csjrpc.Errorf("abstract sockets have no permissions: refusing dir mode/group with root %s", absRoot)
+		os.Exit(2)
+	}
+	// sockets need write permission to connect; never executable
+	sockMode := dirMode &^ 0o111
+
+	if flagStats {
+		os.Exit(printStats(filepath.Join(absRoot, name+".sock")))
 	}
 
-	stdoutReady := make(chan struct{})
-	stdoutL, err := serveOnSocket(stdoutSock, "Stdout", &StdoutService{sink: newReorderSink(os.Stdout)}, stdoutReady)
+	pid := os.Getpid()
+	nonce := csjrpc.NewNonce()
+	mainSock := filepath.Join(absRoot, name+".sock")
+	conn, err := net.Dial("unix", mainSock)
 	if err != nil {
-		csjrpc.Errorf("serve stdout: %v", err)
+		csjrpc.Errorf("dial server: %v", err)
 		os.Exit(1)
 	}
-	defer stdoutL.Close()
-	<-stdoutReady
+	defer conn.Close()
+	client := jsonrpc.NewClient(conn)
 
-	stderrReady := make(chan struct{})
-	stderrL, err := serveOnSocket(stderrSock, "Stderr", &StderrService{sink: newReorderSink(os.Stderr)}, stderrReady)
+	// Agree on the callback protocol before creating any socket
+	proto, err := negotiateProtocol(client, flagProto)
 	if err != nil {
-		csjrpc.Errorf("serve stderr: %v", err)
+		csjrpc.Errorf("rpc error: %v", err)
 		os.Exit(1)
 	}
-	defer stderrL.Close()
-	<-stderrReady
+	csjrpc.Debugf("callback protocol %d", proto)
+
+	dir := csjrpc.DeriveClientSocketDir(absRoot, machineID, pid, nonce)
+	var socks []string
+	if proto >= csjrpc.ProtoMux {
+		socks = []string{csjrpc.DeriveClientMuxSocket(absRoot, machineID, pid, nonce)}
+	} else {
+		stdoutSock, stderrSock, stdinSock := csjrpc.DeriveClientSockets(absRoot, machineID, pid, nonce)
+		socks = []string{stdoutSock, stderrSock, stdinSock}
+	}
+	if !abstract {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			csjrpc.Errorf("mkdir %s: %v", dir, err)
+			os.Exit(2)
+		}
+		for _, d := range []string{filepath.Dir(dir), dir} {
+			if err := csjrpc.ApplyPerms(d, dirMode, dirGID); err != nil {
+				csjrpc.Errorf("%v", err)
+				os.Exit(2)
+			}
+		}
+		for _, s := range socks {
+			if _, err := os.Lstat(s); err == nil {
+				csjrpc.Errorf("refusing to overwrite existing socket: %s", s)
+				os.Exit(2)
+			} else if !os.IsNotExist(err) {
+				csjrpc.Errorf("stat socket %s: %v", s, err)
+				os.Exit(2)
+			}
+		}
+	}
+	removeSockets := func() {
+		if abstract {
+			return // vanish with the listeners
+		}
+		for _, s := range socks {
+			_ = os.Remove(s)
+		}
+		_ = os.Remove(dir)
+	}
+
+	var status *statusLine
+	if flagProgress > 0 {
+		status = newStatusLine(os.Stderr)
+		if err := rpc.RegisterName("Progress", &ProgressService{status: status}); err != nil {
+			csjrpc.Errorf("register progress: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	stdoutSink := newReorderSink(os.Stdout, status)
+	stdoutSink.errOut = os.Stderr
+	var stdoutSvc, stderrSvc any = &StdoutService{sink: stdoutSink}, &StderrService{sink: newReorderSink(os.Stderr, status)}
+	if flagPing {
+		// every ping restarts the line indexes; the ping lines aren't shown
+		stdoutSvc, stderrSvc = discardService{}, discardService{}
+	}
 
 	var stdinReader io.Reader
 	if flagStdinFile != "" {
@@ -273,23 +944,43 @@ func main() {
 	} else {
 		stdinReader = nil
 	}
-	stdinReady := make(chan struct{})
-	stdinL, err := serveOnSocket(stdinSock, "Stdin", &StdinService{r: stdinReader}, stdinReady)
-	if err != nil {
-		csjrpc.Errorf("serve stdin: %v", err)
-		os.Exit(1)
+
+	services := []struct {
+		name string
+		svc  any
+	}{{"Stdout", stdoutSvc}, {"Stderr", stderrSvc}, {"Stdin", &StdinService{r: stdinReader}}, {"Queue", &QueueService{last: -1, status: status}}}
+	for _, sv := range services {
+		if err := rpc.RegisterName(sv.name, sv.svc); err != nil {
+			csjrpc.Errorf("register %s: %v", strings.ToLower(sv.name), err)
+			os.Exit(1)
+		}
+	}
+	// ProtoMux: everything on one socket; else one socket per service
+	for _, sock := range socks {
+		ready := make(chan struct{})
+		l, err := serveOnSocket(sock, ready)
+		if err != nil {
+			csjrpc.Errorf("serve %s: %v", filepath.Base(sock), err)
+			os.Exit(1)
+		}
+		defer l.Close()
+		<-ready
 	}
-	defer stdinL.Close()
-	<-stdinReady
 
-	mainSock := filepath.Join(absRoot, name+".sock")
-	conn, err := net.Dial("unix", mainSock)
-	if err != nil {
-		csjrpc.Errorf("dial server: %v", err)
-		os.Exit(1)
+	if !abstract {
+		for _, s := range socks {
+			if err := csjrpc.ApplyPerms(s, sockMode, dirGID); err != nil {
+				csjrpc.Errorf("%v", err)
+				os.Exit(2)
+			}
+		}
+	}
+
+	if flagPing {
+		n := runPing(client, mainSock, machineID, pid, nonce, proto)
+		removeSockets()
+		os.Exit(n)
 	}
-	defer conn.Close()
-	client := jsonrpc.NewClient(conn)
 
 	// Admin mode
 	if flagServer {
@@ -307,8 +998,10 @@ func main() {
 		err = client.Call("ServerService.Admin", csjrpc.AdminArgs{
 			MachineID: machineID,
 			PID:       pid,
+			Nonce:     nonce,
 			Command:   cmd,
 			Args:      aargs,
+			Protocol:  proto,
 		}, &arep)
 		reqEnd := time.Now().UTC()
 		if err != nil {
@@ -330,17 +1023,86 @@ func main() {
 	localSig := make(chan os.Signal, 1)
 	signal.Notify(localSig, syscall.SIGINT, syscall.SIGTERM)
 	var cancelOnce sync.Once
-	go func() {
-		<-localSig
+	sendCancel := func() {
 		cancelOnce.Do(func() {
 			if c2, err := net.Dial("unix", mainSock); err == nil {
 				defer c2.Close()
 				cc := jsonrpc.NewClient(c2)
-				_ = cc.Call("ServerService.Cancel", csjrpc.CancelArgs{MachineID: machineID, PID: pid}, &csjrpc.CancelReply{})
+				_ = cc.Call("ServerService.Cancel", csjrpc.CancelArgs{MachineID: machineID, PID: pid, Nonce: nonce, GraceMillis: flagGrace.Milliseconds(), HasGrace: flagGraceSet}, &csjrpc.CancelReply{})
 			}
 		})
+	}
+	go func() {
+		<-localSig
+		sendCancel()
 	}()
 
+	// After a -max-wall cancel, allow the grace period plus some slack for
+	// the server to reap the child and answer.
+	settle := flagGrace
+	if !flagGraceSet {
+		settle = time.Second
+	}
+	settle += 5 * time.Second
+
+	finalSummary := flagSummary || cfg.Client.Summary
+
+	// Batch mode
+	if flagBatch != "" {
+		reqStart := time.Now().UTC()
+		var brep csjrpc.ProcessBatchReply
+		timedOut, err := callWithMaxWall(client, "ServerService.ProcessBatch", csjrpc.ProcessBatchArgs{
+			MachineID: machineID,
+			PID:       pid,
+			Nonce:     nonce,
+			StartDir:  flagStartDir,
+			Env:       clientOverlay,
+			Commands:  batchCmds,
+			Policy:    flagBatchPolicy,
+			Parallel:  flagParallel,
+
+			GraceMillis:    flagGrace.Milliseconds(),
+			HasGrace:       flagGraceSet,
+			SignalExitCode: flagSignalRC,
+			Interleave:     flagInterleave,
+			Compress:       flagCompress,
+			Labels:         flagLabels,
+			Protocol:       proto,
+			Queue:          flagQueue,
+		}, &brep, flagMaxWall, settle, sendCancel)
+		reqEnd := time.Now().UTC()
+
+		removeSockets()
+
+		if timedOut {
+			if err != nil {
+				csjrpc.Errorf("%v", err)
+			}
+			csjrpc.Errorf("batch exceeded -max-wall %s", flagMaxWall)
+			os.Exit(maxWallExitCode)
+		}
+		if err != nil {
+			csjrpc.Errorf("rpc error: %v", err)
+			os.Exit(1)
+		}
+		if brep.Error != "" {
+			fmt.Fprintln(os.Stderr, brep.Error)
+		}
+		for i, r := range brep.Replies {
+			if r.Error != "" {
+				fmt.Fprintf(os.Stderr, "batch #%d: %s\n", i, r.Error)
+			}
+			if finalSummary {
+				csjrpc.Infof("batch #%d command=%q exec_ms=%d rc=%d signal=%d stopped=%v stopped_by=%q",
+					i, r.ResolvedCmdLine, r.ElapsedMillis, r.ReturnCode, r.Signal, r.Stopped, r.StoppedBy)
+			}
+		}
+		if finalSummary {
+			csjrpc.Infof("batch ran=%d/%d rtt_ms=%d rc=%d", len(brep.Replies), len(batchCmds), reqEnd.Sub(reqStart).Milliseconds(), brep.ReturnCode)
+		}
+		os.Exit(brep.ReturnCode)
+	}
+
 	cmdline := flag.Args()
 	var command string
 	var cmdArgs []string
@@ -354,22 +1116,59 @@ func main() {
 		cmdArgs = nil
 	}
 
+	// Stage input files; with no command this is a pure transfer
+	for _, spec := range flagPut {
+		if err := putFile(client, machineID, pid, nonce, spec); err != nil {
+			removeSockets()
+			csjrpc.Errorf("put %s: %v", spec, err)
+			os.Exit(1)
+		}
+	}
+	if command == "" && (len(flagPut) > 0 || len(flagGet) > 0) {
+		removeSockets()
+		os.Exit(getFiles(client, machineID, pid, nonce))
+	}
+
 	reqStart := time.Now().UTC()
 	var resp csjrpc.ProcessReply
-	err = client.Call("ServerService.Process", csjrpc.ProcessArgs{
+	timedOut, err := callWithMaxWall(client, "ServerService.Process", csjrpc.ProcessArgs{
 		MachineID: machineID,
 		PID:       pid,
+		Nonce:     nonce,
 		StartDir:  flagStartDir,
 		Command:   command,
 		Args:      cmdArgs,
 		Env:       clientOverlay,
-	}, &resp)
+
+		ProgressMillis: flagProgress.Milliseconds(),
+		GraceMillis:    flagGrace.Milliseconds(),
+		HasGrace:       flagGraceSet,
+		SignalExitCode: flagSignalRC,
+		Interleave:     flagInterleave,
+		Compress:       flagCompress,
+		Labels:         flagLabels,
+		Protocol:       proto,
+		Queue:          flagQueue,
+	}, &resp, flagMaxWall, settle, sendCancel)
+	if err != nil && !timedOut && flagReconnect > 0 && connBroken(err) {
+		csjrpc.Warnf("server connection lost (%v); waiting up to %s for the result", err, flagReconnect)
+		var fresh *rpc.Client
+		if fresh, resp, err = recoverResult(mainSock, machineID, pid, nonce, flagReconnect); err == nil {
+			client = fresh // the old connection is gone; -get needs a live one
+		}
+	}
 	reqEnd := time.Now().UTC()
+	status.clear()
 
-	_ = os.Remove(stdoutSock)
-	_ = os.Remove(stderrSock)
-	_ = os.Remove(stdinSock)
-	_ = os.Remove(dir)
+	removeSockets()
+
+	if timedOut {
+		if err != nil {
+			csjrpc.Errorf("%v", err)
+		}
+		csjrpc.Errorf("command exceeded -max-wall %s (server rc=%d)", flagMaxWall, resp.ReturnCode)
+		os.Exit(maxWallExitCode)
+	}
 
 	if err != nil {
 		csjrpc.Errorf("rpc error: %v", err)
@@ -380,7 +1179,6 @@ func main() {
 		fmt.Fprintln(os.Stderr, resp.Error)
 	}
 
-	finalSummary := flagSummary || cfg.Client.Summary
 	if finalSummary {
 		rtt := reqEnd.Sub(reqStart).Milliseconds()
 		overhead := rtt - resp.ElapsedMillis
@@ -394,7 +1192,7 @@ func main() {
 				cmdShown = "(ping)"
 			}
 		}
-		csjrpc.Infof("command=%q client_start=%s client_end=%s rtt_ms=%d server_start=%s server_end=%s exec_ms=%d overhead_ms=%d rc=%d stopped=%v stopped_by=%q",
+		csjrpc.Infof("command=%q client_start=%s client_end=%s rtt_ms=%d server_start=%s server_end=%s exec_ms=%d overhead_ms=%d rc=%d signal=%d stopped=%v stopped_by=%q truncated_stdout=%v truncated_stderr=%v",
 			cmdShown,
 			reqStart.Format(time.RFC3339Nano),
 			reqEnd.Format(time.RFC3339Nano),
@@ -404,10 +1202,16 @@ func main() {
 			resp.ElapsedMillis,
 			overhead,
 			resp.ReturnCode,
+			resp.Signal,
 			resp.Stopped,
 			resp.StoppedBy,
+			resp.StdoutTruncated,
+			resp.StderrTruncated,
 		)
 	}
 
+	if rc := getFiles(client, machineID, pid, nonce); rc != 0 && resp.ReturnCode == 0 {
+		os.Exit(rc)
+	}
 	os.Exit(resp.ReturnCode)
 }
@@ -0,0 +1,61 @@
+package csjrpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First fd passed by systemd (SD_LISTEN_FDS_START).
+const listenFdsStart = 3
+
+// ActivationListener returns the socket handed over by systemd (LISTEN_FDS),
+// or (nil, false, nil) when the process was not socket-activated. With
+// several fds, the one whose LISTEN_FDNAMES entry equals name wins, else the
+// first. The LISTEN_* variables are cleared so children don't inherit them.
+func ActivationListener(name string) (net.Listener, bool, error) {
+	pidStr := os.Getenv("LISTEN_PID")
+	fdsStr := os.Getenv("LISTEN_FDS")
+	if pidStr == "" || fdsStr == "" {
+		return nil, false, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid != os.Getpid() {
+		// meant for another process (e.g. our parent)
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 1 {
+		return nil, false, fmt.Errorf("invalid LISTEN_FDS=%q", fdsStr)
+	}
+
+	pick := 0
+	for i := 0; i < n && i < len(names); i++ {
+		if names[i] == name {
+			pick = i
+			break
+		}
+	}
+	for i := 0; i < n; i++ {
+		syscall.CloseOnExec(listenFdsStart + i)
+	}
+
+	fd := listenFdsStart + pick
+	f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	l, err := net.FileListener(f)
+	_ = f.Close() // FileListener dups the fd
+	if err != nil {
+		return nil, false, fmt.Errorf("socket activation fd %d: %v", fd, err)
+	}
+	return l, true, nil
+}
@@ -0,0 +1,127 @@
+package csjrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is one append-only line per Process call. Only the keys of the
+// client env overlay are recorded; values may carry secrets.
+type AuditRecord struct {
+	Time           string            `json:"time"`
+	Key            string            `json:"key"`
+	MachineID      string            `json:"machine_id"`
+	PID            int               `json:"pid"`
+	StartDir       string            `json:"startdir,omitempty"`
+	Command        string            `json:"command"`
+	Resolved       string            `json:"resolved,omitempty"`
+	Args           []string          `json:"args"`
+	EnvKeys        []string          `json:"env_keys,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	ReturnCode     int               `json:"rc"`
+	Error          string            `json:"error,omitempty"`
+	Stopped        bool              `json:"stopped,omitempty"`
+	StoppedBy      string            `json:"stopped_by,omitempty"`
+	Signal         int               `json:"signal,omitempty"`
+	ExecMillis     int64             `json:"exec_ms"`
+	DurationMillis int64             `json:"duration_ms"`
+}
+
+// Auditor writes AuditRecords as JSON lines to a file or to syslog.
+// A nil *Auditor is valid and discards everything.
+type Auditor struct {
+	mu   sync.Mutex
+	dest string
+	w    io.WriteCloser
+	sl   *syslog.Writer
+}
+
+// OpenAuditor opens dest for appending. dest is a file path, "syslog" or
+// "syslog:TAG". An empty dest returns (nil, nil).
+func OpenAuditor(dest string) (*Auditor, error) {
+	dest = strings.TrimSpace(dest)
+	if dest == "" {
+		return nil, nil
+	}
+	a := &Auditor{dest: dest}
+	if dest == "syslog" || strings.HasPrefix(dest, "syslog:") {
+		tag := strings.TrimPrefix(strings.TrimPrefix(dest, "syslog"), ":")
+		if tag == "" {
+			tag = "csjrpc-audit"
+		}
+		sl, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, tag)
+		if err != nil {
+			return nil, fmt.Errorf("audit syslog: %v", err)
+		}
+		a.sl = sl
+		return a, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit file: %v", err)
+	}
+	a.w = f
+	return a, nil
+}
+
+func (a *Auditor) Dest() string {
+	if a == nil {
+		return ""
+	}
+	return a.dest
+}
+
+func (a *Auditor) Record(r AuditRecord) {
+	if a == nil {
+		return
+	}
+	if r.Time == "" {
+		r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		Errorf("audit marshal: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sl != nil {
+		err = a.sl.Info(string(b))
+	} else {
+		_, err = a.w.Write(append(b, '\n'))
+	}
+	if err != nil {
+		Errorf("audit write %s: %v", a.dest, err)
+	}
+}
+
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sl != nil {
+		return a.sl.Close()
+	}
+	return a.w.Close()
+}
+
+// EnvKeys returns just the KEY part of KEY=VAL entries.
+func EnvKeys(env []string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package csjrpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+)
+
+// LineBatch carries several Lines in one WriteBatch call, as JSON compressed
+// with Encoding.
+type LineBatch struct {
+	Encoding string
+	Data     []byte
+}
+
+// NegotiateCompression returns the encoding the server will use for a
+// client request: the requested one if supported, else none and an error.
+func NegotiateCompression(requested string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(requested)) {
+	case "", "none":
+		return CompressNone, nil
+	case CompressGzip:
+		return CompressGzip, nil
+	}
+	return CompressNone, fmt.Errorf("unknown compression %q (want gzip or none)", requested)
+}
+
+func EncodeLines(enc string, lines []Line) (LineBatch, error) {
+	raw, err := json.Marshal(lines)
+	if err != nil {
+		return LineBatch{}, err
+	}
+	switch enc {
+	case CompressGzip:
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		if _, err := zw.Write(raw); err != nil {
+			return LineBatch{}, err
+		}
+		if err := zw.Close(); err != nil {
+			return LineBatch{}, err
+		}
+		return LineBatch{Encoding: enc, Data: buf.Bytes()}, nil
+	case CompressNone:
+		return LineBatch{Data: raw}, nil
+	}
+	return LineBatch{}, fmt.Errorf("unsupported encoding %q", enc)
+}
+
+func DecodeLines(b LineBatch) ([]Line, error) {
+	raw := b.Data
+	switch b.Encoding {
+	case CompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b.Data))
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	case CompressNone:
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", b.Encoding)
+	}
+	var lines []Line
+	if err := json.Unmarshal(raw, &lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
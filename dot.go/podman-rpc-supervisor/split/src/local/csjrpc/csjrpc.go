@@ -7,7 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,21 +17,80 @@ import (
 
 const DefaultConfigPath = "./config.toml"
 const ClientConfigEnv = "CSJRPC_CONFIG"
+const MachineIDEnv = "CSJRPC_ID"
 
 type CommonConfig struct {
-	Root string `toml:"root"`
-	Name string `toml:"name"`
+	Root string    `toml:"root"`
+	Name string    `toml:"name"`
+	Log  LogConfig `toml:"log"`
+}
+
+// OutputLimits caps what is forwarded per stream (stdout and stderr each).
+type OutputLimits struct {
+	MaxLines int64 `toml:"max_lines"` // 0: unlimited
+	MaxBytes int64 `toml:"max_bytes"` // 0: unlimited; counts the newline
+	Kill     bool  `toml:"kill"`      // SIGKILL the child's process group once a limit is hit
 }
 
 type ServerSection struct {
 	StartDir string            `toml:"startdir"`
 	Env      map[string]string `toml:"env"`
+	Sandbox  SandboxConfig     `toml:"sandbox"`
+	Audit    string            `toml:"audit"` // file path, "syslog" or "syslog:TAG"
+	Grace    string            `toml:"grace"` // cancel: SIGTERM -> SIGKILL delay, e.g. "10s"
+
+	// Working directories requests may use: each entry allows itself and
+	// everything below it (empty: any directory the server can stat).
+	StartDirs []string `toml:"startdirs"`
+
+	// How long finished Process replies stay available to the Result RPC
+	// (default "5m"; "0s" disables).
+	ResultTTL string `toml:"result_ttl"`
+
+	// Return code for children killed by a signal (1-255); 0 keeps 128+signal.
+	SignalExitCode int `toml:"signal_exit_code"`
+
+	// Stale client socket dirs: swept at startup and every sweep_interval
+	// (unset: startup only); dirs older than sweep_ttl (default "24h", "0s":
+	// no age limit) or whose local PID is gone are removed.
+	SweepInterval string `toml:"sweep_interval"`
+	SweepTTL      string `toml:"sweep_ttl"`
+
+	Limits LimitsConfig `toml:"limits"`
+	Output OutputLimits `toml:"output"`
+	Files  FilesConfig  `toml:"files"`
+
+	// Refuse to start on a root that is a symlink, owned by another uid or
+	// group/world writable (otherwise these only produce warnings).
+	StrictRoot bool `toml:"strict_root"`
+
+	SockMode  string `toml:"sock_mode"`  // main socket mode, octal, e.g. "0660"
+	SockGroup string `toml:"sock_group"` // main socket group (name or gid)
+
+	// Extra sockets <root>/<name>.sock served by the same process, each with
+	// its own defaults and command allowlist.
+	Endpoints map[string]EndpointConfig `toml:"endpoints"`
+}
+
+type EndpointConfig struct {
+	StartDir string            `toml:"startdir"` // working dir when the request names none
+	Env      map[string]string `toml:"env"`      // applied over server.env, under the client overlay
+	// Commands allowed on this endpoint: entries with a "/" match the
+	// resolved path (symlinks followed), bare names a command requested by
+	// that name and found in the server's PATH (server.env and this env,
+	// never the client's). Empty allows everything. Cancel (of the caller's
+	// own call) and the admin "ls" listing are served on every endpoint;
+	// admin cancel/kill only on the main socket.
+	Allow []string `toml:"allow"`
 }
 
 type ClientSection struct {
 	Env     map[string]string `toml:"env"`
 	ID      string            `toml:"id"`
 	Summary bool              `toml:"summary"`
+
+	DirMode  string `toml:"dir_mode"`  // callback socket dirs mode, octal, e.g. "0770"
+	DirGroup string `toml:"dir_group"` // callback socket dirs group (name or gid)
 }
 
 type Config struct {
@@ -81,34 +140,65 @@ func EnvMapToList(m map[string]string) []string {
 	return out
 }
 
-func logWithCaller(level, msg string, args ...any) {
-	ts := time.Now().UTC().Format(time.RFC3339Nano)
-	_, file, line, ok := runtime.Caller(2)
-	if !ok {
-		file = "?"
-		line = 0
-	}
-	base := filepath.Base(file)
-	fmt.Fprintf(os.Stderr, "%s [%s] %s:%d: %s\n",
-		ts, strings.ToUpper(level), base, line, fmt.Sprintf(msg, args...))
-}
-
-func Infof(msg string, args ...any)  { logWithCaller("info", msg, args...) }
-func Warnf(msg string, args ...any)  { logWithCaller("warn", msg, args...) }
-func Errorf(msg string, args ...any) { logWithCaller("error", msg, args...) }
-
 type Line struct {
 	Index int
 	Text  string
+	// Continued marks a piece of an over-long line (see RecordReader): the
+	// line goes on in the next record and no newline follows this one.
+	Continued bool
+	// Origin is set in interleaved mode, where both streams arrive on the
+	// Stdout service and Index is one server-side sequence across them.
+	Origin string
 }
 
+// Line.Origin values
+const (
+	OriginStdout = "stdout"
+	OriginStderr = "stderr"
+)
+
 type ProcessArgs struct {
 	MachineID string
 	PID       int
+	Nonce     string // per client invocation; see NewNonce
 	StartDir  string
 	Command   string
 	Args      []string
 	Env       []string
+
+	// ProgressMillis > 0 asks the server to call Progress.Update on the
+	// client (over the stderr callback socket) at this interval.
+	ProgressMillis int64
+
+	// GraceMillis overrides the server's SIGTERM -> SIGKILL delay when
+	// HasGrace is set (0: SIGKILL at once); older clients leave HasGrace
+	// unset and send > 0 for an override.
+	GraceMillis int64
+	HasGrace    bool
+
+	// SignalExitCode (1-255) overrides the server's return code for children
+	// killed by a signal; 0 keeps the server setting (default 128+signal).
+	SignalExitCode int
+
+	// Interleave delivers stdout and stderr as one ordered stream of
+	// Origin-tagged lines on the Stdout service.
+	Interleave bool
+
+	// Compress asks for output in compressed LineBatches (WriteBatch)
+	// instead of one WriteLine call per line: "gzip".
+	Compress string
+
+	// Labels are opaque key/value tags (e.g. a CI job id) shown in logs,
+	// admin ls, Stats and the audit record.
+	Labels map[string]string
+
+	// Protocol is the callback protocol revision agreed via Hello
+	// (0 or ProtoSockets: three sockets; ProtoMux: one mux socket).
+	Protocol int
+
+	// Queue, if set, runs the call strictly after earlier calls with the
+	// same key (FIFO); the client gets Queue.Update while it waits.
+	Queue string
 }
 
 type ProcessReply struct {
@@ -120,16 +210,89 @@ type ProcessReply struct {
 	ExecEndRFC3339   string
 	ElapsedMillis    int64
 	ResolvedCmdLine  string
+	StdoutTruncated  bool // output limit reached; a marker line was sent instead
+	StderrTruncated  bool
+	Signal           int    // signal that terminated the child (0: exited normally)
+	SignalName       string // e.g. "killed"
+	Compression      string // output encoding actually used ("" for none)
 }
 
 type CancelArgs struct {
-	MachineID string
-	PID       int
+	MachineID   string
+	PID         int
+	Nonce       string
+	GraceMillis int64 // with HasGrace (or > 0): override the grace period for this cancellation
+	HasGrace    bool
 }
 type CancelReply struct {
 	OK bool
 }
 
+// Batch execution policies
+const (
+	BatchSequential  = "sequential"
+	BatchStopOnError = "stop-on-error"
+	BatchParallel    = "parallel"
+)
+
+func NormalizeBatchPolicy(p string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(p)) {
+	case "", BatchSequential:
+		return BatchSequential, nil
+	case BatchStopOnError:
+		return BatchStopOnError, nil
+	case BatchParallel:
+		return BatchParallel, nil
+	}
+	return "", fmt.Errorf("unknown batch policy: %q", p)
+}
+
+type BatchCommand struct {
+	Command string
+	Args    []string
+	Env     []string // per-command overlay on top of ProcessBatchArgs.Env
+}
+
+type ProcessBatchArgs struct {
+	MachineID string
+	PID       int
+	Nonce     string
+	StartDir  string
+	Env       []string
+	Commands  []BatchCommand
+	Policy    string // sequential (default), stop-on-error, parallel
+	Parallel  int    // parallel: max concurrent commands (<=0: all)
+
+	GraceMillis    int64 // as in ProcessArgs
+	HasGrace       bool
+	SignalExitCode int
+	Interleave     bool
+	Compress       string
+	Labels         map[string]string
+	Protocol       int
+	Queue          string
+}
+
+// ProcessBatchReply holds one reply per command that ran, in command order;
+// fewer replies than commands means the batch stopped early.
+type ProcessBatchReply struct {
+	Replies    []ProcessReply
+	ReturnCode int // first non-zero rc among Replies, else 0
+	Error      string
+}
+
+// ProgressArgs is the payload of the client's Progress.Update callback.
+type ProgressArgs struct {
+	PID           int // child PID on the server
+	ElapsedMillis int64
+	StdoutLines   int64
+	StdoutBytes   int64
+	StderrLines   int64
+	StderrBytes   int64
+	CPUMillis     int64 // child user+system CPU time
+	RSSBytes      int64 // child resident set size
+}
+
 type StdinReadArgs struct{ Max int }
 type StdinReadReply struct {
 	Data []byte
@@ -141,14 +304,73 @@ type StdinReadReply struct {
 type AdminArgs struct {
 	MachineID string
 	PID       int
+	Nonce     string
 	Command   string
 	Args      []string
+	Protocol  int
 }
 type AdminReply struct {
 	ReturnCode int
 	Error      string
 }
 
+// Callback protocol revisions. With ProtoSockets the client serves Stdout,
+// Stderr and Stdin on one socket each; with ProtoMux it serves all of them
+// (and Progress) on a single socket, each frame naming its service in the
+// method ("Stdout.WriteLine", "Stdin.ReadChunk", ...).
+const (
+	ProtoSockets = 1
+	ProtoMux     = 2
+	ProtoMax     = ProtoMux
+)
+
+// Hello RPC payloads: the client offers the highest callback protocol it
+// speaks and the server answers with the revision to use. Servers without
+// Hello only speak ProtoSockets.
+type HelloArgs struct {
+	Protocol int
+}
+type HelloReply struct {
+	Protocol int
+}
+
+// NegotiateProtocol picks the revision for a client offering max.
+func NegotiateProtocol(max int) int {
+	switch {
+	case max >= ProtoMax:
+		return ProtoMax
+	case max < ProtoSockets:
+		return ProtoSockets
+	}
+	return max
+}
+
+// Stats RPC payloads
+type StatsArgs struct{}
+type StatsReply struct {
+	StartedRFC3339   string
+	UptimeMillis     int64
+	TotalSessions    int64 // Process and ProcessBatch calls since start
+	ActiveSessions   int
+	Queued           int   // calls waiting for an admission slot
+	Commands         int64 // children started (batch commands count individually)
+	FailedCommands   int64 // non-zero return code
+	ExecMillis       int64 // cumulative child run time
+	LastErrorRFC3339 string
+	LastErrorKey     string
+	LastError        string
+	Active           []SessionInfo  // running sessions, oldest first
+	Queues           map[string]int // queue key -> calls holding or waiting on it
+}
+
+type SessionInfo struct {
+	ID             int64
+	Key            string
+	StartedRFC3339 string
+	Command        string // resolved command line once started
+	Labels         map[string]string
+}
+
 // ProcessReply helpers
 func (r *ProcessReply) FailAt(rc int, msg string, start time.Time) {
 	r.ReturnCode = rc
@@ -216,17 +438,109 @@ func LoadMachineID(override string) string {
 	return id
 }
 
-func IdPidKey(machineID string, pid int) string {
-	return machineID + ":" + strconv.Itoa(pid)
+// Label limits; keys are restricted so FormatLabels stays unambiguous.
+const (
+	MaxLabels     = 32
+	MaxLabelBytes = 256
+)
+
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("too many labels: %d (max %d)", len(labels), MaxLabels)
+	}
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, "=, \t\n") {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if len(k)+len(v) > MaxLabelBytes || strings.ContainsAny(v, "\n") {
+			return fmt.Errorf("invalid label value for %s", k)
+		}
+	}
+	return nil
+}
+
+// FormatLabels renders labels as sorted "k=v,k=v" for log lines and tables.
+func FormatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + labels[k]
+	}
+	return strings.Join(keys, ",")
+}
+
+// NewNonce returns a random per-invocation nonce. It goes into the session
+// key and the callback socket dir, so two clients with the same MachineID
+// and PID (e.g. in different PID namespaces) never collide.
+func NewNonce() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// ValidNonce accepts "" (clients without a nonce) or up to 32 hex digits.
+func ValidNonce(s string) bool {
+	if len(s) > 32 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
 }
 
-func DeriveClientSocketDir(root, machineID string, pid int) string {
-	return filepath.Join(root, machineID, strconv.Itoa(pid))
+// pidNonce is "<pid>" or "<pid>.<nonce>", the last part of keys and dirs.
+func pidNonce(pid int, nonce string) string {
+	if nonce == "" {
+		return strconv.Itoa(pid)
+	}
+	return strconv.Itoa(pid) + "." + nonce
 }
 
-func DeriveClientSockets(root, machineID string, pid int) (stdoutSock, stderrSock, stdinSock string) {
-	dir := DeriveClientSocketDir(root, machineID, pid)
+func IdPidKey(machineID string, pid int, nonce string) string {
+	return machineID + ":" + pidNonce(pid, nonce)
+}
+
+// A root starting with "@" places every socket (main and callbacks) in the
+// Linux abstract namespace: nothing is created on disk, so there is nothing
+// to clean up and no stale sockets. Nor are there permissions: any process
+// in the network namespace can connect, so server and client refuse such a
+// root along with a socket mode or group.
+func IsAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// ResolveRoot makes a filesystem root absolute; abstract roots are only cleaned.
+func ResolveRoot(root string) (string, error) {
+	if IsAbstract(root) {
+		if len(root) < 2 {
+			return "", errors.New("empty abstract root")
+		}
+		return "@" + filepath.Clean(root[1:]), nil
+	}
+	return filepath.Abs(root)
+}
+
+func DeriveClientSocketDir(root, machineID string, pid int, nonce string) string {
+	return filepath.Join(root, machineID, pidNonce(pid, nonce))
+}
+
+func DeriveClientSockets(root, machineID string, pid int, nonce string) (stdoutSock, stderrSock, stdinSock string) {
+	dir := DeriveClientSocketDir(root, machineID, pid, nonce)
 	return filepath.Join(dir, "stdout.sock"),
 		filepath.Join(dir, "stderr.sock"),
 		filepath.Join(dir, "stdin.sock")
 }
+
+// DeriveClientMuxSocket is the single callback socket of ProtoMux.
+func DeriveClientMuxSocket(root, machineID string, pid int, nonce string) string {
+	return filepath.Join(DeriveClientSocketDir(root, machineID, pid, nonce), "mux.sock")
+}
@@ -0,0 +1,204 @@
+package csjrpc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileChunkSize is the client's chunk size for PutFile/GetFile.
+const FileChunkSize = 256 * 1024
+
+type FilesConfig struct {
+	Disable  bool  `toml:"disable"`   // reject PutFile/GetFile
+	MaxBytes int64 `toml:"max_bytes"` // per file (default 64 MiB)
+}
+
+// PutFile writes Data at Offset into a hidden part file next to Path, one
+// per caller and Path; Offset 0 starts over, Final renames the part file
+// into place.
+type PutFileArgs struct {
+	MachineID string
+	PID       int
+	Nonce     string
+	StartDir  string // working dir the path is relative to (as for Process)
+	Path      string // relative, must stay inside the working dir
+	Offset    int64
+	Data      []byte
+	Final     bool
+	Mode      uint32 // permission bits for the new file (0: 0644)
+}
+type PutFileReply struct {
+	Size  int64 // bytes written so far
+	Error string
+}
+
+type GetFileArgs struct {
+	MachineID string
+	PID       int
+	Nonce     string
+	StartDir  string
+	Path      string
+	Offset    int64
+	Max       int // chunk size (<= 0: FileChunkSize)
+}
+type GetFileReply struct {
+	Data  []byte
+	Size  int64 // total file size
+	EOF   bool
+	Error string
+}
+
+// ResolveInDir joins the relative path rel onto dir and makes sure the
+// result, with symlinks in its existing part resolved, stays inside dir.
+func ResolveInDir(dir, rel string) (string, error) {
+	if rel == "" || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("path must be relative to the working directory: %q", rel)
+	}
+	base, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(base, rel)
+	// resolve the longest existing prefix; the rest is created later
+	resolved, rest := p, ""
+	for {
+		r, err := filepath.EvalSymlinks(resolved)
+		if err == nil {
+			resolved = filepath.Join(r, rest)
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(resolved), rest)
+		resolved = filepath.Dir(resolved)
+	}
+	if resolved != base && !strings.HasPrefix(resolved, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes the working directory: %q", rel)
+	}
+	return resolved, nil
+}
+
+// OpenInDir opens path (as returned by ResolveInDir) for reading without
+// following symlinks, and checks the file opened is path itself, so a
+// symlink swapped in after ResolveInDir can't point it elsewhere.
+func OpenInDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	if real, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(f.Fd()))); err == nil && real != path {
+		f.Close()
+		return nil, fmt.Errorf("%s changed while being opened", path)
+	}
+	return f, nil
+}
+
+// uploadIdle is how long an unfinished upload's part file is kept.
+const uploadIdle = 15 * time.Minute
+
+type upload struct {
+	part string
+	fi   os.FileInfo // of part, to reopen the same file
+	last time.Time
+}
+
+// Uploads tracks the part files of PutFile uploads in progress. Each is
+// created afresh (O_EXCL, random name) in the target's directory, and
+// reopened without following symlinks, so neither a planted symlink nor a
+// second upload to the same path can redirect or corrupt it.
+type Uploads struct {
+	mu sync.Mutex
+	m  map[string]*upload // caller key + "\x00" + target
+}
+
+func NewUploads() *Uploads {
+	return &Uploads{m: make(map[string]*upload)}
+}
+
+// Begin starts (or restarts) key's upload of target: a new part file next to
+// target with the permission bits mode.
+func (u *Uploads) Begin(key, target string, mode os.FileMode) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.csjrpc-part")
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pruneLocked()
+	id := key + "\x00" + target
+	if old, ok := u.m[id]; ok {
+		os.Remove(old.part)
+	}
+	u.m[id] = &upload{part: f.Name(), fi: fi, last: time.Now()}
+	return f, nil
+}
+
+// Open reopens the part file of key's upload of target for the next chunk.
+func (u *Uploads) Open(key, target string) (*os.File, error) {
+	u.mu.Lock()
+	up, ok := u.m[key+"\x00"+target]
+	if ok {
+		up.last = time.Now()
+	}
+	u.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no upload of %s in progress (it starts at offset 0)", filepath.Base(target))
+	}
+	f, err := os.OpenFile(up.part, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || !os.SameFile(fi, up.fi) {
+		f.Close()
+		return nil, fmt.Errorf("part file of %s was replaced", filepath.Base(target))
+	}
+	return f, nil
+}
+
+// Part returns the part file of key's upload of target.
+func (u *Uploads) Part(key, target string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up, ok := u.m[key+"\x00"+target]
+	if !ok {
+		return "", false
+	}
+	return up.part, true
+}
+
+// Done forgets key's upload of target, removing its part file if it is still
+// there (not renamed into place).
+func (u *Uploads) Done(key, target string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	id := key + "\x00" + target
+	if up, ok := u.m[id]; ok {
+		os.Remove(up.part)
+		delete(u.m, id)
+	}
+}
+
+func (u *Uploads) pruneLocked() {
+	for id, up := range u.m {
+		if time.Since(up.last) > uploadIdle {
+			os.Remove(up.part)
+			delete(u.m, id)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package csjrpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RCBusy is the ReturnCode for requests rejected by admission control
+// (EX_TEMPFAIL: try again later).
+const RCBusy = 75
+
+type LimitsConfig struct {
+	MaxSessions   int     `toml:"max_sessions"`    // concurrent calls, all clients (0: unlimited)
+	MaxPerMachine int     `toml:"max_per_machine"` // concurrent calls per MachineID (0: unlimited)
+	Rate          float64 `toml:"rate"`            // new calls per second per MachineID (0: unlimited)
+	Burst         int     `toml:"burst"`           // rate bucket size (default: max(1, rate))
+	Queue         int     `toml:"queue"`           // calls allowed to wait for a slot (0: reject at once)
+	QueueTimeout  string  `toml:"queue_timeout"`   // max wait in the queue (default 30s)
+}
+
+// Limits is the validated form of LimitsConfig.
+type Limits struct {
+	MaxSessions   int
+	MaxPerMachine int
+	Rate          float64
+	Burst         int
+	Queue         int
+	QueueTimeout  time.Duration
+}
+
+func (c LimitsConfig) Parse() (Limits, error) {
+	l := Limits{
+		MaxSessions:   c.MaxSessions,
+		MaxPerMachine: c.MaxPerMachine,
+		Rate:          c.Rate,
+		Burst:         c.Burst,
+		Queue:         c.Queue,
+		QueueTimeout:  30 * time.Second,
+	}
+	if l.MaxSessions < 0 || l.MaxPerMachine < 0 || l.Rate < 0 || l.Burst < 0 || l.Queue < 0 {
+		return l, fmt.Errorf("limits must not be negative: %+v", c)
+	}
+	if c.QueueTimeout != "" {
+		d, err := time.ParseDuration(c.QueueTimeout)
+		if err != nil || d <= 0 {
+			return l, fmt.Errorf("invalid limits.queue_timeout %q", c.QueueTimeout)
+		}
+		l.QueueTimeout = d
+	}
+	if l.Rate > 0 && l.Burst == 0 {
+		l.Burst = int(l.Rate)
+		if l.Burst < 1 {
+			l.Burst = 1
+		}
+	}
+	return l, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Admission enforces Limits across calls. The limits are passed per call so
+// a config reload takes effect for new requests immediately.
+type Admission struct {
+	mu         sync.Mutex
+	active     int
+	perMachine map[string]int
+	waiting    int
+	buckets    map[string]*bucket // only the ones not yet refilled
+	swept      time.Time
+	changed    chan struct{} // closed and replaced whenever a slot frees up
+}
+
+func NewAdmission() *Admission {
+	return &Admission{
+		perMachine: make(map[string]int),
+		buckets:    make(map[string]*bucket),
+		changed:    make(chan struct{}),
+	}
+}
+
+// AdmissionError carries the reason a call was refused.
+type AdmissionError struct{ Reason string }
+
+func (e *AdmissionError) Error() string { return e.Reason }
+
+// Acquire admits one call for machineID, waiting in the bounded queue if all
+// slots are taken. The returned release func must be called exactly once.
+func (a *Admission) Acquire(machineID string, l Limits) (func(), error) {
+	a.mu.Lock()
+	a.sweepBuckets(l)
+	if l.Rate > 0 && !a.takeToken(machineID, l) {
+		a.mu.Unlock()
+		return nil, &AdmissionError{Reason: fmt.Sprintf("rate limited: machine %s exceeds %.3g calls/s", machineID, l.Rate)}
+	}
+
+	var deadline time.Time
+	queued := false
+	for !a.fits(machineID, l) {
+		if !queued {
+			if a.waiting >= l.Queue {
+				a.mu.Unlock()
+				return nil, &AdmissionError{Reason: a.busyReason(machineID, l)}
+			}
+			a.waiting++
+			queued = true
+			deadline = time.Now().Add(l.QueueTimeout)
+		}
+		ch := a.changed
+		a.mu.Unlock()
+		wait := time.Until(deadline)
+		timedOut := false
+		if wait <= 0 {
+			timedOut = true
+		} else {
+			t := time.NewTimer(wait)
+			select {
+			case <-ch:
+				t.Stop()
+			case <-t.C:
+				timedOut = true
+			}
+		}
+		a.mu.Lock()
+		if timedOut && !a.fits(machineID, l) {
+			a.waiting--
+			a.mu.Unlock()
+			return nil, &AdmissionError{Reason: fmt.Sprintf("queue timeout after %s: %s", l.QueueTimeout, a.busyReason(machineID, l))}
+		}
+	}
+	if queued {
+		a.waiting--
+	}
+	a.active++
+	a.perMachine[machineID]++
+	a.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			a.active--
+			if a.perMachine[machineID]--; a.perMachine[machineID] <= 0 {
+				delete(a.perMachine, machineID)
+			}
+			close(a.changed)
+			a.changed = make(chan struct{})
+			a.mu.Unlock()
+		})
+	}, nil
+}
+
+func (a *Admission) fits(machineID string, l Limits) bool {
+	if l.MaxSessions > 0 && a.active >= l.MaxSessions {
+		return false
+	}
+	if l.MaxPerMachine > 0 && a.perMachine[machineID] >= l.MaxPerMachine {
+		return false
+	}
+	return true
+}
+
+func (a *Admission) busyReason(machineID string, l Limits) string {
+	if l.MaxSessions > 0 && a.active >= l.MaxSessions {
+		return fmt.Sprintf("server busy: %d/%d sessions", a.active, l.MaxSessions)
+	}
+	return fmt.Sprintf("server busy: machine %s at %d/%d sessions", machineID, a.perMachine[machineID], l.MaxPerMachine)
+}
+
+// takeToken refills machineID's bucket and consumes one token; caller holds a.mu.
+func (a *Admission) takeToken(machineID string, l Limits) bool {
+	now := time.Now()
+	b, ok := a.buckets[machineID]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		a.buckets[machineID] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweepBuckets drops the buckets that have refilled (a new one starts full),
+// so rotating MachineIDs can't grow the map without bound; caller holds a.mu.
+func (a *Admission) sweepBuckets(l Limits) {
+	now := time.Now()
+	if l.Rate <= 0 {
+		clear(a.buckets)
+		return
+	}
+	if now.Sub(a.swept) < bucketSweep {
+		return
+	}
+	a.swept = now
+	for id, b := range a.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(a.buckets, id)
+		}
+	}
+}
+
+const bucketSweep = time.Second
+
+// Counts reports active and queued calls (for admin/stats output).
+func (a *Admission) Counts() (active, waiting int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.active, a.waiting
+}
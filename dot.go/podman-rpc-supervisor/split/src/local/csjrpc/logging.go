@@ -0,0 +1,153 @@
+package csjrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + fmt.Sprint(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+type LogConfig struct {
+	Level  string `toml:"level"`  // debug, info (default), warn, error
+	Format string `toml:"format"` // text (default) or json
+	File   string `toml:"file"`   // append here instead of stderr
+}
+
+// Logger state shared by Debugf/Infof/Warnf/Errorf. Until SetupLogging is
+// called everything at info and above goes to stderr as text.
+var logger = struct {
+	mu    sync.Mutex
+	level LogLevel
+	json  bool
+	out   io.Writer
+	file  *os.File
+}{level: LevelInfo, out: os.Stderr}
+
+// SetupLogging applies c; a previously opened log file is closed.
+func SetupLogging(c LogConfig) error {
+	level, err := ParseLogLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	var asJSON bool
+	switch strings.ToLower(strings.TrimSpace(c.Format)) {
+	case "", "text":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", c.Format)
+	}
+	var f *os.File
+	if c.File != "" {
+		f, err = os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("log file: %v", err)
+		}
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if logger.file != nil {
+		_ = logger.file.Close()
+	}
+	logger.level, logger.json, logger.file = level, asJSON, f
+	logger.out = io.Writer(os.Stderr)
+	if f != nil {
+		logger.out = f
+	}
+	return nil
+}
+
+// LogEnabled reports whether messages at l are currently emitted.
+func LogEnabled(l LogLevel) bool {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return l >= logger.level
+}
+
+type logRecord struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Caller string `json:"caller"`
+	Msg    string `json:"msg"`
+}
+
+func logWithCaller(level LogLevel, msg string, args ...any) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if level < logger.level {
+		return
+	}
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		file = "?"
+		line = 0
+	}
+	caller := fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	text := fmt.Sprintf(msg, args...)
+	if logger.json {
+		b, err := json.Marshal(logRecord{Time: ts, Level: level.String(), Caller: caller, Msg: text})
+		if err == nil {
+			_, _ = logger.out.Write(append(b, '\n'))
+			return
+		}
+	}
+	fmt.Fprintf(logger.out, "%s [%s] %s: %s\n", ts, strings.ToUpper(level.String()), caller, text)
+}
+
+func Debugf(msg string, args ...any) { logWithCaller(LevelDebug, msg, args...) }
+func Infof(msg string, args ...any)  { logWithCaller(LevelInfo, msg, args...) }
+func Warnf(msg string, args ...any)  { logWithCaller(LevelWarn, msg, args...) }
+func Errorf(msg string, args ...any) { logWithCaller(LevelError, msg, args...) }
+
+// WithFlags returns c with any non-empty flag values taking precedence.
+func (c LogConfig) WithFlags(level, format, file string) LogConfig {
+	if level != "" {
+		c.Level = level
+	}
+	if format != "" {
+		c.Format = format
+	}
+	if file != "" {
+		c.File = file
+	}
+	return c
+}
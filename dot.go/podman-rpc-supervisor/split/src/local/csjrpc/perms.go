@@ -0,0 +1,77 @@
+package csjrpc
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ParseMode parses an octal permission string like "0660" ("" -> 0, meaning
+// leave as created).
+func ParseMode(s string) (os.FileMode, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q (want octal like 0660)", s)
+	}
+	return os.FileMode(n), nil
+}
+
+// LookupGID resolves a group name or numeric gid ("" -> -1, meaning unchanged).
+func LookupGID(group string) (int, error) {
+	group = strings.TrimSpace(group)
+	if group == "" {
+		return -1, nil
+	}
+	if n, err := strconv.Atoi(group); err == nil {
+		return n, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// ApplyPerms sets the group (gid >= 0) and mode (non-zero) of path.
+func ApplyPerms(path string, mode os.FileMode, gid int) error {
+	if gid >= 0 {
+		if err := os.Lchown(path, -1, gid); err != nil {
+			return fmt.Errorf("chgrp %s: %v", path, err)
+		}
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("chmod %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// RootProblems lists the reasons path is unsafe as a socket root: a symlink,
+// not owned by this process's uid, or writable by group/others (anyone who
+// can write there could swap the sockets for their own).
+func RootProblems(path string) ([]string, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		out = append(out, fmt.Sprintf("%s is a symlink", path))
+		return out, nil
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		out = append(out, fmt.Sprintf("%s is owned by uid %d, not %d", path, st.Uid, os.Getuid()))
+	}
+	if perm := fi.Mode().Perm(); perm&0o022 != 0 {
+		out = append(out, fmt.Sprintf("%s is group/world writable (mode %04o)", path, perm))
+	}
+	return out, nil
+}
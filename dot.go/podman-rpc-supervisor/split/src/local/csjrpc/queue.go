@@ -0,0 +1,120 @@
+package csjrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MaxQueueKeyBytes bounds the client-chosen queue key.
+const MaxQueueKeyBytes = 128
+
+// QueueArgs is the payload of the client's Queue.Update callback: Position
+// is the number of calls ahead (0: this call now runs), Length the number of
+// calls holding or waiting on Key.
+type QueueArgs struct {
+	Key      string
+	Position int
+	Length   int
+}
+
+func ValidateQueueKey(key string) error {
+	if len(key) > MaxQueueKeyBytes {
+		return fmt.Errorf("queue key longer than %d bytes", MaxQueueKeyBytes)
+	}
+	for _, r := range key {
+		if r < ' ' || r == 0x7f {
+			return fmt.Errorf("invalid queue key %q", key)
+		}
+	}
+	return nil
+}
+
+// KeyQueues serializes calls that share a queue key: one holds the key at a
+// time and the others wait in FIFO order.
+type KeyQueues struct {
+	mu sync.Mutex
+	q  map[string][]*queueWaiter // [0] holds the key
+}
+
+type queueWaiter struct {
+	changed chan struct{} // buffered; poked whenever the queue moves
+}
+
+func NewKeyQueues() *KeyQueues {
+	return &KeyQueues{q: make(map[string][]*queueWaiter)}
+}
+
+// Wait blocks until the caller holds key or ctx is done. report is called
+// with (position, length) on entry and each time the position changes. The
+// returned release func must be called exactly once.
+func (k *KeyQueues) Wait(ctx context.Context, key string, report func(pos, length int)) (func(), error) {
+	w := &queueWaiter{changed: make(chan struct{}, 1)}
+	k.mu.Lock()
+	k.q[key] = append(k.q[key], w)
+	k.mu.Unlock()
+
+	last := -1
+	for {
+		k.mu.Lock()
+		pos, length := k.index(key, w), len(k.q[key])
+		k.mu.Unlock()
+		if pos != last {
+			report(pos, length)
+			last = pos
+		}
+		if pos == 0 {
+			break
+		}
+		select {
+		case <-w.changed:
+		case <-ctx.Done():
+			k.remove(key, w)
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { k.remove(key, w) }) }, nil
+}
+
+// Lengths reports the calls holding or waiting on each key (for Stats).
+func (k *KeyQueues) Lengths() map[string]int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	out := make(map[string]int, len(k.q))
+	for key, ws := range k.q {
+		out[key] = len(ws)
+	}
+	return out
+}
+
+// index returns w's position in key's queue; caller holds k.mu.
+func (k *KeyQueues) index(key string, w *queueWaiter) int {
+	for i, x := range k.q[key] {
+		if x == w {
+			return i
+		}
+	}
+	return -1
+}
+
+func (k *KeyQueues) remove(key string, w *queueWaiter) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ws := k.q[key]
+	if i := k.index(key, w); i >= 0 {
+		ws = append(ws[:i:i], ws[i+1:]...)
+	}
+	if len(ws) == 0 {
+		delete(k.q, key)
+		return
+	}
+	k.q[key] = ws
+	for _, x := range ws {
+		select {
+		case x.changed <- struct{}{}:
+		default:
+		}
+	}
+}
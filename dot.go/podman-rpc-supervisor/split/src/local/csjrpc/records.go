@@ -0,0 +1,65 @@
+package csjrpc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// MaxRecordBytes is the largest Line.Text sent in one call; longer lines are
+// split into continuation records.
+const MaxRecordBytes = 1 << 20
+
+// RecordReader splits output into lines like bufio.Scanner, but never gives
+// up on long lines: past max bytes it returns the line in pieces with cont
+// set on every piece but the last. Pieces end on UTF-8 boundaries so they
+// survive JSON encoding intact.
+type RecordReader struct {
+	br    *bufio.Reader
+	max   int
+	carry []byte // incomplete rune held back from the previous piece
+}
+
+func NewRecordReader(r io.Reader, max int) *RecordReader {
+	if max <= 0 {
+		max = MaxRecordBytes
+	}
+	return &RecordReader{br: bufio.NewReaderSize(r, 64*1024), max: max}
+}
+
+// Next returns the next record. A final line without a newline is returned
+// as a regular record; io.EOF (or the read error) follows it.
+func (r *RecordReader) Next() (text string, cont bool, err error) {
+	buf := r.carry
+	r.carry = nil
+	for {
+		frag, err := r.br.ReadSlice('\n')
+		buf = append(buf, frag...)
+		switch {
+		case err == nil:
+			buf = bytes.TrimSuffix(buf[:len(buf)-1], []byte{'\r'})
+			return string(buf), false, nil
+		case err == bufio.ErrBufferFull:
+			if len(buf) < r.max {
+				continue
+			}
+			// hold back a rune cut in half by the split
+			for k := len(buf) - 1; k >= 0 && k >= len(buf)-utf8.UTFMax; k-- {
+				if utf8.RuneStart(buf[k]) {
+					if !utf8.FullRune(buf[k:]) {
+						r.carry = append([]byte(nil), buf[k:]...)
+						buf = buf[:k]
+					}
+					break
+				}
+			}
+			return string(buf), true, nil
+		default:
+			if len(buf) > 0 {
+				return string(buf), false, nil
+			}
+			return "", false, err
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package csjrpc
+
+import (
+	"sync"
+	"time"
+)
+
+// Result RPC payloads
+type ResultArgs struct {
+	MachineID  string
+	PID        int
+	Nonce      string
+	WaitMillis int64 // > 0: wait up to this long for a running call to finish
+}
+type ResultReply struct {
+	Found   bool // false: unknown call, or its result already expired
+	Running bool
+	Reply   ProcessReply // valid when Found && !Running
+}
+
+type resultEntry struct {
+	done    chan struct{}
+	reply   ProcessReply
+	expires time.Time // zero while running
+}
+
+// ResultStore keeps Process replies keyed by IdPidKey so a client whose main
+// connection broke can collect the result after reconnecting.
+type ResultStore struct {
+	mu sync.Mutex
+	m  map[string]*resultEntry
+}
+
+func NewResultStore() *ResultStore {
+	return &ResultStore{m: make(map[string]*resultEntry)}
+}
+
+// Start marks key as running, replacing any older result for it.
+func (s *ResultStore) Start(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.m[key] = &resultEntry{done: make(chan struct{})}
+}
+
+// Finish records reply for key and keeps it for ttl (<= 0: drop it now).
+func (s *ResultStore) Finish(key string, reply ProcessReply, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok {
+		return
+	}
+	e.reply = reply
+	e.expires = time.Now().Add(ttl)
+	close(e.done)
+	if ttl <= 0 {
+		delete(s.m, key)
+	}
+	s.pruneLocked()
+}
+
+// Get looks up key, waiting up to wait for a running call to finish.
+func (s *ResultStore) Get(key string, wait time.Duration) ResultReply {
+	s.mu.Lock()
+	e, ok := s.m[key]
+	s.mu.Unlock()
+	if !ok {
+		return ResultReply{}
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-e.done:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+	select {
+	case <-e.done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return ResultReply{Found: true, Reply: e.reply}
+	default:
+		return ResultReply{Found: true, Running: true}
+	}
+}
+
+func (s *ResultStore) pruneLocked() {
+	now := time.Now()
+	for k, e := range s.m {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.m, k)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package csjrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// SandboxInitEnv carries the sandbox spec from the server to its re-executed
+// helper (see RunSandboxInit). It is stripped before the target is exec'd.
+const SandboxInitEnv = "CSJRPC_SANDBOX_INIT"
+
+const (
+	SandboxNone    = "none"
+	SandboxChroot  = "chroot"
+	SandboxMountNS = "mountns"
+)
+
+type SandboxConfig struct {
+	Mode     string `toml:"mode"`     // "none" (default), "chroot", "mountns"
+	ReadOnly bool   `toml:"readonly"` // mountns only: remount the sandbox root read-only
+	UserNS   bool   `toml:"userns"`   // mountns only: also unshare a user namespace (unprivileged servers)
+}
+
+// Normalize fills defaults and rejects unknown or unsupported combinations.
+func (c SandboxConfig) Normalize() (SandboxConfig, error) {
+	c.Mode = strings.ToLower(strings.TrimSpace(c.Mode))
+	switch c.Mode {
+	case "", SandboxNone:
+		c.Mode = SandboxNone
+		if c.ReadOnly || c.UserNS {
+			return c, fmt.Errorf("sandbox readonly/userns require mode=%s", SandboxMountNS)
+		}
+	case SandboxChroot:
+		if c.ReadOnly || c.UserNS {
+			return c, fmt.Errorf("sandbox readonly/userns require mode=%s", SandboxMountNS)
+		}
+	case SandboxMountNS:
+	default:
+		return c, fmt.Errorf("unknown sandbox mode: %q", c.Mode)
+	}
+	return c, nil
+}
+
+func (c SandboxConfig) Enabled() bool {
+	return c.Mode != "" && c.Mode != SandboxNone
+}
+
+type sandboxInit struct {
+	Root     string
+	ReadOnly bool
+}
+
+// SandboxCommand builds the child command for path (already resolved inside
+// root) so that it runs confined to root. For chroot the kernel does the work
+// via SysProcAttr; for mountns the server re-executes itself as a small init
+// helper that sets up a private mount namespace before exec'ing the target.
+// A root that is (or resolves to) "/" is refused: it would confine nothing.
+func SandboxCommand(c SandboxConfig, root, path string, args []string, env []string) (*exec.Cmd, error) {
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: root: %v", err)
+	}
+	if real == "/" {
+		return nil, fmt.Errorf("sandbox: refusing %s as the sandbox root: it would confine nothing", root)
+	}
+	root = real
+	switch c.Mode {
+	case SandboxChroot:
+		cmd := exec.Command(path, args...)
+		cmd.Dir = "/"
+		cmd.Env = env
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Chroot: root}
+		return cmd, nil
+	case SandboxMountNS:
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: locate server executable: %v", err)
+		}
+		spec, err := json.Marshal(sandboxInit{Root: root, ReadOnly: c.ReadOnly})
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command(self, append([]string{path}, args...)...)
+		cmd.Env = append(append([]string(nil), env...), SandboxInitEnv+"="+string(spec))
+		attr := &syscall.SysProcAttr{Setpgid: true, Cloneflags: syscall.CLONE_NEWNS}
+		if c.UserNS {
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+			attr.GidMappingsEnableSetgroups = false
+		}
+		cmd.SysProcAttr = attr
+		return cmd, nil
+	}
+	return nil, fmt.Errorf("sandbox not enabled")
+}
+
+func SandboxInitRequested() bool {
+	_, ok := os.LookupEnv(SandboxInitEnv)
+	return ok
+}
+
+// RunSandboxInit runs inside the freshly unshared mount namespace: it makes
+// mounts private, bind-mounts the sandbox root (read-only if requested),
+// chroots into it and execs os.Args[1:]. It never returns.
+func RunSandboxInit() {
+	fail := func(rc int, msg string, args ...any) {
+		fmt.Fprintf(os.Stderr, "sandbox: "+msg+"\n", args...)
+		os.Exit(rc)
+	}
+	var spec sandboxInit
+	if err := json.Unmarshal([]byte(os.Getenv(SandboxInitEnv)), &spec); err != nil {
+		fail(126, "bad spec: %v", err)
+	}
+	if spec.Root == "" || len(os.Args) < 2 {
+		fail(126, "missing root or command")
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, SandboxInitEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fail(126, "make mounts private: %v", err)
+	}
+	if err := syscall.Mount(spec.Root, spec.Root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		fail(126, "bind %s: %v", spec.Root, err)
+	}
+	if spec.ReadOnly {
+		if err := syscall.Mount("", spec.Root, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			fail(126, "remount read-only %s: %v", spec.Root, err)
+		}
+	}
+	if err := syscall.Chroot(spec.Root); err != nil {
+		fail(126, "chroot %s: %v", spec.Root, err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		fail(126, "chdir /: %v", err)
+	}
+	err := syscall.Exec(os.Args[1], os.Args[1:], env)
+	fail(127, "exec %s: %v", os.Args[1], err)
+}
@@ -0,0 +1,92 @@
+package csjrpc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SweepClientDirs removes stale <root>/<machine-id>/<pid>[.<nonce>]/ callback socket
+// directories left behind by clients that died without cleaning up. A
+// directory is stale when none of its sockets accepts a connection and
+// either its PID is gone (only checked for this host's machine-id; other
+// machine-ids may live in other PID namespaces) or it is older than ttl
+// (<= 0: no age limit). Emptied machine-id directories are removed too.
+func SweepClientDirs(root string, ttl time.Duration) (removed int, err error) {
+	if IsAbstract(root) {
+		return 0, nil
+	}
+	hostID := ""
+	if b, err := os.ReadFile("/etc/machine-id"); err == nil {
+		hostID = strings.TrimSpace(string(b))
+	}
+	machines, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, m := range machines {
+		if !m.IsDir() {
+			continue
+		}
+		if _, err := SanitizeMachineID(m.Name()); err != nil {
+			continue // not ours
+		}
+		mdir := filepath.Join(root, m.Name())
+		pids, err := os.ReadDir(mdir)
+		if err != nil {
+			continue
+		}
+		for _, p := range pids {
+			pidStr, _, _ := strings.Cut(p.Name(), ".")
+			pid, err := strconv.Atoi(pidStr)
+			if !p.IsDir() || err != nil || pid <= 0 {
+				continue
+			}
+			dir := filepath.Join(mdir, p.Name())
+			info, err := p.Info()
+			if err != nil {
+				continue
+			}
+			dead := m.Name() == hostID && !pidAlive(pid)
+			old := ttl > 0 && now.Sub(info.ModTime()) > ttl
+			if (!dead && !old) || socketsAnswer(dir) {
+				continue
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				Warnf("sweep %s: %v", dir, err)
+				continue
+			}
+			removed++
+		}
+		_ = os.Remove(mdir) // only succeeds once empty
+	}
+	return removed, nil
+}
+
+func pidAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func socketsAnswer(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Type()&os.ModeSocket == 0 {
+			continue
+		}
+		if c, err := net.DialTimeout("unix", filepath.Join(dir, e.Name()), 200*time.Millisecond); err == nil {
+			c.Close()
+			return true
+		}
+	}
+	return false
+}
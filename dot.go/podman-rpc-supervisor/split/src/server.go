@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -31,6 +32,21 @@ var (
 	flagStartDir string
 	flagEnvs     envList
 	flagConfig   string
+	flagAllowDir envList
+
+	flagSandbox         string
+	flagSandboxReadOnly bool
+	flagAudit           string
+	flagGrace           time.Duration
+	flagGraceSet        bool // -grace given, so 0 counts
+	flagSignalRC        int
+	flagSweepTTL        time.Duration
+	flagStrictRoot      bool
+	flagSockMode        string
+	flagSockGroup       string
+	flagLogLevel        string
+	flagLogFormat       string
+	flagLogFile         string
 )
 
 type envList []string
@@ -46,13 +62,51 @@ func (e *envList) Set(s string) error {
 
 type session struct {
 	serial    int64
+	started   time.Time
+	labels    map[string]string
 	cmdline   string
+	queue     string // -queue key; queuePos > 0 while waiting for it
+	queuePos  int
+	endpoint  string // served on; "" for the main socket
 	mu        sync.Mutex
 	machineID string
 	pid       int
 	cancel    context.CancelFunc
 	stoppedBy string
-	proc      *os.Process
+	procs     map[int]*os.Process // running children (several for parallel batches)
+	grace     time.Duration       // per-request/cancel override of the policy grace; < 0: none
+}
+
+func (s *session) addProc(p *os.Process) {
+	s.mu.Lock()
+	if s.procs == nil {
+		s.procs = make(map[int]*os.Process)
+	}
+	s.procs[p.Pid] = p
+	s.mu.Unlock()
+}
+func (s *session) removeProc(p *os.Process) {
+	s.mu.Lock()
+	delete(s.procs, p.Pid)
+	s.mu.Unlock()
+}
+
+// signalLocked signals every running child's process group; caller holds s.mu.
+func (s *session) signalLocked(sig syscall.Signal) {
+	for pid := range s.procs {
+		_ = signalGroup(pid, sig)
+	}
+}
+
+// firstPIDLocked returns the lowest child PID (0 if none); caller holds s.mu.
+func (s *session) firstPIDLocked() int {
+	first := 0
+	for pid := range s.procs {
+		if first == 0 || pid < first {
+			first = pid
+		}
+	}
+	return first
 }
 
 type sessionTable struct {
@@ -66,6 +120,7 @@ func newSessionTable() *sessionTable { return &sessionTable{m: make(map[string]*
 func (t *sessionTable) add(key string, s *session) {
 	t.mu.Lock()
 	s.serial = t.nextSerial
+	s.started = time.Now()
 	t.nextSerial++
 	t.m[key] = s
 	t.mu.Unlock()
@@ -100,101 +155,716 @@ func (t *sessionTable) cancelAll(by string) {
 		if s.cancel != nil {
 			s.cancel()
 		}
-		if s.proc != nil {
-			_ = signalGroup(s.proc.Pid, syscall.SIGTERM)
-		}
+		s.signalLocked(syscall.SIGTERM)
 		s.mu.Unlock()
 	}
 }
 
+// ServerService serves one endpoint. Endpoints are shallow copies that
+// share everything but the endpoint name.
 type ServerService struct {
-	sessions      *sessionTable
-	wg            sync.WaitGroup
-	root          string
-	serverBaseEnv []string
+	endpoint  string // "" for the main socket
+	sessions  *sessionTable
+	wg        *sync.WaitGroup
+	root      string
+	audit     *csjrpc.Auditor
+	admission *csjrpc.Admission
+	queues    *csjrpc.KeyQueues
+	stats     *serverStats
+	results   *csjrpc.ResultStore
+	pols      *policyBox
+	uploads   *csjrpc.Uploads
 }
 
-func (s *ServerService) Process(args csjrpc.ProcessArgs, reply *csjrpc.ProcessReply) error {
-	s.wg.Add(1)
-	defer s.wg.Done()
+type policyBox struct {
+	mu  sync.RWMutex
+	pol *serverPolicy
+}
+
+// serverStats accumulates the counters reported by the Stats RPC.
+type serverStats struct {
+	mu         sync.Mutex
+	started    time.Time
+	commands   int64
+	failed     int64
+	execMillis int64
+	lastErrAt  time.Time
+	lastErrKey string
+	lastErr    string
+}
+
+func (st *serverStats) command(reply *csjrpc.ProcessReply) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.commands++
+	st.execMillis += reply.ElapsedMillis
+	if reply.ReturnCode != 0 {
+		st.failed++
+	}
+}
+
+func (st *serverStats) noteError(key, msg string) {
+	if msg == "" {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastErrAt = time.Now().UTC()
+	st.lastErrKey = key
+	st.lastErr = msg
+}
+
+// serverPolicy is the part of the server configuration that SIGHUP reloads.
+// Calls snapshot it when they start, so in-flight sessions keep their policy.
+type serverPolicy struct {
+	baseEnv []string // KEY=VAL, config then --env flags
+	sandbox csjrpc.SandboxConfig
+	grace   time.Duration // SIGTERM -> SIGKILL delay on cancel
+	sigRC   int           // rc for signaled children; 0: 128+signal
+	results time.Duration // Result RPC retention of finished replies
+	limits  csjrpc.Limits
+	output  csjrpc.OutputLimits
+	files   csjrpc.FilesConfig
+
+	startDirs []string // allowed working dir prefixes, symlinks resolved (empty: any)
+
+	endpoints map[string]*endpointPolicy
+}
+
+type endpointPolicy struct {
+	startDir string
+	env      []string
+	allow    []string
+}
+
+var mainEndpoint = &endpointPolicy{}
+
+// endpoint returns the policy of the named endpoint ("" is the main socket);
+// false means it was dropped from the config since the server started.
+func (p *serverPolicy) endpoint(name string) (*endpointPolicy, bool) {
+	if name == "" {
+		return mainEndpoint, true
+	}
+	ep, ok := p.endpoints[name]
+	return ep, ok
+}
+
+// allows checks the allowlist against the command as requested and as
+// resolved (symlinks followed, so "sh" may resolve to dash). An entry with a
+// "/" must be the resolved path (the entry's symlinks followed too). A bare
+// name only matches a command requested by that name that lookPath (the
+// server's own PATH, not the client's) resolves to the same file, so "make"
+// doesn't let in ./make, /tmp/x/make or an uploaded file named make.
+func (ep *endpointPolicy) allows(command, resolved string, lookPath func(string) string) bool {
+	if len(ep.allow) == 0 {
+		return true
+	}
+	for _, a := range ep.allow {
+		if strings.Contains(a, "/") {
+			p := filepath.Clean(a)
+			if real, err := filepath.EvalSymlinks(p); err == nil && real == resolved {
+				return true
+			}
+			if p == resolved {
+				return true
+			}
+		} else if a == command && lookPath(command) == resolved {
+			return true
+		}
+	}
+	return false
+}
+
+// buildPolicy merges config and command-line flags (flags win).
+func buildPolicy(cfg csjrpc.Config) (*serverPolicy, error) {
+	p := &serverPolicy{}
+
+	sandbox := cfg.Server.Sandbox
+	if flagSandbox != "" {
+		sandbox.Mode = flagSandbox
+	}
+	if flagSandboxReadOnly {
+		sandbox.ReadOnly = true
+	}
+	sandbox, err := sandbox.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	p.sandbox = sandbox
+
+	p.grace = time.Second
+	if cfg.Server.Grace != "" {
+		d, err := time.ParseDuration(cfg.Server.Grace)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid server.grace %q", cfg.Server.Grace)
+		}
+		p.grace = d
+	}
+	if flagGraceSet {
+		if flagGrace < 0 {
+			return nil, fmt.Errorf("invalid -grace %s", flagGrace)
+		}
+		p.grace = flagGrace
+	}
+
+	p.results = 5 * time.Minute
+	if cfg.Server.ResultTTL != "" {
+		d, err := time.ParseDuration(cfg.Server.ResultTTL)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid server.result_ttl %q", cfg.Server.ResultTTL)
+		}
+		p.results = d
+	}
+
+	p.endpoints = make(map[string]*endpointPolicy, len(cfg.Server.Endpoints))
+	for name, ec := range cfg.Server.Endpoints {
+		if name == "" || strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid endpoint name %q", name)
+		}
+		p.endpoints[name] = &endpointPolicy{
+			startDir: ec.StartDir,
+			env:      csjrpc.EnvMapToList(ec.Env),
+			allow:    ec.Allow,
+		}
+	}
+
+	for _, d := range append(append([]string(nil), cfg.Server.StartDirs...), flagAllowDir...) {
+		if !filepath.IsAbs(d) {
+			return nil, fmt.Errorf("allowed startdir must be absolute: %q", d)
+		}
+		real, err := filepath.EvalSymlinks(d)
+		if err != nil {
+			csjrpc.Warnf("allowed startdir %s: %v", d, err)
+			real = filepath.Clean(d)
+		}
+		p.startDirs = append(p.startDirs, real)
+	}
+	for name, ep := range p.endpoints {
+		if ep.startDir != "" {
+			if msg := p.checkStartDir(ep.startDir); msg != "" {
+				csjrpc.Warnf("endpoint %s: %s", name, msg)
+			}
+		}
+	}
+
+	p.sigRC = cfg.Server.SignalExitCode
+	if flagSignalRC != 0 {
+		p.sigRC = flagSignalRC
+	}
+	if p.sigRC < 0 || p.sigRC > 255 {
+		return nil, fmt.Errorf("signal exit code must be 0-255: %d", p.sigRC)
+	}
+
+	limits, err := cfg.Server.Limits.Parse()
+	if err != nil {
+		return nil, err
+	}
+	p.limits = limits
+
+	if cfg.Server.Output.MaxLines < 0 || cfg.Server.Output.MaxBytes < 0 {
+		return nil, fmt.Errorf("output limits must not be negative: %+v", cfg.Server.Output)
+	}
+	p.output = cfg.Server.Output
+
+	p.files = cfg.Server.Files
+	if p.files.MaxBytes < 0 {
+		return nil, fmt.Errorf("server.files.max_bytes must not be negative")
+	}
+	if p.files.MaxBytes == 0 {
+		p.files.MaxBytes = 64 << 20
+	}
+
+	// Build server base env from config + flags
+	p.baseEnv = csjrpc.EnvMapToList(cfg.Server.Env)
+	for _, e := range flagEnvs {
+		if strings.Contains(e, "=") {
+			p.baseEnv = append(p.baseEnv, e)
+			continue
+		}
+		// bare NAME: must exist
+		val, ok := os.LookupEnv(e)
+		if !ok {
+			return nil, fmt.Errorf("--env %s requested but not present in server environment", e)
+		}
+		p.baseEnv = append(p.baseEnv, e+"="+val)
+	}
+	return p, nil
+}
+
+// diff describes what changed from old to p. Env values are not logged.
+func (p *serverPolicy) diff(old *serverPolicy) []string {
+	var out []string
+	envMap := func(list []string) map[string]string {
+		m := make(map[string]string, len(list))
+		for _, kv := range list {
+			if k, v, ok := splitEnvKV(kv); ok {
+				m[k] = v
+			}
+		}
+		return m
+	}
+	oldEnv, newEnv := envMap(old.baseEnv), envMap(p.baseEnv)
+	var added, removed, changed []string
+	for k, v := range newEnv {
+		if ov, ok := oldEnv[k]; !ok {
+			added = append(added, k)
+		} else if ov != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range oldEnv {
+		if _, ok := newEnv[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	for _, d := range []struct {
+		what string
+		keys []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(d.keys) > 0 {
+			sort.Strings(d.keys)
+			out = append(out, fmt.Sprintf("env %s: %s", d.what, strings.Join(d.keys, ",")))
+		}
+	}
+	if old.grace != p.grace {
+		out = append(out, fmt.Sprintf("grace: %s -> %s", old.grace, p.grace))
+	}
+	if old.results != p.results {
+		out = append(out, fmt.Sprintf("result_ttl: %s -> %s", old.results, p.results))
+	}
+	if old.sigRC != p.sigRC {
+		out = append(out, fmt.Sprintf("signal_exit_code: %d -> %d", old.sigRC, p.sigRC))
+	}
+	if o, n := strings.Join(old.startDirs, ","), strings.Join(p.startDirs, ","); o != n {
+		out = append(out, fmt.Sprintf("startdirs: [%s] -> [%s]", o, n))
+	}
+	if old.files != p.files {
+		out = append(out, fmt.Sprintf("files: %+v -> %+v", old.files, p.files))
+	}
+	if old.output != p.output {
+		out = append(out, fmt.Sprintf("output: %+v -> %+v", old.output, p.output))
+	}
+	if old.limits != p.limits {
+		out = append(out, fmt.Sprintf("limits: %+v -> %+v", old.limits, p.limits))
+	}
+	if old.sandbox != p.sandbox {
+		out = append(out, fmt.Sprintf("sandbox: %+v -> %+v", old.sandbox, p.sandbox))
+	}
+	names := make([]string, 0, len(p.endpoints)+len(old.endpoints))
+	for name := range p.endpoints {
+		names = append(names, name)
+	}
+	for name := range old.endpoints {
+		if _, ok := p.endpoints[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, ok1 := old.endpoints[name]
+		n, ok2 := p.endpoints[name]
+		switch {
+		case !ok1:
+			out = append(out, fmt.Sprintf("endpoint %s: added (not served until restart)", name))
+		case !ok2:
+			out = append(out, fmt.Sprintf("endpoint %s: removed (socket now rejects calls)", name))
+		case o.startDir != n.startDir || strings.Join(o.allow, "\x00") != strings.Join(n.allow, "\x00"):
+			out = append(out, fmt.Sprintf("endpoint %s: startdir %q allow %q -> startdir %q allow %q", name, o.startDir, o.allow, n.startDir, n.allow))
+		}
+		if ok1 && ok2 && strings.Join(o.env, "\x00") != strings.Join(n.env, "\x00") {
+			out = append(out, fmt.Sprintf("endpoint %s: env changed", name))
+		}
+	}
+	return out
+}
+
+func (s *ServerService) policy() *serverPolicy {
+	s.pols.mu.RLock()
+	defer s.pols.mu.RUnlock()
+	return s.pols.pol
+}
+
+// forEndpoint returns this endpoint's policy and working directory (the
+// request's, else the endpoint default); msg is set when the call must fail.
+func (s *ServerService) forEndpoint(pol *serverPolicy, startDir string) (*endpointPolicy, string, string) {
+	ep, ok := pol.endpoint(s.endpoint)
+	if !ok {
+		return nil, "", fmt.Sprintf("endpoint %q is no longer configured", s.endpoint)
+	}
+	if startDir == "" {
+		startDir = ep.startDir
+	}
+	workDir, msg := validateStartDir(startDir)
+	if msg == "" {
+		msg = pol.checkStartDir(workDirOrCwd(workDir))
+	}
+	return ep, workDir, msg
+}
+
+// checkStartDir enforces the startdir allowlist: dir (symlinks resolved)
+// must be one of the allowed directories or below one.
+func (p *serverPolicy) checkStartDir(dir string) string {
+	if len(p.startDirs) == 0 {
+		return ""
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Sprintf("invalid startdir: %q", dir)
+	}
+	for _, allowed := range p.startDirs {
+		if real == allowed || allowed == "/" || strings.HasPrefix(real, allowed+"/") {
+			return ""
+		}
+	}
+	return fmt.Sprintf("startdir %q is outside the allowed directories (%s)", dir, strings.Join(p.startDirs, ", "))
+}
+
+// reload re-reads the config file and swaps in the new policy, keeping the
+// old one if anything fails.
+func (s *ServerService) reload(cfgPath string, required bool) {
+	cfg, err := loadServerConfig(cfgPath, required)
+	if err != nil {
+		csjrpc.Errorf("reload: %v; keeping current configuration", err)
+		return
+	}
+	pol, err := buildPolicy(cfg)
+	if err != nil {
+		csjrpc.Errorf("reload: %v; keeping current configuration", err)
+		return
+	}
+	// reopening also lets logrotate move the file away before the HUP
+	if err := csjrpc.SetupLogging(cfg.Common.Log.WithFlags(flagLogLevel, flagLogFormat, flagLogFile)); err != nil {
+		csjrpc.Errorf("reload: %v; keeping current logging", err)
+	}
+	s.pols.mu.Lock()
+	old := s.pols.pol
+	s.pols.pol = pol
+	s.pols.mu.Unlock()
+
+	changes := pol.diff(old)
+	if len(changes) == 0 {
+		csjrpc.Infof("reload: %s: no changes", cfgPath)
+		return
+	}
+	for _, c := range changes {
+		csjrpc.Infof("reload: %s", c)
+	}
+}
+
+// loadServerConfig loads the server config. Only a missing file falls back
+// to the defaults, and only when not required (explicit -config); one that
+// can't be read or parsed is always an error, so a SIGHUP after a typo keeps
+// the current policy instead of dropping it.
+func loadServerConfig(cfgPath string, required bool) (csjrpc.Config, error) {
+	cfg, found, err := csjrpc.LoadConfig(cfgPath)
+	if err != nil {
+		return cfg, fmt.Errorf("load config %q: %v", cfgPath, err)
+	}
+	if required && !found {
+		return cfg, fmt.Errorf("config file not found: %s", cfgPath)
+	}
+	return cfg, nil
+}
+
+// callbacks are the client's stdout/stderr/stdin services for one call. Line
+// indexes are shared across all commands of the call so the client's reorder
+// sinks see one gapless sequence per stream. With interleave set, both
+// streams go to the stdout service under the single outIdx sequence.
+type callbacks struct {
+	stdout     *rpc.Client
+	stderr     *rpc.Client
+	stdin      *rpc.Client
+	outIdx     int64
+	errIdx     int64
+	interleave bool
+	enc        string       // output compression; "" for plain WriteLine calls
+	outBatch   *lineBatcher // set when output is compressed
+	errBatch   *lineBatcher
+	closer     []net.Conn
+}
+
+func (c *callbacks) writeStdout(text string) { c.stdoutRecord(text, false) }
+func (c *callbacks) writeStderr(text string) { c.stderrRecord(text, false) }
+
+func (c *callbacks) stdoutRecord(text string, cont bool) {
+	idx := atomic.AddInt64(&c.outIdx, 1) - 1
+	line := csjrpc.Line{Index: int(idx), Text: text, Continued: cont}
+	if c.interleave {
+		line.Origin = csjrpc.OriginStdout
+	}
+	c.send(c.stdout, "Stdout", c.outBatch, line)
+}
+func (c *callbacks) stderrRecord(text string, cont bool) {
+	if c.interleave {
+		idx := atomic.AddInt64(&c.outIdx, 1) - 1
+		c.send(c.stdout, "Stdout", c.outBatch, csjrpc.Line{Index: int(idx), Text: text, Continued: cont, Origin: csjrpc.OriginStderr})
+		return
+	}
+	idx := atomic.AddInt64(&c.errIdx, 1) - 1
+	c.send(c.stderr, "Stderr", c.errBatch, csjrpc.Line{Index: int(idx), Text: text, Continued: cont})
+}
+func (c *callbacks) send(cli *rpc.Client, svc string, b *lineBatcher, line csjrpc.Line) {
+	if b != nil {
+		b.add(line)
+		return
+	}
+	_ = cli.Call(svc+".WriteLine", line, &struct{}{})
+}
+
+// compress switches output to compressed WriteBatch calls.
+func (c *callbacks) compress(enc string) {
+	c.enc = enc
+	c.outBatch = &lineBatcher{cli: c.stdout, method: "Stdout.WriteBatch", enc: enc}
+	c.errBatch = &lineBatcher{cli: c.stderr, method: "Stderr.WriteBatch", enc: enc}
+}
+
+// flush sends any batched output; call before the reply goes out.
+func (c *callbacks) flush() {
+	c.outBatch.flush()
+	c.errBatch.flush()
+}
+
+func (c *callbacks) Close() {
+	c.flush()
+	for _, conn := range c.closer {
+		_ = conn.Close()
+	}
+}
+
+// lineBatcher collects Lines into compressed batches, sent when large enough
+// or after a short delay so interactive output is not held back.
+type lineBatcher struct {
+	mu     sync.Mutex
+	cli    *rpc.Client
+	method string
+	enc    string
+	lines  []csjrpc.Line
+	size   int
+	timer  *time.Timer
+}
+
+const (
+	batchMaxLines = 512
+	batchMaxBytes = 256 * 1024
+	batchDelay    = 20 * time.Millisecond
+)
 
-	key := csjrpc.IdPidKey(args.MachineID, args.PID)
-	csjrpc.Infof("Process start: key=%s cmd=%q args=%d startdir=%q", key, args.Command, len(args.Args), args.StartDir)
+func (b *lineBatcher) add(line csjrpc.Line) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines = append(b.lines, line)
+	b.size += len(line.Text)
+	if len(b.lines) >= batchMaxLines || b.size >= batchMaxBytes {
+		b.flushLocked()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(batchDelay, b.flush)
+	}
+}
+
+func (b *lineBatcher) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *lineBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.lines) == 0 {
+		return
+	}
+	batch, err := csjrpc.EncodeLines(b.enc, b.lines)
+	if err != nil {
+		csjrpc.Errorf("encode output batch: %v", err)
+	} else {
+		_ = b.cli.Call(b.method, batch, &struct{}{})
+	}
+	b.lines, b.size = nil, 0
+}
+
+// dialCallbacks waits for and connects to the client's callback sockets
+// (one shared connection under ProtoMux). On failure it returns the message
+// to put in the reply.
+func (s *ServerService) dialCallbacks(key, machineID string, pid int, nonce string, proto int) (*callbacks, string) {
+	if !csjrpc.ValidNonce(nonce) {
+		return nil, fmt.Sprintf("invalid nonce %q", nonce)
+	}
+	if proto >= csjrpc.ProtoMux {
+		sock := csjrpc.DeriveClientMuxSocket(s.root, machineID, pid, nonce)
+		if err := waitForSocket(sock, 5*time.Second); err != nil {
+			csjrpc.Errorf("key=%s mux socket error: %v", key, err)
+			return nil, "mux socket not available: " + err.Error()
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			csjrpc.Errorf("key=%s mux dial: %v", key, err)
+			return nil, "connect mux service: " + err.Error()
+		}
+		cli := jsonrpc.NewClient(conn)
+		return &callbacks{stdout: cli, stderr: cli, stdin: cli, closer: []net.Conn{conn}}, ""
+	}
+	stdoutSock, stderrSock, stdinSock := csjrpc.DeriveClientSockets(s.root, machineID, pid, nonce)
+
+	// Wait for client sockets to appear (up to a few seconds)
+	for _, sock := range []struct{ name, path string }{{"stdout", stdoutSock}, {"stderr", stderrSock}, {"stdin", stdinSock}} {
+		if err := waitForSocket(sock.path, 5*time.Second); err != nil {
+			csjrpc.Errorf("key=%s %s socket error: %v", key, sock.name, err)
+			return nil, sock.name + " socket not available: " + err.Error()
+		}
+	}
+
+	// Connect to client services
+	cb := &callbacks{}
+	for _, sock := range []struct {
+		name, path string
+		cli        **rpc.Client
+	}{{"stdout", stdoutSock, &cb.stdout}, {"stderr", stderrSock, &cb.stderr}, {"stdin", stdinSock, &cb.stdin}} {
+		conn, err := net.Dial("unix", sock.path)
+		if err != nil {
+			cb.Close()
+			csjrpc.Errorf("key=%s %s dial: %v", key, sock.name, err)
+			return nil, "connect " + sock.name + " service: " + err.Error()
+		}
+		cb.closer = append(cb.closer, conn)
+		*sock.cli = jsonrpc.NewClient(conn)
+	}
+	return cb, ""
+}
 
-	// Validate StartDir if provided
-	workDir := args.StartDir
+// validateStartDir returns the absolute working directory for a request
+// ("" means the server's cwd) or a reply error message.
+func validateStartDir(startDir string) (string, string) {
+	workDir := startDir
 	if workDir != "" {
 		if !filepath.IsAbs(workDir) {
 			wd, _ := os.Getwd()
 			workDir = filepath.Join(wd, workDir)
 		}
 		if fi, err := os.Stat(workDir); err != nil || !fi.IsDir() {
-			reply.FailNow(2, fmt.Sprintf("invalid startdir: %q", args.StartDir))
-			csjrpc.Errorf("key=%s startdir invalid: %v", key, args.StartDir)
-			return nil
+			return "", fmt.Sprintf("invalid startdir: %q", startDir)
 		}
 	}
+	return workDir, ""
+}
 
-	// Prepare context & session
-	ctx, cancel := context.WithCancel(context.Background())
-	sess := &session{machineID: args.MachineID, pid: args.PID, cancel: cancel}
-	s.sessions.add(key, sess)
+func (s *ServerService) auditCall(key string, args csjrpc.ProcessArgs, reply *csjrpc.ProcessReply, callStart time.Time) {
+	s.audit.Record(csjrpc.AuditRecord{
+		Key:            key,
+		MachineID:      args.MachineID,
+		PID:            args.PID,
+		StartDir:       args.StartDir,
+		Command:        args.Command,
+		Resolved:       reply.ResolvedCmdLine,
+		Args:           args.Args,
+		EnvKeys:        csjrpc.EnvKeys(args.Env),
+		Labels:         args.Labels,
+		ReturnCode:     reply.ReturnCode,
+		Error:          reply.Error,
+		Stopped:        reply.Stopped,
+		StoppedBy:      reply.StoppedBy,
+		Signal:         reply.Signal,
+		ExecMillis:     reply.ElapsedMillis,
+		DurationMillis: time.Since(callStart).Milliseconds(),
+	})
+}
+
+func (s *ServerService) Process(args csjrpc.ProcessArgs, reply *csjrpc.ProcessReply) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	key := csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)
+	csjrpc.Infof("Process start: key=%s cmd=%q args=%d startdir=%q labels=%q", key, args.Command, len(args.Args), args.StartDir, csjrpc.FormatLabels(args.Labels))
+
+	// Audit every call, including setup failures; keep the reply for Result
+	callStart := time.Now()
+	s.results.Start(s.resultKey(key))
 	defer func() {
-		cancel()
-		s.sessions.delete(key)
+		s.auditCall(key, args, reply, callStart)
+		s.stats.noteError(key, reply.Error)
+		s.results.Finish(s.resultKey(key), *reply, s.policy().results)
 	}()
 
-	stdoutSock, stderrSock, stdinSock := csjrpc.DeriveClientSockets(s.root, args.MachineID, args.PID)
-
-	// Wait for client sockets to appear (up to a few seconds)
-	if err := waitForSocket(stdoutSock, 5*time.Second); err != nil {
-		reply.FailNow(2, "stdout socket not available: "+err.Error())
-		csjrpc.Errorf("key=%s stdout socket error: %v", key, err)
+	if err := csjrpc.ValidateLabels(args.Labels); err != nil {
+		reply.FailNow(2, err.Error())
 		return nil
 	}
-	if err := waitForSocket(stderrSock, 5*time.Second); err != nil {
-		reply.FailNow(2, "stderr socket not available: "+err.Error())
-		csjrpc.Errorf("key=%s stderr socket error: %v", key, err)
+
+	pol := s.policy()
+
+	// Validate StartDir (or the endpoint's default)
+	ep, workDir, msg := s.forEndpoint(pol, args.StartDir)
+	if msg != "" {
+		reply.FailNow(2, msg)
+		csjrpc.Errorf("key=%s startdir rejected: %s", key, msg)
 		return nil
 	}
-	if err := waitForSocket(stdinSock, 5*time.Second); err != nil {
-		reply.FailNow(2, "stdin socket not available: "+err.Error())
-		csjrpc.Errorf("key=%s stdin socket error: %v", key, err)
+
+	if err := csjrpc.ValidateQueueKey(args.Queue); err != nil {
+		reply.FailNow(2, err.Error())
 		return nil
 	}
 
-	// Connect to client services
-	stdoutConn, err := net.Dial("unix", stdoutSock)
-	if err != nil {
-		reply.FailNow(2, "connect stdout service: "+err.Error())
-		csjrpc.Errorf("key=%s stdout dial: %v", key, err)
-		return nil
+	// Admission control: concurrency slots (maybe queued) and rate. A call
+	// with a queue key is admitted when its turn comes instead (below), so
+	// calls waiting on the key hold no slot.
+	if args.Queue == "" {
+		release, err := s.admit(key, args.MachineID, pol)
+		if err != nil {
+			reply.FailNow(csjrpc.RCBusy, err.Error())
+			return nil
+		}
+		defer release()
 	}
-	defer stdoutConn.Close()
-	stdoutCli := jsonrpc.NewClient(stdoutConn)
 
-	stderrConn, err := net.Dial("unix", stderrSock)
-	if err != nil {
-		reply.FailNow(2, "connect stderr service: "+err.Error())
-		csjrpc.Errorf("key=%s stderr dial: %v", key, err)
+	// Prepare context & session
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{machineID: args.MachineID, pid: args.PID, labels: args.Labels, queue: args.Queue, endpoint: s.endpoint, cancel: cancel, grace: requestGrace(args.GraceMillis, args.HasGrace)}
+	s.sessions.add(key, sess)
+	defer func() {
+		cancel()
+		s.sessions.delete(key)
+	}()
+
+	cb, msg := s.dialCallbacks(key, args.MachineID, args.PID, args.Nonce, args.Protocol)
+	if msg != "" {
+		reply.FailNow(2, msg)
 		return nil
 	}
-	defer stderrConn.Close()
-	stderrCli := jsonrpc.NewClient(stderrConn)
+	defer cb.Close()
 
-	stdinConn, err := net.Dial("unix", stdinSock)
-	if err != nil {
-		reply.FailNow(2, "connect stdin service: "+err.Error())
-		csjrpc.Errorf("key=%s stdin dial: %v", key, err)
-		return nil
+	// Serialize on the queue key, then take the admission slot
+	if args.Queue != "" {
+		unqueue, err := s.waitQueue(ctx, key, sess, cb)
+		if err != nil {
+			reply.FailNow(128+int(syscall.SIGTERM), "canceled while queued on "+strconv.Quote(args.Queue))
+			reply.Stopped, reply.StoppedBy = true, sess.stopper()
+			return nil
+		}
+		defer unqueue()
+		release, err := s.admit(key, args.MachineID, pol)
+		if err != nil {
+			reply.FailNow(csjrpc.RCBusy, err.Error())
+			return nil
+		}
+		defer release()
+	}
+	cb.interleave = args.Interleave
+	if enc, err := csjrpc.NegotiateCompression(args.Compress); err != nil {
+		csjrpc.Warnf("key=%s %v; sending uncompressed", key, err)
+	} else if enc != csjrpc.CompressNone {
+		cb.compress(enc)
 	}
-	defer stdinConn.Close()
-	stdinCli := jsonrpc.NewClient(stdinConn)
+	reply.Compression = cb.enc
 
 	// Ping behavior (empty command)
 	if strings.TrimSpace(args.Command) == "" {
-		_ = stdoutCli.Call("Stdout.WriteLine", csjrpc.Line{Index: 0, Text: "server ping to stdout"}, &struct{}{})
-		_ = stderrCli.Call("Stderr.WriteLine", csjrpc.Line{Index: 0, Text: "server ping to stderr"}, &struct{}{})
+		cb.writeStdout("server ping to stdout")
+		cb.writeStderr("server ping to stderr")
 		reply.ReturnCode = 0
 		reply.ExecStartRFC3339 = time.Now().UTC().Format(time.RFC3339Nano)
 		reply.ExecEndRFC3339 = reply.ExecStartRFC3339
@@ -204,196 +874,773 @@ func (s *ServerService) Process(args csjrpc.ProcessArgs, reply *csjrpc.ProcessRe
 		return nil
 	}
 
-	// Build env for child: server base -> client overlay
-	finalEnv := mergeEnv(os.Environ(), s.serverBaseEnv, args.Env)
+	s.runProcess(ctx, key, sess, cb, runSpec{
+		pol:       pol,
+		ep:        ep,
+		workDir:   workDir,
+		command:   args.Command,
+		args:      args.Args,
+		env:       args.Env,
+		withStdin: true,
+		progress:  time.Duration(args.ProgressMillis) * time.Millisecond,
+		sigRC:     args.SignalExitCode,
+	}, reply)
+	csjrpc.Infof("Process end: key=%s rc=%d stopped=%v by=%s elapsed=%dms", key, reply.ReturnCode, reply.Stopped, reply.StoppedBy, reply.ElapsedMillis)
+	return nil
+}
 
-	// Resolve command path
-	resolvedPath, rc, err := resolveCommandPath(args.Command, workDirOrCwd(workDir), finalEnv)
+// waitQueue waits for sess's turn on its queue key, telling the client its
+// position (Queue.Update) whenever it changes. The update is repeated every
+// few seconds so a client that went away gives up its place.
+func (s *ServerService) waitQueue(ctx context.Context, key string, sess *session, cb *callbacks) (func(), error) {
+	qctx, qcancel := context.WithCancel(ctx)
+	defer qcancel()
+	var mu sync.Mutex
+	var last csjrpc.QueueArgs
+	update := func() {
+		mu.Lock()
+		args := last
+		mu.Unlock()
+		if err := cb.stderr.Call("Queue.Update", args, &struct{}{}); err != nil && !errors.As(err, new(rpc.ServerError)) {
+			csjrpc.Warnf("key=%s client gone while queued: %v", key, err)
+			qcancel()
+		}
+	}
+	go func() {
+		t := time.NewTicker(queueHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-qctx.Done():
+				return
+			case <-t.C:
+				update()
+			}
+		}
+	}()
+	return s.queues.Wait(qctx, sess.queue, func(pos, length int) {
+		sess.mu.Lock()
+		sess.queuePos = pos
+		sess.mu.Unlock()
+		if pos > 0 {
+			csjrpc.Infof("key=%s queued on %q: position %d of %d", key, sess.queue, pos, length)
+		}
+		mu.Lock()
+		last = csjrpc.QueueArgs{Key: sess.queue, Position: pos, Length: length}
+		mu.Unlock()
+		update()
+	})
+}
+
+const queueHeartbeat = 5 * time.Second
+
+// admit takes an admission slot for a call: concurrency (maybe waiting for a
+// slot) and rate.
+func (s *ServerService) admit(key, machineID string, pol *serverPolicy) (func(), error) {
+	release, err := s.admission.Acquire(machineID, pol.limits)
 	if err != nil {
-		reply.FailNow(rc, err.Error())
-		csjrpc.Errorf("key=%s resolve command %q failed: %v", key, args.Command, err)
-		return nil
+		csjrpc.Warnf("key=%s rejected: %v", key, err)
 	}
+	return release, err
+}
 
-	// Prepare child process
-	cmd := exec.Command(resolvedPath, args.Args...)
-	if workDir != "" {
-		cmd.Dir = workDir
+// stopper reports who stopped the session ("" if nobody did).
+func (s *session) stopper() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stoppedBy
+}
+
+// runSpec describes one child to run within a call.
+type runSpec struct {
+	pol       *serverPolicy
+	ep        *endpointPolicy
+	workDir   string
+	command   string
+	args      []string
+	env       []string
+	withStdin bool          // false: empty stdin instead of the client's stdin service
+	progress  time.Duration // >0: send Progress.Update to the client at this interval
+	sigRC     int           // >0: per-request override of pol.sigRC
+}
+
+// runProcess resolves, starts and waits for one child, streaming its output
+// to cb and filling reply.
+func (s *ServerService) runProcess(ctx context.Context, key string, sess *session, cb *callbacks, spec runSpec, reply *csjrpc.ProcessReply) {
+	workDir, command, cmdArgs, env, withStdin := spec.workDir, spec.command, spec.args, spec.env, spec.withStdin
+	// Build env for child: server base -> endpoint -> client overlay
+	finalEnv := mergeEnv(os.Environ(), append(append([]string(nil), spec.pol.baseEnv...), spec.ep.env...), env)
+
+	// Resolve command path and prepare child process
+	var resolvedPath string
+	var rc int
+	var err error
+	var cmd *exec.Cmd
+	if spec.pol.sandbox.Enabled() {
+		// The working directory becomes the child's filesystem root
+		sandboxRoot := workDirOrCwd(workDir)
+		resolvedPath, rc, err = resolveSandboxedCommandPath(command, sandboxRoot, finalEnv)
+		if err != nil {
+			reply.FailNow(rc, err.Error())
+			csjrpc.Errorf("key=%s resolve command %q in sandbox %s failed: %v", key, command, sandboxRoot, err)
+			return
+		}
+		cmd, err = csjrpc.SandboxCommand(spec.pol.sandbox, sandboxRoot, resolvedPath, cmdArgs, finalEnv)
+		if err != nil {
+			reply.FailNow(2, err.Error())
+			csjrpc.Errorf("key=%s sandbox setup failed: %v", key, err)
+			return
+		}
+	} else {
+		resolvedPath, rc, err = resolveCommandPath(command, workDirOrCwd(workDir), finalEnv)
+		if err != nil {
+			reply.FailNow(rc, err.Error())
+			csjrpc.Errorf("key=%s resolve command %q failed: %v", key, command, err)
+			return
+		}
+		cmd = exec.Command(resolvedPath, cmdArgs...)
+		if workDir != "" {
+			cmd.Dir = workDir
+		}
+		cmd.Env = finalEnv
+		// Make a new process group so we can signal the whole tree
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	// bare allowlist names resolve through the server's PATH only: the
+	// client's env can't point them at its own files
+	serverEnv := []string{"PATH=" + serverPATH(mergeEnv(os.Environ(), append(append([]string(nil), spec.pol.baseEnv...), spec.ep.env...), nil))}
+	lookPath := func(name string) string {
+		var p string
+		var err error
+		if spec.pol.sandbox.Enabled() {
+			p, _, err = resolveSandboxedCommandPath(name, workDirOrCwd(workDir), serverEnv)
+		} else {
+			p, _, err = resolveCommandPath(name, "/", serverEnv)
+		}
+		if err != nil {
+			return ""
+		}
+		return p
+	}
+	if !spec.ep.allows(command, resolvedPath, lookPath) {
+		reply.FailNow(126, fmt.Sprintf("command %s is not allowed on endpoint %q", resolvedPath, s.endpoint))
+		csjrpc.Warnf("key=%s command %s rejected by endpoint %q allowlist", key, resolvedPath, s.endpoint)
+		return
 	}
-	cmd.Env = finalEnv
-	// Make a new process group so we can signal the whole tree
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		reply.FailNow(2, "stdout pipe: "+err.Error())
-		return nil
+		return
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
 		reply.FailNow(2, "stderr pipe: "+err.Error())
-		return nil
+		return
 	}
 
 	// We'll provide stdin via a pipe and pull from client's stdin service
-	stdinWriter, err := cmd.StdinPipe()
-	if err != nil {
-		reply.FailNow(2, "stdin pipe: "+err.Error())
-		return nil
+	var stdinWriter io.WriteCloser
+	if withStdin {
+		stdinWriter, err = cmd.StdinPipe()
+		if err != nil {
+			reply.FailNow(2, "stdin pipe: "+err.Error())
+			return
+		}
 	}
 
 	// Time stamps (server-side)
 	execStart := time.Now().UTC()
 
-	if err := cmd.Start(); err != nil {
-		reply.FailAt(127, "exec start: "+err.Error(), execStart)
+	if err := cmd.Start(); err != nil {
+		reply.FailAt(127, "exec start: "+err.Error(), execStart)
+		return
+	}
+	reply.ResolvedCmdLine = strings.Join(append([]string{resolvedPath}, cmdArgs...), " ")
+
+	// record cmdline for admin ls
+	sess.mu.Lock()
+	sess.cmdline = reply.ResolvedCmdLine
+	sess.mu.Unlock()
+
+	// Register process to the session
+	sess.addProc(cmd.Process)
+	defer sess.removeProc(cmd.Process)
+
+	// wgOut covers the output pumps, which must drain before cmd.Wait closes
+	// the pipes; wgIO covers the stdin pump, which stops once the child exits.
+	var wgOut, wgIO sync.WaitGroup
+	procDone := make(chan struct{})
+	wgOut.Add(2)
+	var counters csjrpc.ProgressArgs
+	var killedByLimit int32
+
+	// pump forwards one output stream line by line, over-long lines as
+	// continuation records. Past the output limits it sends one truncation
+	// marker and then only drains the pipe (so the child never blocks on a
+	// full pipe), unless the limit kills the child.
+	pump := func(r io.Reader, stream string, lines, nbytes *int64, write func(string, bool), truncated *bool) {
+		defer wgOut.Done()
+		lim := spec.pol.output
+		rr := csjrpc.NewRecordReader(r, csjrpc.MaxRecordBytes)
+		partial := false // inside a continued line
+		for {
+			text, cont, err := rr.Next()
+			if err != nil {
+				return
+			}
+			if *truncated {
+				continue
+			}
+			n := int64(len(text))
+			if !cont {
+				n++
+			}
+			if (lim.MaxLines > 0 && *lines >= lim.MaxLines) || (lim.MaxBytes > 0 && *nbytes+n > lim.MaxBytes) {
+				*truncated = true
+				if partial {
+					write("", false) // end the cut-off line first
+				}
+				write(fmt.Sprintf("[csjrpc: %s truncated after %d lines, %d bytes]", stream, *lines, *nbytes), false)
+				csjrpc.Warnf("key=%s %s output limit reached (%+v)", key, stream, lim)
+				if lim.Kill {
+					atomic.StoreInt32(&killedByLimit, 1)
+					_ = signalGroup(cmd.Process.Pid, syscall.SIGKILL)
+				}
+				continue
+			}
+			if !cont {
+				atomic.AddInt64(lines, 1)
+			}
+			atomic.AddInt64(nbytes, n)
+			partial = cont
+			write(text, cont)
+		}
+	}
+	go pump(stdoutPipe, "stdout", &counters.StdoutLines, &counters.StdoutBytes, cb.stdoutRecord, &reply.StdoutTruncated)
+	go pump(stderrPipe, "stderr", &counters.StderrLines, &counters.StderrBytes, cb.stderrRecord, &reply.StderrTruncated)
+
+	// progress ticker (client registered a Progress service)
+	if spec.progress > 0 {
+		go func(pid int) {
+			t := time.NewTicker(spec.progress)
+			defer t.Stop()
+			for {
+				select {
+				case <-procDone:
+					return
+				case <-t.C:
+				}
+				p := csjrpc.ProgressArgs{
+					PID:           pid,
+					ElapsedMillis: time.Since(execStart).Milliseconds(),
+					StdoutLines:   atomic.LoadInt64(&counters.StdoutLines),
+					StdoutBytes:   atomic.LoadInt64(&counters.StdoutBytes),
+					StderrLines:   atomic.LoadInt64(&counters.StderrLines),
+					StderrBytes:   atomic.LoadInt64(&counters.StderrBytes),
+				}
+				p.CPUMillis, p.RSSBytes = procUsage(pid)
+				if err := cb.stderr.Call("Progress.Update", p, &struct{}{}); err != nil {
+					csjrpc.Warnf("key=%s progress update: %v; disabling", key, err)
+					return
+				}
+			}
+		}(cmd.Process.Pid)
+	}
+
+	// stdin pump (pull from client's stdin service)
+	if withStdin {
+		wgIO.Add(1)
+		go func() {
+			defer wgIO.Done()
+			const chunk = 64 * 1024
+			for {
+				select {
+				case <-ctx.Done():
+					_ = stdinWriter.Close()
+					return
+				case <-procDone:
+					_ = stdinWriter.Close()
+					return
+				default:
+				}
+				var rep csjrpc.StdinReadReply
+				err := cb.stdin.Call("Stdin.ReadChunk", csjrpc.StdinReadArgs{Max: chunk}, &rep)
+				if err != nil {
+					break
+				}
+				if rep.Err != "" {
+					break
+				}
+				if len(rep.Data) > 0 {
+					if _, werr := stdinWriter.Write(rep.Data); werr != nil {
+						break
+					}
+				}
+				if rep.EOF {
+					break
+				}
+				if len(rep.Data) == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			_ = stdinWriter.Close()
+		}()
+	}
+
+	// Cancellation watcher: on ctx.Done, SIGTERM -> wait a bit -> SIGKILL
+	go func(pid int) {
+		select {
+		case <-ctx.Done():
+		case <-procDone:
+			return
+		}
+		grace := spec.pol.grace
+		sess.mu.Lock()
+		if sess.grace >= 0 {
+			grace = sess.grace
+		}
+		sess.mu.Unlock()
+		csjrpc.Infof("key=%s cancel received; signaling process group %d (grace %s)", key, pid, grace)
+		_ = signalGroup(pid, syscall.SIGTERM)
+		select {
+		case <-time.After(grace):
+			_ = signalGroup(pid, syscall.SIGKILL)
+		case <-procDone:
+		}
+	}(cmd.Process.Pid)
+
+	wgOut.Wait()
+	waitErr := cmd.Wait()
+	execEnd := time.Now().UTC()
+	close(procDone)
+	if stdinWriter != nil {
+		_ = stdinWriter.Close()
+	}
+
+	// Ensure stdin pump finishes
+	wgIO.Wait()
+
+	// Determine return code & stopped state
+	rc, sig := exitCodeFromWaitErr(waitErr)
+	reply.ReturnCode = rc
+	if sig != 0 {
+		reply.Signal = int(sig)
+		reply.SignalName = sig.String()
+		sigRC := spec.pol.sigRC
+		if spec.sigRC > 0 && spec.sigRC <= 255 {
+			sigRC = spec.sigRC
+		}
+		if sigRC > 0 {
+			reply.ReturnCode = sigRC
+		}
+	}
+	reply.Stopped = false
+	reply.StoppedBy = ""
+	sess.mu.Lock()
+	if sess.stoppedBy != "" {
+		reply.Stopped = true
+		reply.StoppedBy = sess.stoppedBy
+	}
+	sess.mu.Unlock()
+	if atomic.LoadInt32(&killedByLimit) != 0 && !reply.Stopped {
+		reply.Stopped = true
+		reply.StoppedBy = "output-limit"
+	}
+
+	reply.ExecStartRFC3339 = execStart.Format(time.RFC3339Nano)
+	reply.ExecEndRFC3339 = execEnd.Format(time.RFC3339Nano)
+	reply.ElapsedMillis = execEnd.Sub(execStart).Milliseconds()
+	s.stats.command(reply)
+}
+
+// fileTarget validates a PutFile/GetFile request against the policy and
+// returns the absolute path, or a reply error message.
+func (s *ServerService) fileTarget(startDir, path string) (*serverPolicy, string, string) {
+	pol := s.policy()
+	if pol.files.Disable {
+		return pol, "", "file transfer is disabled on this server"
+	}
+	_, workDir, msg := s.forEndpoint(pol, startDir)
+	if msg != "" {
+		return pol, "", msg
+	}
+	target, err := csjrpc.ResolveInDir(workDirOrCwd(workDir), path)
+	if err != nil {
+		return pol, "", err.Error()
+	}
+	return pol, target, ""
+}
+
+// PutFile stages a client file inside the working directory, chunk by chunk.
+func (s *ServerService) PutFile(args csjrpc.PutFileArgs, reply *csjrpc.PutFileReply) error {
+	key := csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)
+	pol, target, msg := s.fileTarget(args.StartDir, args.Path)
+	if msg != "" {
+		reply.Error = msg
+		csjrpc.Warnf("key=%s PutFile %q: %s", key, args.Path, msg)
+		return nil
+	}
+	if args.Offset < 0 || args.Offset > pol.files.MaxBytes-int64(len(args.Data)) {
+		reply.Error = fmt.Sprintf("file exceeds the server limit of %d bytes", pol.files.MaxBytes)
+		return nil
+	}
+	var f *os.File
+	var err error
+	if args.Offset == 0 {
+		mode := os.FileMode(args.Mode).Perm()
+		if mode == 0 {
+			mode = 0o644
+		}
+		f, err = s.uploads.Begin(key, target, mode)
+	} else if f, err = s.uploads.Open(key, target); err == nil {
+		// chunks come in order: no holes, no rewrites
+		if fi, serr := f.Stat(); serr != nil || fi.Size() != args.Offset {
+			f.Close()
+			err = fmt.Errorf("offset %d does not continue the upload of %s", args.Offset, args.Path)
+		}
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		return nil
+	}
+	reply.Size = args.Offset + int64(len(args.Data))
+	_, err = f.WriteAt(args.Data, args.Offset)
+	if err == nil && args.Final {
+		err = f.Truncate(reply.Size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.uploads.Done(key, target)
+		reply.Error = err.Error()
+		return nil
+	}
+	if args.Final {
+		defer s.uploads.Done(key, target)
+		// the directories may have changed since the first chunk
+		if _, again, msg := s.fileTarget(args.StartDir, args.Path); msg != "" || again != target {
+			if msg == "" {
+				msg = fmt.Sprintf("%s moved during the upload", args.Path)
+			}
+			reply.Error = msg
+			return nil
+		}
+		part, _ := s.uploads.Part(key, target)
+		if err := os.Rename(part, target); err != nil {
+			reply.Error = err.Error()
+			return nil
+		}
+		csjrpc.Infof("key=%s PutFile %s (%d bytes)", key, target, reply.Size)
+	}
+	return nil
+}
+
+// GetFile returns one chunk of a file inside the working directory.
+func (s *ServerService) GetFile(args csjrpc.GetFileArgs, reply *csjrpc.GetFileReply) error {
+	key := csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)
+	pol, target, msg := s.fileTarget(args.StartDir, args.Path)
+	if msg != "" {
+		reply.Error = msg
+		csjrpc.Warnf("key=%s GetFile %q: %s", key, args.Path, msg)
+		return nil
+	}
+	f, err := csjrpc.OpenInDir(target)
+	if err != nil {
+		reply.Error = err.Error()
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		reply.Error = fmt.Sprintf("not a regular file: %s", args.Path)
+		return nil
+	}
+	if fi.Size() > pol.files.MaxBytes {
+		reply.Error = fmt.Sprintf("file exceeds the server limit of %d bytes", pol.files.MaxBytes)
+		return nil
+	}
+	max := args.Max
+	if max <= 0 || max > csjrpc.FileChunkSize {
+		max = csjrpc.FileChunkSize
+	}
+	buf := make([]byte, max)
+	n, err := f.ReadAt(buf, args.Offset)
+	if err != nil && err != io.EOF {
+		reply.Error = err.Error()
+		return nil
+	}
+	reply.Data = buf[:n]
+	reply.Size = fi.Size()
+	reply.EOF = args.Offset+int64(n) >= fi.Size()
+	if reply.EOF {
+		csjrpc.Infof("key=%s GetFile %s (%d bytes)", key, target, fi.Size())
+	}
+	return nil
+}
+
+// Result returns the reply of a Process call by (MachineID, PID), for
+// clients whose main connection broke while the command was running.
+func (s *ServerService) Result(args csjrpc.ResultArgs, reply *csjrpc.ResultReply) error {
+	*reply = s.results.Get(s.resultKey(csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)), millis(args.WaitMillis))
+	return nil
+}
+
+// resultKey scopes a call's stored result to the endpoint that ran it, so
+// another endpoint's callers can't collect it.
+func (s *ServerService) resultKey(key string) string {
+	if s.endpoint == "" {
+		return key
+	}
+	return s.endpoint + "/" + key
+}
+
+// sees reports whether se is visible to this socket's callers: the main
+// socket sees every session, an endpoint only its own.
+func (s *ServerService) sees(se *session) bool {
+	return s.endpoint == "" || se.endpoint == s.endpoint
+}
+
+// Stats reports uptime and cumulative counters; it needs no callback sockets,
+// so it doubles as a cheap health check. On an endpoint socket the active
+// sessions are that endpoint's only.
+func (s *ServerService) Stats(args csjrpc.StatsArgs, reply *csjrpc.StatsReply) error {
+	s.sessions.mu.Lock()
+	reply.TotalSessions = s.sessions.nextSerial
+	for key, se := range s.sessions.m {
+		if !s.sees(se) {
+			continue
+		}
+		reply.ActiveSessions++
+		se.mu.Lock()
+		reply.Active = append(reply.Active, csjrpc.SessionInfo{
+			ID:             se.serial,
+			Key:            key,
+			StartedRFC3339: se.started.UTC().Format(time.RFC3339Nano),
+			Command:        se.cmdline,
+			Labels:         se.labels,
+		})
+		se.mu.Unlock()
+	}
+	s.sessions.mu.Unlock()
+	sort.Slice(reply.Active, func(i, j int) bool { return reply.Active[i].ID < reply.Active[j].ID })
+	_, reply.Queued = s.admission.Counts()
+	reply.Queues = s.queues.Lengths()
+
+	st := s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	reply.StartedRFC3339 = st.started.Format(time.RFC3339Nano)
+	reply.UptimeMillis = time.Since(st.started).Milliseconds()
+	reply.Commands = st.commands
+	reply.FailedCommands = st.failed
+	reply.ExecMillis = st.execMillis
+	if st.lastErr != "" {
+		reply.LastErrorRFC3339 = st.lastErrAt.Format(time.RFC3339Nano)
+		reply.LastErrorKey = st.lastErrKey
+		reply.LastError = st.lastErr
+	}
+	return nil
+}
+
+// ProcessBatch runs several commands for one client call under a single
+// session, sharing the callback sockets. Batch commands get an empty stdin.
+func (s *ServerService) ProcessBatch(args csjrpc.ProcessBatchArgs, reply *csjrpc.ProcessBatchReply) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	key := csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)
+	defer func() { s.stats.noteError(key, reply.Error) }()
+	policy, err := csjrpc.NormalizeBatchPolicy(args.Policy)
+	if err != nil {
+		reply.ReturnCode = 2
+		reply.Error = err.Error()
+		return nil
+	}
+	csjrpc.Infof("ProcessBatch start: key=%s commands=%d policy=%s parallel=%d startdir=%q labels=%q", key, len(args.Commands), policy, args.Parallel, args.StartDir, csjrpc.FormatLabels(args.Labels))
+	if err := csjrpc.ValidateLabels(args.Labels); err != nil {
+		reply.ReturnCode = 2
+		reply.Error = err.Error()
+		return nil
+	}
+
+	pol := s.policy()
+
+	ep, workDir, msg := s.forEndpoint(pol, args.StartDir)
+	if msg != "" {
+		reply.ReturnCode = 2
+		reply.Error = msg
+		csjrpc.Errorf("key=%s startdir rejected: %s", key, msg)
+		return nil
+	}
+
+	if err := csjrpc.ValidateQueueKey(args.Queue); err != nil {
+		reply.ReturnCode = 2
+		reply.Error = err.Error()
 		return nil
 	}
-	reply.ResolvedCmdLine = strings.Join(append([]string{resolvedPath}, args.Args...), " ")
 
-	// record cmdline for admin ls
-	sess.mu.Lock()
-	sess.cmdline = reply.ResolvedCmdLine
-	sess.mu.Unlock()
+	// A batch takes one admission slot for its whole duration; with a queue
+	// key, once its turn comes (below)
+	if args.Queue == "" {
+		release, err := s.admit(key, args.MachineID, pol)
+		if err != nil {
+			reply.ReturnCode = csjrpc.RCBusy
+			reply.Error = err.Error()
+			return nil
+		}
+		defer release()
+	}
 
-	// Register process to the session
-	sess.mu.Lock()
-	sess.proc = cmd.Process
-	sess.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{machineID: args.MachineID, pid: args.PID, labels: args.Labels, queue: args.Queue, endpoint: s.endpoint, cancel: cancel, grace: requestGrace(args.GraceMillis, args.HasGrace)}
+	s.sessions.add(key, sess)
+	defer func() {
+		cancel()
+		s.sessions.delete(key)
+	}()
 
-	var wgIO sync.WaitGroup
-	procDone := make(chan struct{})
-	wgIO.Add(3)
+	cb, msg := s.dialCallbacks(key, args.MachineID, args.PID, args.Nonce, args.Protocol)
+	if msg != "" {
+		reply.ReturnCode = 2
+		reply.Error = msg
+		return nil
+	}
+	defer cb.Close()
 
-	// stdout pump
-	go func() {
-		defer wgIO.Done()
-		sc := bufio.NewScanner(stdoutPipe)
-		sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
-		idx := 0
-		for sc.Scan() {
-			_ = stdoutCli.Call("Stdout.WriteLine", csjrpc.Line{Index: idx, Text: sc.Text()}, &struct{}{})
-			idx++
+	// The whole batch holds the queue key, then one admission slot
+	if args.Queue != "" {
+		unqueue, err := s.waitQueue(ctx, key, sess, cb)
+		if err != nil {
+			reply.ReturnCode = 128 + int(syscall.SIGTERM)
+			reply.Error = "canceled while queued on " + strconv.Quote(args.Queue)
+			return nil
 		}
-	}()
+		defer unqueue()
+		release, err := s.admit(key, args.MachineID, pol)
+		if err != nil {
+			reply.ReturnCode = csjrpc.RCBusy
+			reply.Error = err.Error()
+			return nil
+		}
+		defer release()
+	}
+	cb.interleave = args.Interleave
+	if enc, err := csjrpc.NegotiateCompression(args.Compress); err != nil {
+		csjrpc.Warnf("key=%s %v; sending uncompressed", key, err)
+	} else if enc != csjrpc.CompressNone {
+		cb.compress(enc)
+	}
 
-	// stderr pump
-	go func() {
-		defer wgIO.Done()
-		sc := bufio.NewScanner(stderrPipe)
-		sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
-		idx := 0
-		for sc.Scan() {
-			_ = stderrCli.Call("Stderr.WriteLine", csjrpc.Line{Index: idx, Text: sc.Text()}, &struct{}{})
-			idx++
+	run := func(i int, out *csjrpc.ProcessReply) {
+		out.Compression = cb.enc
+		bc := args.Commands[i]
+		pargs := csjrpc.ProcessArgs{
+			MachineID: args.MachineID,
+			PID:       args.PID,
+			StartDir:  args.StartDir,
+			Command:   bc.Command,
+			Args:      bc.Args,
+			Env:       append(append([]string(nil), args.Env...), bc.Env...),
+			Labels:    args.Labels,
 		}
-	}()
+		callStart := time.Now()
+		if strings.TrimSpace(bc.Command) == "" {
+			out.FailNow(2, "empty command")
+		} else {
+			s.runProcess(ctx, key, sess, cb, runSpec{
+				pol:     pol,
+				ep:      ep,
+				workDir: workDir,
+				command: pargs.Command,
+				args:    pargs.Args,
+				env:     pargs.Env,
+				sigRC:   args.SignalExitCode,
+			}, out)
+		}
+		s.auditCall(key, pargs, out, callStart)
+		csjrpc.Infof("ProcessBatch item: key=%s #%d rc=%d elapsed=%dms", key, i, out.ReturnCode, out.ElapsedMillis)
+	}
 
-	// stdin pump (pull from client's stdin service)
-	go func() {
-		defer wgIO.Done()
-		const chunk = 64 * 1024
-		for {
-			select {
-			case <-ctx.Done():
-				_ = stdinWriter.Close()
-				return
-			case <-procDone:
-				_ = stdinWriter.Close()
-				return
-			default:
-			}
-			var rep csjrpc.StdinReadReply
-			err := stdinCli.Call("Stdin.ReadChunk", csjrpc.StdinReadArgs{Max: chunk}, &rep)
-			if err != nil {
+	replies := make([]csjrpc.ProcessReply, len(args.Commands))
+	ran := len(args.Commands)
+	switch policy {
+	case csjrpc.BatchParallel:
+		n := args.Parallel
+		if n <= 0 || n > len(args.Commands) {
+			n = len(args.Commands)
+		}
+		sem := make(chan struct{}, n)
+		var wg sync.WaitGroup
+		for i := range args.Commands {
+			sem <- struct{}{}
+			if ctx.Err() != nil {
+				<-sem
+				ran = i
 				break
 			}
-			if rep.Err != "" {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				run(i, &replies[i])
+			}(i)
+		}
+		wg.Wait()
+	default:
+		for i := range args.Commands {
+			if ctx.Err() != nil {
+				ran = i
 				break
 			}
-			if len(rep.Data) > 0 {
-				if _, werr := stdinWriter.Write(rep.Data); werr != nil {
-					break
-				}
-			}
-			if rep.EOF {
+			run(i, &replies[i])
+			if policy == csjrpc.BatchStopOnError && replies[i].ReturnCode != 0 {
+				ran = i + 1
 				break
 			}
-			if len(rep.Data) == 0 {
-				time.Sleep(10 * time.Millisecond)
-			}
 		}
-		_ = stdinWriter.Close()
-	}()
-
-	// Cancellation watcher: on ctx.Done, SIGTERM -> wait a bit -> SIGKILL
-	done := make(chan struct{})
-	go func(pid int) {
-		defer close(done)
-		<-ctx.Done()
-		csjrpc.Infof("key=%s cancel received; signaling process group", key)
-		_ = signalGroup(pid, syscall.SIGTERM)
-		// small grace period
-		time.Sleep(1 * time.Second)
-		_ = signalGroup(pid, syscall.SIGKILL)
-	}(cmd.Process.Pid)
-
-	waitErr := cmd.Wait()
-	execEnd := time.Now().UTC()
-	close(procDone)
-	_ = stdinWriter.Close()
-
-	// Ensure I/O pumps finish
-	wgIO.Wait()
-
-	// Determine return code & stopped state
-	rc = exitCodeFromWaitErr(waitErr)
-	reply.ReturnCode = rc
-	reply.Stopped = false
-	reply.StoppedBy = ""
-	sess.mu.Lock()
-	if sess.stoppedBy != "" {
-		reply.Stopped = true
-		reply.StoppedBy = sess.stoppedBy
 	}
-	sess.mu.Unlock()
-
-	reply.ExecStartRFC3339 = execStart.Format(time.RFC3339Nano)
-	reply.ExecEndRFC3339 = execEnd.Format(time.RFC3339Nano)
-	reply.ElapsedMillis = execEnd.Sub(execStart).Milliseconds()
+	reply.Replies = replies[:ran]
+	for _, r := range reply.Replies {
+		if r.ReturnCode != 0 {
+			reply.ReturnCode = r.ReturnCode
+			break
+		}
+	}
+	csjrpc.Infof("ProcessBatch end: key=%s ran=%d/%d rc=%d", key, ran, len(args.Commands), reply.ReturnCode)
+	return nil
+}
 
-	csjrpc.Infof("Process end: key=%s rc=%d stopped=%v by=%s elapsed=%dms", key, rc, reply.Stopped, reply.StoppedBy, reply.ElapsedMillis)
+// Hello negotiates the callback protocol revision for later calls.
+func (s *ServerService) Hello(args csjrpc.HelloArgs, reply *csjrpc.HelloReply) error {
+	reply.Protocol = csjrpc.NegotiateProtocol(args.Protocol)
 	return nil
 }
 
 func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) error {
-	// Connect to client's stdout/stderr sockets using caller's MachineID/PID
-	stdoutSock, stderrSock, _ := csjrpc.DeriveClientSockets(s.root, args.MachineID, args.PID)
-
-	stdoutConn, err := net.Dial("unix", stdoutSock)
-	if err != nil {
-		reply.ReturnCode = 2
-		reply.Error = "connect stdout service: " + err.Error()
-		csjrpc.Errorf("admin stdout dial: %v", err)
-		return nil
-	}
-	defer stdoutConn.Close()
-	stdoutCli := jsonrpc.NewClient(stdoutConn)
-
-	stderrConn, err := net.Dial("unix", stderrSock)
-	if err != nil {
+	// Connect to client's callback services using caller's MachineID/PID
+	key := csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)
+	cb, msg := s.dialCallbacks(key, args.MachineID, args.PID, args.Nonce, args.Protocol)
+	if msg != "" {
 		reply.ReturnCode = 2
-		reply.Error = "connect stderr service: " + err.Error()
-		csjrpc.Errorf("admin stderr dial: %v", err)
+		reply.Error = msg
 		return nil
 	}
-	defer stderrConn.Close()
-	stderrCli := jsonrpc.NewClient(stderrConn)
+	defer cb.Close()
+	stdoutCli, stderrCli := cb.stdout, cb.stderr
 
 	cmd := strings.TrimSpace(args.Command)
 	if cmd == "" {
 		cmd = "ls"
 	}
+	// cancel/kill reach any session by id; an endpoint (which may be
+	// restricted to a few commands) only gets the listing, of its own sessions
+	if s.endpoint != "" && cmd != "ls" {
+		_ = stderrCli.Call("Stderr.WriteLine", csjrpc.Line{Index: 0, Text: fmt.Sprintf("server command %s is only served on the main socket", cmd)}, &struct{}{})
+		reply.ReturnCode = 2
+		return nil
+	}
 
 	switch cmd {
 	case "ls":
@@ -420,9 +1667,9 @@ func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) e
 			var buf bytes.Buffer
 			tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
 			if showCmdline {
-				fmt.Fprintf(tw, "admin\t%s\t%d\t\tadmin\t(you)\t\n", args.MachineID, args.PID)
+				fmt.Fprintf(tw, "admin\t%s\t%d\t\tadmin\t(you)\t\t\n", args.MachineID, args.PID)
 			} else {
-				fmt.Fprintf(tw, "admin\t%s\t%d\t\tadmin\t(you)\n", args.MachineID, args.PID)
+				fmt.Fprintf(tw, "admin\t%s\t%d\t\tadmin\t(you)\t\n", args.MachineID, args.PID)
 			}
 			_ = tw.Flush()
 			for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
@@ -441,27 +1688,31 @@ func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) e
 			pid     int
 			procpid int
 			state   string
+			labels  string
 			cmdline string
 		}
 
 		var rows []row
 		s.sessions.mu.Lock()
 		for _, se := range s.sessions.m {
+			if !s.sees(se) {
+				continue
+			}
 			se.mu.Lock()
 			st := "running"
 			if se.stoppedBy != "" {
 				st = "stopping(by=" + se.stoppedBy + ")"
+			} else if se.queuePos > 0 {
+				st = fmt.Sprintf("queued(%s #%d)", se.queue, se.queuePos)
 			}
-			childPID := 0
-			if se.proc != nil {
-				childPID = se.proc.Pid
-			}
+			childPID := se.firstPIDLocked()
 			r := row{
 				serial:  se.serial,
 				machine: se.machineID,
 				pid:     se.pid,
 				procpid: childPID,
 				state:   st,
+				labels:  csjrpc.FormatLabels(se.labels),
 				cmdline: se.cmdline,
 			}
 			se.mu.Unlock()
@@ -477,15 +1728,15 @@ func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) e
 			var buf bytes.Buffer
 			tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
 			if showCmdline {
-				fmt.Fprintln(tw, "ID\tMACHINE\tPID\tPROC\tSTATE\tNOTE\tCMDLINE")
+				fmt.Fprintln(tw, "ID\tMACHINE\tPID\tPROC\tSTATE\tNOTE\tLABELS\tCMDLINE")
 			} else {
-				fmt.Fprintln(tw, "ID\tMACHINE\tPID\tPROC\tSTATE\tNOTE")
+				fmt.Fprintln(tw, "ID\tMACHINE\tPID\tPROC\tSTATE\tNOTE\tLABELS")
 			}
 			for _, r := range rows {
 				if showCmdline {
-					fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t\t%s\n", r.serial, r.machine, r.pid, r.procpid, r.state, r.cmdline)
+					fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t\t%s\t%s\n", r.serial, r.machine, r.pid, r.procpid, r.state, r.labels, r.cmdline)
 				} else {
-					fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t\n", r.serial, r.machine, r.pid, r.procpid, r.state)
+					fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t\t%s\n", r.serial, r.machine, r.pid, r.procpid, r.state, r.labels)
 				}
 			}
 			_ = tw.Flush()
@@ -516,9 +1767,7 @@ func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) e
 			if sess.cancel != nil {
 				sess.cancel()
 			}
-			if sess.proc != nil {
-				_ = signalGroup(sess.proc.Pid, syscall.SIGTERM)
-			}
+			sess.signalLocked(syscall.SIGTERM)
 			sess.mu.Unlock()
 			reply.ReturnCode = 0
 			_ = stdoutCli.Call("Stdout.WriteLine", csjrpc.Line{Index: 0, Text: fmt.Sprintf("cancelled id %d", id)}, &struct{}{})
@@ -543,9 +1792,7 @@ func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) e
 		if sess, ok := s.sessions.getBySerial(id); ok {
 			sess.mu.Lock()
 			sess.stoppedBy = "admin-kill"
-			if sess.proc != nil {
-				_ = signalGroup(sess.proc.Pid, syscall.SIGKILL)
-			}
+			sess.signalLocked(syscall.SIGKILL)
 			if sess.cancel != nil {
 				sess.cancel()
 			}
@@ -566,16 +1813,17 @@ func (s *ServerService) Admin(args csjrpc.AdminArgs, reply *csjrpc.AdminReply) e
 }
 
 func (s *ServerService) Cancel(args csjrpc.CancelArgs, reply *csjrpc.CancelReply) error {
-	key := csjrpc.IdPidKey(args.MachineID, args.PID)
-	if sess, ok := s.sessions.get(key); ok {
+	key := csjrpc.IdPidKey(args.MachineID, args.PID, args.Nonce)
+	if sess, ok := s.sessions.get(key); ok && s.sees(sess) {
 		sess.mu.Lock()
 		sess.stoppedBy = "client"
+		if g := requestGrace(args.GraceMillis, args.HasGrace); g >= 0 {
+			sess.grace = g
+		}
 		if sess.cancel != nil {
 			sess.cancel()
 		}
-		if sess.proc != nil {
-			_ = signalGroup(sess.proc.Pid, syscall.SIGTERM)
-		}
+		sess.signalLocked(syscall.SIGTERM)
 		sess.mu.Unlock()
 		reply.OK = true
 		csjrpc.Infof("Cancel: key=%s acknowledged", key)
@@ -592,6 +1840,20 @@ func (s *ServerService) Cancel(args csjrpc.CancelArgs, reply *csjrpc.CancelReply
 
 func waitForSocket(path string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
+	if csjrpc.IsAbstract(path) {
+		// no file to watch; probe until the client is listening
+		for {
+			conn, err := net.Dial("unix", path)
+			if err == nil {
+				conn.Close()
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
 	for {
 		fi, err := os.Lstat(path)
 		if err == nil && (fi.Mode()&os.ModeSocket) != 0 {
@@ -607,6 +1869,43 @@ func waitForSocket(path string, timeout time.Duration) error {
 	}
 }
 
+// listenSocket creates a unix socket, refusing to replace an existing file,
+// and applies mode/group to it (not for abstract sockets).
+func listenSocket(sock string, abstract bool, mode os.FileMode, gid int) (net.Listener, error) {
+	if !abstract {
+		if _, err := os.Lstat(sock); err == nil {
+			return nil, fmt.Errorf("refusing to overwrite existing socket: %s", sock)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("stat socket %s: %v", sock, err)
+		}
+	}
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %v", sock, err)
+	}
+	if !abstract {
+		if err := csjrpc.ApplyPerms(sock, mode, gid); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func millis(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// requestGrace is a request's grace override, -1 for none: GraceMillis
+// counts with HasGrace (0 is SIGKILL at once), or when > 0 from clients that
+// predate HasGrace.
+func requestGrace(ms int64, has bool) time.Duration {
+	if (has && ms >= 0) || ms > 0 {
+		return millis(ms)
+	}
+	return -1
+}
+
 func signalGroup(pid int, sig syscall.Signal) error {
 	// negative pid => signal process group
 	return syscall.Kill(-pid, sig)
@@ -649,6 +1948,25 @@ func defaultPATH() string {
 	return "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 }
 
+// serverPATH is the PATH of env with only its absolute entries (an empty or
+// relative entry would be looked up in the request's working directory).
+func serverPATH(env []string) string {
+	var dirs []string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			for _, d := range filepath.SplitList(strings.TrimPrefix(kv, "PATH=")) {
+				if filepath.IsAbs(d) {
+					dirs = append(dirs, d)
+				}
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return defaultPATH()
+	}
+	return strings.Join(dirs, string(filepath.ListSeparator))
+}
+
 func workDirOrCwd(workDir string) string {
 	if workDir != "" {
 		return workDir
@@ -719,6 +2037,75 @@ func resolveCommandPath(cmdStr, workDir string, env []string) (string, int, erro
 	return resolved, 0, nil
 }
 
+// resolveSandboxedCommandPath resolves cmdStr as the child will see it after
+// being confined to root (the child's cwd is "/"). The returned path is
+// relative to the sandbox, e.g. "/bin/sh".
+func resolveSandboxedCommandPath(cmdStr, root string, env []string) (string, int, error) {
+	var PATH string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			PATH = strings.TrimPrefix(kv, "PATH=")
+			break
+		}
+	}
+	if PATH == "" {
+		PATH = defaultPATH()
+	}
+
+	var inner string
+	if strings.ContainsRune(cmdStr, '/') {
+		inner = filepath.Join("/", cmdStr)
+	} else {
+		for _, dir := range filepath.SplitList(PATH) {
+			try := filepath.Join("/", dir, cmdStr)
+			if isExecutableFile(filepath.Join(root, try)) {
+				inner = try
+				break
+			}
+		}
+		if inner == "" {
+			return "", 127, fmt.Errorf("command %q not found in sandbox PATH (root %s)", cmdStr, root)
+		}
+	}
+
+	outer := filepath.Join(root, inner)
+	if !exists(outer) {
+		return "", 127, fmt.Errorf("no such file in sandbox: %s", inner)
+	}
+	if isDir(outer) {
+		return "", 126, fmt.Errorf("is a directory: %s", inner)
+	}
+	if !isExecutableFile(outer) {
+		return "", 126, fmt.Errorf("not executable: %s", inner)
+	}
+	return inner, 0, nil
+}
+
+// procUsage returns user+system CPU time and resident set size of pid from
+// /proc (zeros if unavailable, e.g. the child just exited).
+func procUsage(pid int) (cpuMillis, rssBytes int64) {
+	const clkTck = 100 // USER_HZ; fixed at 100 on Linux
+	if b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// fields after "(comm)"; utime and stime are fields 14 and 15
+		if i := bytes.LastIndexByte(b, ')'); i >= 0 {
+			f := strings.Fields(string(b[i+1:]))
+			if len(f) > 12 {
+				ut, _ := strconv.ParseInt(f[11], 10, 64)
+				st, _ := strconv.ParseInt(f[12], 10, 64)
+				cpuMillis = (ut + st) * 1000 / clkTck
+			}
+		}
+	}
+	if b, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid)); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) > 1 {
+			pages, _ := strconv.ParseInt(f[1], 10, 64)
+			rssBytes = pages * int64(os.Getpagesize())
+		}
+	}
+	return cpuMillis, rssBytes
+}
+
 func exists(p string) bool {
 	_, err := os.Stat(p)
 	return err == nil
@@ -739,25 +2126,32 @@ func isExecutableFile(p string) bool {
 	return (mode & 0111) != 0
 }
 
-func exitCodeFromWaitErr(err error) int {
+// exitCodeFromWaitErr returns the shell-style return code (128+signal for
+// signaled children) and the terminating signal, if any.
+func exitCodeFromWaitErr(err error) (int, syscall.Signal) {
 	if err == nil {
-		return 0
+		return 0, 0
 	}
 	var exitErr *exec.ExitError
 	if errors.As(err, &exitErr) {
 		// On Unix, extract wait status
 		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 			if status.Signaled() {
-				return 128 + int(status.Signal())
+				return 128 + int(status.Signal()), status.Signal()
 			}
-			return status.ExitStatus()
+			return status.ExitStatus(), 0
 		}
 	}
 	// Fallback (treat as generic failure)
-	return 1
+	return 1, 0
 }
 
 func main() {
+	// Re-executed by ourselves as the mountns sandbox helper
+	if csjrpc.SandboxInitRequested() {
+		csjrpc.RunSandboxInit()
+	}
+
 	// Allow zero flags when config provides required values.
 	// Usage is shown later only if root/name are still missing after
 	// merging config and flags.
@@ -768,25 +2162,40 @@ func main() {
 	flag.StringVar(&flagStartDir, "startdir", "", "server: chdir on startup")
 	flag.Var(&flagEnvs, "env", "repeatable env (KEY=VAL or KEY) for server base environment (repeat)")
 	flag.StringVar(&flagConfig, "config", "", "path to JSON config (optional; default ./config.json). If provided and missing, it's an error.")
+	flag.Var(&flagAllowDir, "allow-startdir", "allow requests to run in DIR or below it; any other startdir is rejected (repeat; adds to config.server.startdirs)")
+	flag.StringVar(&flagSandbox, "sandbox", "", "confine children to their working directory: none, chroot or mountns (overrides config.server.sandbox.mode)")
+	flag.BoolVar(&flagSandboxReadOnly, "sandbox-readonly", false, "mountns sandbox: mount the working directory read-only")
+	flag.DurationVar(&flagGrace, "grace", 0, "cancel grace period between SIGTERM and SIGKILL, 0 for SIGKILL at once (default 1s; overrides config.server.grace)")
+	flag.BoolVar(&flagStrictRoot, "strict-root", false, "refuse to start unless the root is a real directory owned by this uid and not group/world writable (or set config.server.strict_root)")
+	flag.DurationVar(&flagSweepTTL, "sweep-ttl", -1, "remove client socket dirs older than this at startup, 0 for no age limit (default 24h; overrides config.server.sweep_ttl)")
+	flag.IntVar(&flagSignalRC, "signal-rc", 0, "return code for children killed by a signal, 1-255 (default 128+signal; overrides config.server.signal_exit_code)")
+	flag.StringVar(&flagSockMode, "sock-mode", "", "chmod the main socket after creation, octal e.g. 0660 (overrides config.server.sock_mode)")
+	flag.StringVar(&flagSockGroup, "sock-group", "", "chgrp the main socket after creation, name or gid (overrides config.server.sock_group)")
+	flag.StringVar(&flagAudit, "audit", "", "append a JSON audit record per Process call to FILE, or 'syslog[:TAG]' (overrides config.server.audit)")
+	flag.StringVar(&flagLogLevel, "log-level", "", "minimum log level: debug, info, warn or error (overrides config.common.log.level)")
+	flag.StringVar(&flagLogFormat, "log-format", "", "log line format: text or json (overrides config.common.log.format)")
+	flag.StringVar(&flagLogFile, "log-file", "", "append log lines to FILE instead of stderr (overrides config.common.log.file)")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { flagGraceSet = flagGraceSet || f.Name == "grace" })
 
 	// Load config (sparse allowed)
 	cfgPath := csjrpc.DefaultConfigPath
 	if flagConfig != "" {
 		cfgPath = flagConfig
 	}
-	cfg, found, err := csjrpc.LoadConfig(cfgPath)
+	cfg, err := loadServerConfig(cfgPath, flagConfig != "")
 	if err != nil {
-		if flagConfig != "" {
-			csjrpc.Errorf("load config %q: %v", cfgPath, err)
-			os.Exit(2)
-		}
-		found = false
+		csjrpc.Errorf("%v", err)
+		os.Exit(2)
 	}
-	if flagConfig != "" && !found {
-		csjrpc.Errorf("config file not found: %s", cfgPath)
+	if err := csjrpc.SetupLogging(cfg.Common.Log.WithFlags(flagLogLevel, flagLogFormat, flagLogFile)); err != nil {
+		csjrpc.Errorf("%v", err)
 		os.Exit(2)
 	}
+	// SIGHUP reloads re-read this path after any startdir chdir
+	if abs, err := filepath.Abs(cfgPath); err == nil {
+		cfgPath = abs
+	}
 
 	root := cfg.Common.Root
 	name := cfg.Common.Name
@@ -797,38 +2206,70 @@ func main() {
 		name = flagName
 	}
 	if root == "" || name == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -name <name> [-startdir DIR] [--env ...] [-config PATH]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "usage: %s -root <path> -name <name> [-startdir DIR] [--env ...] [-config PATH] [-allow-startdir DIR] [-sandbox MODE [-sandbox-readonly]] [-audit DEST] [-grace D] [-signal-rc N] [-sweep-ttl D] [-strict-root] [-sock-mode MODE] [-sock-group GROUP] [-log-level L] [-log-format F] [-log-file FILE]\n", filepath.Base(os.Args[0]))
+		os.Exit(2)
+	}
+
+	pol, err := buildPolicy(cfg)
+	if err != nil {
+		csjrpc.Errorf("%v", err)
 		os.Exit(2)
 	}
+	if pol.sandbox.Enabled() {
+		csjrpc.Infof("sandbox: mode=%s readonly=%v userns=%v", pol.sandbox.Mode, pol.sandbox.ReadOnly, pol.sandbox.UserNS)
+	}
 
-	absRoot, err := filepath.Abs(root)
+	absRoot, err := csjrpc.ResolveRoot(root)
 	if err != nil {
 		csjrpc.Errorf("invalid root: %v", err)
 		os.Exit(2)
 	}
+	abstract := csjrpc.IsAbstract(absRoot)
 	if absRoot == "/" {
 		csjrpc.Errorf("refusing to use root=/")
 		os.Exit(2)
 	}
 
-	// Build server base env from config + flags
-	serverBase := csjrpc.EnvMapToList(cfg.Server.Env)
-	for _, e := range flagEnvs {
-		if strings.Contains(e, "=") {
-			serverBase = append(serverBase, e)
-			continue
-		}
-		// bare NAME: must exist
-		val, ok := os.LookupEnv(e)
-		if !ok {
-			csjrpc.Errorf("--env %s requested but not present in server environment", e)
-			os.Exit(2)
-		}
-		serverBase = append(serverBase, e+"="+val)
+	auditDest := cfg.Server.Audit
+	if flagAudit != "" {
+		auditDest = flagAudit
+	}
+	auditor, err := csjrpc.OpenAuditor(auditDest)
+	if err != nil {
+		csjrpc.Errorf("%v", err)
+		os.Exit(2)
+	}
+	defer auditor.Close()
+	if auditor != nil {
+		csjrpc.Infof("audit: %s", auditor.Dest())
+	}
+
+	sockModeStr, sockGroup := cfg.Server.SockMode, cfg.Server.SockGroup
+	if flagSockMode != "" {
+		sockModeStr = flagSockMode
+	}
+	if flagSockGroup != "" {
+		sockGroup = flagSockGroup
+	}
+	sockMode, err := csjrpc.ParseMode(sockModeStr)
+	if err != nil {
+		csjrpc.Errorf("sock mode: %v", err)
+		os.Exit(2)
+	}
+	sockGID, err := csjrpc.LookupGID(sockGroup)
+	if err != nil {
+		csjrpc.Errorf("sock group %q: %v", sockGroup, err)
+		os.Exit(2)
 	}
 
 	// Ensure root exists and is a directory; no auto-cleanup/overwrite
-	if fi, err := os.Stat(absRoot); err != nil {
+	if abstract {
+		csjrpc.Infof("server root: %s (abstract namespace)", absRoot)
+		if sockMode != 0 || sockGID >= 0 {
+			csjrpc.Errorf("abstract sockets have no permissions: refusing sock mode/group with root %s", absRoot)
+			os.Exit(2)
+		}
+	} else if fi, err := os.Stat(absRoot); err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(absRoot, 0o755); err != nil {
 				csjrpc.Errorf("mkdir root: %v", err)
@@ -845,6 +2286,62 @@ func main() {
 	} else {
 		csjrpc.Infof("server root: %s", absRoot)
 	}
+	if !abstract {
+		strict := cfg.Server.StrictRoot || flagStrictRoot
+		problems, err := csjrpc.RootProblems(absRoot)
+		if err != nil {
+			csjrpc.Errorf("check root: %v", err)
+			os.Exit(2)
+		}
+		for _, p := range problems {
+			if strict {
+				csjrpc.Errorf("strict root: %s", p)
+			} else {
+				csjrpc.Warnf("unsafe root: %s (use -strict-root to refuse)", p)
+			}
+		}
+		if strict && len(problems) > 0 {
+			os.Exit(2)
+		}
+	}
+
+	// Sweep callback socket dirs of dead clients, now and periodically
+	if !abstract {
+		sweepTTL, sweepEvery := 24*time.Hour, time.Duration(0)
+		for _, d := range []struct {
+			key, val string
+			dst      *time.Duration
+		}{{"sweep_ttl", cfg.Server.SweepTTL, &sweepTTL}, {"sweep_interval", cfg.Server.SweepInterval, &sweepEvery}} {
+			if d.val == "" {
+				continue
+			}
+			v, err := time.ParseDuration(d.val)
+			if err != nil || v < 0 {
+				csjrpc.Errorf("invalid server.%s %q", d.key, d.val)
+				os.Exit(2)
+			}
+			*d.dst = v
+		}
+		if flagSweepTTL >= 0 {
+			sweepTTL = flagSweepTTL
+		}
+		sweep := func() {
+			n, err := csjrpc.SweepClientDirs(absRoot, sweepTTL)
+			if err != nil {
+				csjrpc.Warnf("sweep %s: %v", absRoot, err)
+			} else if n > 0 {
+				csjrpc.Infof("sweep: removed %d stale client socket dir(s)", n)
+			}
+		}
+		sweep()
+		if sweepEvery > 0 {
+			go func() {
+				for range time.Tick(sweepEvery) {
+					sweep()
+				}
+			}()
+		}
+	}
 
 	// Optional chdir at startup
 	startDir := cfg.Server.StartDir
@@ -860,33 +2357,83 @@ func main() {
 		csjrpc.Infof("server cwd: %s", cwd)
 	}
 
-	// Main RPC socket (fail if exists)
+	// Main RPC socket: inherited from systemd if socket-activated,
+	// else created here (fail if exists)
 	mainSock := filepath.Join(absRoot, name+".sock")
-	if _, err := os.Lstat(mainSock); err == nil {
-		csjrpc.Errorf("refusing to overwrite existing socket: %s", mainSock)
-		os.Exit(2)
-	} else if !os.IsNotExist(err) {
-		csjrpc.Errorf("stat socket %s: %v", mainSock, err)
-		os.Exit(2)
-	}
-	l, err := net.Listen("unix", mainSock)
+	l, activated, err := csjrpc.ActivationListener(name)
 	if err != nil {
-		csjrpc.Errorf("listen %s: %v", mainSock, err)
+		csjrpc.Errorf("%v", err)
 		os.Exit(1)
 	}
-	fmt.Println("Server listening on", mainSock)
+	if activated {
+		if sockMode != 0 || sockGID >= 0 {
+			csjrpc.Warnf("socket activated: ignoring sock mode/group (set SocketMode=/SocketGroup= in the .socket unit)")
+		}
+		csjrpc.Infof("socket activated: %s", l.Addr())
+		fmt.Println("Server listening on", l.Addr(), "(socket activated)")
+	} else {
+		l, err = listenSocket(mainSock, abstract, sockMode, sockGID)
+		if err != nil {
+			csjrpc.Errorf("%v", err)
+			os.Exit(2)
+		}
+		fmt.Println("Server listening on", mainSock)
+	}
 
 	sessions := newSessionTable()
 	svc := &ServerService{
-		sessions:      sessions,
-		root:          absRoot,
-		serverBaseEnv: serverBase,
+		sessions:  sessions,
+		wg:        &sync.WaitGroup{},
+		root:      absRoot,
+		audit:     auditor,
+		admission: csjrpc.NewAdmission(),
+		queues:    csjrpc.NewKeyQueues(),
+		stats:     &serverStats{started: time.Now().UTC()},
+		results:   csjrpc.NewResultStore(),
+		pols:      &policyBox{pol: pol},
+		uploads:   csjrpc.NewUploads(),
 	}
 	if err := rpc.Register(svc); err != nil {
 		csjrpc.Errorf("rpc register: %v", err)
 		os.Exit(1)
 	}
 
+	// Extra endpoints: own socket and rpc.Server, shared sessions/limits.
+	// They are fixed at startup; a reload only changes their policies.
+	type endpoint struct {
+		name string
+		sock string
+		l    net.Listener
+		srv  *rpc.Server
+	}
+	var endpoints []endpoint
+	epNames := make([]string, 0, len(pol.endpoints))
+	for epName := range pol.endpoints {
+		epNames = append(epNames, epName)
+	}
+	sort.Strings(epNames)
+	for _, epName := range epNames {
+		if epName == name {
+			csjrpc.Errorf("endpoint %q clashes with the main socket name", epName)
+			os.Exit(2)
+		}
+		sock := filepath.Join(absRoot, epName+".sock")
+		el, err := listenSocket(sock, abstract, sockMode, sockGID)
+		if err != nil {
+			csjrpc.Errorf("endpoint %s: %v", epName, err)
+			os.Exit(2)
+		}
+		epSvc := *svc
+		epSvc.endpoint = epName
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("ServerService", &epSvc); err != nil {
+			csjrpc.Errorf("rpc register endpoint %s: %v", epName, err)
+			os.Exit(1)
+		}
+		endpoints = append(endpoints, endpoint{name: epName, sock: sock, l: el, srv: srv})
+		fmt.Println("Server listening on", sock, "(endpoint "+epName+")")
+	}
+
 	// Graceful shutdown
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
@@ -895,9 +2442,36 @@ func main() {
 		csjrpc.Warnf("server signal: %v; canceling all sessions", sig)
 		sessions.cancelAll("server")
 		_ = l.Close()
+		for _, ep := range endpoints {
+			_ = ep.l.Close()
+		}
+	}()
+
+	// SIGHUP: reload env/sandbox policy; in-flight sessions are untouched
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			csjrpc.Infof("server signal: SIGHUP; reloading %s", cfgPath)
+			svc.reload(cfgPath, flagConfig != "")
+		}
 	}()
 
-	// Accept loop
+	// Accept loops
+	var wgEP sync.WaitGroup
+	for _, ep := range endpoints {
+		wgEP.Add(1)
+		go func(ep endpoint) {
+			defer wgEP.Done()
+			for {
+				conn, err := ep.l.Accept()
+				if err != nil {
+					return // listener closed
+				}
+				go ep.srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+			}
+		}(ep)
+	}
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -907,7 +2481,16 @@ func main() {
 	}
 
 	// Wait for in-flight Process calls
+	wgEP.Wait()
 	svc.wg.Wait()
-	_ = os.Remove(mainSock)
+	if !activated && !abstract {
+		// an activated socket belongs to systemd and must survive restarts
+		_ = os.Remove(mainSock)
+	}
+	if !abstract {
+		for _, ep := range endpoints {
+			_ = os.Remove(ep.sock)
+		}
+	}
 	csjrpc.Infof("server shutdown complete")
 }
@@ -0,0 +1 @@
+(export GO111MODULE=auto; export GOPATH=/usr/share/gocode:$(pwd); go build -trimpath -ldflags="-s -w" -o supervisor . )
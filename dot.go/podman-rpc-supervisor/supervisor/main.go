@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,65 +14,39 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"local/svcconfig"
 )
 
 /* ===========================
    Config types
    =========================== */
 
-// Dur unmarshals either a JSON string like "10s" or a number of nanoseconds.
-type Dur struct{ time.Duration }
+// The config format is shared with zombie-reaping-supervisor (TOML, or JSON
+// by extension; see local/svcconfig). This supervisor runs the common
+// per-service keys and [supervisor].grace, and warns about the rest.
+type ServiceCfg = svcconfig.Service
 
-func (d *Dur) UnmarshalJSON(b []byte) error {
-	if len(b) == 0 {
-		d.Duration = 0
-		return nil
-	}
-	switch b[0] {
-	case '"':
-		var s string
-		if err := json.Unmarshal(b, &s); err != nil {
-			return err
-		}
-		if s == "" {
-			d.Duration = 0
-			return nil
-		}
-		dd, err := time.ParseDuration(s)
-		if err != nil {
-			return err
-		}
-		d.Duration = dd
-		return nil
-	default:
-		// accept integer or float nanoseconds
-		var n json.Number
-		if err := json.Unmarshal(b, &n); err != nil {
-			return err
-		}
-		if i, err := n.Int64(); err == nil {
-			d.Duration = time.Duration(i)
-			return nil
-		}
-		f, err := n.Float64()
-		if err != nil {
-			return err
-		}
-		d.Duration = time.Duration(f)
-		return nil
-	}
+type Config struct {
+	Supervisor struct {
+		Grace svcconfig.Dur `toml:"grace"` // default grace; -grace wins when given
+	} `toml:"supervisor"`
+	Services map[string]ServiceCfg `toml:"services"`
 }
 
-type ServiceCfg struct {
-	Path    string   `json:"path"`              // executable (absolute or PATH-searchable)
-	Args    []string `json:"args,omitempty"`    // arguments
-	Restart bool     `json:"restart,omitempty"` // restart on exit
-	Dir     string   `json:"dir,omitempty"`     // optional working directory
-	Grace   Dur      `json:"grace,omitempty"`   // per-service grace (e.g., "10s"), overrides global -grace
+// unsupported trims undecoded keys to the outermost ones, so an unknown
+// table is one warning rather than one per key inside it.
+func unsupported(keys []string) []string {
+	var out []string
+	for _, k := range keys {
+		if n := len(out); n > 0 && strings.HasPrefix(k, out[n-1]+".") {
+			continue
+		}
+		out = append(out, k)
+	}
+	return out
 }
 
-type Config map[string]ServiceCfg
-
 /* ===========================
    Logging (ts + file:line)
    =========================== */
@@ -160,7 +133,7 @@ func (r *runner) startLoop(ctx context.Context, wg *sync.WaitGroup, defaultGrace
 		path, err := lookPathOrAbs(r.cfg.Path, env)
 		if err != nil {
 			errorf(r.name, "resolve path: %v", err)
-			if !r.cfg.Restart {
+			if !r.cfg.Restart.Daemon() {
 				return
 			}
 			// backoff then retry unless shutting down
@@ -192,7 +165,7 @@ func (r *runner) startLoop(ctx context.Context, wg *sync.WaitGroup, defaultGrace
 
 		if err := cmd.Start(); err != nil {
 			errorf(r.name, "start failed: %v", err)
-			if !r.cfg.Restart {
+			if !r.cfg.Restart.Daemon() {
 				return
 			}
 			select {
@@ -270,7 +243,7 @@ func (r *runner) startLoop(ctx context.Context, wg *sync.WaitGroup, defaultGrace
 		r.mu.Unlock()
 
 		// Restart policy
-		if !r.cfg.Restart {
+		if !r.cfg.Restart.Restarts(exitCode) {
 			return
 		}
 		select {
@@ -289,22 +262,25 @@ func (r *runner) startLoop(ctx context.Context, wg *sync.WaitGroup, defaultGrace
 func main() {
 	var cfgPath string
 	var defaultGrace time.Duration
-	flag.StringVar(&cfgPath, "config", "/etc/services.json", "path to JSON config (map of service name -> options)")
+	flag.StringVar(&cfgPath, "config", "/etc/services.json", "path to .json or TOML config (see zombie-reaping-supervisor's services.toml)")
 	flag.DurationVar(&defaultGrace, "grace", 3*time.Second, "default grace before SIGKILL on shutdown (overridden by per-service 'grace')")
 	flag.Parse()
 
-	f, err := os.Open(cfgPath)
+	var root Config
+	undecoded, err := svcconfig.Load(cfgPath, &root)
 	if err != nil {
-		errorf("", "open config: %v", err)
-		os.Exit(2)
-	}
-	defer f.Close()
-
-	var cfg Config
-	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
 		errorf("", "parse config: %v", err)
 		os.Exit(2)
 	}
+	for _, k := range unsupported(undecoded) {
+		warn("", "config: ignoring %s (zombie-reaping-supervisor only)", k)
+	}
+	graceFlag := false
+	flag.Visit(func(f *flag.Flag) { graceFlag = graceFlag || f.Name == "grace" })
+	if g := root.Supervisor.Grace; g.Set && !graceFlag {
+		defaultGrace = g.Duration
+	}
+	cfg := root.Services
 	if len(cfg) == 0 {
 		errorf("", "empty config")
 		os.Exit(2)
@@ -0,0 +1,326 @@
+// Package svcconfig is the config loader shared by the plain supervisor and
+// the zombie-reaping one, so one file works with either binary.
+//
+// A config is TOML, or JSON when the file name ends in ".json", in one of two
+// layouts:
+//
+//	[supervisor] ... and [services.NAME] ...     (the full layout)
+//	{"NAME": {"path": ..., ...}, ...}            (the older flat map of services)
+//
+// Both binaries decode the same document through the same TOML rules (JSON is
+// converted first), so restart policies and numbers mean the same thing
+// everywhere. The one exception is a duration given as a bare number: seconds
+// in TOML, but nanoseconds in JSON, as the JSON configs always had them (so
+// "grace": 3000000000 stays 3s). Each binary decodes the fields it knows;
+// Decode reports the rest.
+package svcconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+/* ===========================
+   Field types
+   =========================== */
+
+// Dur is a duration given as a string ("10s") or a number of seconds (of
+// nanoseconds in a JSON file). Set records whether the key was present at
+// all.
+type Dur struct {
+	time.Duration
+	Set bool
+}
+
+func (d *Dur) UnmarshalTOML(v interface{}) error {
+	d.Set = true
+	if v == nil {
+		d.Duration = 0
+		return nil
+	}
+	switch x := v.(type) {
+	case string:
+		if x == "" {
+			d.Duration = 0
+			return nil
+		}
+		dd, err := time.ParseDuration(x)
+		if err != nil {
+			return err
+		}
+		d.Duration = dd
+		return nil
+	case int64:
+		d.Duration = time.Duration(x) * time.Second
+		return nil
+	case float64:
+		d.Duration = time.Duration(x * float64(time.Second))
+		return nil
+	default:
+		return fmt.Errorf("unsupported duration type %T", v)
+	}
+}
+
+// Restart is "always", "on-failure" or "never". The older boolean form is
+// still accepted: true means always, false never.
+type Restart string
+
+const (
+	RestartNever     Restart = "never"
+	RestartAlways    Restart = "always"
+	RestartOnFailure Restart = "on-failure"
+)
+
+func (p *Restart) UnmarshalTOML(v interface{}) error {
+	switch x := v.(type) {
+	case bool:
+		*p = RestartNever
+		if x {
+			*p = RestartAlways
+		}
+		return nil
+	case string:
+		switch Restart(x) {
+		case RestartNever, RestartAlways, RestartOnFailure:
+			*p = Restart(x)
+			return nil
+		}
+		return fmt.Errorf("restart %q: want \"always\", \"on-failure\" or \"never\"", x)
+	default:
+		return fmt.Errorf("unsupported restart type %T", v)
+	}
+}
+
+// Daemon reports whether the service is kept running (vs a oneshot).
+func (p Restart) Daemon() bool { return p == RestartAlways || p == RestartOnFailure }
+
+// Restarts reports whether an exit with rc should be followed by a restart.
+func (p Restart) Restarts(rc int) bool {
+	return p == RestartAlways || (p == RestartOnFailure && rc != 0)
+}
+
+// Service holds the per-service keys every supervisor understands; each
+// binary embeds it in its own service struct.
+type Service struct {
+	Path    string   `toml:"path"` // absolute, relative to dir, or searched in PATH
+	Args    []string `toml:"args"`
+	Restart Restart  `toml:"restart"`
+	Dir     string   `toml:"dir"`
+	Grace   Dur      `toml:"grace"` // SIGTERM-to-SIGKILL on stop; default [supervisor] grace
+}
+
+/* ===========================
+   Loading
+   =========================== */
+
+// Load reads path and decodes it into v; see Decode for undecoded.
+func Load(path string, v any) (undecoded []string, err error) {
+	raw, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(raw, v)
+}
+
+// Read decodes a TOML or .json file into plain maps in the full layout.
+func Read(path string) (map[string]any, error) {
+	m := map[string]any{}
+	if strings.HasSuffix(path, ".json") {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		m = jsonToTOML(m).(map[string]any)
+	} else if _, err := toml.DecodeFile(path, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if flat(m) {
+		m = map[string]any{"services": m}
+	}
+	return m, nil
+}
+
+// flat reports whether m is the older layout: a map of services only.
+func flat(m map[string]any) bool {
+	if len(m) == 0 {
+		return false
+	}
+	if _, ok := m["services"]; ok {
+		return false
+	}
+	if _, ok := m["supervisor"]; ok {
+		return false
+	}
+	for _, v := range m {
+		if _, ok := v.(map[string]any); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeDir merges every *.toml and *.json in dir into raw, sorted by file
+// name. A later [services.X] replaces an earlier one whole; other sections
+// (such as [supervisor]) are overridden key by key.
+func MergeDir(raw map[string]any, dir string) error {
+	var files []string
+	for _, pat := range []string{"*.toml", "*.json"} {
+		m, err := filepath.Glob(filepath.Join(dir, pat))
+		if err != nil {
+			return err
+		}
+		files = append(files, m...)
+	}
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) < filepath.Base(files[j]) })
+	for _, f := range files {
+		frag, err := Read(f)
+		if err != nil {
+			return err
+		}
+		for section, v := range frag {
+			sub, ok := v.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: %q is not a table", f, section)
+			}
+			dst, _ := raw[section].(map[string]any)
+			if dst == nil {
+				dst = map[string]any{}
+				raw[section] = dst
+			}
+			for k, x := range sub {
+				dst[k] = x
+			}
+		}
+	}
+	return nil
+}
+
+// Decode decodes raw into v with the TOML rules, whatever the source format.
+// undecoded lists the keys v has no field for (e.g. "services.web.notify"),
+// for a binary that supports only part of the config to report.
+func Decode(raw map[string]any, v any) (undecoded []string, err error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(jsonNums(raw, reflect.TypeOf(v))); err != nil {
+		return nil, err
+	}
+	md, err := toml.Decode(buf.String(), v)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range md.Undecoded() {
+		undecoded = append(undecoded, k.String())
+	}
+	return undecoded, nil
+}
+
+// jsonNum is a number read from a JSON file, left for Decode to convert once
+// it knows the field it goes to.
+type jsonNum float64
+
+// jsonToTOML marks JSON's numbers as jsonNum and drops nulls, which TOML
+// can't express.
+func jsonToTOML(v any) any {
+	switch x := v.(type) {
+	case float64:
+		return jsonNum(x)
+	case map[string]any:
+		for k, e := range x {
+			if e == nil {
+				delete(x, k)
+				continue
+			}
+			x[k] = jsonToTOML(e)
+		}
+	case []any:
+		for i, e := range x {
+			x[i] = jsonToTOML(e)
+		}
+	}
+	return v
+}
+
+var durType = reflect.TypeOf(Dur{})
+
+// jsonNums returns v (decoding into a t) with its jsonNums converted: into a
+// duration string of that many nanoseconds for a Dur, else into int64 for a
+// whole number so it decodes into int fields, else float64.
+func jsonNums(v any, t reflect.Type) any {
+	switch x := v.(type) {
+	case jsonNum:
+		if deref(t) == durType {
+			return time.Duration(x).String()
+		}
+		if f := float64(x); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f)
+		}
+		return float64(x)
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, e := range x {
+			out[k] = jsonNums(e, fieldType(t, k))
+		}
+		return out
+	case []any:
+		var et reflect.Type
+		if t = deref(t); t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		out := make([]any, len(x))
+		for i, e := range x {
+			out[i] = jsonNums(e, et)
+		}
+		return out
+	}
+	return v
+}
+
+// fieldType is the type the key decodes into in a t (a struct, by toml tag,
+// or a map); nil when unknown.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	t = deref(t)
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+			if f.Anonymous && name == "" {
+				if ft := fieldType(f.Type, key); ft != nil {
+					return ft
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if name == key || strings.EqualFold(name, key) {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
+
+func deref(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* ===========================
+   cgroup v2 limits
+   =========================== */
+
+const cgroupMount = "/sys/fs/cgroup"
+
+func (sc *ServiceCfg) hasLimits() bool { return sc.CPUMax != "" || sc.MemoryMax != "" }
+
+// parseCPUMax accepts "max", a share of one CPU like "150%", or the raw
+// cpu.max form "QUOTA PERIOD" (microseconds), and returns the cpu.max value.
+func parseCPUMax(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return "max 100000", nil
+	}
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(pct, 64)
+		if err != nil || p <= 0 {
+			return "", fmt.Errorf("cpu_max %q: bad percentage", s)
+		}
+		return fmt.Sprintf("%d 100000", int64(p*1000)), nil
+	}
+	f := strings.Fields(s)
+	if len(f) == 2 {
+		q, err1 := strconv.ParseUint(f[0], 10, 64)
+		p, err2 := strconv.ParseUint(f[1], 10, 64)
+		if err1 == nil && err2 == nil && q > 0 && p > 0 {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("cpu_max %q: want \"max\", \"N%%\" or \"QUOTA PERIOD\"", s)
+}
+
+// parseMemoryMax accepts "max" or a byte count (see parseBytes), and
+// returns the memory.max value.
+func parseMemoryMax(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return s, nil
+	}
+	v, err := parseBytes(s)
+	if err != nil {
+		return "", fmt.Errorf("memory_max %q: want \"max\" or bytes like 512M", s)
+	}
+	return strconv.FormatUint(v, 10), nil
+}
+
+// parseBytes accepts a byte count with an optional K/M/G/T suffix, also
+// spelled KiB/KB etc.; all are powers of 1024.
+func parseBytes(s string) (uint64, error) {
+	num, mult := strings.TrimSpace(s), uint64(1)
+	upper := strings.ToUpper(num)
+	upper = strings.TrimSuffix(strings.TrimSuffix(upper, "IB"), "B")
+	if n := len(upper); n > 0 {
+		switch upper[n-1:] {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			upper = upper[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(upper, 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("%q: want bytes like 512M or 512MiB", s)
+	}
+	return v * mult, nil
+}
+
+func (sc *ServiceCfg) validateLimits() error {
+	if sc.CPUMax != "" {
+		if _, err := parseCPUMax(sc.CPUMax); err != nil {
+			return err
+		}
+	}
+	if sc.MemoryMax != "" {
+		if _, err := parseMemoryMax(sc.MemoryMax); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	cgBaseOnce sync.Once
+	cgBase     string
+	cgBaseErr  error
+)
+
+// cgroupBase returns the supervisor's own cgroup, prepared to hold one child
+// cgroup per service. v2 forbids processes in a cgroup that delegates
+// controllers, so unless it is the root the supervisor (and anything already
+// in there) first moves into a "supervisor" leaf.
+func cgroupBase() (string, error) {
+	cgBaseOnce.Do(func() {
+		if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+			cgBaseErr = fmt.Errorf("cgroup v2 is not mounted at %s", cgroupMount)
+			return
+		}
+		own, err := ownCgroup()
+		if err != nil {
+			cgBaseErr = err
+			return
+		}
+		base := filepath.Join(cgroupMount, own)
+		if own != "/" {
+			leaf := filepath.Join(base, "supervisor")
+			if err := os.Mkdir(leaf, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+				cgBaseErr = err
+				return
+			}
+			procs, err := os.ReadFile(filepath.Join(base, "cgroup.procs"))
+			if err != nil {
+				cgBaseErr = err
+				return
+			}
+			for _, pid := range strings.Fields(string(procs)) {
+				if err := writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+					cgBaseErr = err
+					return
+				}
+			}
+		}
+		if err := writeCgroupFile(base, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+			cgBaseErr = err
+			return
+		}
+		cgBase = base
+	})
+	return cgBase, cgBaseErr
+}
+
+// ownCgroup reads the v2 ("0::") entry of /proc/self/cgroup.
+func ownCgroup() (string, error) { return readCgroup("self") }
+
+// procCgroup returns pid's v2 cgroup directory, or "" if unknown.
+func procCgroup(pid int) string {
+	p, err := readCgroup(strconv.Itoa(pid))
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cgroupMount, p)
+}
+
+func readCgroup(pid string) (string, error) {
+	f, err := os.Open("/proc/" + pid + "/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if p, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/%s/cgroup", pid)
+}
+
+func writeCgroupFile(dir, name, val string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(val), 0); err != nil {
+		return fmt.Errorf("cgroup %s: %w", name, err)
+	}
+	return nil
+}
+
+// serviceCgroup creates (or reuses) the service's cgroup with the configured
+// limits and returns its directory, opened for SysProcAttr.CgroupFD.
+func serviceCgroup(name string, sc *ServiceCfg) (*os.File, error) {
+	base, err := cgroupBase()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(base, "svc-"+strings.ReplaceAll(name, "/", "_"))
+	if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	cpu, mem := "max 100000", "max"
+	if sc.CPUMax != "" {
+		cpu, _ = parseCPUMax(sc.CPUMax)
+	}
+	if sc.MemoryMax != "" {
+		mem, _ = parseMemoryMax(sc.MemoryMax)
+	}
+	if err := writeCgroupFile(dir, "cpu.max", cpu); err != nil {
+		return nil, err
+	}
+	if err := writeCgroupFile(dir, "memory.max", mem); err != nil {
+		return nil, err
+	}
+	return os.Open(dir)
+}
+
+// oomKills reads the oom_kill counter of the cgroup at dir (0 on error).
+func oomKills(dir string) int {
+	b, err := os.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.Atoi(strings.TrimSpace(v))
+			return n
+		}
+	}
+	return 0
+}
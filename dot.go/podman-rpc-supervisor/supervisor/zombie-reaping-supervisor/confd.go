@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"local/svcconfig"
+)
+
+/* ===========================
+   conf.d fragments
+   =========================== */
+
+// decodeWithFragments reads the main config (which may be missing when a
+// fragment dir is used) and then every *.toml / *.json in dir, sorted by
+// name. A later [services.X] replaces an earlier one whole; [supervisor]
+// keys override one by one. dir defaults to [supervisor].config_dir.
+func decodeWithFragments(path, dir string) (RootCfg, error) {
+	var root RootCfg
+	raw := map[string]any{}
+	if m, err := svcconfig.Read(path); err == nil {
+		raw = m
+	} else if dir == "" || !errors.Is(err, fs.ErrNotExist) {
+		return root, err
+	}
+	if dir == "" {
+		if sup, ok := raw["supervisor"].(map[string]any); ok {
+			dir, _ = sup["config_dir"].(string)
+		}
+	}
+	if dir == "" {
+		_, err := svcconfig.Decode(raw, &root)
+		return root, err
+	}
+
+	if err := svcconfig.MergeDir(raw, dir); err != nil {
+		return root, err
+	}
+	if _, err := svcconfig.Decode(raw, &root); err != nil {
+		return root, fmt.Errorf("merged config (%s + %s): %w", path, dir, err)
+	}
+	return root, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/* ===========================
+   Console: ctl attach NAME
+   =========================== */
+
+// console = "pipe" or "pty" gives the service a stdin the supervisor holds
+// and a merged stdout/stderr it reads; output still goes to the supervisor's
+// stdout (prefixed with prefix_output) and is also copied to every client
+// attached with `ctl attach NAME`, whose input goes to the service's stdin.
+// Attached clients stay across restarts and are dropped when the service is
+// stopped.
+
+type console struct {
+	mu      sync.Mutex
+	in      *os.File // service stdin: pipe write end or pty master; nil between runs
+	pty     *os.File // pty master, for window size changes
+	clients map[net.Conn]struct{}
+}
+
+// openConsole sets up cmd's stdio for one run and starts the output copier.
+// It returns the child's ends, to close once the child has started. Call it
+// after cmd.SysProcAttr is set: a pty makes the service a session leader.
+func (r *runner) openConsole(cmd *exec.Cmd) (childEnds []*os.File, err error) {
+	var sink io.Writer = os.Stdout
+	var prefixed *os.File
+	if r.cfg.PrefixOutput {
+		if prefixed, err = prefixPipe(r.name, os.Stdout); err != nil {
+			return nil, err
+		}
+		sink = prefixed
+	}
+	var in, out *os.File // supervisor ends
+	switch r.cfg.Console {
+	case "pty":
+		master, slave, perr := openPTY()
+		if perr != nil {
+			err = perr
+			break
+		}
+		in, out = master, master
+		childEnds = []*os.File{slave}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		// the pty's session; the leader keeps pgid == pid as with Setpgid
+		cmd.SysProcAttr.Setpgid = false
+		cmd.SysProcAttr.Setsid, cmd.SysProcAttr.Setctty, cmd.SysProcAttr.Ctty = true, true, 0
+	default:
+		inR, inW, perr := os.Pipe()
+		if perr != nil {
+			err = perr
+			break
+		}
+		outR, outW, perr := os.Pipe()
+		if perr != nil {
+			inR.Close()
+			inW.Close()
+			err = perr
+			break
+		}
+		in, out = inW, outR
+		childEnds = []*os.File{inR, outW}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, outW
+	}
+	if err != nil {
+		if prefixed != nil {
+			prefixed.Close()
+		}
+		return nil, err
+	}
+
+	c := &r.con
+	c.mu.Lock()
+	c.in = in
+	if r.cfg.Console == "pty" {
+		c.pty = in
+	}
+	c.mu.Unlock()
+
+	outWG.Add(1)
+	go func() {
+		defer outWG.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := out.Read(buf)
+			if n > 0 {
+				outMu.Lock()
+				_, _ = sink.Write(buf[:n])
+				outMu.Unlock()
+				c.broadcast(buf[:n])
+			}
+			if err != nil { // EOF, or EIO on a pty once the last slave holder exits
+				break
+			}
+		}
+		c.mu.Lock()
+		if c.in == in {
+			c.in, c.pty = nil, nil
+		}
+		c.mu.Unlock()
+		if in != out {
+			in.Close()
+		}
+		out.Close()
+		if prefixed != nil {
+			prefixed.Close()
+		}
+	}()
+	return childEnds, nil
+}
+
+// broadcast copies service output to the attached clients, dropping any that
+// can't keep up.
+func (c *console) broadcast(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.clients {
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(b); err != nil {
+			conn.Close()
+			delete(c.clients, conn)
+		}
+	}
+}
+
+// detachAll drops every attached client (the service was stopped).
+func (c *console) detachAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.clients {
+		conn.Close()
+		delete(c.clients, conn)
+	}
+}
+
+// attach serves one `attach NAME [COLSxROWS]` connection until the client
+// leaves or the service is stopped: the client's bytes go to the service's
+// stdin. The reply line is "ok pipe" or "ok pty", so the client knows
+// whether to put its terminal in raw mode.
+func (s *supervisor) attach(c net.Conn, br *bufio.Reader, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(c, "error: usage: attach NAME [COLSxROWS]")
+		return
+	}
+	r, err := s.lookup(args[0])
+	if err != nil {
+		fmt.Fprintf(c, "error: %v\n", err)
+		return
+	}
+	if r.cfg.Console == "" {
+		fmt.Fprintf(c, "error: %s has no console (set console = \"pipe\" or \"pty\")\n", r.name)
+		return
+	}
+	con := &r.con
+	con.mu.Lock()
+	if len(args) == 2 && con.pty != nil {
+		if err := setWinsize(con.pty, args[1]); err != nil {
+			warn(r.name, "attach: %v", err)
+		}
+	}
+	if con.clients == nil {
+		con.clients = make(map[net.Conn]struct{})
+	}
+	con.clients[c] = struct{}{}
+	con.mu.Unlock()
+	fmt.Fprintf(c, "ok %s\n", r.cfg.Console)
+	info(r.name, "console: client attached")
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := br.Read(buf)
+		if n > 0 {
+			con.mu.Lock()
+			in := con.in
+			con.mu.Unlock()
+			if in != nil {
+				_, _ = in.Write(buf[:n]) // lost when the service is between runs
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	con.mu.Lock()
+	_, still := con.clients[c]
+	delete(con.clients, c)
+	con.mu.Unlock()
+	if still {
+		info(r.name, "console: client detached")
+	}
+}
+
+/* ===========================
+   pty and terminal helpers
+   =========================== */
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// openPTY allocates a pty pair, 80x24 until a client says otherwise.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var n uint32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("pty: %w", err)
+	}
+	_ = setWinsize(master, "80x24")
+	return master, slave, nil
+}
+
+type winsize struct {
+	Row, Col, X, Y uint16
+}
+
+// setWinsize applies "COLSxROWS"; the kernel sends the service SIGWINCH.
+func setWinsize(f *os.File, size string) error {
+	cs, rs, ok := strings.Cut(size, "x")
+	cols, err1 := strconv.ParseUint(cs, 10, 16)
+	rows, err2 := strconv.ParseUint(rs, 10, 16)
+	if !ok || err1 != nil || err2 != nil {
+		return fmt.Errorf("bad window size %q: want COLSxROWS", size)
+	}
+	ws := winsize{Row: uint16(rows), Col: uint16(cols)}
+	return ioctl(f.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// termSize returns "COLSxROWS" for a terminal fd, "" otherwise.
+func termSize(fd uintptr) string {
+	var ws winsize
+	if ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)) != nil || ws.Col == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", ws.Col, ws.Row)
+}
+
+// makeRaw puts a terminal in raw mode and returns a func restoring it.
+func makeRaw(fd uintptr) (restore func(), err error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() { _ = ioctl(fd, syscall.TCSETS, unsafe.Pointer(&old)) }, nil
+}
+
+// detachKey is Ctrl-], as in telnet; only seen in raw mode (a pty console).
+const detachKey = 0x1d
+
+// ctlAttach is the client side of `ctl attach NAME` once the request line is
+// sent: copy stdin to the service and its output to stdout until the
+// supervisor hangs up, stdin ends, or Ctrl-] on a pty console.
+func ctlAttach(c net.Conn, br *bufio.Reader, mode, name string) int {
+	if mode == "pty" {
+		if restore, err := makeRaw(os.Stdin.Fd()); err == nil {
+			defer restore()
+			fmt.Fprintf(os.Stderr, "attached to %s (Ctrl-] to detach)\r\n", name)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "attached to %s (Ctrl-D to detach)\n", name)
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(os.Stdout, br)
+		close(done)
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := strings.IndexByte(string(buf[:n]), detachKey); mode == "pty" && i >= 0 {
+				_, _ = c.Write(buf[:i])
+				break
+			}
+			if n > 0 {
+				if _, werr := c.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		c.Close()
+	}()
+	<-done
+	return 0
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"local/svcconfig"
+)
+
+/* ===========================
+   Per-service lifecycle
+   =========================== */
+
+// supervisor owns the running set of services so they can be started,
+// stopped and replaced one at a time from the control socket.
+type supervisor struct {
+	ctx     context.Context // canceled at shutdown; parent of every runner's loop
+	cfgPath string
+	cfgDir  string        // -config-dir, "" to follow [supervisor].config_dir
+	grace   time.Duration // default shutdown grace
+	wg      sync.WaitGroup
+
+	opMu    sync.Mutex // serializes start/stop/restart/reload
+	booted  atomic.Bool
+	mu      sync.Mutex // guards runners
+	runners map[string]*runner
+
+	abortOnWants bool          // [supervisor].abort_on_failed_wants
+	aborted      chan struct{} // boot gave up on a failed wanted oneshot
+
+	stateMu   sync.Mutex      // guards disabled; taken last, nothing is locked under it
+	statePath string          // "" keeps enable/disable in memory
+	disabled  map[string]bool // by `ctl disable`, see state.go
+}
+
+func newRunner(name string, sc ServiceCfg) *runner {
+	return &runner{name: name, cfg: sc, exitCh: make(chan exitMsg, 1), state: "stopped", since: time.Now()}
+}
+
+func (s *supervisor) graceFor(r *runner) time.Duration {
+	if r.cfg.Grace.Duration > 0 {
+		return r.cfg.Grace.Duration
+	}
+	return s.grace
+}
+
+// list returns the services sorted by name.
+func (s *supervisor) list() []*runner {
+	s.mu.Lock()
+	out := make([]*runner, 0, len(s.runners))
+	for _, r := range s.runners {
+		out = append(out, r)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// startOrdered returns the services in start_order, then by name.
+func (s *supervisor) startOrdered() []*runner {
+	out := s.list()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].cfg.StartOrder < out[j].cfg.StartOrder })
+	return out
+}
+
+// boot starts the services in start_order, each after its start_delay and
+// the oneshots it wants. Before moving on to a higher start_order it waits
+// for the notify services already started to report READY=1 (or stop
+// trying).
+func (s *supervisor) boot() {
+	s.opMu.Lock()
+	defer s.opMu.Unlock()
+	defer s.booted.Store(true)
+	seen := make(map[*runner]bool)
+	var started []*runner
+	for _, r := range s.startOrdered() {
+		if len(started) > 0 && r.cfg.StartOrder != started[len(started)-1].cfg.StartOrder {
+			if !s.waitReady(started) {
+				return
+			}
+		}
+		if seen[r] {
+			continue // started early for a service that wants it
+		}
+		if !s.bootStart(r, seen, &started) {
+			return
+		}
+	}
+}
+
+// waitReady waits while any notify service in rs is still starting; false
+// if the supervisor is shutting down.
+func (s *supervisor) waitReady(rs []*runner) bool {
+	logged := map[string]bool{}
+	for {
+		pending := false
+		for _, r := range rs {
+			if !r.cfg.Notify {
+				continue
+			}
+			r.mu.Lock()
+			starting := r.state == "starting" && r.cancel != nil
+			r.mu.Unlock()
+			if starting {
+				pending = true
+				if !logged[r.name] {
+					info("", "boot: waiting for %s to be ready", r.name)
+					logged[r.name] = true
+				}
+			}
+		}
+		if !pending {
+			return true
+		}
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// stopOrdered returns the services in stop_order.
+func (s *supervisor) stopOrdered() []*runner {
+	out := s.list()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].cfg.StopOrder < out[j].cfg.StopOrder })
+	return out
+}
+
+func (s *supervisor) lookup(name string) (*runner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.runners[name]
+	if r == nil {
+		return nil, fmt.Errorf("no such service %q", name)
+	}
+	return r, nil
+}
+
+// start launches r's loop unless it is already running.
+func (s *supervisor) start(r *runner) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return fmt.Errorf("%s is already running", r.name)
+	}
+	if s.isDisabled(r.name) {
+		r.state, r.since = "disabled", time.Now()
+		return fmt.Errorf("%s is disabled (ctl enable %s)", r.name, r.name)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	r.state, r.since = "starting", time.Now() // before the loop gets going, for waitReady
+	loop := r.startLoop
+	if r.cfg.Schedule != nil {
+		loop = r.scheduleLoop
+	}
+	s.wg.Add(1)
+	go loop(ctx, s.grace, func() {
+		cancel()
+		r.mu.Lock()
+		r.cancel = nil
+		r.mu.Unlock()
+		close(done)
+		s.wg.Done()
+	})
+	return nil
+}
+
+// stop ends r's loop so it won't restart, then stops its process group and
+// waits for the leader's exit.
+func (s *supervisor) stop(r *runner, escalateNow func() bool) error {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	if !r.terminate(s.graceFor(r), escalateNow) && cancel == nil {
+		return fmt.Errorf("%s is not running", r.name)
+	}
+	r.setState("stopped", 0)
+	r.event("stopped", 0, "")
+	r.mu.Lock()
+	if r.cgroup != "" {
+		_ = os.Remove(r.cgroup) // best effort; fails while leftovers remain
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// terminate stops the leader a canceled loop left running (its pid stays
+// recorded) and waits for its exit; false when there was none.
+func (r *runner) terminate(grace time.Duration, escalateNow func() bool) bool {
+	r.mu.Lock()
+	leader := r.pid
+	r.mu.Unlock()
+	if leader == 0 {
+		return false
+	}
+	r.stop(grace, escalateNow)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if msg, ok := r.waitExit(ctx, leader); ok {
+		r.setLastExit(msg.code)
+		infoKV(r.name, msg.fields(), "exited rc=%d %s", msg.code, msg.usage())
+	} else {
+		warn(r.name, "pid=%d exit not seen after stop", leader)
+	}
+	r.setState("stopped", 0)
+	return true
+}
+
+// reload re-reads the config and applies the difference: added services
+// start, removed ones stop, and changed ones restart with their new
+// definition. Untouched services keep running. Caller holds s.opMu.
+func (s *supervisor) reload() error {
+	root, err := loadConfig(s.cfgPath, s.cfgDir)
+	if err != nil {
+		return err
+	}
+	if root.Supervisor.Grace.Duration > 0 {
+		s.grace = root.Supervisor.Grace.Duration
+	}
+	setOnFailure(root.Supervisor.OnFailureExec)
+	setEventHistory(root.Supervisor.EventHistory)
+
+	var added, removed, changed []string
+	for _, r := range s.stopOrdered() {
+		sc, ok := root.Services[r.name]
+		if ok && reflect.DeepEqual(sc, r.cfg) {
+			continue
+		}
+		if ok {
+			changed = append(changed, r.name)
+		} else {
+			removed = append(removed, r.name)
+		}
+		r.mu.Lock()
+		wasStopped := r.state == "stopped"
+		r.mu.Unlock()
+		_ = s.stop(r, nil)
+		if !ok || len(sc.Sockets) == 0 {
+			releaseSockets(r.name) // kept otherwise, so clients only wait for the restart
+		}
+
+		s.mu.Lock()
+		delete(s.runners, r.name)
+		if ok {
+			nr := newRunner(r.name, sc)
+			s.runners[r.name] = nr
+			if !wasStopped {
+				_ = s.start(nr)
+			}
+		}
+		s.mu.Unlock()
+	}
+	for _, name := range sortedKeys(root.Services) {
+		if _, err := s.lookup(name); err == nil {
+			continue
+		}
+		added = append(added, name)
+		r := newRunner(name, root.Services[name])
+		s.mu.Lock()
+		s.runners[name] = r
+		s.mu.Unlock()
+		_ = s.start(r)
+	}
+	info("", "reloaded %s: added=%v removed=%v changed=%v", s.cfgPath, added, removed, changed)
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s *supervisor) writeStatus(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tSINCE\tRESTARTS\tLAST_RC")
+	for _, st := range s.status() {
+		state := st.State
+		if state == "running" && st.Unhealthy {
+			state = "unhealthy"
+		}
+		pidStr := "-"
+		if st.PID != 0 {
+			pidStr = fmt.Sprint(st.PID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", st.Name, state, pidStr, time.Since(st.Since).Round(time.Second), st.Restarts, st.LastExit)
+	}
+	tw.Flush()
+}
+
+/* ===========================
+   Control socket
+   =========================== */
+
+// The protocol is one request line ("status", "status-json", "events NAME",
+// "start NAME", "stop NAME", "restart NAME", "enable NAME", "disable NAME",
+// "reload", "reload NAME") answered by "ok" or "error: MSG", then any
+// output, then EOF. "attach NAME [COLSxROWS]" is answered by "ok pipe" or
+// "ok pty" and then stays open both ways as the service's console.
+
+func listenControl(path string) (net.Listener, error) {
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("control socket %s is in use", path)
+	}
+	_ = os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (s *supervisor) serveControl(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				warn("control", "accept: %v", err)
+			}
+			return
+		}
+		go s.handleControl(c)
+	}
+}
+
+func (s *supervisor) handleControl(c net.Conn) {
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lr := &io.LimitedReader{R: c, N: 4096}
+	br := bufio.NewReader(lr)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprintln(c, "error: empty request")
+		return
+	}
+	info("control", "request: %s", strings.Join(fields, " "))
+	if fields[0] == "attach" {
+		lr.N = math.MaxInt64 // the rest of the connection is console input
+		s.attach(c, br, fields[1:])
+		return
+	}
+
+	var out strings.Builder
+	if err := s.control(fields, &out); err != nil {
+		warn("control", "%s: %v", fields[0], err)
+		fmt.Fprintf(c, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintln(c, "ok")
+	io.WriteString(c, out.String())
+}
+
+func (s *supervisor) control(fields []string, out io.Writer) error {
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "status":
+		s.writeStatus(out)
+		return nil
+	case "status-json":
+		return s.writeStatusJSON(out)
+	case "events":
+		if len(args) != 1 {
+			return errors.New("usage: events NAME")
+		}
+		return s.writeEvents(out, args[0])
+	}
+
+	s.opMu.Lock()
+	defer s.opMu.Unlock()
+	if s.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+	switch cmd {
+	case "reload":
+		if len(args) == 1 {
+			r, err := s.lookup(args[0])
+			if err != nil {
+				return err
+			}
+			return r.reloadService()
+		}
+		if len(args) != 0 {
+			return errors.New("usage: reload [NAME]")
+		}
+		return s.reload()
+	case "start", "stop", "restart", "enable", "disable":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s NAME", cmd)
+		}
+		r, err := s.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case "start":
+			return s.start(r)
+		case "stop":
+			return s.stop(r, nil)
+		case "enable":
+			return s.enable(r, out)
+		case "disable":
+			return s.disable(r, out)
+		}
+		_ = s.stop(r, nil)
+		return s.start(r)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+/* ===========================
+   Client mode: supervisor ctl ...
+   =========================== */
+
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/services.toml", "config to read [supervisor].control from")
+	sock := fs.String("control", "", "control socket (overrides [supervisor].control)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: supervisor ctl [-config PATH] [-control SOCK] status | status-json | events NAME | start NAME | stop NAME | restart NAME | enable NAME | disable NAME | reload [NAME] | attach NAME")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *sock == "" {
+		var root RootCfg
+		if _, err := svcconfig.Load(*cfgPath, &root); err != nil {
+			errorf("", "parse config: %v", err)
+			return 2
+		}
+		*sock = root.Supervisor.Control
+	}
+	if *sock == "" {
+		errorf("", "no control socket: set [supervisor].control or pass -control")
+		return 2
+	}
+
+	c, err := net.Dial("unix", *sock)
+	if err != nil {
+		errorf("", "%v", err)
+		return 1
+	}
+	defer c.Close()
+	req := fs.Args()
+	if req[0] == "attach" && len(req) == 2 {
+		if size := termSize(os.Stdin.Fd()); size != "" {
+			req = append(req, size)
+		}
+	}
+	if _, err := fmt.Fprintln(c, strings.Join(req, " ")); err != nil {
+		errorf("", "%v", err)
+		return 1
+	}
+	br := bufio.NewReader(c)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		errorf("", "no reply: %v", err)
+		return 1
+	}
+	status = strings.TrimSpace(status)
+	if mode, ok := strings.CutPrefix(status, "ok "); ok && req[0] == "attach" {
+		return ctlAttach(c, br, mode, req[1])
+	}
+	if status != "ok" {
+		fmt.Fprintln(os.Stderr, status)
+		return 1
+	}
+	_, _ = io.Copy(os.Stdout, br)
+	return 0
+}
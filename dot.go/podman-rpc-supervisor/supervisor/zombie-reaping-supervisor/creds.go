@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+/* ===========================
+   Per-service credentials
+   =========================== */
+
+// credential resolves user/group to the credentials the child execs with;
+// nil when neither is set. A user brings its primary group and supplementary
+// groups; group replaces the primary group. Numeric ids are taken as-is.
+func (sc *ServiceCfg) credential() (*syscall.Credential, error) {
+	if sc.User == "" && sc.Group == "" {
+		return nil, nil
+	}
+	cred := &syscall.Credential{Uid: uint32(syscall.Getuid()), Gid: uint32(syscall.Getgid())}
+	if sc.User != "" {
+		u, err := lookupUser(sc.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: bad uid %q", sc.User, u.Uid)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: bad gid %q", sc.User, u.Gid)
+		}
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		if ids, err := u.GroupIds(); err == nil {
+			for _, s := range ids {
+				if g, err := strconv.ParseUint(s, 10, 32); err == nil {
+					cred.Groups = append(cred.Groups, uint32(g))
+				}
+			}
+		}
+	}
+	if sc.Group != "" {
+		gid, err := lookupGroup(sc.Group)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = gid
+	}
+	if cred.Groups == nil {
+		cred.Groups = []uint32{cred.Gid} // drop the supervisor's own supplementary groups
+	}
+	return cred, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// numeric uid with no passwd entry: run as uid with gid = uid
+		return &user.User{Uid: name, Gid: name, Username: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("user %q: %w", name, err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (uint32, error) {
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("group %q: %w", name, err)
+	}
+	n, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %q: bad gid %q", name, g.Gid)
+	}
+	return uint32(n), nil
+}
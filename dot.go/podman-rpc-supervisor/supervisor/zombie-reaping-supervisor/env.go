@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/* ===========================
+   Per-service environment
+   =========================== */
+
+// environ builds a service's environment: the supervisor's own (unless
+// clear_env), then env_file, then env; later keys replace earlier ones.
+func (sc *ServiceCfg) environ() ([]string, error) {
+	base := []string{} // non-nil: exec.Cmd treats a nil Env as "inherit"
+	if !sc.ClearEnv {
+		base = os.Environ()
+	}
+	if sc.EnvFile == "" && len(sc.Env) == 0 {
+		return base, nil
+	}
+	var overlay []string
+	if sc.EnvFile != "" {
+		kvs, err := readEnvFile(sc.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		overlay = kvs
+	}
+	overlay = append(overlay, sc.Env...)
+	return mergeEnv(base, overlay), nil
+}
+
+// mergeEnv returns base with each KEY=VAL of overlay replacing or adding KEY.
+func mergeEnv(base, overlay []string) []string {
+	idx := make(map[string]int, len(base)+len(overlay))
+	out := make([]string, 0, len(base)+len(overlay))
+	for _, kv := range append(append([]string(nil), base...), overlay...) {
+		k, _, _ := strings.Cut(kv, "=")
+		if i, ok := idx[k]; ok {
+			out[i] = kv
+			continue
+		}
+		idx[k] = len(out)
+		out = append(out, kv)
+	}
+	return out
+}
+
+// readEnvFile parses KEY=VAL lines. Blank lines and # comments are skipped,
+// a leading "export " is allowed, and a value wrapped in matching single or
+// double quotes is unwrapped (no escapes or expansion).
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("env_file: %w", err)
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("env_file %s:%d: not KEY=VAL", path, n)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		out = append(out, k+"="+v)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("env_file %s: %w", path, err)
+	}
+	return out, nil
+}
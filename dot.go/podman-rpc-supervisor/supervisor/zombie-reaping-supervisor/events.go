@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+/* ===========================
+   Event history (ctl events NAME)
+   =========================== */
+
+const defaultEventHistory = 50
+
+// eventHistory is [supervisor].event_history; a ring takes its size when
+// first written, so a reload applies to services (re)created by it.
+var eventHistory atomic.Int32
+
+func setEventHistory(n int) {
+	if n <= 0 {
+		n = defaultEventHistory
+	}
+	eventHistory.Store(int32(n))
+}
+
+// event is one state transition: started, restarted, start-failed, exited,
+// unhealthy, failed, stopped, enabled, disabled or reloaded.
+type event struct {
+	Time   time.Time
+	Kind   string
+	PID    int
+	Detail string
+}
+
+// eventRing keeps the last len(buf) events of one service.
+type eventRing struct {
+	mu   sync.Mutex
+	buf  []event
+	next int // slot for the next event
+	full bool
+}
+
+func (e *eventRing) add(ev event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.buf == nil {
+		n := int(eventHistory.Load())
+		if n <= 0 {
+			n = defaultEventHistory
+		}
+		e.buf = make([]event, n)
+	}
+	e.buf[e.next] = ev
+	e.next = (e.next + 1) % len(e.buf)
+	e.full = e.full || e.next == 0
+}
+
+// list returns the events oldest first.
+func (e *eventRing) list() []event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.full {
+		return append([]event(nil), e.buf[:e.next]...)
+	}
+	return append(append([]event(nil), e.buf[e.next:]...), e.buf[:e.next]...)
+}
+
+func (r *runner) event(kind string, pid int, format string, a ...any) {
+	r.events.add(event{Time: time.Now(), Kind: kind, PID: pid, Detail: fmt.Sprintf(format, a...)})
+}
+
+// exitDetail describes an exit code for the history: "rc=143 (SIGTERM)".
+func exitDetail(rc int) string {
+	if rc > 128 && rc < 128+65 {
+		return fmt.Sprintf("rc=%d (%s)", rc, sigName(syscall.Signal(rc-128)))
+	}
+	return fmt.Sprintf("rc=%d", rc)
+}
+
+func (s *supervisor) writeEvents(w io.Writer, name string) error {
+	r, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tPID\tDETAIL")
+	for _, ev := range r.events.list() {
+		pidStr := "-"
+		if ev.PID != 0 {
+			pidStr = fmt.Sprint(ev.PID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ev.Time.Format("2006-01-02T15:04:05.000Z07:00"), ev.Kind, pidStr, ev.Detail)
+	}
+	return tw.Flush()
+}
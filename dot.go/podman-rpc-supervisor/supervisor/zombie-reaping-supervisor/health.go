@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+/* ===========================
+   Health checks
+   =========================== */
+
+// HealthCfg is [services.X.health]; exactly one of exec/tcp/http is set.
+type HealthCfg struct {
+	Exec     []string `toml:"exec"`     // command + args, healthy on rc 0
+	TCP      string   `toml:"tcp"`      // "host:port", healthy when connect succeeds
+	HTTP     string   `toml:"http"`     // URL, healthy on a 2xx/3xx GET
+	Interval Dur      `toml:"interval"` // between checks (default 10s)
+	Timeout  Dur      `toml:"timeout"`  // per check (default 2s)
+	Retries  int      `toml:"retries"`  // consecutive failures before unhealthy (default 3)
+	Delay    Dur      `toml:"delay"`    // grace after start before the first check (default: interval)
+}
+
+func (h *HealthCfg) validate() error {
+	n := 0
+	if len(h.Exec) > 0 {
+		n++
+	}
+	if h.TCP != "" {
+		n++
+	}
+	if h.HTTP != "" {
+		n++
+	}
+	if n != 1 {
+		return fmt.Errorf("health: set exactly one of exec, tcp, http")
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("health: retries must not be negative")
+	}
+	return nil
+}
+
+func (h *HealthCfg) interval() time.Duration {
+	if h.Interval.Duration > 0 {
+		return h.Interval.Duration
+	}
+	return 10 * time.Second
+}
+
+func (h *HealthCfg) timeout() time.Duration {
+	if h.Timeout.Duration > 0 {
+		return h.Timeout.Duration
+	}
+	return 2 * time.Second
+}
+
+func (h *HealthCfg) retries() int {
+	if h.Retries > 0 {
+		return h.Retries
+	}
+	return 3
+}
+
+func (h *HealthCfg) kind() string {
+	switch {
+	case len(h.Exec) > 0:
+		return "exec"
+	case h.TCP != "":
+		return "tcp"
+	}
+	return "http"
+}
+
+// check runs one probe; nil means healthy.
+func (h *HealthCfg) check(ctx context.Context, dir string) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	switch {
+	case len(h.Exec) > 0:
+		rc, out, err := execReaped(ctx, h.Exec[0], h.Exec[1:], dir)
+		if err != nil {
+			return err
+		}
+		if rc != 0 {
+			if len(out) > 0 {
+				return fmt.Errorf("rc=%d: %s", rc, firstLine(out))
+			}
+			return fmt.Errorf("rc=%d", rc)
+		}
+		return nil
+	case h.TCP != "":
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", h.TCP)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	default:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("http status %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+func firstLine(b []byte) string {
+	for i, c := range b {
+		if c == '\n' {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// execReaped runs a short helper command to completion. The global reaper
+// collects every child, so the exit status comes through the registry like
+// a service's; on ctx expiry the helper's group is killed. out holds the
+// first few KiB of combined stdout/stderr.
+func execReaped(ctx context.Context, name string, args []string, dir string) (rc int, out []byte, err error) {
+	path, err := lookPathOrAbs(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return 0, nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = pw, pw
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	w := &runner{name: filepath.Base(path), exitCh: make(chan exitMsg, 1)}
+	err = startRegistered(cmd, w)
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return 0, nil, err
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+
+	outCh := make(chan []byte, 1)
+	go func() {
+		defer pr.Close()
+		b, _ := io.ReadAll(io.LimitReader(pr, 4096))
+		_, _ = io.Copy(io.Discard, pr)
+		outCh <- b
+	}()
+
+	// a daemonizing helper may keep the pipe open past its exit
+	output := func() []byte {
+		select {
+		case b := <-outCh:
+			return b
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	select {
+	case msg := <-w.exitCh:
+		return msg.code, output(), nil
+	case <-ctx.Done():
+		_ = signalGroup(pid, syscall.SIGKILL)
+		<-w.exitCh
+		return 0, nil, fmt.Errorf("timed out: %w", ctx.Err())
+	}
+}
+
+// healthLoop probes the running service until ctx is done. After retries
+// consecutive failures it marks the runner unhealthy and stops the process
+// group, so the exit goes through the normal restart policy.
+func (r *runner) healthLoop(ctx context.Context, grace time.Duration) {
+	h := r.cfg.Health
+	delay := h.interval()
+	if h.Delay.Set {
+		delay = h.Delay.Duration
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	fails := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := h.check(ctx, r.cfg.Dir); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fails++
+			warn(r.name, "health %s check failed (%d/%d): %v", h.kind(), fails, h.retries(), err)
+			if fails >= h.retries() {
+				r.unhealthy.Store(true)
+				errorf(r.name, "unhealthy; stopping for restart policy")
+				r.event("unhealthy", r.groupID(), "%s check failed %d times: %v", h.kind(), fails, err)
+				r.stop(grace, nil)
+				return
+			}
+		} else {
+			if fails > 0 || r.unhealthy.Load() {
+				info(r.name, "health %s check ok", h.kind())
+			} else {
+				debug(r.name, "health %s check ok", h.kind())
+			}
+			fails = 0
+			r.unhealthy.Store(false)
+		}
+		t.Reset(h.interval())
+	}
+}
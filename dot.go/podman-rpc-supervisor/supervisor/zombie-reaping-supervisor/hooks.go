@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* ===========================
+   on_failure_exec hook
+   =========================== */
+
+// onFailureCmd is [supervisor].on_failure_exec; swapped on reload.
+var onFailureCmd atomic.Pointer[[]string]
+
+const onFailureTimeout = 30 * time.Second
+
+func setOnFailure(cmd []string) {
+	if len(cmd) == 0 {
+		onFailureCmd.Store(nil)
+		return
+	}
+	onFailureCmd.Store(&cmd)
+}
+
+// expandHook substitutes %SERVICE%, %RC%, %PID% and %EVENT% ("failed" when
+// the service gave up, "exited" otherwise).
+func expandHook(args []string, svc string, rc, pid int, event string) []string {
+	rep := strings.NewReplacer("%SERVICE%", svc, "%RC%", strconv.Itoa(rc), "%PID%", strconv.Itoa(pid), "%EVENT%", event)
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = rep.Replace(a)
+	}
+	return out
+}
+
+// onFailure runs the hook in the background after an exit (pid 0: the
+// start failed) that was abnormal or left the service failed; stopping
+// means the supervisor or an operator ended the run. It never delays the
+// restart.
+func (r *runner) onFailure(stopping bool, rc, pid int) {
+	p := onFailureCmd.Load()
+	if p == nil || stopping {
+		return
+	}
+	r.mu.Lock()
+	failed := r.state == "failed"
+	r.mu.Unlock()
+	if rc == 0 && !failed {
+		return
+	}
+	event := "exited"
+	if failed {
+		event = "failed"
+	}
+	argv := expandHook(*p, r.name, rc, pid, event)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), onFailureTimeout)
+		defer cancel()
+		hrc, out, err := execReaped(ctx, argv[0], argv[1:], "")
+		switch {
+		case err != nil:
+			warn(r.name, "on_failure_exec: %v", err)
+		case hrc != 0:
+			warn(r.name, "on_failure_exec: rc=%d: %s", hrc, firstLine(out))
+		}
+	}()
+}
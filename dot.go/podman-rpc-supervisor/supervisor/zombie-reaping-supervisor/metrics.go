@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* ===========================
+   Prometheus metrics
+   =========================== */
+
+var (
+	reapedTotal  atomic.Int64 // every child collected by the reaper
+	orphansTotal atomic.Int64 // ... of which no runner claimed
+)
+
+var serviceStates = []string{"starting", "running", "backoff", "scheduled", "exited", "failed", "stopped", "disabled"}
+
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// writeMetrics renders the Prometheus text exposition format.
+func (s *supervisor) writeMetrics(w io.Writer) {
+	help := func(name, typ, text string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, text, name, typ)
+	}
+	type row struct {
+		name, state    string
+		restarts, last int
+		orphans        int64
+		uptime         float64
+		unhealthy      bool
+	}
+	var rows []row
+	for _, r := range s.list() {
+		r.mu.Lock()
+		x := row{name: r.name, state: r.state, restarts: r.restarts, last: r.lastExit, unhealthy: r.unhealthy.Load(), orphans: r.orphans.Load()}
+		if r.state == "running" {
+			x.uptime = time.Since(r.since).Seconds()
+		}
+		r.mu.Unlock()
+		rows = append(rows, x)
+	}
+
+	help("supervisor_service_up", "gauge", "1 when the service is running (READY=1 for notify services).")
+	for _, x := range rows {
+		up := 0
+		if x.state == "running" {
+			up = 1
+		}
+		fmt.Fprintf(w, "supervisor_service_up{service=\"%s\"} %d\n", promLabel(x.name), up)
+	}
+	help("supervisor_service_state", "gauge", "1 for the service's current state.")
+	for _, x := range rows {
+		for _, st := range serviceStates {
+			v := 0
+			if st == x.state {
+				v = 1
+			}
+			fmt.Fprintf(w, "supervisor_service_state{service=\"%s\",state=\"%s\"} %d\n", promLabel(x.name), st, v)
+		}
+	}
+	help("supervisor_service_unhealthy", "gauge", "1 while health checks or the watchdog consider the service unhealthy.")
+	for _, x := range rows {
+		v := 0
+		if x.unhealthy {
+			v = 1
+		}
+		fmt.Fprintf(w, "supervisor_service_unhealthy{service=\"%s\"} %d\n", promLabel(x.name), v)
+	}
+	help("supervisor_service_restarts_total", "counter", "Restarts since the service was last started by the supervisor.")
+	for _, x := range rows {
+		fmt.Fprintf(w, "supervisor_service_restarts_total{service=\"%s\"} %d\n", promLabel(x.name), x.restarts)
+	}
+	help("supervisor_service_last_exit_code", "gauge", "Exit code of the last run (128+N when killed by signal N).")
+	for _, x := range rows {
+		fmt.Fprintf(w, "supervisor_service_last_exit_code{service=\"%s\"} %d\n", promLabel(x.name), x.last)
+	}
+	help("supervisor_service_uptime_seconds", "gauge", "Seconds since the service became running (0 otherwise).")
+	for _, x := range rows {
+		fmt.Fprintf(w, "supervisor_service_uptime_seconds{service=\"%s\"} %.3f\n", promLabel(x.name), x.uptime)
+	}
+	help("supervisor_service_orphans_reaped_total", "counter", "Orphans reaped from the service's process group or cgroup.")
+	for _, x := range rows {
+		fmt.Fprintf(w, "supervisor_service_orphans_reaped_total{service=\"%s\"} %d\n", promLabel(x.name), x.orphans)
+	}
+	help("supervisor_reaped_total", "counter", "Child processes reaped.")
+	fmt.Fprintf(w, "supervisor_reaped_total %d\n", reapedTotal.Load())
+	help("supervisor_orphans_reaped_total", "counter", "Reaped processes no runner waited for (re-parented orphans).")
+	fmt.Fprintf(w, "supervisor_orphans_reaped_total %d\n", orphansTotal.Load())
+}
+
+// serveMetrics listens on addr and serves /metrics until the process exits.
+func (s *supervisor) serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			warn("metrics", "%v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/* ===========================
+   sd_notify readiness
+   =========================== */
+
+var (
+	notifyDirOnce sync.Once
+	notifyDirPath string
+	notifyDirErr  error
+)
+
+// notifyDir is a private directory for the per-run NOTIFY_SOCKETs. It is
+// traversable (0711) so services that dropped to another user can reach
+// their own socket, which is chowned to them.
+func notifyDir() (string, error) {
+	notifyDirOnce.Do(func() {
+		notifyDirPath, notifyDirErr = os.MkdirTemp("", "supervisor-notify-")
+		if notifyDirErr == nil {
+			notifyDirErr = os.Chmod(notifyDirPath, 0o711)
+		}
+	})
+	return notifyDirPath, notifyDirErr
+}
+
+func cleanupNotify() {
+	if notifyDirPath != "" {
+		_ = os.RemoveAll(notifyDirPath)
+	}
+}
+
+// notifier receives one run's sd_notify datagrams.
+type notifier struct {
+	conn    *net.UnixConn
+	path    string
+	ready   chan struct{} // closed on the first READY=1
+	isReady atomic.Bool
+	pings   chan struct{} // WATCHDOG=1
+}
+
+func openNotify(name string, cred *syscall.Credential) (*notifier, error) {
+	dir, err := notifyDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, strings.ReplaceAll(name, "/", "_")+".sock")
+	_ = os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	if cred != nil {
+		_ = os.Chown(path, int(cred.Uid), int(cred.Gid))
+	}
+	n := &notifier{conn: conn, path: path, ready: make(chan struct{}), pings: make(chan struct{}, 1)}
+	go n.read(name)
+	return n, nil
+}
+
+func (n *notifier) read(svc string) {
+	buf := make([]byte, 4096)
+	for {
+		k, _, err := n.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(buf[:k]), "\n") {
+			key, val, _ := strings.Cut(line, "=")
+			switch key {
+			case "READY":
+				if val == "1" && !n.isReady.Swap(true) {
+					close(n.ready)
+				}
+			case "WATCHDOG":
+				if val == "1" {
+					select {
+					case n.pings <- struct{}{}:
+					default:
+					}
+				}
+			case "STATUS":
+				info(svc, "status: %s", val)
+			case "STOPPING", "RELOADING":
+				if val == "1" {
+					info(svc, "%s", strings.ToLower(key))
+				}
+			}
+		}
+	}
+}
+
+func (n *notifier) Close() {
+	n.conn.Close()
+	_ = os.Remove(n.path)
+}
+
+// notifyWatch marks the service running on READY=1, stops it if it isn't
+// ready within ready_timeout, and once ready starts the watchdog.
+func (r *runner) notifyWatch(ctx context.Context, n *notifier, leader int, grace time.Duration) {
+	var readyTimeout <-chan time.Time
+	if d := r.cfg.ReadyTimeout.Duration; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		readyTimeout = t.C
+	}
+	select {
+	case <-ctx.Done():
+	case <-n.ready:
+		info(r.name, "ready (READY=1)")
+		r.setState("running", leader)
+		if r.cfg.Watchdog.Duration > 0 {
+			r.watchdogLoop(ctx, n.pings, grace)
+		}
+	case <-readyTimeout:
+		errorf(r.name, "no READY=1 within %s (ready_timeout); stopping for restart policy", r.cfg.ReadyTimeout.Duration)
+		r.unhealthy.Store(true)
+		r.event("unhealthy", leader, "no READY=1 within %s", r.cfg.ReadyTimeout.Duration)
+		r.stop(grace, nil)
+	}
+}
+
+// watchdogLoop stops the running service when it has neither sent
+// WATCHDOG=1 on pings (nil for non-notify services) nor touched
+// watchdog_file within the watchdog interval.
+func (r *runner) watchdogLoop(ctx context.Context, pings <-chan struct{}, grace time.Duration) {
+	interval := r.cfg.Watchdog.Duration
+	file := r.cfg.WatchdogFile
+	if file != "" && !filepath.IsAbs(file) && r.cfg.Dir != "" {
+		file = filepath.Join(r.cfg.Dir, file)
+	}
+	tick := interval / 4
+	if tick > time.Second {
+		tick = time.Second
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pings:
+			last = time.Now()
+		case now := <-t.C:
+			if file != "" {
+				if fi, err := os.Stat(file); err == nil && fi.ModTime().After(last) {
+					last = fi.ModTime()
+				}
+			}
+			if now.Sub(last) > interval {
+				errorf(r.name, "watchdog: no ping for %s (watchdog = %s); stopping for restart policy", now.Sub(last).Round(time.Millisecond), interval)
+				r.unhealthy.Store(true)
+				r.event("unhealthy", r.groupID(), "watchdog: no ping for %s", now.Sub(last).Round(time.Millisecond))
+				r.stop(grace, nil)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/* ===========================
+   Prefixed child output
+   =========================== */
+
+var (
+	outMu sync.Mutex     // whole lines only, across all services and streams
+	outWG sync.WaitGroup // running copiers
+)
+
+// prefixPipe returns the write end to hand the child as stdout/stderr. Each
+// line read back is stamped "[name] RFC3339 " and written to dst. The parent
+// must close the returned file once the child has started; the copier ends
+// when the last holder of the write end (including grandchildren) exits.
+func prefixPipe(name string, dst *os.File) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outWG.Add(1)
+	go func() {
+		defer outWG.Done()
+		defer pr.Close()
+		br := bufio.NewReader(pr)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				if line[len(line)-1] != '\n' {
+					line += "\n"
+				}
+				stamp := "[" + name + "] " + time.Now().UTC().Format(time.RFC3339) + " "
+				outMu.Lock()
+				_, _ = io.WriteString(dst, stamp+line)
+				outMu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return pw, nil
+}
+
+// flushOutput waits up to timeout for the copiers to drain, so the last
+// lines of exited children are not lost when the supervisor exits.
+func flushOutput(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		outWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
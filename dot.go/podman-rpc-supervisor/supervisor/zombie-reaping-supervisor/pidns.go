@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+/* ===========================
+   pidns: a minimal init per service
+   =========================== */
+
+// With pidns = true the service's leader is the exec helper running as pid 1
+// of a fresh PID namespace. The kernel won't deliver default-action signals
+// to a namespace init, and orphans inside the namespace reparent to it, so it
+// runs the service as its child, forwards stop and reload signals, reaps
+// everything, and exits with the service's status. When it exits the kernel
+// kills whatever is left in the namespace, so nothing outlives the service.
+
+var initForward = []os.Signal{
+	syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGCONT, syscall.SIGWINCH,
+}
+
+func runInit(argv, env []string) int {
+	sigs := make(chan os.Signal, 8)
+	signal.Notify(sigs, initForward...)
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// its own group, so the supervisor's group signals reach it once: via us
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); n > 0 {
+		for fd := 3; fd < 3+n; fd++ {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(uintptr(fd), "listen"))
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "supervisor __exec: init: %v\n", err)
+		return 126
+	}
+	child := cmd.Process.Pid
+	go func() {
+		for s := range sigs {
+			_ = syscall.Kill(-child, s.(syscall.Signal))
+		}
+	}()
+
+	// cmd.Wait would miss the child if the loop below reaped it first
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "supervisor __exec: init: wait: %v\n", err)
+			return 126
+		}
+		if pid != child {
+			continue
+		}
+		if ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return ws.ExitStatus()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/* ===========================
+   no_new_privs and capability dropping
+   =========================== */
+
+// Go can't run code between fork and exec, so services that need it start
+// via this binary re-executed as "__exec": it drops the capabilities,
+// switches user, sets no_new_privs and LISTEN_PID, and then execs the
+// service in place (same pid), or for pidns stays on as the namespace's
+// init (see pidns.go).
+
+const privHelperArg = "__exec"
+
+const (
+	prCapbsetDrop  = 24
+	prSetNoNewPriv = 38
+	prCapAmbient   = 47
+	prCapAmbLower  = 3
+	capVersion3    = 0x20080522
+)
+
+var capNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK",
+	"CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE", "CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD", "CAP_LEASE", "CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL", "CAP_SETFCAP", "CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG",
+	"CAP_WAKE_ALARM", "CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+func (sc *ServiceCfg) needsHelper() bool {
+	return sc.NoNewPrivs || len(sc.DropCaps) > 0 || len(sc.Sockets) > 0 || sc.PIDNS
+}
+
+// capNumbers maps drop_caps names ("CAP_NET_RAW", "net_raw", or "ALL").
+func capNumbers(names []string) ([]int, error) {
+	var out []int
+	for _, n := range names {
+		u := strings.ToUpper(strings.TrimSpace(n))
+		if u == "ALL" {
+			out = out[:0]
+			for i := range capNames {
+				out = append(out, i)
+			}
+			return out, nil
+		}
+		if !strings.HasPrefix(u, "CAP_") {
+			u = "CAP_" + u
+		}
+		found := false
+		for i, c := range capNames {
+			if c == u {
+				out = append(out, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("drop_caps: unknown capability %q", n)
+		}
+	}
+	return out, nil
+}
+
+// helperArgv returns the helper argv to put in front of "path args...".
+func helperArgv(sc *ServiceCfg, cred *syscall.Credential) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	caps, err := capNumbers(sc.DropCaps)
+	if err != nil {
+		return nil, err
+	}
+	argv := []string{exe, privHelperArg}
+	if sc.NoNewPrivs {
+		argv = append(argv, "-nnp")
+	}
+	if len(sc.Sockets) > 0 {
+		argv = append(argv, "-listen-pid")
+	}
+	if sc.PIDNS {
+		argv = append(argv, "-init")
+	}
+	if len(caps) > 0 {
+		argv = append(argv, "-drop", joinInts(caps))
+	}
+	if cred != nil {
+		groups := make([]int, len(cred.Groups))
+		for i, g := range cred.Groups {
+			groups[i] = int(g)
+		}
+		argv = append(argv, "-uid", strconv.Itoa(int(cred.Uid)), "-gid", strconv.Itoa(int(cred.Gid)), "-groups", joinInts(groups))
+	}
+	return append(argv, "--"), nil
+}
+
+func joinInts(v []int) string {
+	s := make([]string, len(v))
+	for i, n := range v {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func splitInts(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective, permitted, inheritable uint32
+}
+
+// runPrivHelper is main for "__exec"; it only returns on failure.
+func runPrivHelper(args []string) int {
+	fs := flag.NewFlagSet(privHelperArg, flag.ContinueOnError)
+	nnp := fs.Bool("nnp", false, "")
+	drop := fs.String("drop", "", "")
+	uid := fs.Int("uid", -1, "")
+	gid := fs.Int("gid", -1, "")
+	groups := fs.String("groups", "", "")
+	listenPid := fs.Bool("listen-pid", false, "")
+	asInit := fs.Bool("init", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "supervisor __exec: bad arguments")
+		return 126
+	}
+	fail := func(what string, err error) int {
+		fmt.Fprintf(os.Stderr, "supervisor __exec: %s: %v\n", what, err)
+		return 126
+	}
+	caps, err := splitInts(*drop)
+	if err != nil {
+		return fail("drop", err)
+	}
+
+	// all of these are per thread; exec from the same one
+	runtime.LockOSThread()
+
+	for _, c := range caps {
+		if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(c), 0, 0, 0, 0); e != 0 && e != syscall.EINVAL {
+			return fail(fmt.Sprintf("drop %s from bounding set", capNames[c]), e)
+		}
+		_, _, _ = syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbLower, uintptr(c), 0, 0, 0)
+	}
+	if *uid >= 0 {
+		gs, err := splitInts(*groups)
+		if err != nil {
+			return fail("groups", err)
+		}
+		if err := syscall.Setgroups(gs); err != nil {
+			return fail("setgroups", err)
+		}
+		if err := syscall.Setgid(*gid); err != nil {
+			return fail("setgid", err)
+		}
+		if err := syscall.Setuid(*uid); err != nil {
+			return fail("setuid", err)
+		}
+	}
+	if len(caps) > 0 {
+		hdr := capHeader{version: capVersion3}
+		var data [2]capData
+		if _, _, e := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e != 0 {
+			return fail("capget", e)
+		}
+		for _, c := range caps {
+			bit := uint32(1) << (uint(c) % 32)
+			d := &data[c/32]
+			d.effective &^= bit
+			d.permitted &^= bit
+			d.inheritable &^= bit
+		}
+		if _, _, e := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e != 0 {
+			return fail("capset", e)
+		}
+	}
+	if *nnp {
+		if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPriv, 1, 0, 0, 0, 0); e != 0 {
+			return fail("no_new_privs", e)
+		}
+	}
+	env := os.Environ()
+	if *listenPid {
+		pid := os.Getpid()
+		if *asInit {
+			pid = 2 // the init's first child in the new namespace
+		}
+		env = mergeEnv(env, []string{"LISTEN_PID=" + strconv.Itoa(pid)})
+	}
+	argv := fs.Args()
+	if *asInit {
+		return runInit(argv, env)
+	}
+	return fail("exec "+argv[0], syscall.Exec(argv[0], argv, env))
+}
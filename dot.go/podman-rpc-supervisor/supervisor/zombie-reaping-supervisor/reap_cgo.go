@@ -0,0 +1,93 @@
+//go:build cgo && !purego
+
+package main
+
+/*
+#cgo linux LDFLAGS: -lc
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <sys/resource.h>
+#include <signal.h>
+#include <errno.h>
+#include <unistd.h>
+
+// Prototypes
+int waitid_peek(pid_t *out_pid);
+int wait4_reap(pid_t pid, int *status, long *maxrss_kb, long *utime_us, long *stime_us);
+void decode_status(int st, int *out_code, int *out_signaled, int *out_sig);
+long clk_tck(void);
+
+// Definitions
+int waitid_peek(pid_t *out_pid) {
+    siginfo_t si;
+    int r = waitid(P_ALL, 0, &si, WEXITED | WNOHANG | WNOWAIT);
+    if (r < 0) return -errno;
+    *out_pid = si.si_pid; // 0 when nothing ready
+    return 0;
+}
+int wait4_reap(pid_t pid, int *status, long *maxrss_kb, long *utime_us, long *stime_us) {
+    struct rusage ru;
+    pid_t r = wait4(pid, status, 0, &ru);
+    if (r < 0) return -errno;
+    *maxrss_kb = ru.ru_maxrss;
+    *utime_us = ru.ru_utime.tv_sec * 1000000L + ru.ru_utime.tv_usec;
+    *stime_us = ru.ru_stime.tv_sec * 1000000L + ru.ru_stime.tv_usec;
+    return 0;
+}
+void decode_status(int st, int *out_code, int *out_signaled, int *out_sig) {
+    if (WIFEXITED(st)) {
+        *out_code = WEXITSTATUS(st);
+        *out_signaled = 0;
+        *out_sig = 0;
+        return;
+    }
+    if (WIFSIGNALED(st)) {
+        int s = WTERMSIG(st);
+        *out_code = 128 + s;
+        *out_signaled = 1;
+        *out_sig = s;
+        return;
+    }
+    *out_code = 1;
+    *out_signaled = 0;
+    *out_sig = 0;
+}
+long clk_tck(void) { return sysconf(_SC_CLK_TCK); }
+*/
+import "C"
+
+import (
+	"syscall"
+	"time"
+)
+
+// peekExited returns a child that can be reaped, without reaping it (0:
+// none ready), so /proc/<pid> can still be read.
+func peekExited() (int, syscall.Errno) {
+	var cpid C.pid_t
+	if rc := C.waitid_peek(&cpid); rc < 0 {
+		return 0, syscall.Errno(-rc)
+	}
+	return int(cpid), 0
+}
+
+// reapPid collects pid's exit status and rusage.
+func reapPid(pid int) (waitStatus, syscall.Errno) {
+	var st C.int
+	var maxRSS, utime, stime C.long
+	if rc := C.wait4_reap(C.pid_t(pid), &st, &maxRSS, &utime, &stime); rc < 0 {
+		return waitStatus{}, syscall.Errno(-rc)
+	}
+	var code, signaled, sig C.int
+	C.decode_status(st, &code, &signaled, &sig)
+	return waitStatus{
+		code:     int(code),
+		signaled: signaled != 0,
+		sig:      syscall.Signal(sig),
+		maxRSS:   int64(maxRSS),
+		utime:    time.Duration(utime) * time.Microsecond,
+		stime:    time.Duration(stime) * time.Microsecond,
+	}, 0
+}
+
+func clockTicks() int64 { return int64(C.clk_tck()) }
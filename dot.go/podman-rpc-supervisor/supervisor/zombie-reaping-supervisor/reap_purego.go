@@ -0,0 +1,68 @@
+//go:build !cgo || purego
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Same peek-before-reap as reap_cgo.go, through golang.org/x/sys so the
+// supervisor builds with CGO_ENABLED=0.
+
+func peekExited() (int, syscall.Errno) {
+	var si unix.Siginfo
+	if err := unix.Waitid(unix.P_ALL, 0, &si, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil); err != nil {
+		return 0, errnoOf(err)
+	}
+	return siginfoPid(&si), 0 // 0 when nothing ready
+}
+
+// siginfoPid reads si_pid, which x/sys leaves in the unexported union: it
+// follows the signo/errno/code header (in whatever order the arch has it;
+// mips puts code before errno) at pointer alignment.
+func siginfoPid(si *unix.Siginfo) int {
+	align := unsafe.Sizeof(uintptr(0))
+	end := max(unsafe.Offsetof(si.Signo)+unsafe.Sizeof(si.Signo),
+		unsafe.Offsetof(si.Errno)+unsafe.Sizeof(si.Errno),
+		unsafe.Offsetof(si.Code)+unsafe.Sizeof(si.Code))
+	off := (end + align - 1) &^ (align - 1)
+	return int(*(*int32)(unsafe.Add(unsafe.Pointer(si), off)))
+}
+
+func reapPid(pid int) (waitStatus, syscall.Errno) {
+	var ws unix.WaitStatus
+	var ru unix.Rusage
+	if _, err := unix.Wait4(pid, &ws, 0, &ru); err != nil {
+		return waitStatus{}, errnoOf(err)
+	}
+	st := waitStatus{
+		code:   1,
+		maxRSS: int64(ru.Maxrss),
+		utime:  time.Duration(ru.Utime.Nano()),
+		stime:  time.Duration(ru.Stime.Nano()),
+	}
+	switch {
+	case ws.Exited():
+		st.code = ws.ExitStatus()
+	case ws.Signaled():
+		st.signaled, st.sig = true, syscall.Signal(ws.Signal())
+		st.code = 128 + int(st.sig)
+	}
+	return st, 0
+}
+
+func errnoOf(err error) syscall.Errno {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+	return syscall.EINVAL
+}
+
+// USER_HZ, the unit of /proc/<pid>/stat times, is 100 on every Linux ABI.
+func clockTicks() int64 { return 100 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   restart_if_rss_above
+   =========================== */
+
+// restart_if_rss_above = "512MiB" samples the leader's VmRSS every
+// rss_interval (default 10s); after rss_samples (default 3) samples in a row
+// over the limit the service is stopped gracefully, like a failed health
+// check, and the restart policy applies. Under pidns the leader is the
+// namespace's init, so the limit is not useful there.
+
+func (sc *ServiceCfg) validateRSS() error {
+	if sc.RestartIfRSSAbove == "" {
+		return nil
+	}
+	if _, err := parseBytes(sc.RestartIfRSSAbove); err != nil {
+		return fmt.Errorf("restart_if_rss_above: %v", err)
+	}
+	if sc.RSSSamples < 0 || sc.RSSInterval.Duration < 0 {
+		return fmt.Errorf("rss_samples and rss_interval must not be negative")
+	}
+	if sc.PIDNS {
+		return fmt.Errorf("restart_if_rss_above can't be combined with pidns (it would sample the init)")
+	}
+	return nil
+}
+
+func (sc *ServiceCfg) rssInterval() time.Duration {
+	if sc.RSSInterval.Duration > 0 {
+		return sc.RSSInterval.Duration
+	}
+	return 10 * time.Second
+}
+
+func (sc *ServiceCfg) rssSamples() int {
+	if sc.RSSSamples > 0 {
+		return sc.RSSSamples
+	}
+	return 3
+}
+
+// procRSS reads VmRSS from /proc/PID/status, in KiB.
+func procRSS(pid int) (int64, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "VmRSS:"); ok {
+			return strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("pid %d: no VmRSS", pid)
+}
+
+// rssLoop runs for one run of the service, until ctx is done or it stops it.
+func (r *runner) rssLoop(ctx context.Context, leader int, grace time.Duration) {
+	limit, _ := parseBytes(r.cfg.RestartIfRSSAbove) // validated
+	limitKiB := int64(limit / 1024)
+	samples := r.cfg.rssSamples()
+	t := time.NewTicker(r.cfg.rssInterval())
+	defer t.Stop()
+	over := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		rss, err := procRSS(leader)
+		if err != nil {
+			return // gone; the exit is handled by the loop
+		}
+		debug(r.name, "rss %s (restart_if_rss_above %s)", fmtKiB(rss), r.cfg.RestartIfRSSAbove)
+		if rss <= limitKiB {
+			if over > 0 {
+				info(r.name, "rss %s back under restart_if_rss_above %s", fmtKiB(rss), r.cfg.RestartIfRSSAbove)
+			}
+			over = 0
+			continue
+		}
+		over++
+		warn(r.name, "rss %s above restart_if_rss_above %s (%d/%d)", fmtKiB(rss), r.cfg.RestartIfRSSAbove, over, samples)
+		if over >= samples {
+			errorf(r.name, "rss over the limit for %d samples; stopping for restart policy", over)
+			r.unhealthy.Store(true)
+			r.event("unhealthy", leader, "rss %s above restart_if_rss_above %s", fmtKiB(rss), r.cfg.RestartIfRSSAbove)
+			r.stop(grace, nil)
+			return
+		}
+	}
+}
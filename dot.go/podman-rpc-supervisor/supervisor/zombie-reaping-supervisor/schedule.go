@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   Scheduled (timer/cron) services
+   =========================== */
+
+// ScheduleCfg is [services.X.schedule]: run the oneshot service X at each
+// cron time or every interval instead of once at startup.
+type ScheduleCfg struct {
+	Cron    string `toml:"cron"`    // "m h dom mon dow" or @hourly/@daily/@weekly/@monthly/@yearly, local time
+	Every   Dur    `toml:"every"`   // fixed interval, first run one interval after start
+	Overlap string `toml:"overlap"` // previous run still active: "skip" (default), "queue" or "kill-previous"
+	Jitter  Dur    `toml:"jitter"`  // random delay in [0, jitter) added to each run
+
+	spec *cronSpec
+}
+
+func (sc *ScheduleCfg) validate() error {
+	if (sc.Cron == "") == (sc.Every.Duration <= 0) {
+		return fmt.Errorf("schedule: set exactly one of cron, every")
+	}
+	switch sc.Overlap {
+	case "", "skip", "queue", "kill-previous":
+	default:
+		return fmt.Errorf("schedule: overlap %q: want skip, queue or kill-previous", sc.Overlap)
+	}
+	if sc.Jitter.Duration < 0 {
+		return fmt.Errorf("schedule: jitter must not be negative")
+	}
+	if sc.Cron != "" {
+		spec, err := parseCron(sc.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+		if spec.next(time.Now()).IsZero() {
+			return fmt.Errorf("schedule: cron %q never matches", sc.Cron)
+		}
+		sc.spec = spec
+	}
+	return nil
+}
+
+// next returns the first run time after t, jitter included.
+func (sc *ScheduleCfg) next(t time.Time) time.Time {
+	var n time.Time
+	if sc.spec != nil {
+		n = sc.spec.next(t)
+	} else {
+		n = t.Add(sc.Every.Duration)
+	}
+	if j := sc.Jitter.Duration; j > 0 {
+		n = n.Add(time.Duration(rand.Int63n(int64(j))))
+	}
+	return n
+}
+
+// scheduleLoop fires one run of the service (via startLoop) per schedule
+// tick until ctx is done, applying the overlap policy when a tick finds the
+// previous run still going.
+func (r *runner) scheduleLoop(ctx context.Context, grace time.Duration, wgDone func()) {
+	defer wgDone()
+	sch := r.cfg.Schedule
+
+	var runCancel context.CancelFunc
+	var runDone chan struct{} // nil when no run is active
+	pending := false
+	launch := func() {
+		rctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		runCancel, runDone = cancel, done
+		go r.startLoop(rctx, grace, func() {
+			cancel()
+			close(done)
+		})
+	}
+
+	r.setState("scheduled", 0)
+	next := sch.next(time.Now())
+	info(r.name, "scheduled; next run %s", next.Format(time.RFC3339))
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if runDone != nil {
+				<-runDone // the caller stops a leader left running
+			}
+			return
+		case <-runDone:
+			timer.Stop()
+			runDone = nil
+			if pending {
+				pending = false
+				launch()
+			} else {
+				r.setState("scheduled", 0)
+			}
+		case <-timer.C:
+			next = sch.next(time.Now())
+			if runDone == nil {
+				launch()
+				continue
+			}
+			switch sch.Overlap {
+			case "queue":
+				if !pending {
+					info(r.name, "previous run still active; queued")
+				}
+				pending = true
+			case "kill-previous":
+				warn(r.name, "previous run still active; stopping it")
+				runCancel()
+				<-runDone
+				r.terminate(grace, nil)
+				launch()
+			default:
+				warn(r.name, "previous run still active; skipped (next %s)", next.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+/* ---------- cron expressions ---------- */
+
+type cronSpec struct {
+	minute, hour, dom, month, dow [64]bool
+	domAny, dowAny                bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dowNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+func parseCron(expr string) (*cronSpec, error) {
+	if m, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = m
+	}
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	s := &cronSpec{domAny: f[2] == "*", dowAny: f[4] == "*"}
+	fields := []struct {
+		set      *[64]bool
+		lo, hi   int
+		names    []string
+		nameBase int
+	}{
+		{&s.minute, 0, 59, nil, 0},
+		{&s.hour, 0, 23, nil, 0},
+		{&s.dom, 1, 31, nil, 0},
+		{&s.month, 1, 12, monthNames, 1},
+		{&s.dow, 0, 7, dowNames, 0},
+	}
+	for i, fd := range fields {
+		if err := parseCronField(f[i], fd.set, fd.lo, fd.hi, fd.names, fd.nameBase); err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+	}
+	if s.dow[7] {
+		s.dow[0] = true // 7 is also Sunday
+	}
+	return s, nil
+}
+
+func parseCronField(field string, set *[64]bool, lo, hi int, names []string, nameBase int) error {
+	num := func(v string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(v, n) {
+				return i + nameBase, nil
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", v, lo, hi)
+		}
+		return n, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+		}
+		a, b := lo, hi
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			x, y, _ := strings.Cut(rng, "-")
+			var err error
+			if a, err = num(x); err != nil {
+				return err
+			}
+			if b, err = num(y); err != nil {
+				return err
+			}
+			if a > b {
+				return fmt.Errorf("bad range %q", rng)
+			}
+		default:
+			n, err := num(rng)
+			if err != nil {
+				return err
+			}
+			a, b = n, n
+			if hasStep {
+				b = hi // "5/15" means from 5 on
+			}
+		}
+		for v := a; v <= b; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// dayMatches follows cron: when both day fields are restricted, either may match.
+func (s *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute strictly after t, or the zero time
+// if there is none within five years (e.g. "0 0 31 4 *").
+func (s *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0) // impossible dates (Feb 30) must not spin forever
+	for t.Before(limit) {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ===========================
+   Socket activation
+   =========================== */
+
+// [services.X.sockets] maps a name to "tcp:HOST:PORT", "tcp6:...",
+// "unix:/path" (a bare "/path" or "@abstract" is unix too). The supervisor
+// binds them once and hands the same listeners to every run of the service
+// as fds 3.. with LISTEN_FDS, LISTEN_FDNAMES and LISTEN_PID (sd_listen_fds),
+// so connections queue in the backlog instead of failing across a restart.
+
+type boundSocket struct {
+	spec string
+	f    *os.File
+	path string // unix socket file, removed on release
+}
+
+var (
+	sockMu sync.Mutex
+	bound  = make(map[string]map[string]*boundSocket) // service -> name -> socket
+)
+
+// parseSocket splits a sockets entry into a net.Listen network and address.
+func parseSocket(spec string) (network, addr string, err error) {
+	if strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, "@") {
+		return "unix", spec, nil
+	}
+	network, addr, ok := strings.Cut(spec, ":")
+	if ok {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return "", "", fmt.Errorf("socket %q: %v", spec, err)
+			}
+			return network, addr, nil
+		case "unix":
+			if addr == "" {
+				return "", "", fmt.Errorf("socket %q: empty path", spec)
+			}
+			return network, addr, nil
+		}
+	}
+	return "", "", fmt.Errorf("socket %q: want tcp:HOST:PORT, tcp6:..., or unix:/path", spec)
+}
+
+func validateSockets(socks map[string]string) error {
+	for name, spec := range socks {
+		if name == "" || len(name) > 255 || strings.ContainsAny(name, ":\n") {
+			return fmt.Errorf("sockets: bad name %q (no ':' and at most 255 bytes)", name)
+		}
+		if _, _, err := parseSocket(spec); err != nil {
+			return fmt.Errorf("sockets: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// activationFiles returns svc's listeners in LISTEN_FDNAMES order, binding
+// the ones not bound yet and closing any no longer configured.
+func activationFiles(svc string, socks map[string]string) (files []*os.File, names []string, err error) {
+	sockMu.Lock()
+	defer sockMu.Unlock()
+	have := bound[svc]
+	if have == nil {
+		have = make(map[string]*boundSocket)
+		bound[svc] = have
+	}
+	for name, b := range have {
+		if socks[name] != b.spec {
+			b.close()
+			delete(have, name)
+		}
+	}
+	names = sortedKeys(socks)
+	for _, name := range names {
+		b := have[name]
+		if b == nil {
+			if b, err = bindSocket(socks[name]); err != nil {
+				return nil, nil, fmt.Errorf("socket %s: %w", name, err)
+			}
+			have[name] = b
+			info(svc, "socket %s: listening on %s", name, b.spec)
+		}
+		files = append(files, b.f)
+	}
+	return files, names, nil
+}
+
+// releaseSockets closes svc's listeners (on removal by reload or at exit).
+func releaseSockets(svc string) {
+	sockMu.Lock()
+	defer sockMu.Unlock()
+	for _, b := range bound[svc] {
+		b.close()
+	}
+	delete(bound, svc)
+}
+
+func releaseAllSockets() {
+	sockMu.Lock()
+	names := make([]string, 0, len(bound))
+	for svc := range bound {
+		names = append(names, svc)
+	}
+	sockMu.Unlock()
+	for _, svc := range names {
+		releaseSockets(svc)
+	}
+}
+
+func bindSocket(spec string) (*boundSocket, error) {
+	network, addr, err := parseSocket(spec)
+	if err != nil {
+		return nil, err
+	}
+	b := &boundSocket{spec: spec}
+	if network == "unix" && !strings.HasPrefix(addr, "@") {
+		// same stale-socket rule as the control socket
+		if c, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", addr)
+		}
+		_ = os.Remove(addr)
+		b.path = addr
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	switch l := l.(type) {
+	case *net.TCPListener:
+		b.f, err = l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		b.f, err = l.File()
+	}
+	l.Close() // b.f is a dup that stays open
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *boundSocket) close() {
+	b.f.Close()
+	if b.path != "" {
+		_ = os.Remove(b.path)
+	}
+}
+
+// activationEnv is the environment sd_listen_fds expects, less LISTEN_PID
+// (only known after fork; the exec helper adds it).
+func activationEnv(names []string) []string {
+	return []string{
+		"LISTEN_FDS=" + strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/* ===========================
+   enable / disable, persisted
+   =========================== */
+
+// The state file ([supervisor].state_file or -state-file) records services
+// disabled with `ctl disable NAME`: they are not started at boot, by reload
+// or by `ctl start` until `ctl enable NAME`. Names no longer in the config
+// are kept, in case they come back.
+
+type stateDoc struct {
+	Disabled []string `json:"disabled"`
+}
+
+func loadState(path string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	if path == "" {
+		return disabled, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return disabled, nil
+	}
+	if err != nil {
+		return disabled, err
+	}
+	var doc stateDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return disabled, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, name := range doc.Disabled {
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// saveState replaces the state file atomically. Caller holds s.stateMu.
+func (s *supervisor) saveState() error {
+	if s.statePath == "" {
+		return nil
+	}
+	doc := stateDoc{Disabled: make([]string, 0, len(s.disabled))}
+	for name := range s.disabled {
+		doc.Disabled = append(doc.Disabled, name)
+	}
+	sort.Strings(doc.Disabled)
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.statePath), "."+filepath.Base(s.statePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.statePath)
+}
+
+func (s *supervisor) isDisabled(name string) bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.disabled[name]
+}
+
+// setDisabled records the change, persisting it first so a failed write
+// leaves both the file and the running set as they were.
+func (s *supervisor) setDisabled(name string, off bool) error {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.disabled[name] == off {
+		return nil
+	}
+	if off {
+		s.disabled[name] = true
+	} else {
+		delete(s.disabled, name)
+	}
+	if err := s.saveState(); err != nil {
+		if off {
+			delete(s.disabled, name)
+		} else {
+			s.disabled[name] = true
+		}
+		return fmt.Errorf("state file: %w", err)
+	}
+	return nil
+}
+
+// enable and disable are the control commands. Caller holds s.opMu.
+func (s *supervisor) enable(r *runner, out io.Writer) error {
+	if err := s.setDisabled(r.name, false); err != nil {
+		return err
+	}
+	s.noteUnpersisted(out)
+	r.mu.Lock()
+	if r.state == "disabled" {
+		r.state, r.since = "stopped", time.Now()
+	}
+	r.mu.Unlock()
+	r.event("enabled", 0, "")
+	info(r.name, "enabled")
+	return s.start(r)
+}
+
+func (s *supervisor) disable(r *runner, out io.Writer) error {
+	if err := s.setDisabled(r.name, true); err != nil {
+		return err
+	}
+	s.noteUnpersisted(out)
+	_ = s.stop(r, nil) // "not running" is fine
+	r.setState("disabled", 0)
+	r.event("disabled", 0, "")
+	info(r.name, "disabled")
+	return nil
+}
+
+func (s *supervisor) noteUnpersisted(out io.Writer) {
+	if s.statePath == "" {
+		fmt.Fprintln(out, "note: no state_file configured; this lasts until the supervisor restarts")
+	}
+}
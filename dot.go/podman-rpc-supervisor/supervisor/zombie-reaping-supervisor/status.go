@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/* ===========================
+   Machine-readable status
+   =========================== */
+
+// serviceStatus is one service in `ctl status-json` and the status file.
+type serviceStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	PID       int       `json:"pid"`   // 0 unless a process is up
+	Since     time.Time `json:"since"` // of the current state
+	Restarts  int       `json:"restarts"`
+	LastExit  int       `json:"last_exit"` // 128+N when killed by signal N
+	Unhealthy bool      `json:"unhealthy"`
+	Orphans   int64     `json:"orphans"`
+}
+
+type statusDoc struct {
+	Time     time.Time       `json:"time"` // when written; a stale status file means a hung supervisor
+	PID      int             `json:"pid"`  // the supervisor's
+	Services []serviceStatus `json:"services"`
+}
+
+// status snapshots every service, by name.
+func (s *supervisor) status() []serviceStatus {
+	var out []serviceStatus
+	for _, r := range s.list() {
+		r.mu.Lock()
+		st := serviceStatus{Name: r.name, State: r.state, PID: r.pid, Since: r.since, Restarts: r.restarts, LastExit: r.lastExit}
+		r.mu.Unlock()
+		st.Unhealthy = r.unhealthy.Load()
+		st.Orphans = r.orphans.Load()
+		out = append(out, st)
+	}
+	return out
+}
+
+func (s *supervisor) writeStatusJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(statusDoc{Time: time.Now().UTC(), PID: os.Getpid(), Services: s.status()})
+}
+
+// writeStatusFile replaces path atomically so readers never see a partial
+// document.
+func (s *supervisor) writeStatusFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := s.writeStatusJSON(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// statusFileLoop rewrites the status file every interval until ctx is done.
+func (s *supervisor) statusFileLoop(ctx context.Context, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failing := false
+	for {
+		if err := s.writeStatusFile(path); err != nil {
+			if !failing {
+				warn("status", "%v", err)
+			}
+			failing = true
+		} else {
+			failing = false
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/* ===========================
+   Stop signal sequence
+   =========================== */
+
+var signalNames = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT, "KILL": syscall.SIGKILL, "USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2, "PIPE": syscall.SIGPIPE, "ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM, "CONT": syscall.SIGCONT, "STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP, "WINCH": syscall.SIGWINCH, "PWR": syscall.SIGPWR,
+}
+
+// parseSignal accepts "SIGINT", "INT" (any case) or a number.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// sigName is "SIGTERM" rather than syscall's "terminated".
+func sigName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// stopStep sends sig, then gives the service wait to exit before the next
+// step. SIGKILL follows the last one.
+type stopStep struct {
+	sig  syscall.Signal
+	wait time.Duration
+}
+
+// stopSteps is stop_sequence ("SIGINT:5s", ...; a step without a timeout
+// waits grace), else stop_signal (default SIGTERM) for grace.
+func (sc *ServiceCfg) stopSteps(grace time.Duration) ([]stopStep, error) {
+	if len(sc.StopSequence) == 0 {
+		sig := syscall.SIGTERM
+		if sc.StopSignal != "" {
+			var err error
+			if sig, err = parseSignal(sc.StopSignal); err != nil {
+				return nil, fmt.Errorf("stop_signal: %v", err)
+			}
+		}
+		return []stopStep{{sig, grace}}, nil
+	}
+	if sc.StopSignal != "" {
+		return nil, fmt.Errorf("set stop_signal or stop_sequence, not both")
+	}
+	steps := make([]stopStep, 0, len(sc.StopSequence))
+	for _, step := range sc.StopSequence {
+		name, wait, timed := strings.Cut(step, ":")
+		sig, err := parseSignal(name)
+		if err != nil {
+			return nil, fmt.Errorf("stop_sequence: %v", err)
+		}
+		st := stopStep{sig, grace}
+		if timed {
+			if st.wait, err = time.ParseDuration(wait); err != nil || st.wait <= 0 {
+				return nil, fmt.Errorf("stop_sequence: %q: want SIGNAL or SIGNAL:DURATION", step)
+			}
+		}
+		steps = append(steps, st)
+	}
+	return steps, nil
+}
+
+/* ===========================
+   reload_signal: ctl reload NAME
+   =========================== */
+
+// reloadService forwards reload_signal to r's process group, for daemons
+// that re-read their own config in place; nothing is restarted.
+func (r *runner) reloadService() error {
+	if r.cfg.ReloadSignal == "" {
+		return fmt.Errorf("%s has no reload_signal (use restart)", r.name)
+	}
+	sig, err := parseSignal(r.cfg.ReloadSignal)
+	if err != nil {
+		return fmt.Errorf("reload_signal: %v", err)
+	}
+	r.mu.Lock()
+	leader := r.pid
+	r.mu.Unlock()
+	pgid := r.groupID()
+	if leader == 0 || pgid <= 0 {
+		return fmt.Errorf("%s is not running", r.name)
+	}
+	if err := signalGroup(pgid, sig); err != nil {
+		return fmt.Errorf("%s: %v", sigName(sig), err)
+	}
+	info(r.name, "reload: sent %s to pgid=%d", sigName(sig), pgid)
+	r.event("reloaded", leader, "%s", sigName(sig))
+	return nil
+}
@@ -1,74 +1,35 @@
-// supervisor.go (libc/cgo reaper; robust drain + pretty logs + idle-exit + process-group shutdown)
+// supervisor.go (peek-before-reap drain + pretty logs + idle-exit + process-group shutdown)
 //
-// Build:
+// Build (libc/cgo reaper, reap_cgo.go):
 //
-//	CGO_ENABLED=1 GO111MODULE=auto go build -trimpath -ldflags="-s -w" -o supervisor supervisor.go
+//	CGO_ENABLED=1 GO111MODULE=auto go build -trimpath -ldflags="-s -w" -o supervisor .
+//
+// Static, without cgo (golang.org/x/sys reaper, reap_purego.go; also -tags purego):
+//
+//	CGO_ENABLED=0 GO111MODULE=auto go build -trimpath -ldflags="-s -w" -o supervisor .
+//
+// GOPATH must include the parent directory for local/svcconfig (build.sh
+// sets it up).
 //
 // Run:
 //
 //	./supervisor --config /etc/services.toml
+//	./supervisor ctl status | start NAME | stop NAME | restart NAME | enable NAME | disable NAME
+//	./supervisor ctl reload [NAME] | events NAME | attach NAME
+//	./supervisor validate --config /etc/services.toml   # dry run: check, start nothing
 package main
 
-/*
-#cgo linux LDFLAGS: -lc
-#include <sys/types.h>
-#include <sys/wait.h>
-#include <signal.h>
-#include <errno.h>
-#include <unistd.h>
-
-// Prototypes
-int waitid_peek(pid_t *out_pid);
-int waitpid_reap(pid_t pid, int *status);
-void decode_status(int st, int *out_code, int *out_signaled, int *out_sig);
-long clk_tck(void);
-
-// Definitions
-int waitid_peek(pid_t *out_pid) {
-    siginfo_t si;
-    int r = waitid(P_ALL, 0, &si, WEXITED | WNOHANG | WNOWAIT);
-    if (r < 0) return -errno;
-    *out_pid = si.si_pid; // 0 when nothing ready
-    return 0;
-}
-int waitpid_reap(pid_t pid, int *status) {
-    pid_t r = waitpid(pid, status, 0);
-    if (r < 0) return -errno;
-    return 0;
-}
-void decode_status(int st, int *out_code, int *out_signaled, int *out_sig) {
-    if (WIFEXITED(st)) {
-        *out_code = WEXITSTATUS(st);
-        *out_signaled = 0;
-        *out_sig = 0;
-        return;
-    }
-    if (WIFSIGNALED(st)) {
-        int s = WTERMSIG(st);
-        *out_code = 128 + s;
-        *out_signaled = 1;
-        *out_sig = s;
-        return;
-    }
-    *out_code = 1;
-    *out_signaled = 0;
-    *out_sig = 0;
-}
-long clk_tck(void) { return sysconf(_SC_CLK_TCK); }
-*/
-import "C"
-
 import (
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -76,54 +37,121 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
+	"local/svcconfig"
 )
 
 /* ===========================
    Config (TOML)
    =========================== */
 
-type Dur struct {
-	time.Duration
-	set bool
+// The field types and the keys both supervisors share live in
+// local/svcconfig, so a config works with either binary.
+type (
+	Dur           = svcconfig.Dur
+	RestartPolicy = svcconfig.Restart
+)
+
+const (
+	RestartNever     = svcconfig.RestartNever
+	RestartAlways    = svcconfig.RestartAlways
+	RestartOnFailure = svcconfig.RestartOnFailure
+)
+
+type ServiceCfg struct {
+	svcconfig.Service // path, args, restart, dir, grace
+
+	StopOrder int    `toml:"stop_order"`
+	KillMode  string `toml:"kill_mode"` // "group" (default), "process" or "mixed"; see runner.stop
+
+	StopSignal   string   `toml:"stop_signal"`   // first stop signal instead of SIGTERM, e.g. "SIGINT"
+	StopSequence []string `toml:"stop_sequence"` // e.g. ["SIGINT:5s", "SIGTERM:10s"]; SIGKILL follows the last step
+	ReloadSignal string   `toml:"reload_signal"` // sent to the group by `ctl reload NAME`, e.g. "SIGHUP"
+
+	BackoffCfg
+
+	StartOrder int `toml:"start_order"` // boot in ascending order; notify services must be ready before the next order
+	StartDelay Dur `toml:"start_delay"` // wait this long before starting at boot
+
+	Wants []string `toml:"wants"` // oneshots that must exit 0 before this starts at boot
+
+	MaxRestarts   int `toml:"max_restarts"`   // give up (state failed) after this many restarts (0: unlimited)
+	RestartWindow Dur `toml:"restart_window"` // ... counted within this sliding window (default: forever)
+
+	Env      []string `toml:"env"`       // KEY=VAL, applied after env_file
+	EnvFile  string   `toml:"env_file"`  // KEY=VAL lines, re-read on every start
+	ClearEnv bool     `toml:"clear_env"` // start from an empty environment instead of the supervisor's
+
+	User  string `toml:"user"`  // name or uid to run as (supervisor must be root)
+	Group string `toml:"group"` // name or gid; default: the user's primary group
+
+	NoNewPrivs bool     `toml:"no_new_privs"` // PR_SET_NO_NEW_PRIVS: setuid binaries and file caps can't elevate
+	DropCaps   []string `toml:"drop_caps"`    // e.g. ["CAP_NET_RAW"] or ["ALL"]: removed from the bounding and all sets
+
+	Notify       bool   `toml:"notify"`        // sd_notify: running only after READY=1 on $NOTIFY_SOCKET
+	ReadyTimeout Dur    `toml:"ready_timeout"` // notify: stop if not ready in time (default: wait forever)
+	Watchdog     Dur    `toml:"watchdog"`      // stop unless pinged this often once running: WATCHDOG=1 or a watchdog_file touch
+	WatchdogFile string `toml:"watchdog_file"` // the service touches this to ping (relative to dir)
+
+	PrefixOutput bool   `toml:"prefix_output"` // stamp each output line with "[name] time" instead of passing stdio through
+	Console      string `toml:"console"`       // "pipe" or "pty": stdio held by the supervisor, for `ctl attach NAME`
+
+	CPUMax    string `toml:"cpu_max"`    // cgroup v2 cpu.max: "150%", "QUOTA PERIOD" or "max"
+	MemoryMax string `toml:"memory_max"` // cgroup v2 memory.max: bytes, "512M" or "max"
+
+	RestartIfRSSAbove string `toml:"restart_if_rss_above"` // e.g. "512MiB": restart when the leader's RSS stays above this
+	RSSInterval       Dur    `toml:"rss_interval"`         // between samples (default 10s)
+	RSSSamples        int    `toml:"rss_samples"`          // consecutive samples over the limit before the restart (default 3)
+
+	Instances []string `toml:"instances"` // for a template "NAME@": one service NAME@INST each, %i = INST
+
+	Sockets map[string]string `toml:"sockets"` // name -> "tcp:HOST:PORT" / "unix:/path", passed as LISTEN_FDS
+
+	PIDNS bool `toml:"pidns"` // own PID namespace: everything the service forked dies with it
+
+	Health   *HealthCfg   `toml:"health"`
+	Schedule *ScheduleCfg `toml:"schedule"`
+}
+
+// BackoffCfg tunes restart backoff. Set in [supervisor] it is the default
+// for services that don't set their own.
+type BackoffCfg struct {
+	BackoffInitial Dur `toml:"backoff_initial"` // first restart delay, doubled per quick failure (default 1s)
+	BackoffMax     Dur `toml:"backoff_max"`     // cap on the delay (default 30s)
+	HealthyUptime  Dur `toml:"healthy_uptime"`  // a run at least this long resets the delay (default 10s)
 }
 
-func (d *Dur) UnmarshalTOML(v interface{}) error {
-	d.set = true
-	if v == nil {
-		d.Duration = 0
-		return nil
+func (b BackoffCfg) initial() time.Duration {
+	if b.BackoffInitial.Duration > 0 {
+		return b.BackoffInitial.Duration
 	}
-	switch x := v.(type) {
-	case string:
-		if x == "" {
-			d.Duration = 0
-			return nil
-		}
-		dd, err := time.ParseDuration(x)
-		if err != nil {
-			return err
-		}
-		d.Duration = dd
-		return nil
-	case int64:
-		d.Duration = time.Duration(x) * time.Second
-		return nil
-	case float64:
-		d.Duration = time.Duration(int64(x)) * time.Second
-		return nil
-	default:
-		return fmt.Errorf("unsupported duration type %T", v)
+	return time.Second
+}
+
+func (b BackoffCfg) max() time.Duration {
+	if b.BackoffMax.Duration > 0 {
+		return b.BackoffMax.Duration
 	}
+	return 30 * time.Second
 }
 
-type ServiceCfg struct {
-	Path      string   `toml:"path"`
-	Args      []string `toml:"args"`
-	Restart   bool     `toml:"restart"`
-	Dir       string   `toml:"dir"`
-	Grace     Dur      `toml:"grace"`
-	StopOrder int      `toml:"stop_order"`
+func (b BackoffCfg) healthy() time.Duration {
+	if b.HealthyUptime.Set {
+		return b.HealthyUptime.Duration
+	}
+	return 10 * time.Second
+}
+
+// inherit fills the fields not set here from def.
+func (b *BackoffCfg) inherit(def BackoffCfg) {
+	if !b.BackoffInitial.Set {
+		b.BackoffInitial = def.BackoffInitial
+	}
+	if !b.BackoffMax.Set {
+		b.BackoffMax = def.BackoffMax
+	}
+	if !b.HealthyUptime.Set {
+		b.HealthyUptime = def.HealthyUptime
+	}
 }
 
 type SupervisorCfg struct {
@@ -131,6 +159,26 @@ type SupervisorCfg struct {
 	Subreaper     bool `toml:"subreaper"`
 	DrainTick     Dur  `toml:"drain_tick"`
 	IdleExitAfter Dur  `toml:"idle_exit_after"`
+
+	LogLevel  string `toml:"log_level"`  // debug, info (default), warn or error
+	LogFormat string `toml:"log_format"` // text (default) or json: one object per line
+
+	Control string `toml:"control"` // unix control socket path ("" disables)
+	Metrics string `toml:"metrics"` // host:port for Prometheus /metrics ("" disables)
+
+	OnFailureExec []string `toml:"on_failure_exec"` // run on an abnormal exit or exhausted restarts; %SERVICE% %RC% %PID% %EVENT%
+	EventHistory  int      `toml:"event_history"`   // state transitions kept per service for `ctl events NAME` (default 50)
+
+	StatusFile     string `toml:"status_file"`     // JSON status rewritten every status_interval ("" disables)
+	StatusInterval Dur    `toml:"status_interval"` // default 5s
+
+	StateFile string `toml:"state_file"` // JSON list of services kept down by `ctl disable` across restarts
+
+	ConfigDir string `toml:"config_dir"` // merge *.toml/*.json fragments from here, sorted, later wins
+
+	AbortOnFailedWants bool `toml:"abort_on_failed_wants"` // shut down (exit 1) when a wanted oneshot fails at boot
+
+	BackoffCfg
 }
 
 type RootCfg struct {
@@ -142,22 +190,99 @@ type RootCfg struct {
    Logging helpers
    =========================== */
 
-func logf(level, svc, msg string, a ...any) {
+// Log lines go to stderr as text ("TIME [LEVEL] file:line [service]: msg")
+// or, with -log-format json, one object per line with time, level, msg,
+// source, service and any per-line fields (pid, rc, ...).
+var (
+	logLevel = slog.LevelInfo
+	logJSON  *slog.Logger // nil: text
+)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("log level %q: want debug, info, warn or error", s)
+}
+
+// setLogging applies -log-level (debug, info, warn, error) and -log-format
+// (text, json); "" keeps the current setting.
+func setLogging(level, format string) error {
+	if level != "" {
+		lvl, err := parseLogLevel(level)
+		if err != nil {
+			return err
+		}
+		logLevel = lvl
+	}
+	switch format {
+	case "":
+	case "text":
+		logJSON = nil
+	case "json":
+		logJSON = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			AddSource: true,
+			Level:     slog.LevelDebug, // filtered in logf
+			ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+				if src, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+					return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+				}
+				if a.Key == slog.TimeKey {
+					return slog.String(slog.TimeKey, a.Value.Time().UTC().Format(time.RFC3339Nano))
+				}
+				return a
+			},
+		}))
+	default:
+		return fmt.Errorf("log format %q: want text or json", format)
+	}
+	return nil
+}
+
+// logf logs for the caller of info/warn/errorf; kv are extra fields as
+// key, value pairs, shown only in the JSON format.
+func logf(level slog.Level, svc string, kv []any, msg string, a ...any) {
+	if level < logLevel {
+		return
+	}
+	if logJSON != nil {
+		var pcs [1]uintptr
+		runtime.Callers(3, pcs[:])
+		rec := slog.NewRecord(time.Now(), level, fmt.Sprintf(msg, a...), pcs[0])
+		if svc != "" {
+			rec.Add("service", svc)
+		}
+		rec.Add(kv...)
+		_ = logJSON.Handler().Handle(context.Background(), rec)
+		return
+	}
 	ts := time.Now().UTC().Format(time.RFC3339Nano)
 	_, file, line, ok := runtime.Caller(2)
 	if !ok {
 		file, line = "?", 0
 	}
 	base := filepath.Base(file)
-	prefix := fmt.Sprintf("%s [%s] %s:%d", ts, strings.ToUpper(level), base, line)
+	prefix := fmt.Sprintf("%s [%s] %s:%d", ts, level, base, line)
 	if svc != "" {
 		prefix += " [" + svc + "]"
 	}
 	fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, fmt.Sprintf(msg, a...))
 }
-func info(svc, m string, a ...any)   { logf("info", svc, m, a...) }
-func warn(svc, m string, a ...any)   { logf("warn", svc, m, a...) }
-func errorf(svc, m string, a ...any) { logf("error", svc, m, a...) }
+func debug(svc, m string, a ...any)  { logf(slog.LevelDebug, svc, nil, m, a...) }
+func info(svc, m string, a ...any)   { logf(slog.LevelInfo, svc, nil, m, a...) }
+func warn(svc, m string, a ...any)   { logf(slog.LevelWarn, svc, nil, m, a...) }
+func errorf(svc, m string, a ...any) { logf(slog.LevelError, svc, nil, m, a...) }
+
+// infoKV and warnKV attach fields for the JSON format to a line.
+func infoKV(svc string, kv []any, m string, a ...any) { logf(slog.LevelInfo, svc, kv, m, a...) }
+func warnKV(svc string, kv []any, m string, a ...any) { logf(slog.LevelWarn, svc, kv, m, a...) }
 
 func quoteArgs(args []string) string {
 	if len(args) == 0 {
@@ -186,30 +311,83 @@ type exitMsg struct {
 	signal syscall.Signal // signal for signaled exits
 	comm   string         // /proc/<pid>/comm
 	age    time.Duration  // lifetime since start
+	pgid   int            // process group at reap time (0 if unknown)
+	cgroup string         // cgroup v2 directory at reap time ("" if unknown)
+	maxRSS int64          // KiB, from wait4's rusage
+	utime  time.Duration  // user CPU
+	stime  time.Duration  // system CPU
+}
+
+// usage formats the rusage part of an exit log line.
+func (m exitMsg) usage() string {
+	return fmt.Sprintf("maxrss=%s user=%s sys=%s", fmtKiB(m.maxRSS), m.utime.Round(time.Millisecond), m.stime.Round(time.Millisecond))
+}
+
+// fields are an exit's log fields for the JSON format.
+func (m exitMsg) fields() []any {
+	return []any{"event", "exited", "pid", m.pid, "rc", m.code, "maxrss_kib", m.maxRSS, "user_ms", m.utime.Milliseconds(), "sys_ms", m.stime.Milliseconds()}
+}
+
+func fmtKiB(kib int64) string {
+	switch {
+	case kib >= 1<<20:
+		return fmt.Sprintf("%.1fGiB", float64(kib)/(1<<20))
+	case kib >= 1<<10:
+		return fmt.Sprintf("%.1fMiB", float64(kib)/(1<<10))
+	}
+	return fmt.Sprintf("%dKiB", kib)
 }
 
 var (
-	repMu     sync.Mutex
-	reg       = make(map[int]*runner) // pid -> runner
-	preReaped = make(map[int]exitMsg) // pid -> exit (race: exit before register)
+	repMu    sync.Mutex
+	reg      = make(map[int]*runner)    // pid -> runner
+	owners   = make(map[int]*runner)    // pgid -> service, kept past the leader's exit
+	cgOwners = make(map[string]*runner) // service cgroup dir -> service
 )
 
-func registerPid(pid int, r *runner) (pre *exitMsg) {
+// ownGroup records r as the owner of pgid (and of its cgroup, if any), so
+// orphans left behind by the service are attributed to it when reaped. A
+// runner owns only its latest group.
+func ownGroup(r *runner, pgid int, cgroup string) {
 	repMu.Lock()
 	defer repMu.Unlock()
-	if msg, ok := preReaped[pid]; ok {
-		delete(preReaped, pid)
-		return &msg
+	for g, o := range owners {
+		if o == r {
+			delete(owners, g)
+		}
+	}
+	owners[pgid] = r
+	if cgroup != "" {
+		cgOwners[cgroup] = r
 	}
-	reg[pid] = r
+}
+
+// startRegistered starts cmd with r already registered for its exit, so the
+// reaper can't collect it first and log a short-lived helper as an orphan.
+func startRegistered(cmd *exec.Cmd, r *runner) error {
+	repMu.Lock()
+	defer repMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	reg[cmd.Process.Pid] = r
 	return nil
 }
-func deliverOrStash(pid int, msg exitMsg) (delivered bool) {
+
+// deliver hands a reaped exit to the runner that started pid. Anything else
+// is an orphan: logged under the service whose process group or cgroup it
+// was in, or as "orphan" when no service claims it.
+func deliver(pid int, msg exitMsg) (delivered bool) {
+	reapedTotal.Add(1)
 	repMu.Lock()
 	r := reg[pid]
 	if r != nil {
 		delete(reg, pid)
 	}
+	o := owners[msg.pgid]
+	if o == nil && msg.cgroup != "" {
+		o = cgOwners[msg.cgroup]
+	}
 	repMu.Unlock()
 	if r != nil {
 		select {
@@ -218,10 +396,13 @@ func deliverOrStash(pid int, msg exitMsg) (delivered bool) {
 		}
 		return true
 	}
-	repMu.Lock()
-	preReaped[pid] = msg
-	repMu.Unlock()
-	warn("orphan", "reaped pid=%d comm=%q cause=%s rc=%d sig=%d age=%s", pid, msg.comm, msg.cause, msg.code, msg.signal, msg.age)
+	orphansTotal.Add(1)
+	svc := "orphan"
+	if o != nil {
+		o.orphans.Add(1)
+		svc = o.name
+	}
+	warnKV(svc, []any{"event", "orphan", "pid", pid, "pgid", msg.pgid, "rc", msg.code}, "reaped orphan pid=%d pgid=%d comm=%q cause=%s rc=%d sig=%d age=%s", pid, msg.pgid, msg.comm, msg.cause, msg.code, msg.signal, msg.age)
 	return false
 }
 
@@ -259,7 +440,7 @@ var (
 )
 
 func initBoot() {
-	clkTck = int64(C.clk_tck())
+	clkTck = clockTicks()
 	if clkTck <= 0 {
 		clkTck = 100
 	}
@@ -307,9 +488,19 @@ func procAge(pid int) time.Duration {
 }
 
 /* ===========================
-   Robust global reaper (libc)
+   Robust global reaper
    =========================== */
 
+// waitStatus is what reapPid (reap_cgo.go or reap_purego.go) collects.
+type waitStatus struct {
+	code     int // exit status, or 128+signal
+	signaled bool
+	sig      syscall.Signal
+	maxRSS   int64 // KiB
+	utime    time.Duration
+	stime    time.Duration
+}
+
 func reaper(ctx context.Context, sigchld <-chan os.Signal, drainTick time.Duration) {
 	if drainTick <= 0 {
 		drainTick = time.Second
@@ -322,50 +513,52 @@ func reaper(ctx context.Context, sigchld <-chan os.Signal, drainTick time.Durati
 
 	drain := func() {
 		for {
-			var cpid C.pid_t
-			if rc := C.waitid_peek(&cpid); rc < 0 {
-				errno := syscall.Errno(-rc)
+			pid, errno := peekExited()
+			if errno != 0 {
 				if errno == syscall.EINTR {
 					continue
 				} // retry
 				if errno == syscall.ECHILD {
 					break
 				} // nothing to reap
-				warn("reaper", "waitid_peek error: errno=%d", int(errno))
+				warn("reaper", "waitid peek error: errno=%d", int(errno))
 				break
 			}
-			pid := int(cpid)
 			if pid == 0 {
 				break
 			} // nothing ready
 
 			comm := readProcComm(pid)
 			age := procAge(pid)
+			pgid, _ := syscall.Getpgid(pid) // still a zombie: not reaped yet
+			cgroup := procCgroup(pid)
 
-			var st C.int
-			if rc := C.waitpid_reap(C.pid_t(pid), &st); rc < 0 {
-				errno := syscall.Errno(-rc)
+			ws, errno := reapPid(pid)
+			if errno != 0 {
 				if errno == syscall.EINTR {
 					continue
 				} // try again next cycle
 				if errno == syscall.ECHILD || errno == syscall.ESRCH {
-					info("reaper", "waitpid nochild pid=%d errno=%d", pid, int(errno))
+					info("reaper", "wait4 nochild pid=%d errno=%d", pid, int(errno))
 					continue
 				}
-				warn("reaper", "waitpid error pid=%d errno=%d", pid, int(errno))
+				warn("reaper", "wait4 error pid=%d errno=%d", pid, int(errno))
 				continue
 			}
-			var code, signaled, sig C.int
-			C.decode_status(st, &code, &signaled, &sig)
 			msg := exitMsg{
 				pid:    pid,
-				code:   int(code),
-				cause:  map[bool]string{true: "signaled", false: "exited"}[signaled != 0],
-				signal: syscall.Signal(sig),
+				code:   ws.code,
+				cause:  map[bool]string{true: "signaled", false: "exited"}[ws.signaled],
+				signal: ws.sig,
 				comm:   comm,
 				age:    age,
+				pgid:   pgid,
+				cgroup: cgroup,
+				maxRSS: ws.maxRSS,
+				utime:  ws.utime,
+				stime:  ws.stime,
 			}
-			_ = deliverOrStash(pid, msg)
+			_ = deliver(pid, msg)
 		}
 	}
 
@@ -389,54 +582,243 @@ type runner struct {
 	name string
 	cfg  ServiceCfg
 
-	pgid   atomic.Int32 // process group id (leader pid at spawn)
-	exitCh chan exitMsg
+	pgid      atomic.Int32 // process group id (leader pid at spawn)
+	exitCh    chan exitMsg
+	unhealthy atomic.Bool  // set by healthLoop when checks keep failing
+	orphans   atomic.Int64 // strays from its group or cgroup reaped by the supervisor
+
+	// lifecycle, guarded by mu (see control.go)
+	mu       sync.Mutex
+	lastExit int                // rc of the last run, for oneshot aggregation and status
+	cancel   context.CancelFunc // stops this runner's loop; nil when not running
+	done     chan struct{}      // closed when the loop returns
+	state    string             // starting, running, backoff, exited, failed, stopped
+	pid      int                // current leader, 0 when none
+	since    time.Time          // last state change
+	restarts int
+	cgroup   string // service cgroup dir when limits are set
+
+	con    console   // console = "pipe"/"pty": stdin and attached clients
+	events eventRing // recent state transitions, for `ctl events NAME`
+}
 
-	lastExit int // for oneshot aggregation
+func (r *runner) setState(state string, pid int) {
+	r.mu.Lock()
+	r.state, r.pid, r.since = state, pid, time.Now()
+	r.mu.Unlock()
 }
 
-const (
-	healthyUptime = 10 * time.Second
-	maxBackoff    = 30 * time.Second
-)
+// setLastExit records the rc of the last run; status and metrics read it
+// under r.mu.
+func (r *runner) setLastExit(code int) {
+	r.mu.Lock()
+	r.lastExit = code
+	r.mu.Unlock()
+}
+
+// waitExit waits for leader's exit, skipping stale messages left over from
+// an earlier run; ok is false when ctx is done first.
+func (r *runner) waitExit(ctx context.Context, leader int) (msg exitMsg, ok bool) {
+	for {
+		select {
+		case msg = <-r.exitCh:
+			if msg.pid == leader {
+				return msg, true
+			}
+		case <-ctx.Done():
+			return exitMsg{}, false
+		}
+	}
+}
 
 func (r *runner) startLoop(ctx context.Context, defaultGrace time.Duration, wgDone func()) {
 	defer wgDone()
-	backoff := time.Second
+	defer r.con.detachAll()
+	backoff, maxBackoff, healthyUptime := r.cfg.initial(), r.cfg.max(), r.cfg.healthy()
+	grace := r.cfg.Grace.Duration
+	if grace <= 0 {
+		grace = defaultGrace
+	}
 
-	for {
+	// giveUp decides, after an exit with rc, whether the loop ends; if so it
+	// records the final state. Restarts are budgeted by max_restarts within
+	// restart_window.
+	var recent []time.Time
+	giveUp := func(rc int, state string) bool {
+		if ctx.Err() != nil || !r.cfg.Restart.Restarts(rc) {
+			r.setState(state, 0)
+			return true
+		}
+		limit := r.cfg.MaxRestarts
+		if limit <= 0 {
+			return false
+		}
+		now := time.Now()
+		if w := r.cfg.RestartWindow.Duration; w > 0 {
+			keep := recent[:0]
+			for _, t := range recent {
+				if now.Sub(t) < w {
+					keep = append(keep, t)
+				}
+			}
+			recent = keep
+		}
+		if len(recent) >= limit {
+			if w := r.cfg.RestartWindow.Duration; w > 0 {
+				errorf(r.name, "restarted %d times within %s; giving up (max_restarts)", len(recent), w)
+			} else {
+				errorf(r.name, "restarted %d times; giving up (max_restarts)", len(recent))
+			}
+			r.setState("failed", 0)
+			r.event("failed", 0, "max_restarts %d reached", limit)
+			return true
+		}
+		recent = append(recent, now)
+		return false
+	}
+
+	for first := true; ; first = false {
 		if ctx.Err() != nil {
 			return
 		}
+		if !first {
+			r.mu.Lock()
+			r.restarts++
+			r.mu.Unlock()
+		}
+		r.setState("starting", 0)
 
 		path, err := lookPathOrAbs(r.cfg.Path)
 		if err != nil {
-			errorf(r.name, "resolve path: %v", err)
-			if !r.cfg.Restart {
-				r.lastExit = 1
+			err = fmt.Errorf("resolve path: %w", err)
+		}
+		var env []string
+		if err == nil {
+			env, err = r.cfg.environ()
+		}
+		var cred *syscall.Credential
+		if err == nil {
+			cred, err = r.cfg.credential()
+		}
+		var wrap []string
+		if err == nil && r.cfg.needsHelper() {
+			wrap, err = helperArgv(&r.cfg, cred)
+		}
+		var socks []*os.File
+		if err == nil && len(r.cfg.Sockets) > 0 {
+			var names []string
+			if socks, names, err = activationFiles(r.name, r.cfg.Sockets); err == nil {
+				env = mergeEnv(env, activationEnv(names))
+			}
+		}
+		var n *notifier
+		if err == nil && r.cfg.Notify {
+			if n, err = openNotify(r.name, cred); err == nil {
+				env = mergeEnv(env, []string{"NOTIFY_SOCKET=" + n.path})
+				if r.cfg.Watchdog.Duration > 0 {
+					env = mergeEnv(env, []string{fmt.Sprintf("WATCHDOG_USEC=%d", r.cfg.Watchdog.Duration.Microseconds())})
+				}
+			}
+		}
+		var cg *os.File
+		if err == nil && r.cfg.hasLimits() {
+			cg, err = serviceCgroup(r.name, &r.cfg)
+		}
+		if err != nil {
+			if n != nil {
+				n.Close()
+			}
+			errorf(r.name, "%v", err)
+			r.event("start-failed", 0, "%v", err)
+			r.setLastExit(1)
+			stopping := ctx.Err() != nil
+			done := giveUp(1, "failed")
+			r.onFailure(stopping, 1, 0)
+			if done {
 				return
 			}
-			if !sleepBackoff(ctx, &backoff) {
+			r.setState("backoff", 0)
+			if !sleepBackoff(ctx, &backoff, maxBackoff) {
 				return
 			}
 			continue
 		}
 
 		cmd := exec.Command(path, r.cfg.Args...)
+		if wrap != nil {
+			cmd = exec.Command(wrap[0], append(append(wrap[1:], path), r.cfg.Args...)...)
+			cred = nil // the helper switches user itself, after dropping caps
+		}
+		cmd.ExtraFiles = socks // fds 3.., as LISTEN_FDS counts them
 		if r.cfg.Dir != "" {
 			cmd.Dir = r.cfg.Dir
 		}
+		cmd.Env = env
 		cmd.Stdout, cmd.Stderr, cmd.Stdin = os.Stdout, os.Stderr, nil
-		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		var pipes []*os.File // write ends, closed once the child has them
+		if r.cfg.PrefixOutput && r.cfg.Console == "" {
+			for _, dst := range []*os.File{os.Stdout, os.Stderr} {
+				pw, perr := prefixPipe(r.name, dst)
+				if perr != nil {
+					errorf(r.name, "output pipe: %v", perr)
+					break
+				}
+				pipes = append(pipes, pw)
+			}
+			if len(pipes) == 2 {
+				cmd.Stdout, cmd.Stderr = pipes[0], pipes[1]
+			}
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+		if r.cfg.PIDNS {
+			cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWPID
+		}
+		if r.cfg.Console != "" {
+			ends, cerr := r.openConsole(cmd)
+			if cerr != nil {
+				errorf(r.name, "console: %v", cerr)
+			}
+			pipes = append(pipes, ends...)
+		}
+		ooms := 0
+		if cg != nil {
+			// clone straight into the cgroup so no fork escapes the limits
+			cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, int(cg.Fd())
+			ooms = oomKills(cg.Name())
+			r.mu.Lock()
+			r.cgroup = cg.Name()
+			r.mu.Unlock()
+		}
+
+		// drop an exit left over from a run stopped via the control socket
+		select {
+		case <-r.exitCh:
+		default:
+		}
 
 		startAt := time.Now()
-		if err := cmd.Start(); err != nil {
+		err = startRegistered(cmd, r)
+		if cg != nil {
+			cg.Close()
+		}
+		for _, pw := range pipes {
+			pw.Close()
+		}
+		if err != nil {
+			if n != nil {
+				n.Close()
+			}
 			errorf(r.name, "start failed: %v", err)
-			if !r.cfg.Restart {
-				r.lastExit = 1
+			r.event("start-failed", 0, "%v", err)
+			r.setLastExit(1)
+			stopping := ctx.Err() != nil
+			done := giveUp(1, "failed")
+			r.onFailure(stopping, 1, 0)
+			if done {
 				return
 			}
-			if !sleepBackoff(ctx, &backoff) {
+			r.setState("backoff", 0)
+			if !sleepBackoff(ctx, &backoff, maxBackoff) {
 				return
 			}
 			continue
@@ -452,43 +834,72 @@ func (r *runner) startLoop(ctx context.Context, defaultGrace time.Duration, wgDo
 			pgid = leader
 		}
 		r.pgid.Store(int32(pgid))
-
-		if pre := registerPid(leader, r); pre != nil {
-			info(r.name, "(race) pid=%d exited early rc=%d", leader, pre.code)
-			r.lastExit = pre.code
-			if !r.cfg.Restart || ctx.Err() != nil {
-				return
-			}
-			uptime := time.Since(startAt)
-			if uptime < healthyUptime {
-				if !sleepBackoff(ctx, &backoff) {
-					return
-				}
-			} else {
-				backoff = time.Second
+		r.mu.Lock()
+		cgroup := r.cgroup
+		r.mu.Unlock()
+		ownGroup(r, pgid, cgroup)
+
+		infoKV(r.name, []any{"event", "started", "pid", leader, "pgid", pgid}, "started pid=%d pgid=%d path=%q args=%s dir=%q", leader, pgid, path, quoteArgs(r.cfg.Args), r.cfg.Dir)
+		if first {
+			r.event("started", leader, "")
+		} else {
+			r.event("restarted", leader, "restart #%d", r.restarts)
+		}
+		r.unhealthy.Store(false)
+		hctx, hcancel := context.WithCancel(ctx)
+		if n != nil {
+			r.setState("starting", leader) // until READY=1
+			go r.notifyWatch(hctx, n, leader, grace)
+		} else {
+			r.setState("running", leader)
+			if r.cfg.Watchdog.Duration > 0 {
+				go r.watchdogLoop(hctx, nil, grace)
 			}
-			continue
+		}
+		if r.cfg.Health != nil {
+			go r.healthLoop(hctx, grace)
+		}
+		if r.cfg.RestartIfRSSAbove != "" {
+			go r.rssLoop(hctx, leader, grace)
 		}
 
-		info(r.name, "started pid=%d pgid=%d path=%q args=%s dir=%q", leader, pgid, path, quoteArgs(r.cfg.Args), r.cfg.Dir)
-
-		select {
-		case msg := <-r.exitCh:
-			r.lastExit = msg.code
-			info(r.name, "exited rc=%d", msg.code)
-			if ctx.Err() != nil || !r.cfg.Restart {
+		msg, ok := r.waitExit(ctx, leader)
+		hcancel()
+		if n != nil {
+			n.Close()
+		}
+		if !ok {
+			return // leader still running; whoever canceled ctx stops it
+		}
+		r.setLastExit(msg.code)
+		why := ""
+		kv := msg.fields()
+		if cg != nil && oomKills(cg.Name()) > ooms {
+			warnKV(r.name, append(kv, "oom_killed", true), "exited rc=%d %s (oom-killed, memory_max=%s)", msg.code, msg.usage(), r.cfg.MemoryMax)
+			why = ", oom-killed"
+		} else if r.unhealthy.Load() {
+			infoKV(r.name, append(kv, "unhealthy", true), "exited rc=%d %s (unhealthy)", msg.code, msg.usage())
+			why = ", unhealthy"
+		} else {
+			infoKV(r.name, kv, "exited rc=%d %s", msg.code, msg.usage())
+		}
+		r.event("exited", leader, "%s after %s%s", exitDetail(msg.code), time.Since(startAt).Round(time.Millisecond), why)
+		stopping := ctx.Err() != nil
+		done := giveUp(msg.code, "exited")
+		r.onFailure(stopping, msg.code, leader)
+		if done {
+			return
+		}
+		uptime := time.Since(startAt)
+		if n != nil && n.isReady.Load() {
+			backoff = r.cfg.initial() // READY=1 counts as a successful start
+		} else if uptime < healthyUptime || n != nil {
+			r.setState("backoff", 0)
+			if !sleepBackoff(ctx, &backoff, maxBackoff) {
 				return
 			}
-			uptime := time.Since(startAt)
-			if uptime < healthyUptime {
-				if !sleepBackoff(ctx, &backoff) {
-					return
-				}
-			} else {
-				backoff = time.Second
-			}
-		case <-ctx.Done():
-			return
+		} else {
+			backoff = r.cfg.initial()
 		}
 	}
 }
@@ -512,34 +923,97 @@ func (r *runner) groupAlive() bool {
 	return true
 }
 
+// stop signals the service per kill_mode: "group" sends the stop sequence
+// (SIGTERM, or stop_signal / stop_sequence) and then SIGKILL to the whole
+// process group; "process" only to the leader, leaving children that it
+// manages itself alone; "mixed" signals the leader and KILLs whatever is
+// left of the group once it exits or the sequence runs out.
 func (r *runner) stop(grace time.Duration, escalateNow func() bool) {
 	pgid := r.groupID()
 	if pgid <= 0 {
 		return
 	}
+	r.mu.Lock()
+	leader := r.pid
+	r.mu.Unlock()
+	mode := r.cfg.KillMode
+	if leader <= 0 {
+		// only leftovers of an exited leader: nothing to aim at but the group
+		if mode == "process" {
+			return
+		}
+		mode = "group"
+	}
+	steps, err := r.cfg.stopSteps(grace)
+	if err != nil { // rejected by loadConfig
+		steps = []stopStep{{syscall.SIGTERM, grace}}
+	}
 
-	warn(r.name, "shutdown: sending SIGTERM to pgid=%d", pgid)
-	_ = signalGroup(pgid, syscall.SIGTERM)
+	alive := r.groupAlive
+	target := fmt.Sprintf("pgid=%d", pgid)
+	send := func(sig syscall.Signal) { _ = signalGroup(pgid, sig) }
+	if mode != "" && mode != "group" {
+		alive = func() bool { return pidAlive(leader) }
+		target = fmt.Sprintf("pid=%d (kill_mode=%s)", leader, mode)
+		send = func(sig syscall.Signal) { _ = syscall.Kill(leader, sig) }
+	}
 
-	deadline := time.Now().Add(grace)
-	for time.Now().Before(deadline) {
-		if !r.groupAlive() {
-			info(r.name, "shutdown: group exited after SIGTERM")
+	var last stopStep
+	for i, st := range steps {
+		if i == 0 {
+			warn(r.name, "shutdown: sending %s to %s", sigName(st.sig), target)
+		} else {
+			warn(r.name, "shutdown: %s after %s elapsed; sending %s to %s", last.wait, sigName(last.sig), sigName(st.sig), target)
+		}
+		send(st.sig)
+		last = st
+		if st.sig == syscall.SIGKILL {
 			return
 		}
+		deadline := time.Now().Add(st.wait)
+		for time.Now().Before(deadline) {
+			if !alive() {
+				if mode == "mixed" && r.groupAlive() {
+					warn(r.name, "shutdown: leader exited; sending SIGKILL to the rest of pgid=%d", pgid)
+					_ = signalGroup(pgid, syscall.SIGKILL)
+					return
+				}
+				if mode == "" || mode == "group" {
+					info(r.name, "shutdown: group exited after %s", sigName(st.sig))
+				} else {
+					info(r.name, "shutdown: pid=%d exited after %s", leader, sigName(st.sig))
+				}
+				return
+			}
+			if escalateNow != nil && escalateNow() {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
 		if escalateNow != nil && escalateNow() {
 			break
 		}
-		time.Sleep(50 * time.Millisecond)
 	}
 
-	if r.groupAlive() {
-		warn(r.name, "shutdown: grace %s elapsed; sending SIGKILL to pgid=%d", grace, pgid)
+	switch {
+	case mode == "process":
+		if alive() {
+			warn(r.name, "shutdown: %s after %s elapsed; sending SIGKILL to pid=%d", last.wait, sigName(last.sig), leader)
+			_ = syscall.Kill(leader, syscall.SIGKILL)
+		}
+	case r.groupAlive():
+		warn(r.name, "shutdown: %s after %s elapsed; sending SIGKILL to pgid=%d", last.wait, sigName(last.sig), pgid)
 		_ = signalGroup(pgid, syscall.SIGKILL)
 	}
 }
 
-func sleepBackoff(ctx context.Context, backoff *time.Duration) bool {
+// pidAlive probes pid; a zombie awaiting the reaper still counts.
+func pidAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func sleepBackoff(ctx context.Context, backoff *time.Duration, maxBackoff time.Duration) bool {
 	b := *backoff
 	if b > maxBackoff {
 		b = maxBackoff
@@ -577,7 +1051,7 @@ func setSubreaper() error {
 func allDaemonsDown(runners []*runner) bool {
 	anyDaemon := false
 	for _, r := range runners {
-		if r.cfg.Restart {
+		if r.cfg.Restart.Daemon() {
 			anyDaemon = true
 			if r.groupAlive() {
 				return false
@@ -587,22 +1061,180 @@ func allDaemonsDown(runners []*runner) bool {
 	return anyDaemon // true only if there was at least one daemon and none alive
 }
 
+// loadConfig reads and validates the config (TOML or .json) plus any
+// fragments in dir.
+func loadConfig(path, dir string) (RootCfg, error) {
+	root, err := decodeWithFragments(path, dir)
+	if err != nil {
+		return root, fmt.Errorf("parse config: %w", err)
+	}
+	if err := expandTemplates(&root); err != nil {
+		return root, err
+	}
+	if len(root.Services) == 0 {
+		return root, errors.New("empty [services]")
+	}
+	if _, err := parseLogLevel(root.Supervisor.LogLevel); err != nil {
+		return root, err
+	}
+	switch root.Supervisor.LogFormat {
+	case "", "text", "json":
+	default:
+		return root, fmt.Errorf("log_format %q: want text or json", root.Supervisor.LogFormat)
+	}
+	if h := root.Supervisor.OnFailureExec; len(h) > 0 && strings.TrimSpace(h[0]) == "" {
+		return root, errors.New("on_failure_exec: empty command")
+	}
+	for name, sc := range root.Services {
+		sc.BackoffCfg.inherit(root.Supervisor.BackoffCfg)
+		root.Services[name] = sc
+		if sc.BackoffInitial.Duration < 0 || sc.BackoffMax.Duration < 0 || sc.HealthyUptime.Duration < 0 {
+			return root, fmt.Errorf("%s: backoff durations must not be negative", name)
+		}
+		if sc.max() < sc.initial() {
+			return root, fmt.Errorf("%s: backoff_max %s is below backoff_initial %s", name, sc.max(), sc.initial())
+		}
+		if strings.TrimSpace(name) == "" {
+			return root, errors.New("blank service name")
+		}
+		if strings.TrimSpace(sc.Path) == "" {
+			return root, fmt.Errorf("%s: missing path", name)
+		}
+		if sc.Health != nil {
+			if err := sc.Health.validate(); err != nil {
+				return root, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		if sc.Schedule != nil {
+			if err := sc.Schedule.validate(); err != nil {
+				return root, fmt.Errorf("%s: %v", name, err)
+			}
+			if sc.Restart == RestartAlways {
+				return root, fmt.Errorf("%s: a scheduled service can't use restart = \"always\"", name)
+			}
+		}
+		if !sc.Notify && sc.ReadyTimeout.Duration > 0 {
+			return root, fmt.Errorf("%s: ready_timeout needs notify = true", name)
+		}
+		if sc.Watchdog.Duration > 0 && !sc.Notify && sc.WatchdogFile == "" {
+			return root, fmt.Errorf("%s: watchdog needs notify = true or a watchdog_file", name)
+		}
+		switch sc.KillMode {
+		case "", "group", "process", "mixed":
+		default:
+			return root, fmt.Errorf("%s: kill_mode %q: want group, process or mixed", name, sc.KillMode)
+		}
+		if _, err := sc.stopSteps(0); err != nil {
+			return root, fmt.Errorf("%s: %v", name, err)
+		}
+		if sc.ReloadSignal != "" {
+			if _, err := parseSignal(sc.ReloadSignal); err != nil {
+				return root, fmt.Errorf("%s: reload_signal: %v", name, err)
+			}
+		}
+		if sc.MaxRestarts < 0 {
+			return root, fmt.Errorf("%s: max_restarts must not be negative", name)
+		}
+		if err := sc.validateLimits(); err != nil {
+			return root, fmt.Errorf("%s: %v", name, err)
+		}
+		if err := sc.validateRSS(); err != nil {
+			return root, fmt.Errorf("%s: %v", name, err)
+		}
+		switch sc.Console {
+		case "", "pipe", "pty":
+		default:
+			return root, fmt.Errorf("%s: console %q: want pipe or pty", name, sc.Console)
+		}
+		if sc.Console == "pty" && sc.PIDNS {
+			return root, fmt.Errorf("%s: console = \"pty\" can't be combined with pidns", name)
+		}
+		if err := validateSockets(sc.Sockets); err != nil {
+			return root, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := capNumbers(sc.DropCaps); err != nil {
+			return root, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := sc.credential(); err != nil {
+			return root, fmt.Errorf("%s: %v", name, err)
+		}
+		for _, kv := range sc.Env {
+			if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+				return root, fmt.Errorf("%s: env entry %q is not KEY=VAL", name, kv)
+			}
+		}
+	}
+	if err := checkWants(root.Services); err != nil {
+		return root, err
+	}
+	return root, nil
+}
+
 func main() {
-	var cfgPath string
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == privHelperArg {
+		os.Exit(runPrivHelper(os.Args[2:]))
+	}
+
+	var cfgPath, cfgDir, controlPath, metricsAddr, statusPath, statePath, logLevelFlag, logFormat string
 	var defaultGrace time.Duration
-	flag.StringVar(&cfgPath, "config", "/etc/services.toml", "path to TOML config")
+	flag.StringVar(&cfgPath, "config", "/etc/services.toml", "path to TOML or .json config")
+	flag.StringVar(&cfgDir, "config-dir", "", "directory of *.toml/*.json fragments merged after -config (overrides [supervisor].config_dir)")
 	flag.DurationVar(&defaultGrace, "grace", 3*time.Second, "default shutdown grace (overridden by [supervisor].grace)")
+	flag.StringVar(&controlPath, "control", "", "unix control socket for 'supervisor ctl' (overrides [supervisor].control)")
+	flag.StringVar(&metricsAddr, "metrics", "", "host:port to serve Prometheus /metrics on (overrides [supervisor].metrics)")
+	flag.StringVar(&statusPath, "status-file", "", "JSON status file rewritten periodically (overrides [supervisor].status_file)")
+	flag.StringVar(&statePath, "state-file", "", "JSON file keeping 'ctl disable' across restarts (overrides [supervisor].state_file)")
+	flag.StringVar(&logLevelFlag, "log-level", "", "debug, info, warn or error (overrides [supervisor].log_level; default info)")
+	flag.StringVar(&logFormat, "log-format", "", "text or json (overrides [supervisor].log_format; default text)")
 	flag.Parse()
+	if err := setLogging(logLevelFlag, logFormat); err != nil {
+		errorf("", "%v", err)
+		os.Exit(2)
+	}
 
-	var root RootCfg
-	if _, err := toml.DecodeFile(cfgPath, &root); err != nil {
-		errorf("", "parse config: %v", err)
+	root, err := loadConfig(cfgPath, cfgDir)
+	if err != nil {
+		errorf("", "%v", err)
 		os.Exit(2)
 	}
-	if len(root.Services) == 0 {
-		errorf("", "empty [services]")
+	if logLevelFlag == "" || logFormat == "" {
+		level, format := root.Supervisor.LogLevel, root.Supervisor.LogFormat
+		if logLevelFlag != "" {
+			level = ""
+		}
+		if logFormat != "" {
+			format = ""
+		}
+		if err := setLogging(level, format); err != nil {
+			errorf("", "%v", err)
+			os.Exit(2)
+		}
+	}
+	if controlPath == "" {
+		controlPath = root.Supervisor.Control
+	}
+	if metricsAddr == "" {
+		metricsAddr = root.Supervisor.Metrics
+	}
+	if statusPath == "" {
+		statusPath = root.Supervisor.StatusFile
+	}
+	if statePath == "" {
+		statePath = root.Supervisor.StateFile
+	}
+	disabled, err := loadState(statePath)
+	if err != nil {
+		errorf("", "state file: %v", err)
 		os.Exit(2)
 	}
+	setOnFailure(root.Supervisor.OnFailureExec)
+	setEventHistory(root.Supervisor.EventHistory)
 	if root.Supervisor.Grace.Duration > 0 {
 		defaultGrace = root.Supervisor.Grace.Duration
 	}
@@ -623,24 +1255,19 @@ func main() {
 	}
 
 	// Build runners
-	runners := make([]*runner, 0, len(root.Services))
+	runners := make(map[string]*runner, len(root.Services))
 	hasDaemons := false
 	for name, sc := range root.Services {
-		if strings.TrimSpace(name) == "" {
-			errorf("", "blank service name")
-			os.Exit(2)
-		}
-		if strings.TrimSpace(sc.Path) == "" {
-			errorf(name, "missing path")
-			os.Exit(2)
-		}
-		if sc.Restart {
+		if sc.Restart.Daemon() || sc.Schedule != nil {
 			hasDaemons = true
 		}
-		r := &runner{name: name, cfg: sc, exitCh: make(chan exitMsg, 1)}
-		runners = append(runners, r)
+		runners[name] = newRunner(name, sc)
 	}
 
+	// The reaper outlives the services' context so their final exits are
+	// still collected during shutdown.
+	reapCtx, reapCancel := context.WithCancel(context.Background())
+	defer reapCancel()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	sigTerm := make(chan os.Signal, 2)
@@ -648,19 +1275,67 @@ func main() {
 	var sigCount int32
 	sigChld := make(chan os.Signal, 1)
 	signal.Notify(sigChld, syscall.SIGCHLD)
-	go reaper(ctx, sigChld, drainTick)
+	go reaper(reapCtx, sigChld, drainTick)
 
 	// Start services
-	var wgAll sync.WaitGroup
-	wgAll.Add(len(runners))
-	for _, r := range runners {
-		go r.startLoop(ctx, defaultGrace, wgAll.Done)
+	sup := &supervisor{ctx: ctx, cfgPath: cfgPath, cfgDir: cfgDir, grace: defaultGrace, runners: runners,
+		abortOnWants: root.Supervisor.AbortOnFailedWants, aborted: make(chan struct{}, 1),
+		statePath: statePath, disabled: disabled}
+	sup.wg.Add(1)
+	go func() {
+		defer sup.wg.Done()
+		sup.boot()
+	}()
+
+	// SIGHUP: re-read the config and apply only what changed
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	go func() {
+		for range sigHup {
+			sup.opMu.Lock()
+			if ctx.Err() == nil {
+				info("", "SIGHUP: reloading %s", cfgPath)
+				if err := sup.reload(); err != nil {
+					errorf("", "reload: %v (keeping current services)", err)
+				}
+			}
+			sup.opMu.Unlock()
+		}
+	}()
+
+	if metricsAddr != "" {
+		if err := sup.serveMetrics(metricsAddr); err != nil {
+			errorf("metrics", "%v", err)
+			os.Exit(2)
+		}
+		info("metrics", "serving http://%s/metrics", metricsAddr)
+	}
+
+	if controlPath != "" {
+		ln, err := listenControl(controlPath)
+		if err != nil {
+			errorf("control", "%v", err)
+			os.Exit(2)
+		}
+		defer os.Remove(controlPath)
+		defer ln.Close()
+		info("control", "listening on %s", controlPath)
+		go sup.serveControl(ln)
+	}
+
+	if statusPath != "" {
+		interval := 5 * time.Second
+		if root.Supervisor.StatusInterval.Duration > 0 {
+			interval = root.Supervisor.StatusInterval.Duration
+		}
+		info("status", "writing %s every %s", statusPath, interval)
+		go sup.statusFileLoop(ctx, statusPath, interval)
 	}
 
 	// Idle-exit watcher (only if at least one daemon and setting is present)
 	idleCh := make(chan struct{}, 1)
 	idleEnabled := false
-	if hasDaemons && root.Supervisor.IdleExitAfter.set {
+	if hasDaemons && root.Supervisor.IdleExitAfter.Set {
 		idleEnabled = true
 		idleAfter := root.Supervisor.IdleExitAfter.Duration // 0s => immediate when all daemons down
 		go func() {
@@ -672,7 +1347,7 @@ func main() {
 				case <-ctx.Done():
 					return
 				case <-tick.C:
-					if allDaemonsDown(runners) {
+					if sup.booted.Load() && allDaemonsDown(sup.list()) {
 						if idleAfter == 0 {
 							select {
 							case idleCh <- struct{}{}:
@@ -707,23 +1382,29 @@ func main() {
 		}()
 	}
 
-	// Shutdown ordering
-	sorted := append([]*runner(nil), runners...)
-	sort.Slice(sorted, func(i, j int) bool { return sorted[i].cfg.StopOrder < sorted[j].cfg.StopOrder })
-
 	if !hasDaemons {
-		wgAll.Wait()
+		sup.wg.Wait()
 		exitStatus := 0
-		for _, r := range runners {
-			if !r.cfg.Restart && r.lastExit != 0 {
+		for _, r := range sup.list() {
+			r.mu.Lock()
+			failed := r.lastExit != 0
+			r.mu.Unlock()
+			if !r.cfg.Restart.Daemon() && failed {
 				exitStatus = 1
 			}
 		}
+		flushOutput(time.Second)
+		if statusPath != "" {
+			_ = sup.writeStatusFile(statusPath) // final states
+		}
+		releaseAllSockets()
+		cleanupNotify()
 		info("", "all oneshot services exited; shutting down")
 		os.Exit(exitStatus)
 	}
 
 	info("", "daemon mode: waiting for signal")
+	exitStatus := 0
 	select {
 	case <-sigTerm:
 		warn("", "received stop signal; initiating shutdown")
@@ -731,9 +1412,12 @@ func main() {
 		if idleEnabled {
 			warn("", "idle timeout reached; shutting down")
 		}
+	case <-sup.aborted:
+		warn("", "boot aborted; shutting down")
+		exitStatus = 1
 	}
 	atomic.AddInt32(&sigCount, 1)
-	cancel() // prevent restarts
+	cancel() // prevent restarts and further control requests
 
 	// second-signal escalation watcher
 	go func() {
@@ -744,15 +1428,27 @@ func main() {
 	}()
 	escalateNow := func() bool { return atomic.LoadInt32(&sigCount) >= 2 }
 
-	// Stop in declared order
-	for _, r := range sorted {
-		grace := r.cfg.Grace.Duration
-		if grace <= 0 {
-			grace = defaultGrace
+	// Stop in declared order, after any in-flight control request
+	sup.opMu.Lock()
+	for _, r := range sup.stopOrdered() {
+		if err := sup.stop(r, escalateNow); err != nil && r.groupAlive() {
+			r.stop(sup.graceFor(r), escalateNow) // leftovers of a loop that already ended
 		}
-		r.stop(grace, escalateNow)
 	}
+	sup.opMu.Unlock()
 
-	wgAll.Wait()
+	sup.wg.Wait()
+	flushOutput(time.Second)
+	if statusPath != "" {
+		_ = sup.writeStatusFile(statusPath) // final states
+	}
+	releaseAllSockets()
+	cleanupNotify()
 	info("", "supervisor exiting")
+	if exitStatus != 0 {
+		if controlPath != "" {
+			_ = os.Remove(controlPath) // os.Exit skips the deferred cleanup
+		}
+		os.Exit(exitStatus)
+	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* ===========================
+   Templated instances
+   =========================== */
+
+// expandTemplates replaces each template service "NAME@" with one service
+// "NAME@INST" per entry of its instances list, substituting %i (and %%) in
+// path, args, dir, env and env_file.
+func expandTemplates(root *RootCfg) error {
+	for name, sc := range root.Services {
+		if !strings.HasSuffix(name, "@") {
+			if len(sc.Instances) > 0 {
+				return fmt.Errorf("%s: instances needs a template name ending in '@'", name)
+			}
+			continue
+		}
+		if len(sc.Instances) == 0 {
+			return fmt.Errorf("%s: template without instances", name)
+		}
+		delete(root.Services, name)
+		for _, inst := range sc.Instances {
+			if inst == "" || strings.ContainsAny(inst, " \t/@") {
+				return fmt.Errorf("%s: bad instance name %q", name, inst)
+			}
+			iname := name + inst
+			if _, dup := root.Services[iname]; dup {
+				return fmt.Errorf("%s: instance %s is also defined on its own", name, iname)
+			}
+			root.Services[iname] = sc.instance(inst)
+		}
+	}
+	return nil
+}
+
+func (sc ServiceCfg) instance(inst string) ServiceCfg {
+	sub := func(s string) string {
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			if s[i] == '%' && i+1 < len(s) {
+				switch s[i+1] {
+				case 'i':
+					b.WriteString(inst)
+					i++
+					continue
+				case '%':
+					b.WriteByte('%')
+					i++
+					continue
+				}
+			}
+			b.WriteByte(s[i])
+		}
+		return b.String()
+	}
+	subAll := func(in []string) []string {
+		if in == nil {
+			return nil
+		}
+		out := make([]string, len(in))
+		for i, s := range in {
+			out[i] = sub(s)
+		}
+		return out
+	}
+	sc.Path, sc.Dir, sc.EnvFile = sub(sc.Path), sub(sc.Dir), sub(sc.EnvFile)
+	sc.Args, sc.Env = subAll(sc.Args), subAll(sc.Env)
+	sc.Instances = nil
+	return sc
+}
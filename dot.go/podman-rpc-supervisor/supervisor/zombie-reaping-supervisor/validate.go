@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* ===========================
+   supervisor validate (dry run)
+   =========================== */
+
+// finding is one line of the validate report; svc is "" for global ones.
+type finding struct {
+	svc, level, msg string
+}
+
+// runValidate is `supervisor validate`: load the config exactly as the
+// supervisor would, then check what would otherwise only fail at start time.
+// Nothing is started. Exit 1 on errors (or warnings with -strict).
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/services.toml", "path to TOML or .json config")
+	cfgDir := fs.String("config-dir", "", "directory of *.toml/*.json fragments merged after -config")
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: supervisor validate [-config PATH] [-config-dir DIR] [-strict]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	root, err := loadConfig(*cfgPath, *cfgDir)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return 1
+	}
+	found := validateRoot(root)
+	errs, warns := 0, 0
+	for _, f := range found {
+		if f.svc != "" {
+			fmt.Printf("%s: %s: %s\n", f.svc, f.level, f.msg)
+		} else {
+			fmt.Printf("%s: %s\n", f.level, f.msg)
+		}
+		if f.level == "error" {
+			errs++
+		} else {
+			warns++
+		}
+	}
+	fmt.Printf("%s: %d services, %d errors, %d warnings\n", *cfgPath, len(root.Services), errs, warns)
+	if errs > 0 || (*strict && warns > 0) {
+		return 1
+	}
+	return 0
+}
+
+// validateRoot checks what loadConfig can't: that binaries, directories and
+// files a service depends on exist, and that stop_order is unambiguous.
+func validateRoot(root RootCfg) []finding {
+	var out []finding
+	add := func(svc, level, format string, a ...any) {
+		out = append(out, finding{svc, level, fmt.Sprintf(format, a...)})
+	}
+
+	if p := root.Supervisor.Control; p != "" {
+		if err := isDir(filepath.Dir(p)); err != nil {
+			add("", "error", "control: %v", err)
+		}
+	}
+	if h := root.Supervisor.OnFailureExec; len(h) > 0 {
+		if err := checkExecutable(h[0], ""); err != nil {
+			add("", "error", "on_failure_exec: %v", err)
+		}
+	}
+
+	names := make([]string, 0, len(root.Services))
+	for name := range root.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byStop := make(map[int][]string)
+	for _, name := range names {
+		sc := root.Services[name]
+		if sc.Dir != "" {
+			if err := isDir(sc.Dir); err != nil {
+				add(name, "error", "dir: %v", err)
+			}
+		}
+		if err := checkExecutable(sc.Path, sc.Dir); err != nil {
+			add(name, "error", "path: %v", err)
+		}
+		if sc.Health != nil && len(sc.Health.Exec) > 0 {
+			if err := checkExecutable(sc.Health.Exec[0], sc.Dir); err != nil {
+				add(name, "error", "health exec: %v", err)
+			}
+		}
+		if sc.EnvFile != "" {
+			if _, err := readEnvFile(sc.EnvFile); err != nil {
+				add(name, "error", "%v", err)
+			}
+		}
+		if f := sc.WatchdogFile; f != "" {
+			if !filepath.IsAbs(f) && sc.Dir != "" {
+				f = filepath.Join(sc.Dir, f)
+			}
+			if err := isDir(filepath.Dir(f)); err != nil {
+				add(name, "error", "watchdog_file: %v", err)
+			}
+		}
+		for _, sock := range sortedKeys(sc.Sockets) {
+			if network, addr, _ := parseSocket(sc.Sockets[sock]); network == "unix" && !strings.HasPrefix(addr, "@") {
+				if err := isDir(filepath.Dir(addr)); err != nil {
+					add(name, "error", "socket %s: %v", sock, err)
+				}
+			}
+		}
+		if sc.PIDNS && os.Geteuid() != 0 {
+			add(name, "warning", "pidns needs root (CLONE_NEWPID)")
+		}
+		if sc.hasLimits() {
+			if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+				add(name, "warning", "cpu_max/memory_max: cgroup v2 is not mounted at %s", cgroupMount)
+			}
+		}
+		if sc.StopOrder != 0 {
+			byStop[sc.StopOrder] = append(byStop[sc.StopOrder], name)
+		}
+	}
+
+	orders := make([]int, 0, len(byStop))
+	for o := range byStop {
+		orders = append(orders, o)
+	}
+	sort.Ints(orders)
+	for _, o := range orders {
+		if same := byStop[o]; len(same) > 1 {
+			add("", "warning", "stop_order %d is shared by %s (they stop in name order)", o, strings.Join(same, ", "))
+		}
+	}
+	return out
+}
+
+// checkExecutable resolves name the way startLoop does (a relative path
+// with a slash is relative to the service's dir) and checks it can be run.
+func checkExecutable(name, dir string) error {
+	path, err := lookPathOrAbs(name)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0o111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+func isDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
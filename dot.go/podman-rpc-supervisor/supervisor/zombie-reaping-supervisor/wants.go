@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   wants: oneshots before dependents
+   =========================== */
+
+// wants = ["setup", ...] names oneshot services that must exit 0 before the
+// service starts at boot; a wanted oneshot whose start_order hasn't come up
+// yet is run first. When one fails the dependent is left stopped, or, with
+// [supervisor].abort_on_failed_wants, the supervisor shuts down (exit 1).
+// `ctl start` does not consult wants.
+
+// checkWants rejects unknown, non-oneshot and circular wants.
+func checkWants(services map[string]ServiceCfg) error {
+	for _, name := range sortedKeys(services) {
+		for _, w := range services[name].Wants {
+			ws, ok := services[w]
+			switch {
+			case !ok:
+				return fmt.Errorf("%s: wants %q: no such service", name, w)
+			case ws.Restart.Daemon() || ws.Schedule != nil:
+				return fmt.Errorf("%s: wants %s, which is not a oneshot (restart = \"never\", no schedule)", name, w)
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	mark := make(map[string]int, len(services))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch mark[name] {
+		case visiting:
+			return fmt.Errorf("wants cycle: %s -> %s", strings.Join(path, " -> "), name)
+		case visited:
+			return nil
+		}
+		mark[name] = visiting
+		for _, w := range services[name].Wants {
+			if err := visit(w, append(path, name)); err != nil {
+				return err
+			}
+		}
+		mark[name] = visited
+		return nil
+	}
+	for _, name := range sortedKeys(services) {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bootStart starts r after its start_delay, first running the oneshots it
+// wants to completion. started collects what was started, for waitReady;
+// false means stop booting (shutting down or aborted).
+func (s *supervisor) bootStart(r *runner, seen map[*runner]bool, started *[]*runner) bool {
+	seen[r] = true
+	for _, name := range r.cfg.Wants {
+		w, err := s.lookup(name)
+		if err != nil {
+			continue // rejected by loadConfig
+		}
+		if !seen[w] {
+			info("", "boot: %s wants %s; starting it first", r.name, w.name)
+			if !s.bootStart(w, seen, started) {
+				return false
+			}
+		}
+		rc, ok := s.waitDone(w)
+		if !ok {
+			return false
+		}
+		if rc == 0 {
+			continue
+		}
+		if s.abortOnWants {
+			errorf("", "boot: %s wants %s, which failed (%s); aborting startup (abort_on_failed_wants)", r.name, w.name, exitDetail(rc))
+			select {
+			case s.aborted <- struct{}{}:
+			default:
+			}
+			return false
+		}
+		warn("", "boot: not starting %s: wanted %s failed (%s)", r.name, w.name, exitDetail(rc))
+		r.event("start-failed", 0, "wanted %s failed: %s", w.name, exitDetail(rc))
+		return true
+	}
+	if d := r.cfg.StartDelay.Duration; d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-s.ctx.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+	}
+	if s.ctx.Err() != nil {
+		return false
+	}
+	if err := s.start(r); err != nil {
+		info("", "boot: %v", err)
+		return true
+	}
+	*started = append(*started, r)
+	return true
+}
+
+// waitDone waits for the oneshot w's loop to end and returns its exit code
+// (1 when it never ran or was stopped); ok is false when shutting down.
+func (s *supervisor) waitDone(w *runner) (rc int, ok bool) {
+	w.mu.Lock()
+	done := w.done
+	w.mu.Unlock()
+	if done == nil {
+		return 1, true // skipped: its own wants failed
+	}
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+		return 0, false
+	}
+	w.mu.Lock()
+	state, last := w.state, w.lastExit
+	w.mu.Unlock()
+	if last == 0 && state != "exited" {
+		return 1, true
+	}
+	return last, true
+}